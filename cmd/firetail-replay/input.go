@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	logshandler "aws-golang-simple-http-endpoint/logs-handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+type inputFormat string
+
+const (
+	autoFormat    inputFormat = "auto"
+	awslogsFormat inputFormat = "awslogs"
+	jsonFormat    inputFormat = "json"
+	textFormat    inputFormat = "text"
+)
+
+var gzipMagicBytes = []byte{0x1f, 0x8b}
+
+// parseInput reads a batch of Cloudwatch logs from input in the given format:
+//   - awslogs is the base64 encoded, gzipped data of a CloudwatchLogsEvent, as found in its
+//     awslogs.data field. A whole CloudwatchLogsEvent is accepted too.
+//   - json is a CloudwatchLogsData as JSON.
+//   - text is a line per log event, which may start with a timestamp as in a Cloudwatch export file.
+//
+// The auto format works out which of the others input is in.
+func parseInput(input []byte, format inputFormat) (*events.CloudwatchLogsData, error) {
+	if format == autoFormat {
+		format = detectInputFormat(input)
+	}
+	switch format {
+	case awslogsFormat:
+		data := string(bytes.TrimSpace(input))
+		var event events.CloudwatchLogsEvent
+		if err := json.Unmarshal(input, &event); err == nil && event.AWSLogs.Data != "" {
+			data = event.AWSLogs.Data
+		}
+		logsData, err := events.CloudwatchLogsRawData{Data: data}.Parse()
+		if err != nil {
+			return nil, errors.WithMessage(err, "err parsing awslogs data")
+		}
+		return &logsData, nil
+
+	case jsonFormat:
+		logsData := &events.CloudwatchLogsData{}
+		if err := json.Unmarshal(input, logsData); err != nil {
+			return nil, errors.WithMessage(err, "err unmarshalling CloudwatchLogsData")
+		}
+		return logsData, nil
+
+	case textFormat:
+		logsData := &events.CloudwatchLogsData{MessageType: "DATA_MESSAGE"}
+		scanner := bufio.NewScanner(bytes.NewReader(input))
+		scanner.Buffer(nil, 1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			logEvent, err := logshandler.ParseExportLine(scanner.Text())
+			if err != nil {
+				logEvent = &events.CloudwatchLogsLogEvent{Message: scanner.Text()}
+			}
+			logEvent.ID = strconv.Itoa(line)
+			logsData.LogEvents = append(logsData.LogEvents, *logEvent)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.WithMessage(err, "err reading log lines")
+		}
+		return logsData, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported input format: %s", format)
+	}
+}
+
+// detectInputFormat works out which format input is in. JSON objects are a CloudwatchLogsEvent if they
+// have an awslogs field, or otherwise a CloudwatchLogsData. Anything which is base64 encoded gzip is
+// awslogs data. Everything else is text.
+func detectInputFormat(input []byte) inputFormat {
+	trimmedInput := bytes.TrimSpace(input)
+	if bytes.HasPrefix(trimmedInput, []byte("{")) {
+		var event map[string]json.RawMessage
+		if err := json.Unmarshal(trimmedInput, &event); err == nil {
+			if _, isEvent := event["awslogs"]; isEvent {
+				return awslogsFormat
+			}
+			return jsonFormat
+		}
+	}
+	if decodedInput, err := base64.StdEncoding.DecodeString(string(trimmedInput)); err == nil && bytes.HasPrefix(decodedInput, gzipMagicBytes) {
+		return awslogsFormat
+	}
+	return textFormat
+}
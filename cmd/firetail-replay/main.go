@@ -0,0 +1,144 @@
+// firetail-replay runs a batch of Cloudwatch logs from AppSync through the same extraction as the
+// Firetail AppSync Lambda, and prints the resulting Firetail logs or sends them to Firetail. It's for
+// debugging the Lambda without deploying it.
+//
+// Usage:
+//
+//	firetail-replay [flags] [file]
+//
+// The logs are read from file, or from stdin if file is omitted or "-".
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	logshandler "aws-golang-simple-http-endpoint/logs-handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/hashicorp/go-multierror"
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run is the CLI with its arguments and standard streams passed in, so that it can be tested. It
+// returns the exit code.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("firetail-replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", string(autoFormat), "the format of the input, one of auto, awslogs, json or text")
+	logGroup := flags.String("log-group", "", "overrides the log group of the input, which text input doesn't have")
+	apiUrl := flags.String("url", "", "the URL of the Firetail logging API to send the logs to; if unset, the logs are printed")
+	apiToken := flags.String("token", "", "the Firetail API token to send the logs with; defaults to $FIRETAIL_API_TOKEN")
+	dryRun := flags.Bool("dry-run", false, "print the logs instead of sending them, even if -url is set")
+	pretty := flags.Bool("pretty", false, "indent the printed logs, which makes them no longer NDJSON")
+	showErrors := flags.Bool("show-errors", false, "print the errs encountered parsing each log event")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	// The token isn't the flag's default, so that it's never printed in the usage message
+	if *apiToken == "" {
+		*apiToken = os.Getenv("FIRETAIL_API_TOKEN")
+	}
+	if flags.NArg() > 1 {
+		fmt.Fprintln(stderr, "at most one input file may be given")
+		return 2
+	}
+
+	input, err := readInput(flags.Arg(0), stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Err reading input: %s\n", err)
+		return 1
+	}
+	logsData, err := parseInput(input, inputFormat(*format))
+	if err != nil {
+		fmt.Fprintf(stderr, "Err parsing input: %s\n", err)
+		return 1
+	}
+	if *logGroup != "" {
+		logsData.LogGroup = *logGroup
+	}
+
+	if *showErrors {
+		printEventErrors(ctx, stderr, logsData)
+	}
+	firetailLogs, err := logshandler.ExtractFiretailLogs(ctx, logsData)
+	if err != nil && !*showErrors {
+		fmt.Fprintf(stderr, "%d errs extracting Firetail logs, use -show-errors to see them\n", len(multierror.Append(nil, err).Errors))
+	}
+	fmt.Fprintf(stderr, "Extracted %d Firetail logs from %d log events\n", len(firetailLogs), len(logsData.LogEvents))
+
+	if *apiUrl == "" || *dryRun {
+		if err := printFiretailLogs(stdout, firetailLogs, *pretty); err != nil {
+			fmt.Fprintf(stderr, "Err printing Firetail logs: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	chunkResults, err := logshandler.SendToFiretail(ctx, firetailLogs, *apiUrl, logshandler.StaticTokenProvider(*apiToken))
+	for i, chunkResult := range chunkResults {
+		if chunkResult.Err != nil {
+			fmt.Fprintf(stderr, "Chunk %d of %d failed after %d attempts: %s\n", i+1, len(chunkResults), chunkResult.Attempts, chunkResult.Err)
+		} else {
+			fmt.Fprintf(stderr, "Chunk %d of %d sent with %d logs\n", i+1, len(chunkResults), len(chunkResult.Chunk.RequestIDs))
+		}
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// readInput reads the whole of the named file, or stdin if name is empty or "-".
+func readInput(name string, stdin io.Reader) ([]byte, error) {
+	if name == "" || name == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// printEventErrors extracts each log event of logsData on its own so that any errs can be attributed to
+// the event which caused them.
+func printEventErrors(ctx context.Context, stderr io.Writer, logsData *events.CloudwatchLogsData) {
+	for _, logEvent := range logsData.LogEvents {
+		_, err := logshandler.ExtractFiretailLogs(ctx, &events.CloudwatchLogsData{
+			LogGroup:  logsData.LogGroup,
+			LogStream: logsData.LogStream,
+			LogEvents: []events.CloudwatchLogsLogEvent{logEvent},
+		})
+		if err == nil {
+			continue
+		}
+		for _, eventErr := range multierror.Append(nil, err).Errors {
+			fmt.Fprintf(stderr, "Err parsing log event %s: %s\n", logEvent.ID, eventErr)
+		}
+	}
+}
+
+// printFiretailLogs prints firetailLogs ordered by request ID as NDJSON, or as indented JSON if pretty is
+// true.
+func printFiretailLogs(stdout io.Writer, firetailLogs map[string]*logshandler.FiretailLog, pretty bool) error {
+	requestIDs := make([]string, 0, len(firetailLogs))
+	for requestID := range firetailLogs {
+		requestIDs = append(requestIDs, requestID)
+	}
+	sort.Strings(requestIDs)
+
+	encoder := json.NewEncoder(stdout)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+	for _, requestID := range requestIDs {
+		if err := encoder.Encode(firetailLogs[requestID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
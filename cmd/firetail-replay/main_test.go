@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLogsData = `{
+	"logGroup": "/aws/appsync/apis/TEST_API_ID",
+	"logEvents": [
+		{"id": "1", "message": "TEST_ID_1 GraphQL Query: TEST_QUERY_1"},
+		{"id": "2", "message": "TEST_ID_2 GraphQL Query: TEST_QUERY_2"},
+		{"id": "3", "message": "TEST_ID_3 Invalid Prefix"}
+	]
+}`
+
+// encodeTestLogsData gzips and base64 encodes logsData in the same way as Cloudwatch
+func encodeTestLogsData(t *testing.T, logsData string) string {
+	var gzipBytes bytes.Buffer
+	gzipper := gzip.NewWriter(&gzipBytes)
+	_, err := gzipper.Write([]byte(logsData))
+	require.Nil(t, err)
+	require.Nil(t, gzipper.Close())
+	return base64.StdEncoding.EncodeToString(gzipBytes.Bytes())
+}
+
+func TestDetectInputFormat(t *testing.T) {
+	assert.Equal(t, awslogsFormat, detectInputFormat([]byte(encodeTestLogsData(t, testLogsData)+"\n")))
+	assert.Equal(t, awslogsFormat, detectInputFormat([]byte(`{"awslogs":{"data":"TEST_DATA"}}`)))
+	assert.Equal(t, jsonFormat, detectInputFormat([]byte(testLogsData)))
+	assert.Equal(t, textFormat, detectInputFormat([]byte("TEST_ID GraphQL Query: TEST_QUERY\n")))
+	assert.Equal(t, textFormat, detectInputFormat([]byte(`{"logType":"RequestSummary"}`+"\n"+`{"logType":"ExecutionSummary"}`)))
+}
+
+func TestParseInputAwslogs(t *testing.T) {
+	for _, input := range []string{
+		encodeTestLogsData(t, testLogsData),
+		`{"awslogs":{"data":"` + encodeTestLogsData(t, testLogsData) + `"}}`,
+	} {
+		logsData, err := parseInput([]byte(input), autoFormat)
+		require.Nil(t, err)
+		assert.Equal(t, "/aws/appsync/apis/TEST_API_ID", logsData.LogGroup)
+		assert.Len(t, logsData.LogEvents, 3)
+	}
+}
+
+func TestParseInputText(t *testing.T) {
+	logsData, err := parseInput([]byte(
+		"2022-11-30T11:03:56.123Z TEST_ID_1 GraphQL Query: TEST_QUERY_1\n\nTEST_ID_2 GraphQL Query: TEST_QUERY_2\n",
+	), textFormat)
+	require.Nil(t, err)
+	assert.Equal(t, &events.CloudwatchLogsData{
+		MessageType: "DATA_MESSAGE",
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{ID: "1", Timestamp: 1669806236123, Message: "TEST_ID_1 GraphQL Query: TEST_QUERY_1"},
+			{ID: "3", Message: "TEST_ID_2 GraphQL Query: TEST_QUERY_2"},
+		},
+	}, logsData)
+}
+
+func TestParseInputInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		input         string
+		format        inputFormat
+		expectedError string
+	}{
+		{"not base64", awslogsFormat, "err parsing awslogs data: illegal base64 data at input byte 3"},
+		{"not json", jsonFormat, "err unmarshalling CloudwatchLogsData: invalid character 'o' in literal null (expecting 'u')"},
+		{"TEST_INPUT", "xml", "unsupported input format: xml"},
+	} {
+		logsData, err := parseInput([]byte(testCase.input), testCase.format)
+		require.NotNil(t, err, testCase.input)
+		assert.Equal(t, testCase.expectedError, err.Error())
+		assert.Nil(t, logsData)
+	}
+}
+
+func TestRunPrintsLogs(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{}, strings.NewReader(testLogsData), &stdout, &stderr)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t,
+		`{"query":"TEST_QUERY_1","request_id":"TEST_ID_1"}`+"\n"+`{"query":"TEST_QUERY_2","request_id":"TEST_ID_2"}`+"\n",
+		stdout.String(),
+	)
+	assert.Equal(t,
+		"1 errs extracting Firetail logs, use -show-errors to see them\nExtracted 2 Firetail logs from 3 log events\n",
+		stderr.String(),
+	)
+}
+
+func TestRunPrettyAndShowErrors(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	require.Nil(t, os.WriteFile(inputFile, []byte("TEST_ID_1 GraphQL Query: TEST_QUERY_1\nTEST_ID_2 Invalid Prefix\n"), 0644))
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-pretty", "-show-errors", inputFile}, nil, &stdout, &stderr)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "{\n  \"query\": \"TEST_QUERY_1\",\n  \"request_id\": \"TEST_ID_1\"\n}\n", stdout.String())
+	assert.Equal(t,
+		"Err parsing log event 2: err adding event message to firetail log: plaintext logEventMessage matched no plaintext log prefixes: TEST_ID_2 Invalid Prefix\n"+
+			"Extracted 1 Firetail logs from 2 log events\n",
+		stderr.String(),
+	)
+}
+
+func TestRunSendsLogs(t *testing.T) {
+	requestBodies := []string{}
+	requestTokens := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(bodyBytes))
+		requestTokens = append(requestTokens, r.Header.Get("x-ft-api-key"))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer testServer.Close()
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-url", testServer.URL, "-token", "TEST_TOKEN"}, strings.NewReader(testLogsData), &stdout, &stderr)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "", stdout.String())
+	assert.Contains(t, stderr.String(), "Chunk 1 of 1 sent with 2 logs\n")
+	assert.Equal(t, []string{`{"query":"TEST_QUERY_1","request_id":"TEST_ID_1"}` + "\n" + `{"query":"TEST_QUERY_2","request_id":"TEST_ID_2"}` + "\n"}, requestBodies)
+	assert.Equal(t, []string{"TEST_TOKEN"}, requestTokens)
+}
+
+func TestRunSendsLogsWithTokenFromEnv(t *testing.T) {
+	t.Setenv("FIRETAIL_API_TOKEN", "TEST_ENV_TOKEN")
+	requestTokens := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestTokens = append(requestTokens, r.Header.Get("x-ft-api-key"))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer testServer.Close()
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-url", testServer.URL}, strings.NewReader(testLogsData), &stdout, &stderr)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, []string{"TEST_ENV_TOKEN"}, requestTokens)
+}
+
+func TestRunUsageOmitsTokenFromEnv(t *testing.T) {
+	t.Setenv("FIRETAIL_API_TOKEN", "TEST_ENV_TOKEN")
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-help"}, nil, &stdout, &stderr)
+	assert.Equal(t, 2, exitCode)
+	assert.NotContains(t, stderr.String(), "TEST_ENV_TOKEN")
+}
+
+func TestRunDryRun(t *testing.T) {
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+	}))
+	defer testServer.Close()
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-url", testServer.URL, "-dry-run"}, strings.NewReader(testLogsData), &stdout, &stderr)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, 0, requestCount)
+	assert.Contains(t, stdout.String(), `"request_id":"TEST_ID_1"`)
+}
+
+func TestRunSendFails(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	defer testServer.Close()
+
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-url", testServer.URL}, strings.NewReader(testLogsData), &stdout, &stderr)
+	assert.Equal(t, 1, exitCode)
+	assert.Contains(t, stderr.String(), "Chunk 1 of 1 failed after 1 attempts:")
+}
+
+func TestRunInvalidInput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	exitCode := run(context.Background(), []string{"-format", "json"}, strings.NewReader("not json"), &stdout, &stderr)
+	assert.Equal(t, 1, exitCode)
+	assert.Equal(t, "Err parsing input: err unmarshalling CloudwatchLogsData: invalid character 'o' in literal null (expecting 'u')\n", stderr.String())
+}
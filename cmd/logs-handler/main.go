@@ -0,0 +1,8 @@
+// The Firetail AppSync Lambda, which forwards AppSync logs from Cloudwatch to Firetail.
+package main
+
+import logshandler "aws-golang-simple-http-endpoint/logs-handler"
+
+func main() {
+	logshandler.Main()
+}
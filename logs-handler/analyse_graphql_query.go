@@ -0,0 +1,161 @@
+package logshandler
+
+import (
+	"math"
+	"sort"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// GraphQLMetadata describes the operation selected by a GraphQL query document.
+type GraphQLMetadata struct {
+	OperationType   string   `json:"operationType"`
+	RootFields      []string `json:"rootFields"`
+	FragmentSpreads []string `json:"fragmentSpreads,omitempty"`
+	InlineFragments int      `json:"inlineFragments"`
+	AliasCount      int      `json:"aliasCount"`
+	MaxDepth        int      `json:"maxDepth"`
+	// Complexity is the number of fields selected by the operation once all of its fragments have
+	// been expanded. It doesn't account for lists, so it's only a rough indication of cost.
+	Complexity int `json:"complexity"`
+}
+
+// analyseGraphQLQuery parses a GraphQL query document and describes the operation within it with the
+// given name. If the operation name is nil, the document must contain exactly one operation. If the
+// document can't be parsed or the operation can't be found then nil is returned.
+func analyseGraphQLQuery(query string, operationName *string) *GraphQLMetadata {
+	queryDocument, err := parser.ParseQuery(&ast.Source{Input: query})
+	if err != nil {
+		return nil
+	}
+	name := ""
+	if operationName != nil {
+		name = *operationName
+	}
+	operation := queryDocument.Operations.ForName(name)
+	if operation == nil {
+		return nil
+	}
+
+	analyser := &graphQLQueryAnalyser{
+		fragments:       queryDocument.Fragments,
+		fragmentStats:   map[string]*selectionSetStats{},
+		fragmentSpreads: map[string]bool{},
+	}
+	stats := analyser.analyseSelectionSet(operation.SelectionSet)
+
+	metadata := &GraphQLMetadata{
+		OperationType:   string(operation.Operation),
+		RootFields:      analyser.rootFields(operation.SelectionSet, map[string]bool{}, map[string]bool{}),
+		InlineFragments: analyser.inlineFragments,
+		AliasCount:      stats.aliases,
+		MaxDepth:        stats.depth,
+		Complexity:      stats.fields,
+	}
+	for fragmentName := range analyser.fragmentSpreads {
+		metadata.FragmentSpreads = append(metadata.FragmentSpreads, fragmentName)
+	}
+	sort.Strings(metadata.FragmentSpreads)
+	return metadata
+}
+
+type selectionSetStats struct {
+	depth   int
+	fields  int
+	aliases int
+}
+
+// add combines the stats of a selection nested at the same depth as s.
+func (s *selectionSetStats) add(other *selectionSetStats, depthOffset int) {
+	if other.depth+depthOffset > s.depth {
+		s.depth = other.depth + depthOffset
+	}
+	s.fields = saturatingAdd(s.fields, other.fields)
+	s.aliases = saturatingAdd(s.aliases, other.aliases)
+}
+
+// graphQLQueryAnalyser walks through the selection sets of a query document. The stats of each
+// fragment are only calculated once, so documents which spread the same fragments many times over
+// don't take exponentially long to analyse.
+type graphQLQueryAnalyser struct {
+	fragments       ast.FragmentDefinitionList
+	fragmentStats   map[string]*selectionSetStats
+	fragmentSpreads map[string]bool
+	inlineFragments int
+}
+
+func (a *graphQLQueryAnalyser) analyseSelectionSet(selectionSet ast.SelectionSet) *selectionSetStats {
+	stats := &selectionSetStats{}
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			fieldStats := &selectionSetStats{depth: 1, fields: 1}
+			if selection.Alias != "" && selection.Alias != selection.Name {
+				fieldStats.aliases = 1
+			}
+			fieldStats.add(a.analyseSelectionSet(selection.SelectionSet), 1)
+			stats.add(fieldStats, 0)
+
+		case *ast.FragmentSpread:
+			a.fragmentSpreads[selection.Name] = true
+			stats.add(a.analyseFragment(selection.Name), 0)
+
+		case *ast.InlineFragment:
+			a.inlineFragments++
+			stats.add(a.analyseSelectionSet(selection.SelectionSet), 0)
+		}
+	}
+	return stats
+}
+
+func (a *graphQLQueryAnalyser) analyseFragment(name string) *selectionSetStats {
+	if stats, analysed := a.fragmentStats[name]; analysed {
+		return stats
+	}
+	// Fragments which spread themselves are invalid, so we just count them as empty if we find one
+	// which is already being analysed.
+	a.fragmentStats[name] = &selectionSetStats{}
+	fragment := a.fragments.ForName(name)
+	if fragment == nil {
+		return a.fragmentStats[name]
+	}
+	stats := a.analyseSelectionSet(fragment.SelectionSet)
+	a.fragmentStats[name] = stats
+	return stats
+}
+
+// rootFields returns the names of the fields selected at the root of an operation, including those
+// selected through fragments.
+func (a *graphQLQueryAnalyser) rootFields(selectionSet ast.SelectionSet, seenFields, seenFragments map[string]bool) []string {
+	rootFields := []string{}
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if !seenFields[selection.Name] {
+				seenFields[selection.Name] = true
+				rootFields = append(rootFields, selection.Name)
+			}
+
+		case *ast.FragmentSpread:
+			if seenFragments[selection.Name] {
+				continue
+			}
+			seenFragments[selection.Name] = true
+			if fragment := a.fragments.ForName(selection.Name); fragment != nil {
+				rootFields = append(rootFields, a.rootFields(fragment.SelectionSet, seenFields, seenFragments)...)
+			}
+
+		case *ast.InlineFragment:
+			rootFields = append(rootFields, a.rootFields(selection.SelectionSet, seenFields, seenFragments)...)
+		}
+	}
+	return rootFields
+}
+
+func saturatingAdd(a, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
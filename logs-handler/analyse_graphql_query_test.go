@@ -0,0 +1,92 @@
+package logshandler
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyseGraphQLQuerySelectsNamedOperation(t *testing.T) {
+	operationName := "MyMutation"
+	metadata := analyseGraphQLQuery(
+		"query MyQuery { getPost(id: 1) { id } }\nmutation MyMutation { createPost(input: {title: \"A\"}) { id title } }",
+		&operationName,
+	)
+	require.NotNil(t, metadata)
+	assert.Equal(t, &GraphQLMetadata{
+		OperationType: "mutation",
+		RootFields:    []string{"createPost"},
+		MaxDepth:      2,
+		Complexity:    3,
+	}, metadata)
+}
+
+func TestAnalyseGraphQLQueryAnonymousOperation(t *testing.T) {
+	metadata := analyseGraphQLQuery("{ listPosts { items { id } } }", nil)
+	require.NotNil(t, metadata)
+	assert.Equal(t, &GraphQLMetadata{
+		OperationType: "query",
+		RootFields:    []string{"listPosts"},
+		MaxDepth:      3,
+		Complexity:    3,
+	}, metadata)
+}
+
+func TestAnalyseGraphQLQueryFragmentsAndAliases(t *testing.T) {
+	metadata := analyseGraphQLQuery(`
+		subscription OnPost {
+			first: onCreatePost { ...PostFields }
+			second: onCreatePost { ...PostFields }
+			...RootFields
+			... on Subscription { onDeletePost { id } }
+		}
+		fragment PostFields on Post { id author { name } }
+		fragment RootFields on Subscription { onUpdatePost { id } }
+	`, nil)
+	require.NotNil(t, metadata)
+	assert.Equal(t, &GraphQLMetadata{
+		OperationType:   "subscription",
+		RootFields:      []string{"onCreatePost", "onUpdatePost", "onDeletePost"},
+		FragmentSpreads: []string{"PostFields", "RootFields"},
+		InlineFragments: 1,
+		AliasCount:      2,
+		MaxDepth:        3,
+		Complexity:      12,
+	}, metadata)
+}
+
+func TestAnalyseGraphQLQueryRecursiveFragment(t *testing.T) {
+	metadata := analyseGraphQLQuery("{ getPost { ...A } } fragment A on Post { id ...A }", nil)
+	require.NotNil(t, metadata)
+	assert.Equal(t, 2, metadata.MaxDepth)
+	assert.Equal(t, 2, metadata.Complexity)
+}
+
+func TestAnalyseGraphQLQueryFragmentBomb(t *testing.T) {
+	// Each fragment spreads the next one twice, so expanding them all would select over 2^64 fields
+	document := "{ ...F0 } fragment F64 on Query { a }"
+	for i := 0; i < 64; i++ {
+		document += fmt.Sprintf(" fragment F%d on Query { x { ...F%d } y { ...F%d } }", i, i+1, i+1)
+	}
+	metadata := analyseGraphQLQuery(document, nil)
+	require.NotNil(t, metadata)
+	assert.Equal(t, 65, metadata.MaxDepth)
+	assert.Equal(t, math.MaxInt, metadata.Complexity)
+	assert.Len(t, metadata.FragmentSpreads, 65)
+}
+
+func TestAnalyseGraphQLQueryUnparseable(t *testing.T) {
+	assert.Nil(t, analyseGraphQLQuery("TEST_QUERY", nil))
+}
+
+func TestAnalyseGraphQLQueryAmbiguousOperation(t *testing.T) {
+	assert.Nil(t, analyseGraphQLQuery("query A { a } query B { b }", nil))
+}
+
+func TestAnalyseGraphQLQueryMissingOperation(t *testing.T) {
+	operationName := "C"
+	assert.Nil(t, analyseGraphQLQuery("query A { a } query B { b }", &operationName))
+}
@@ -0,0 +1,86 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+type EventType string
+
+const (
+	CloudwatchLogsEventType EventType = "cloudwatchLogs"
+	KinesisEventType        EventType = "kinesis"
+	FirehoseEventType       EventType = "firehose"
+	S3EventType             EventType = "s3"
+	UnknownEventType        EventType = "unknown"
+)
+
+// detectEventType works out which type of event the raw payload of a Lambda invocation is.
+func detectEventType(payload json.RawMessage) EventType {
+	var event struct {
+		AWSLogs           *json.RawMessage `json:"awslogs"`
+		DeliveryStreamArn *string          `json:"deliveryStreamArn"`
+		Records           []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return UnknownEventType
+	}
+	if event.AWSLogs != nil {
+		return CloudwatchLogsEventType
+	}
+	if event.DeliveryStreamArn != nil {
+		return FirehoseEventType
+	}
+	if len(event.Records) > 0 && event.Records[0].EventSource == "aws:kinesis" {
+		return KinesisEventType
+	}
+	if len(event.Records) > 0 && event.Records[0].EventSource == "aws:s3" {
+		return S3EventType
+	}
+	return UnknownEventType
+}
+
+// AutoHandler detects the type of each event it's invoked with and passes it to the matching handler,
+// so the same Lambda can be subscribed to Cloudwatch logs directly or through a Kinesis Data Stream,
+// or used as a Kinesis Data Firehose data transformation. S3 events are handled as notifications of
+// Cloudwatch export files to backfill.
+func AutoHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	switch eventType := detectEventType(payload); eventType {
+	case CloudwatchLogsEventType:
+		var event events.CloudwatchLogsEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, errors.WithMessage(err, "err unmarshalling CloudwatchLogsEvent")
+		}
+		return nil, Handler(ctx, event)
+
+	case KinesisEventType:
+		var event events.KinesisEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, errors.WithMessage(err, "err unmarshalling KinesisEvent")
+		}
+		return KinesisHandler(ctx, event)
+
+	case FirehoseEventType:
+		var event events.KinesisFirehoseEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, errors.WithMessage(err, "err unmarshalling KinesisFirehoseEvent")
+		}
+		return FirehoseHandler(ctx, event)
+
+	case S3EventType:
+		var event events.S3Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, errors.WithMessage(err, "err unmarshalling S3Event")
+		}
+		return BackfillHandler(ctx, event)
+
+	default:
+		return nil, fmt.Errorf("unsupported event: %.100s", string(payload))
+	}
+}
@@ -0,0 +1,97 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectEventType(t *testing.T) {
+	assert.Equal(t, CloudwatchLogsEventType, detectEventType(json.RawMessage(`{"awslogs":{"data":"TEST_DATA"}}`)))
+	assert.Equal(t, KinesisEventType, detectEventType(json.RawMessage(`{"Records":[{"eventSource":"aws:kinesis"}]}`)))
+	assert.Equal(t, FirehoseEventType, detectEventType(json.RawMessage(`{"deliveryStreamArn":"TEST_ARN","records":[{"recordId":"1"}]}`)))
+	assert.Equal(t, S3EventType, detectEventType(json.RawMessage(`{"Records":[{"eventSource":"aws:s3"}]}`)))
+	assert.Equal(t, UnknownEventType, detectEventType(json.RawMessage(`{"Records":[{"eventSource":"aws:sqs"}]}`)))
+	assert.Equal(t, UnknownEventType, detectEventType(json.RawMessage(`not json`)))
+}
+
+func TestAutoHandlerCloudwatchLogs(t *testing.T) {
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := AutoHandler(ctx, json.RawMessage(fmt.Sprintf(`{"awslogs":{"data":%q}}`, encodeTestLogsData(t, `{
+		"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]
+	}`))))
+	require.Nil(t, err)
+	assert.Nil(t, response)
+	assert.Equal(t, 1, requestCount)
+}
+
+func TestAutoHandlerKinesis(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := AutoHandler(ctx, json.RawMessage(fmt.Sprintf(`{"Records":[{
+		"eventSource": "aws:kinesis",
+		"kinesis": {"sequenceNumber": "TEST_SEQUENCE_NUMBER", "data": %q}
+	}]}`, base64.StdEncoding.EncodeToString(gzipTestData(t, `{
+		"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]
+	}`)))))
+	require.Nil(t, err)
+	assert.Equal(t, events.KinesisEventResponse{
+		BatchItemFailures: []events.KinesisBatchItemFailure{{ItemIdentifier: "TEST_SEQUENCE_NUMBER"}},
+	}, response)
+}
+
+func TestAutoHandlerFirehose(t *testing.T) {
+	response, err := AutoHandler(context.Background(), json.RawMessage(fmt.Sprintf(`{
+		"deliveryStreamArn": "TEST_ARN",
+		"records": [{"recordId": "TEST_RECORD_ID", "data": %q}]
+	}`, base64.StdEncoding.EncodeToString([]byte("not json")))))
+	require.Nil(t, err)
+	assert.Equal(t, events.KinesisFirehoseResponse{Records: []events.KinesisFirehoseResponseRecord{
+		{RecordID: "TEST_RECORD_ID", Result: events.KinesisFirehoseTransformedStateProcessingFailed},
+	}}, response)
+}
+
+func TestAutoHandlerS3(t *testing.T) {
+	backfillS3Client = &fakeS3Client{objects: map[string][]byte{}}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillS3Client = nil
+		requestStateStore = nil
+	}()
+
+	response, err := AutoHandler(context.Background(), json.RawMessage(`{"Records":[{
+		"eventSource": "aws:s3",
+		"s3": {"bucket": {"name": "TEST_BUCKET"}, "object": {"key": "TEST_KEY"}}
+	}]}`))
+	require.Nil(t, err)
+	assert.Equal(t, &BackfillResult{}, response)
+}
+
+func TestAutoHandlerUnsupportedEvent(t *testing.T) {
+	response, err := AutoHandler(context.Background(), json.RawMessage(`{"Records":[{"eventSource":"aws:sqs"}]}`))
+	require.NotNil(t, err)
+	assert.Equal(t, `unsupported event: {"Records":[{"eventSource":"aws:sqs"}]}`, err.Error())
+	assert.Nil(t, response)
+}
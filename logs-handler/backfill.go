@@ -0,0 +1,306 @@
+package logshandler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+const DefaultBackfillBatchEvents int = 10000
+
+// maxExportLineBytes is the longest line read from an export file. Cloudwatch log events are limited
+// to 256KiB, so this leaves plenty of room for the timestamp.
+const maxExportLineBytes = 1024 * 1024
+
+// backfillBatchEvents is how many log events are read from an export file before they're sent to
+// Firetail and the file's checkpoint is updated.
+var backfillBatchEvents = DefaultBackfillBatchEvents
+
+// backfillLogGroup is the log group which export files were exported from. Export files don't include
+// it, but it's needed to route the logs and annotate them with their API ID.
+var backfillLogGroup string
+
+// backfillS3Client is used by BackfillHandler to read export files from S3.
+var backfillS3Client s3BackfillClient
+
+// s3BackfillClient is the subset of the S3 client's methods used to read export files.
+type s3BackfillClient interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// BackfillResult summarises the export files read by a backfill, and how many Firetail logs were
+// still buffered in the requestStateStore once they had been read.
+type BackfillResult struct {
+	Files        int `json:"files"`
+	LogEvents    int `json:"logEvents"`
+	BufferedLogs int `json:"bufferedLogs"`
+}
+
+// BackfillHandler forwards historical logs from the export files written to S3 by a Cloudwatch
+// CreateExportTask, which it's notified of by S3 events. Only gzipped files are read, so that the
+// other objects export tasks write, and any checkpoints in the same bucket, are ignored. If a file
+// can't be fully forwarded, the err is returned so that the invocation is retried, and the retry
+// resumes from the file's last checkpoint. Once the files have been read, every Firetail log still
+// buffered in the requestStateStore is forwarded, so requests which are cut off by the end of an
+// export aren't lost.
+func BackfillHandler(ctx context.Context, event events.S3Event) (*BackfillResult, error) {
+	if backfillS3Client == nil {
+		return nil, errors.New("no S3 client configured for backfill")
+	}
+	if requestStateStore == nil {
+		return nil, errors.New("FIRETAIL_REQUEST_STATE_STORE must be set to backfill export files")
+	}
+	handlerLogger := invocationLogger(ctx)
+	result := &BackfillResult{}
+	var errs error
+	for _, record := range event.Records {
+		bucket := record.S3.Bucket.Name
+		// Object keys in S3 events are URL encoded
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "err decoding object key %s", record.S3.Object.Key))
+			continue
+		}
+		if !strings.HasSuffix(key, ".gz") {
+			continue
+		}
+
+		fileLogger := handlerLogger.With(LogFields{"bucket": bucket, "key": key})
+		object, err := backfillS3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "err getting export file s3://%s/%s", bucket, key))
+			continue
+		}
+		logEvents, err := backfillExportFile(ctx, fileLogger, bucket+"/"+key, path.Base(path.Dir(key)), object.Body)
+		object.Body.Close()
+		result.Files++
+		result.LogEvents += logEvents
+		if err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "err backfilling export file s3://%s/%s", bucket, key))
+		}
+	}
+	bufferedLogs, err := drainRequestStateStore(ctx, handlerLogger)
+	result.BufferedLogs = bufferedLogs
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	handlerLogger.Info("Backfilled export files", LogFields{
+		"files": result.Files, "logEvents": result.LogEvents, "bufferedLogs": result.BufferedLogs,
+	})
+	return result, errs
+}
+
+// BackfillLocal forwards historical logs from every gzipped export file under root, such as a copy of
+// an export task's S3 prefix. Files are checkpointed by their path relative to root. Once the walk
+// is over, every Firetail log still buffered in the requestStateStore is forwarded, so requests which
+// are cut off by the end of the export aren't lost when the process exits.
+func BackfillLocal(ctx context.Context, root string) (*BackfillResult, error) {
+	if requestStateStore == nil {
+		return nil, errors.New("FIRETAIL_REQUEST_STATE_STORE must be set to backfill export files")
+	}
+	result := &BackfillResult{}
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(filePath, ".gz") {
+			return nil
+		}
+		name, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fileLogger := logger.With(LogFields{"file": name})
+		logEvents, err := backfillExportFile(ctx, fileLogger, filepath.ToSlash(name), filepath.Base(filepath.Dir(filePath)), file)
+		result.Files++
+		result.LogEvents += logEvents
+		if err != nil {
+			return errors.WithMessagef(err, "err backfilling export file %s", name)
+		}
+		return nil
+	})
+	bufferedLogs, drainErr := drainRequestStateStore(ctx, logger)
+	result.BufferedLogs = bufferedLogs
+	if drainErr != nil {
+		err = multierror.Append(err, drainErr)
+	}
+	logger.Info("Backfilled export files", LogFields{
+		"files": result.Files, "logEvents": result.LogEvents, "bufferedLogs": result.BufferedLogs,
+	})
+	return result, err
+}
+
+// drainRequestStateStore forwards every Firetail log which is still buffered in the requestStateStore,
+// whether or not it has expired, through the rest of the pipeline: filtering, routing and dead letters.
+// It returns how many Firetail logs were forwarded.
+func drainRequestStateStore(ctx context.Context, handlerLogger *Logger) (int, error) {
+	// Every buffered Firetail log expires within requestStateTTL of now. A later time isn't used, as
+	// the DynamoDB store only sweeps the expiry buckets of the day before the time it's given.
+	bufferedLogs, err := requestStateStore.Expired(ctx, time.Now().Add(requestStateTTL+time.Second))
+	if err != nil {
+		return 0, errors.WithMessage(err, "err getting buffered firetail logs")
+	}
+	firetailLogs := map[string]*FiretailLog{}
+	for _, bufferedLog := range bufferedLogs {
+		firetailLogs[bufferedLog.RequestID] = bufferedLog
+	}
+	removeUnpopulatedFiretailLogs(firetailLogs)
+	if filterPolicy != nil {
+		FilterFiretailLogs(filterPolicy, firetailLogs)
+	}
+	if len(firetailLogs) == 0 {
+		return 0, nil
+	}
+
+	chunkResults, err := sendRoutedFiretailLogs(ctx, routingTable, backfillLogGroup, firetailLogs)
+	handlerLogger.Info("Sent buffered Firetail logs", summariseChunkResults(chunkResults, LogFields{
+		"firetailLogs": len(firetailLogs),
+	}))
+	if err != nil {
+		err = handleFailedChunks(ctx, handlerLogger, chunkResults, err)
+	}
+	if err != nil {
+		return len(firetailLogs), errors.WithMessage(err, "err sending buffered firetail logs")
+	}
+	return len(firetailLogs), nil
+}
+
+// backfillExportFile reads the log events from an export file, which may be gzipped, and forwards them
+// to Firetail in batches through the same pipeline as logs delivered by a Cloudwatch subscription. After
+// each batch, the number of lines read is checkpointed under name, and lines which were checkpointed by
+// an earlier attempt are skipped. It returns how many log events were forwarded. Batches are cut
+// regardless of which requests their log events belong to, so the requestStateStore is relied upon to
+// correlate the requests which are split between batches.
+func backfillExportFile(ctx context.Context, fileLogger *Logger, name, logStream string, reader io.Reader) (int, error) {
+	skipLines := 0
+	if backfillCheckpointStore != nil {
+		var err error
+		skipLines, err = backfillCheckpointStore.Get(ctx, name)
+		if err != nil {
+			return 0, errors.WithMessage(err, "err getting checkpoint")
+		}
+		if skipLines > 0 {
+			fileLogger.Info("Resuming export file from checkpoint", LogFields{"lines": skipLines})
+		}
+	}
+
+	bufferedReader := bufio.NewReader(reader)
+	if magicBytes, err := bufferedReader.Peek(len(gzipMagicBytes)); err == nil && bytes.Equal(magicBytes, gzipMagicBytes) {
+		gzipReader, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return 0, errors.WithMessage(err, "err decompressing export file")
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	} else {
+		reader = bufferedReader
+	}
+
+	logsData := &events.CloudwatchLogsData{
+		MessageType: "DATA_MESSAGE",
+		LogGroup:    backfillLogGroup,
+		LogStream:   logStream,
+	}
+	forwardedEvents := 0
+	// batchLines is the number of lines read up to the end of the last event in the batch
+	batchLines := skipLines
+	flush := func() error {
+		if len(logsData.LogEvents) == 0 {
+			return nil
+		}
+		if err := handleLogsData(ctx, logsData); err != nil {
+			return err
+		}
+		forwardedEvents += len(logsData.LogEvents)
+		logsData.LogEvents = nil
+		if backfillCheckpointStore != nil {
+			if err := backfillCheckpointStore.Put(ctx, name, batchLines); err != nil {
+				return errors.WithMessage(err, "err putting checkpoint")
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, maxExportLineBytes)
+	var pendingEvent *events.CloudwatchLogsLogEvent
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line <= skipLines {
+			continue
+		}
+		logEvent, err := ParseExportLine(scanner.Text())
+		if err != nil {
+			// Messages can span multiple lines, in which case only the first line has a timestamp
+			if pendingEvent != nil {
+				pendingEvent.Message += "\n" + scanner.Text()
+			} else {
+				fileLogger.Warn("Err parsing export file line, skipping it", LogFields{"line": line, "error": err})
+			}
+			continue
+		}
+
+		if pendingEvent != nil {
+			logsData.LogEvents = append(logsData.LogEvents, *pendingEvent)
+			batchLines = line - 1
+			if len(logsData.LogEvents) >= backfillBatchEvents {
+				if err := flush(); err != nil {
+					return forwardedEvents, err
+				}
+			}
+		}
+		logEvent.ID = fmt.Sprintf("%s:%d", name, line)
+		pendingEvent = logEvent
+	}
+	if err := scanner.Err(); err != nil {
+		return forwardedEvents, errors.WithMessagef(err, "err reading export file after %d lines", line)
+	}
+	if pendingEvent != nil {
+		logsData.LogEvents = append(logsData.LogEvents, *pendingEvent)
+	}
+	batchLines = line
+	return forwardedEvents, flush()
+}
+
+// ParseExportLine parses the first line of a log event in a Cloudwatch export file, which holds its
+// timestamp and message separated by a space.
+func ParseExportLine(line string) (*events.CloudwatchLogsLogEvent, error) {
+	timestampValue, message, found := strings.Cut(line, " ")
+	if !found {
+		return nil, errors.New("line has no timestamp")
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, timestampValue)
+	if err != nil {
+		return nil, err
+	}
+	return &events.CloudwatchLogsLogEvent{
+		Timestamp: timestamp.UnixMilli(),
+		Message:   message,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package logshandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const DefaultBackfillCheckpointFile = "firetail-backfill-checkpoints.json"
+
+// BackfillCheckpointStore records how many lines of each export file have been forwarded to Firetail,
+// so that a backfill which is interrupted resumes where it left off rather than starting again.
+type BackfillCheckpointStore interface {
+	// Get returns the number of lines of the named export file which have been forwarded, or 0 if
+	// there's no checkpoint for it.
+	Get(ctx context.Context, name string) (int, error)
+	Put(ctx context.Context, name string, lines int) error
+}
+
+// backfillCheckpointStore is used to checkpoint export files if it's not nil.
+var backfillCheckpointStore BackfillCheckpointStore
+
+// FileBackfillCheckpointStore stores the checkpoints of every export file in a single JSON file, which
+// is replaced atomically whenever a checkpoint is put.
+type FileBackfillCheckpointStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileBackfillCheckpointStore) Get(ctx context.Context, name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoints, err := s.read()
+	if err != nil {
+		return 0, err
+	}
+	return checkpoints[name], nil
+}
+
+func (s *FileBackfillCheckpointStore) Put(ctx context.Context, name string, lines int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoints, err := s.read()
+	if err != nil {
+		return err
+	}
+	checkpoints[name] = lines
+	checkpointBytes, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(checkpointBytes); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), s.Path)
+}
+
+func (s *FileBackfillCheckpointStore) read() (map[string]int, error) {
+	checkpoints := map[string]int{}
+	checkpointBytes, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoints, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(checkpointBytes, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// s3BackfillCheckpointClient is the subset of the S3 client's methods used by S3BackfillCheckpointStore.
+type s3BackfillCheckpointClient interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3BackfillCheckpointStore stores the checkpoint of each export file as an object in an S3 bucket,
+// under a key prefix followed by the export file's name. The objects hold the number of lines
+// forwarded. It needs s3:ListBucket on the bucket as well as s3:GetObject and s3:PutObject on the
+// prefix, as without it S3 responds 403 rather than 404 for checkpoints which don't exist yet.
+type S3BackfillCheckpointStore struct {
+	Client s3BackfillCheckpointClient
+	Bucket string
+	Prefix string
+}
+
+func (s *S3BackfillCheckpointStore) Get(ctx context.Context, name string) (int, error) {
+	object, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer object.Body.Close()
+
+	var lines int
+	if err := json.NewDecoder(object.Body).Decode(&lines); err != nil {
+		return 0, err
+	}
+	return lines, nil
+}
+
+func (s *S3BackfillCheckpointStore) Put(ctx context.Context, name string, lines int) error {
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.key(name)),
+		Body:        bytes.NewReader([]byte(strconv.Itoa(lines))),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (s *S3BackfillCheckpointStore) key(name string) string {
+	return s.Prefix + name + ".json"
+}
@@ -0,0 +1,64 @@
+package logshandler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileBackfillCheckpointStore(t *testing.T) {
+	store := &FileBackfillCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoints.json")}
+
+	lines, err := store.Get(context.Background(), "TEST_FILE_1")
+	require.Nil(t, err)
+	assert.Equal(t, 0, lines)
+
+	require.Nil(t, store.Put(context.Background(), "TEST_FILE_1", 10))
+	require.Nil(t, store.Put(context.Background(), "TEST_FILE_2", 20))
+	require.Nil(t, store.Put(context.Background(), "TEST_FILE_1", 30))
+
+	lines, err = store.Get(context.Background(), "TEST_FILE_1")
+	require.Nil(t, err)
+	assert.Equal(t, 30, lines)
+	lines, err = store.Get(context.Background(), "TEST_FILE_2")
+	require.Nil(t, err)
+	assert.Equal(t, 20, lines)
+
+	checkpointBytes, err := os.ReadFile(store.Path)
+	require.Nil(t, err)
+	assert.Equal(t, `{"TEST_FILE_1":30,"TEST_FILE_2":20}`, string(checkpointBytes))
+
+	// Only the checkpoint file itself should be left behind
+	entries, err := os.ReadDir(filepath.Dir(store.Path))
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestFileBackfillCheckpointStoreMalformed(t *testing.T) {
+	store := &FileBackfillCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoints.json")}
+	require.Nil(t, os.WriteFile(store.Path, []byte("not json"), 0644))
+
+	_, err := store.Get(context.Background(), "TEST_FILE")
+	require.NotNil(t, err)
+	assert.Equal(t, "invalid character 'o' in literal null (expecting 'u')", err.Error())
+}
+
+func TestS3BackfillCheckpointStore(t *testing.T) {
+	client := &fakeS3Client{objects: map[string][]byte{}}
+	store := &S3BackfillCheckpointStore{Client: client, Bucket: "TEST_BUCKET", Prefix: "TEST_PREFIX/"}
+
+	lines, err := store.Get(context.Background(), "TEST_EXPORT_BUCKET/TEST_KEY.gz")
+	require.Nil(t, err)
+	assert.Equal(t, 0, lines)
+
+	require.Nil(t, store.Put(context.Background(), "TEST_EXPORT_BUCKET/TEST_KEY.gz", 42))
+	assert.Equal(t, map[string][]byte{"TEST_PREFIX/TEST_EXPORT_BUCKET/TEST_KEY.gz.json": []byte("42")}, client.objects)
+
+	lines, err = store.Get(context.Background(), "TEST_EXPORT_BUCKET/TEST_KEY.gz")
+	require.Nil(t, err)
+	assert.Equal(t, 42, lines)
+}
@@ -0,0 +1,290 @@
+package logshandler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testExportFile = `2022-11-30T11:03:56.000Z TEST_ID_1 GraphQL Query: query {
+  getPost
+}
+2022-11-30T11:03:56.100Z TEST_ID_1 End Request
+2022-11-30T11:03:56.500Z TEST_ID_2 GraphQL Query: TEST_QUERY_2
+2022-11-30T11:03:56.600Z TEST_ID_2 End Request
+2022-11-30T11:03:57.000Z TEST_ID_3 GraphQL Query: TEST_QUERY_3
+2022-11-30T11:03:57.100Z TEST_ID_3 End Request
+`
+
+// makeTestBackfillServer returns a test server which records the body of every request made to it,
+// and configures it as the Firetail API.
+func makeTestBackfillServer(t *testing.T, requestBodies *[]string) *httptest.Server {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		*requestBodies = append(*requestBodies, string(bodyBytes))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+	return testServer
+}
+
+func TestParseExportLine(t *testing.T) {
+	logEvent, err := ParseExportLine("2022-11-30T11:03:56.123Z TEST_ID GraphQL Query: TEST_QUERY")
+	require.Nil(t, err)
+	assert.Equal(t, &events.CloudwatchLogsLogEvent{
+		Timestamp: 1669806236123,
+		Message:   "TEST_ID GraphQL Query: TEST_QUERY",
+	}, logEvent)
+}
+
+func TestParseExportLineInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		line          string
+		expectedError string
+	}{
+		{"TEST_MESSAGE", "line has no timestamp"},
+		{"  getPost", `parsing time "" as "2006-01-02T15:04:05.999999999Z07:00": cannot parse "" as "2006"`},
+	} {
+		logEvent, err := ParseExportLine(testCase.line)
+		require.NotNil(t, err, testCase.line)
+		assert.Equal(t, testCase.expectedError, err.Error())
+		assert.Nil(t, logEvent)
+	}
+}
+
+func TestBackfillExportFile(t *testing.T) {
+	requestBodies := []string{}
+	testServer := makeTestBackfillServer(t, &requestBodies)
+	defer testServer.Close()
+	backfillBatchEvents = 3
+	backfillLogGroup = "/aws/appsync/apis/TEST_API_ID"
+	backfillCheckpointStore = &FileBackfillCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoints.json")}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillBatchEvents = DefaultBackfillBatchEvents
+		backfillLogGroup = ""
+		backfillCheckpointStore = nil
+		requestStateStore = nil
+	}()
+
+	logEvents, err := backfillExportFile(
+		context.Background(), logger, "TEST_FILE", "TEST_STREAM", strings.NewReader(string(gzipTestData(t, testExportFile))),
+	)
+	require.Nil(t, err)
+	assert.Equal(t, 6, logEvents)
+
+	// TEST_ID_2 is split between the two batches, so it's buffered until the second
+	require.Len(t, requestBodies, 2)
+	assert.Contains(t, requestBodies[0], `"query":"query {\n  getPost\n}","request_id":"TEST_ID_1"`)
+	assert.Contains(t, requestBodies[0], `"apiId":"TEST_API_ID"`)
+	assert.NotContains(t, requestBodies[0], `"request_id":"TEST_ID_2"`)
+	assert.Contains(t, requestBodies[1], `"endRequestTimestamp":1669806236600,`)
+	assert.Contains(t, requestBodies[1], `"query":"TEST_QUERY_2","request_id":"TEST_ID_2"`)
+	assert.Contains(t, requestBodies[1], `"request_id":"TEST_ID_3"`)
+
+	lines, err := backfillCheckpointStore.Get(context.Background(), "TEST_FILE")
+	require.Nil(t, err)
+	assert.Equal(t, 8, lines)
+}
+
+func TestBackfillExportFileResumesFromCheckpoint(t *testing.T) {
+	requestBodies := []string{}
+	testServer := makeTestBackfillServer(t, &requestBodies)
+	defer testServer.Close()
+	backfillCheckpointStore = &FileBackfillCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoints.json")}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillCheckpointStore = nil
+		requestStateStore = nil
+	}()
+	require.Nil(t, backfillCheckpointStore.Put(context.Background(), "TEST_FILE", 6))
+
+	// Export files which have already been decompressed are read too
+	logEvents, err := backfillExportFile(context.Background(), logger, "TEST_FILE", "TEST_STREAM", strings.NewReader(testExportFile))
+	require.Nil(t, err)
+	assert.Equal(t, 2, logEvents)
+
+	require.Len(t, requestBodies, 1)
+	assert.Contains(t, requestBodies[0], `"request_id":"TEST_ID_3"`)
+	assert.NotContains(t, requestBodies[0], `"request_id":"TEST_ID_2"`)
+}
+
+func TestBackfillExportFileSendFails(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	defer testServer.Close()
+	firetailApiUrl = testServer.URL
+	backfillCheckpointStore = &FileBackfillCheckpointStore{Path: filepath.Join(t.TempDir(), "checkpoints.json")}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillCheckpointStore = nil
+		requestStateStore = nil
+	}()
+
+	logEvents, err := backfillExportFile(context.Background(), logger, "TEST_FILE", "TEST_STREAM", strings.NewReader(testExportFile))
+	require.NotNil(t, err)
+	assert.Equal(t, 0, logEvents)
+
+	// The file should be read from the start again next time
+	lines, err := backfillCheckpointStore.Get(context.Background(), "TEST_FILE")
+	require.Nil(t, err)
+	assert.Equal(t, 0, lines)
+}
+
+func TestBackfillLocal(t *testing.T) {
+	requestBodies := []string{}
+	testServer := makeTestBackfillServer(t, &requestBodies)
+	defer testServer.Close()
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoints.json")
+	backfillCheckpointStore = &FileBackfillCheckpointStore{Path: checkpointFile}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillCheckpointStore = nil
+		requestStateStore = nil
+	}()
+
+	root := t.TempDir()
+	for _, name := range []string{"TEST_STREAM_1/000000.gz", "TEST_STREAM_2/000000.gz"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755))
+		require.Nil(t, os.WriteFile(filepath.Join(root, name), gzipTestData(t, testExportFile), 0644))
+	}
+	require.Nil(t, os.WriteFile(filepath.Join(root, "aws-logs-write-test"), []byte("Permission Check Successful"), 0644))
+
+	result, err := BackfillLocal(context.Background(), root)
+	require.Nil(t, err)
+	assert.Equal(t, &BackfillResult{Files: 2, LogEvents: 12}, result)
+	assert.Len(t, requestBodies, 2)
+
+	checkpointBytes, err := os.ReadFile(checkpointFile)
+	require.Nil(t, err)
+	assert.Equal(t, `{"TEST_STREAM_1/000000.gz":8,"TEST_STREAM_2/000000.gz":8}`, string(checkpointBytes))
+
+	// Running the backfill again should send nothing more
+	result, err = BackfillLocal(context.Background(), root)
+	require.Nil(t, err)
+	assert.Equal(t, &BackfillResult{Files: 2, LogEvents: 0}, result)
+	assert.Len(t, requestBodies, 2)
+}
+
+func TestBackfillLocalSendsIncompleteRequests(t *testing.T) {
+	requestBodies := []string{}
+	testServer := makeTestBackfillServer(t, &requestBodies)
+	defer testServer.Close()
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() { requestStateStore = nil }()
+
+	// The export ends before TEST_ID_3's End Request
+	root := t.TempDir()
+	truncatedExportFile := strings.TrimSuffix(testExportFile, "2022-11-30T11:03:57.100Z TEST_ID_3 End Request\n")
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "TEST_STREAM"), 0755))
+	require.Nil(t, os.WriteFile(filepath.Join(root, "TEST_STREAM/000000.gz"), gzipTestData(t, truncatedExportFile), 0644))
+
+	result, err := BackfillLocal(context.Background(), root)
+	require.Nil(t, err)
+	assert.Equal(t, &BackfillResult{Files: 1, LogEvents: 5, BufferedLogs: 1}, result)
+	require.Len(t, requestBodies, 2)
+	assert.NotContains(t, requestBodies[0], `"request_id":"TEST_ID_3"`)
+	assert.Contains(t, requestBodies[1], `"query":"TEST_QUERY_3","request_id":"TEST_ID_3"`)
+	assert.Contains(t, requestBodies[1], `"logStream":"TEST_STREAM"`)
+
+	bufferedLogs, err := requestStateStore.Expired(context.Background(), time.Now().Add(requestStateTTL+time.Second))
+	require.Nil(t, err)
+	assert.Len(t, bufferedLogs, 0)
+}
+
+func TestBackfillHandlerSendBufferedLogsFails(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	defer testServer.Close()
+	firetailApiUrl = testServer.URL
+	backfillS3Client = &fakeS3Client{objects: map[string][]byte{}}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillS3Client = nil
+		requestStateStore = nil
+	}()
+	testQuery := "TEST_QUERY"
+	require.Nil(t, requestStateStore.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID", Query: &testQuery}, time.Now().Add(time.Minute), 0))
+
+	// The err is returned so that S3 retries the invocation
+	result, err := BackfillHandler(context.Background(), events.S3Event{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "err sending buffered firetail logs")
+	assert.Equal(t, &BackfillResult{BufferedLogs: 1}, result)
+}
+
+func TestBackfillHandler(t *testing.T) {
+	requestBodies := []string{}
+	testServer := makeTestBackfillServer(t, &requestBodies)
+	defer testServer.Close()
+	backfillS3Client = &fakeS3Client{objects: map[string][]byte{
+		"TEST_PREFIX/TEST_TASK_ID/TEST STREAM/000000.gz": gzipTestData(t, testExportFile),
+	}}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillS3Client = nil
+		requestStateStore = nil
+	}()
+
+	result, err := BackfillHandler(context.Background(), events.S3Event{Records: []events.S3EventRecord{
+		{S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: "TEST_BUCKET"},
+			Object: events.S3Object{Key: "TEST_PREFIX/TEST_TASK_ID/TEST+STREAM/000000.gz"},
+		}},
+		{S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: "TEST_BUCKET"},
+			Object: events.S3Object{Key: "TEST_PREFIX/aws-logs-write-test"},
+		}},
+	}})
+	require.Nil(t, err)
+	assert.Equal(t, &BackfillResult{Files: 1, LogEvents: 6}, result)
+	require.Len(t, requestBodies, 1)
+	assert.Contains(t, requestBodies[0], `"logStream":"TEST STREAM"`)
+}
+
+func TestBackfillHandlerMissingFile(t *testing.T) {
+	backfillS3Client = &fakeS3Client{objects: map[string][]byte{}}
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() {
+		backfillS3Client = nil
+		requestStateStore = nil
+	}()
+
+	result, err := BackfillHandler(context.Background(), events.S3Event{Records: []events.S3EventRecord{
+		{S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: "TEST_BUCKET"},
+			Object: events.S3Object{Key: "TEST_KEY.gz"},
+		}},
+	}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "err getting export file s3://TEST_BUCKET/TEST_KEY.gz")
+	assert.Equal(t, &BackfillResult{}, result)
+}
+
+func TestBackfillWithoutRequestStateStore(t *testing.T) {
+	backfillS3Client = &fakeS3Client{objects: map[string][]byte{}}
+	defer func() { backfillS3Client = nil }()
+
+	result, err := BackfillHandler(context.Background(), events.S3Event{})
+	require.NotNil(t, err)
+	assert.Equal(t, "FIRETAIL_REQUEST_STATE_STORE must be set to backfill export files", err.Error())
+	assert.Nil(t, result)
+
+	result, err = BackfillLocal(context.Background(), t.TempDir())
+	require.NotNil(t, err)
+	assert.Equal(t, "FIRETAIL_REQUEST_STATE_STORE must be set to backfill export files", err.Error())
+	assert.Nil(t, result)
+}
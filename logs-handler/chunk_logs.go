@@ -0,0 +1,56 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+const DefaultMaxChunkBytes int = 1024 * 1024
+const DefaultMaxChunkRecords int = 1000
+
+var maxChunkBytes = DefaultMaxChunkBytes
+var maxChunkRecords = DefaultMaxChunkRecords
+
+// logChunk is a portion of a batch of Firetail logs, serialised as NDJSON, which is sent to the
+// Firetail logging API in a single request.
+type logChunk struct {
+	RequestIDs []string
+	Payload    []byte
+}
+
+// chunkFiretailLogs serialises firetailLogs into NDJSON chunks of no more than maxBytes and
+// maxRecords each, ordered by request ID. A single log larger than maxBytes is put in a chunk on
+// its own rather than being dropped. Values less than 1 for maxBytes or maxRecords disable that
+// limit.
+func chunkFiretailLogs(firetailLogs map[string]*FiretailLog, maxBytes, maxRecords int) ([]*logChunk, error) {
+	requestIDs := make([]string, 0, len(firetailLogs))
+	for requestID := range firetailLogs {
+		requestIDs = append(requestIDs, requestID)
+	}
+	sort.Strings(requestIDs)
+
+	chunks := []*logChunk{}
+	var currentChunk *logChunk
+	for _, requestID := range requestIDs {
+		logBytes, err := json.Marshal(*firetailLogs[requestID])
+		if err != nil {
+			return nil, err
+		}
+		logBytes = append(logBytes, '\n')
+
+		if currentChunk != nil &&
+			((maxBytes > 0 && len(currentChunk.Payload)+len(logBytes) > maxBytes) ||
+				(maxRecords > 0 && len(currentChunk.RequestIDs) >= maxRecords)) {
+			currentChunk = nil
+		}
+		if currentChunk == nil {
+			currentChunk = &logChunk{}
+			chunks = append(chunks, currentChunk)
+		}
+
+		currentChunk.RequestIDs = append(currentChunk.RequestIDs, requestID)
+		currentChunk.Payload = append(currentChunk.Payload, logBytes...)
+	}
+
+	return chunks, nil
+}
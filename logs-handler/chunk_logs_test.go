@@ -0,0 +1,65 @@
+package logshandler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestFiretailLogs(requestIDs ...string) map[string]*FiretailLog {
+	firetailLogs := map[string]*FiretailLog{}
+	for _, requestID := range requestIDs {
+		testQuery := "TEST_QUERY"
+		firetailLogs[requestID] = &FiretailLog{
+			Query:     &testQuery,
+			RequestID: requestID,
+		}
+	}
+	return firetailLogs
+}
+
+func TestChunkFiretailLogsSingleChunk(t *testing.T) {
+	chunks, err := chunkFiretailLogs(makeTestFiretailLogs("TEST_ID_2", "TEST_ID_1"), 0, 0)
+	require.Nil(t, err)
+	require.Len(t, chunks, 1)
+	assert.Equal(t, []string{"TEST_ID_1", "TEST_ID_2"}, chunks[0].RequestIDs)
+	assert.Equal(
+		t,
+		"{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_2\"}\n",
+		string(chunks[0].Payload),
+	)
+}
+
+func TestChunkFiretailLogsMaxRecords(t *testing.T) {
+	chunks, err := chunkFiretailLogs(makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2", "TEST_ID_3"), 0, 2)
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	assert.Equal(t, []string{"TEST_ID_1", "TEST_ID_2"}, chunks[0].RequestIDs)
+	assert.Equal(t, []string{"TEST_ID_3"}, chunks[1].RequestIDs)
+}
+
+func TestChunkFiretailLogsMaxBytes(t *testing.T) {
+	// Each of these logs is 48 bytes long including the trailing newline
+	chunks, err := chunkFiretailLogs(makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2", "TEST_ID_3"), 100, 0)
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	assert.Equal(t, []string{"TEST_ID_1", "TEST_ID_2"}, chunks[0].RequestIDs)
+	assert.Len(t, chunks[0].Payload, 96)
+	assert.Equal(t, []string{"TEST_ID_3"}, chunks[1].RequestIDs)
+	assert.Len(t, chunks[1].Payload, 48)
+}
+
+func TestChunkFiretailLogsOversizedLog(t *testing.T) {
+	chunks, err := chunkFiretailLogs(makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2"), 10, 0)
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	assert.Equal(t, []string{"TEST_ID_1"}, chunks[0].RequestIDs)
+	assert.Equal(t, []string{"TEST_ID_2"}, chunks[1].RequestIDs)
+}
+
+func TestChunkFiretailLogsEmpty(t *testing.T) {
+	chunks, err := chunkFiretailLogs(map[string]*FiretailLog{}, 0, 0)
+	require.Nil(t, err)
+	assert.Len(t, chunks, 0)
+}
@@ -0,0 +1,64 @@
+package logshandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type CompressionType string
+
+const (
+	NoCompression   CompressionType = "none"
+	GzipCompression CompressionType = "gzip"
+	ZstdCompression CompressionType = "zstd"
+)
+
+var compressionType = NoCompression
+
+// parseCompressionType validates a compression type given as a string, such as the value of the
+// FIRETAIL_COMPRESSION environment variable.
+func parseCompressionType(value string) (CompressionType, error) {
+	switch CompressionType(value) {
+	case NoCompression, GzipCompression, ZstdCompression:
+		return CompressionType(value), nil
+	case "":
+		return NoCompression, nil
+	default:
+		return NoCompression, fmt.Errorf("unsupported compression type: %s", value)
+	}
+}
+
+// compressPayload compresses payload using the given compression type, and returns the compressed
+// bytes along with the value that should be used for the Content-Encoding header, which will be
+// empty if no compression was applied.
+func compressPayload(payload []byte, compression CompressionType) ([]byte, string, error) {
+	switch compression {
+	case GzipCompression:
+		var compressedPayload bytes.Buffer
+		gzipWriter := gzip.NewWriter(&compressedPayload)
+		if _, err := gzipWriter.Write(payload); err != nil {
+			return nil, "", err
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return nil, "", err
+		}
+		return compressedPayload.Bytes(), "gzip", nil
+
+	case ZstdCompression:
+		zstdEncoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer zstdEncoder.Close()
+		return zstdEncoder.EncodeAll(payload, nil), "zstd", nil
+
+	case NoCompression, "":
+		return payload, "", nil
+
+	default:
+		return nil, "", fmt.Errorf("unsupported compression type: %s", compression)
+	}
+}
@@ -0,0 +1,72 @@
+package logshandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompressionType(t *testing.T) {
+	for value, expectedCompressionType := range map[string]CompressionType{
+		"":     NoCompression,
+		"none": NoCompression,
+		"gzip": GzipCompression,
+		"zstd": ZstdCompression,
+	} {
+		compressionType, err := parseCompressionType(value)
+		require.Nil(t, err)
+		assert.Equal(t, expectedCompressionType, compressionType)
+	}
+}
+
+func TestParseCompressionTypeUnsupported(t *testing.T) {
+	compressionType, err := parseCompressionType("brotli")
+	require.NotNil(t, err)
+	assert.Equal(t, "unsupported compression type: brotli", err.Error())
+	assert.Equal(t, NoCompression, compressionType)
+}
+
+func TestCompressPayloadNone(t *testing.T) {
+	payload, contentEncoding, err := compressPayload([]byte("TEST_PAYLOAD"), NoCompression)
+	require.Nil(t, err)
+	assert.Equal(t, "", contentEncoding)
+	assert.Equal(t, "TEST_PAYLOAD", string(payload))
+}
+
+func TestCompressPayloadGzip(t *testing.T) {
+	payload, contentEncoding, err := compressPayload([]byte("TEST_PAYLOAD"), GzipCompression)
+	require.Nil(t, err)
+	assert.Equal(t, "gzip", contentEncoding)
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+	require.Nil(t, err)
+	decompressedPayload, err := ioutil.ReadAll(gzipReader)
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_PAYLOAD", string(decompressedPayload))
+}
+
+func TestCompressPayloadZstd(t *testing.T) {
+	payload, contentEncoding, err := compressPayload([]byte("TEST_PAYLOAD"), ZstdCompression)
+	require.Nil(t, err)
+	assert.Equal(t, "zstd", contentEncoding)
+
+	zstdDecoder, err := zstd.NewReader(nil)
+	require.Nil(t, err)
+	defer zstdDecoder.Close()
+	decompressedPayload, err := zstdDecoder.DecodeAll(payload, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_PAYLOAD", string(decompressedPayload))
+}
+
+func TestCompressPayloadUnsupported(t *testing.T) {
+	payload, contentEncoding, err := compressPayload([]byte("TEST_PAYLOAD"), CompressionType("brotli"))
+	require.NotNil(t, err)
+	assert.Equal(t, "unsupported compression type: brotli", err.Error())
+	assert.Equal(t, "", contentEncoding)
+	assert.Nil(t, payload)
+}
@@ -0,0 +1,87 @@
+package logshandler
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// maxRequestStateConflictAttempts is how many times the merge of a Firetail log into the store is
+// attempted when other invocations keep changing the same request's buffered Firetail log.
+const maxRequestStateConflictAttempts = 5
+
+// CorrelateFiretailLogs merges firetailLogs with any incomplete Firetail logs for the same requests
+// which were buffered in the store from earlier Cloudwatch deliveries. Firetail logs which are now
+// complete are returned, along with any buffered Firetail logs which have expired, and the rest are
+// buffered until requestStateTTL after now. If the store fails, the affected Firetail logs are
+// returned rather than risking them being lost.
+func CorrelateFiretailLogs(ctx context.Context, store RequestStateStore, firetailLogs map[string]*FiretailLog, now time.Time) (map[string]*FiretailLog, error) {
+	readyLogs := map[string]*FiretailLog{}
+	var errs error
+
+	for requestID, firetailLog := range firetailLogs {
+		readyLog, err := correlateFiretailLog(ctx, store, requestID, firetailLog, now)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if readyLog != nil {
+			readyLogs[requestID] = readyLog
+		}
+	}
+
+	expiredLogs, err := store.Expired(ctx, now)
+	if err != nil {
+		errs = multierror.Append(errs, errors.WithMessage(err, "err getting expired firetail logs"))
+	}
+	for _, expiredLog := range expiredLogs {
+		if _, alreadyReady := readyLogs[expiredLog.RequestID]; alreadyReady {
+			continue
+		}
+		logger.Warn("Buffered Firetail log expired before it was completed", LogFields{"requestId": expiredLog.RequestID})
+		readyLogs[expiredLog.RequestID] = expiredLog
+	}
+
+	removeUnpopulatedFiretailLogs(readyLogs)
+	return readyLogs, errs
+}
+
+// correlateFiretailLog merges firetailLog with the buffered Firetail log for the same request, and
+// either removes the buffered Firetail log and returns the merged one if it's complete, or buffers
+// the merged one. If another invocation changes the buffered Firetail log in between, the merge is
+// retried, so that neither invocation's events are lost.
+func correlateFiretailLog(ctx context.Context, store RequestStateStore, requestID string, firetailLog *FiretailLog, now time.Time) (*FiretailLog, error) {
+	for attempt := 1; ; attempt++ {
+		bufferedLog, version, err := store.Get(ctx, requestID)
+		if err != nil {
+			return firetailLog, errors.WithMessagef(err, "err getting buffered firetail log for request ID %s", requestID)
+		}
+		mergedLog := firetailLog
+		if bufferedLog != nil {
+			bufferedLog.Merge(firetailLog)
+			mergedLog = bufferedLog
+		}
+
+		var errMessage string
+		if mergedLog.IsComplete() {
+			if bufferedLog == nil {
+				return mergedLog, nil
+			}
+			if err = store.Delete(ctx, requestID, version); err == nil {
+				return mergedLog, nil
+			}
+			errMessage = "err deleting buffered firetail log for request ID %s"
+		} else {
+			if err = store.Put(ctx, mergedLog, now.Add(requestStateTTL), version); err == nil {
+				return nil, nil
+			}
+			errMessage = "err buffering firetail log for request ID %s"
+		}
+
+		var conflictErr *RequestStateConflictError
+		if !errors.As(err, &conflictErr) || attempt >= maxRequestStateConflictAttempts {
+			return mergedLog, errors.WithMessagef(err, errMessage, requestID)
+		}
+	}
+}
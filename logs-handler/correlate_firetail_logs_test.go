@@ -0,0 +1,177 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingRequestStateStore is a RequestStateStore whose every method fails.
+type failingRequestStateStore struct{}
+
+func (failingRequestStateStore) Get(ctx context.Context, requestID string) (*FiretailLog, int64, error) {
+	return nil, 0, errors.New("TEST_GET_ERR")
+}
+
+func (failingRequestStateStore) Put(ctx context.Context, firetailLog *FiretailLog, expiresAt time.Time, version int64) error {
+	return errors.New("TEST_PUT_ERR")
+}
+
+func (failingRequestStateStore) Delete(ctx context.Context, requestID string, version int64) error {
+	return errors.New("TEST_DELETE_ERR")
+}
+
+// racingRequestStateStore is a MemoryRequestStateStore which calls beforePut before each Put, to
+// simulate another invocation changing the store between a Get and a Put.
+type racingRequestStateStore struct {
+	*MemoryRequestStateStore
+	beforePut func()
+}
+
+func (r *racingRequestStateStore) Put(ctx context.Context, firetailLog *FiretailLog, expiresAt time.Time, version int64) error {
+	if r.beforePut != nil {
+		r.beforePut()
+	}
+	return r.MemoryRequestStateStore.Put(ctx, firetailLog, expiresAt, version)
+}
+
+func (failingRequestStateStore) Expired(ctx context.Context, now time.Time) ([]*FiretailLog, error) {
+	return nil, errors.New("TEST_EXPIRED_ERR")
+}
+
+func TestCorrelateFiretailLogsAcrossDeliveries(t *testing.T) {
+	store := NewMemoryRequestStateStore()
+	now := time.Now()
+
+	firstDelivery, err := extractAllFiretailLogs(context.Background(), &events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{Timestamp: 1000, Message: "TEST_ID Begin Request"},
+			{Timestamp: 1001, Message: "TEST_ID GraphQL Query: TEST_QUERY"},
+		},
+	}, nil)
+	require.Nil(t, err)
+	readyLogs, err := CorrelateFiretailLogs(context.Background(), store, firstDelivery, now)
+	require.Nil(t, err)
+	assert.Len(t, readyLogs, 0)
+
+	secondDelivery, err := extractAllFiretailLogs(context.Background(), &events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{Timestamp: 1088, Message: `{"logType":"RequestSummary","requestId":"TEST_ID","statusCode":200}`},
+			{Timestamp: 1089, Message: "TEST_ID End Request"},
+		},
+	}, nil)
+	require.Nil(t, err)
+	readyLogs, err = CorrelateFiretailLogs(context.Background(), store, secondDelivery, now.Add(time.Second))
+	require.Nil(t, err)
+
+	require.Contains(t, readyLogs, "TEST_ID")
+	testQuery := "TEST_QUERY"
+	testRequestSummary := json.RawMessage(`{"logType":"RequestSummary","requestId":"TEST_ID","statusCode":200}`)
+	assert.Equal(t, &FiretailLog{
+		RequestID:             "TEST_ID",
+		BeginRequestTimestamp: 1000,
+		EndRequestTimestamp:   1089,
+		Query:                 &testQuery,
+		RequestSummary:        &testRequestSummary,
+	}, readyLogs["TEST_ID"])
+
+	firetailLog, _, err := store.Get(context.Background(), "TEST_ID")
+	require.Nil(t, err)
+	assert.Nil(t, firetailLog)
+}
+
+func TestCorrelateFiretailLogsConcurrentDeliveries(t *testing.T) {
+	store := &racingRequestStateStore{MemoryRequestStateStore: NewMemoryRequestStateStore()}
+	now := time.Now()
+	testQuery := "TEST_QUERY"
+
+	// Another invocation buffers the start of the request between this invocation's Get and Put
+	store.beforePut = func() {
+		store.beforePut = nil
+		_, err := CorrelateFiretailLogs(context.Background(), store.MemoryRequestStateStore, map[string]*FiretailLog{
+			"TEST_ID": {RequestID: "TEST_ID", BeginRequestTimestamp: 1000},
+		}, now)
+		require.Nil(t, err)
+	}
+	readyLogs, err := CorrelateFiretailLogs(context.Background(), store, map[string]*FiretailLog{
+		"TEST_ID": {RequestID: "TEST_ID", Query: &testQuery},
+	}, now)
+	require.Nil(t, err)
+	assert.Len(t, readyLogs, 0)
+
+	// Neither invocation's events were lost
+	firetailLog, version, err := store.Get(context.Background(), "TEST_ID")
+	require.Nil(t, err)
+	assert.Equal(t, &FiretailLog{RequestID: "TEST_ID", BeginRequestTimestamp: 1000, Query: &testQuery}, firetailLog)
+	assert.Equal(t, int64(2), version)
+}
+
+func TestCorrelateFiretailLogsPersistentConflicts(t *testing.T) {
+	store := &racingRequestStateStore{MemoryRequestStateStore: NewMemoryRequestStateStore()}
+	now := time.Now()
+	testQuery := "TEST_QUERY"
+
+	// Another invocation changes the request's buffered log before every Put
+	store.beforePut = func() {
+		firetailLog, version, err := store.MemoryRequestStateStore.Get(context.Background(), "TEST_ID")
+		require.Nil(t, err)
+		if firetailLog == nil {
+			firetailLog = &FiretailLog{RequestID: "TEST_ID"}
+		}
+		require.Nil(t, store.MemoryRequestStateStore.Put(context.Background(), firetailLog, now.Add(time.Minute), version))
+	}
+	readyLogs, err := CorrelateFiretailLogs(context.Background(), store, map[string]*FiretailLog{
+		"TEST_ID": {RequestID: "TEST_ID", Query: &testQuery},
+	}, now)
+
+	// The log is returned rather than being lost
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* err buffering firetail log for request ID TEST_ID: buffered firetail log for request ID TEST_ID was changed concurrently\n\n", err.Error())
+	assert.Equal(t, map[string]*FiretailLog{
+		"TEST_ID": {RequestID: "TEST_ID", Query: &testQuery},
+	}, readyLogs)
+}
+
+func TestCorrelateFiretailLogsExpiry(t *testing.T) {
+	requestStateTTL = time.Minute
+	defer func() { requestStateTTL = DefaultRequestStateTTL }()
+	store := NewMemoryRequestStateStore()
+	now := time.Now()
+	testQuery := "TEST_QUERY"
+
+	readyLogs, err := CorrelateFiretailLogs(context.Background(), store, map[string]*FiretailLog{
+		"TEST_ID_1": {RequestID: "TEST_ID_1", Query: &testQuery},
+		"TEST_ID_2": {RequestID: "TEST_ID_2", BeginRequestTimestamp: 1000},
+	}, now)
+	require.Nil(t, err)
+	assert.Len(t, readyLogs, 0)
+
+	readyLogs, err = CorrelateFiretailLogs(context.Background(), store, map[string]*FiretailLog{}, now.Add(2*time.Minute))
+	require.Nil(t, err)
+
+	// Expired logs are sent as they are, unless they were never populated
+	assert.Equal(t, map[string]*FiretailLog{
+		"TEST_ID_1": {RequestID: "TEST_ID_1", Query: &testQuery},
+	}, readyLogs)
+	expired, err := store.Expired(context.Background(), now.Add(2*time.Minute))
+	require.Nil(t, err)
+	assert.Len(t, expired, 0)
+}
+
+func TestCorrelateFiretailLogsStoreFails(t *testing.T) {
+	testQuery := "TEST_QUERY"
+	readyLogs, err := CorrelateFiretailLogs(context.Background(), failingRequestStateStore{}, map[string]*FiretailLog{
+		"TEST_ID": {RequestID: "TEST_ID", Query: &testQuery},
+	}, time.Now())
+	require.NotNil(t, err)
+	assert.Equal(t, "2 errors occurred:\n\t* err getting buffered firetail log for request ID TEST_ID: TEST_GET_ERR\n\t* err getting expired firetail logs: TEST_EXPIRED_ERR\n\n", err.Error())
+	assert.Equal(t, map[string]*FiretailLog{
+		"TEST_ID": {RequestID: "TEST_ID", Query: &testQuery},
+	}, readyLogs)
+}
@@ -0,0 +1,66 @@
+package logshandler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is a chunk of logs which could not be delivered to Firetail, along with some metadata
+// describing why.
+type DeadLetter struct {
+	FailedAt time.Time `json:"failedAt"`
+	Error    string    `json:"error"`
+	ApiUrl   string    `json:"apiUrl"`
+	// Route is the name of the route the chunk took through the routing table, which is used to
+	// find the token to redrive it with.
+	Route      string   `json:"route,omitempty"`
+	RequestIDs []string `json:"requestIds"`
+	// Payload is the NDJSON that was sent to the Firetail logging API.
+	Payload string `json:"payload"`
+}
+
+// DeadLetterSink stores dead letters so that they can later be redriven through SendToFiretail.
+type DeadLetterSink interface {
+	// Put stores a dead letter in the sink.
+	Put(ctx context.Context, deadLetter *DeadLetter) error
+	// ForEach calls fn for each dead letter currently in the sink. If fn returns nil the dead letter
+	// is removed from the sink, otherwise it is left in place to be retried later.
+	ForEach(ctx context.Context, fn func(*DeadLetter) error) error
+}
+
+var deadLetterSink DeadLetterSink
+
+// newDeadLetter creates a dead letter for a chunk which failed to send, holding only that chunk's logs.
+func newDeadLetter(chunkResult *ChunkResult) *DeadLetter {
+	return &DeadLetter{
+		FailedAt:   time.Now().UTC(),
+		Error:      chunkResult.Err.Error(),
+		ApiUrl:     chunkResult.ApiUrl,
+		Route:      chunkResult.Route,
+		RequestIDs: chunkResult.Chunk.RequestIDs,
+		Payload:    string(chunkResult.Chunk.Payload),
+	}
+}
+
+// FiretailLogs decodes the NDJSON payload of the dead letter back into Firetail logs.
+func (d *DeadLetter) FiretailLogs() (map[string]*FiretailLog, error) {
+	firetailLogs := map[string]*FiretailLog{}
+	scanner := bufio.NewScanner(bytes.NewBufferString(d.Payload))
+	scanner.Buffer(nil, len(d.Payload)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var firetailLog FiretailLog
+		if err := json.Unmarshal(scanner.Bytes(), &firetailLog); err != nil {
+			return nil, errors.WithMessage(err, "err unmarshalling firetail log from dead letter")
+		}
+		firetailLogs[firetailLog.RequestID] = &firetailLog
+	}
+	return firetailLogs, scanner.Err()
+}
@@ -0,0 +1,101 @@
+package logshandler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+// s3DeadLetterClient is the subset of the S3 client's methods used by S3DeadLetterSink.
+type s3DeadLetterClient interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	s3.ListObjectsV2APIClient
+}
+
+// S3DeadLetterSink stores each dead letter as a JSON object in an S3 bucket under a key prefix.
+type S3DeadLetterSink struct {
+	Client s3DeadLetterClient
+	Bucket string
+	Prefix string
+}
+
+func (s *S3DeadLetterSink) Put(ctx context.Context, deadLetter *DeadLetter) error {
+	deadLetterBytes, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	randomBytes := make([]byte, 8)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return err
+	}
+	key := fmt.Sprintf(
+		"%s%s/%d-%s.json",
+		s.Prefix, deadLetter.FailedAt.Format("2006/01/02"), deadLetter.FailedAt.UnixNano(), hex.EncodeToString(randomBytes),
+	)
+
+	_, err = s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(deadLetterBytes),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (s *S3DeadLetterSink) ForEach(ctx context.Context, fn func(*DeadLetter) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return errors.WithMessage(err, "err listing dead letters")
+		}
+		for _, object := range page.Contents {
+			deadLetter, err := s.get(ctx, object.Key)
+			if err != nil {
+				logger.Warn("Err getting dead letter, skipping", LogFields{"key": aws.ToString(object.Key), "error": err})
+				continue
+			}
+			if err := fn(deadLetter); err != nil {
+				continue
+			}
+			_, err = s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    object.Key,
+			})
+			if err != nil {
+				return errors.WithMessagef(err, "err deleting dead letter %s", aws.ToString(object.Key))
+			}
+		}
+	}
+	return nil
+}
+
+func (s *S3DeadLetterSink) get(ctx context.Context, key *string) (*DeadLetter, error) {
+	object, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	var deadLetter DeadLetter
+	if err := json.NewDecoder(object.Body).Decode(&deadLetter); err != nil {
+		return nil, err
+	}
+	return &deadLetter, nil
+}
@@ -0,0 +1,110 @@
+package logshandler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3Client is an in-memory stand-in for a single S3 bucket.
+type fakeS3Client struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, exists := f.objects[aws.ToString(params.Key)]
+	if !exists {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, types.Object{Key: aws.String(key)})
+	}
+	return output, nil
+}
+
+func TestS3DeadLetterSinkPut(t *testing.T) {
+	client := &fakeS3Client{objects: map[string][]byte{}}
+	sink := &S3DeadLetterSink{Client: client, Bucket: "TEST_BUCKET", Prefix: "TEST_PREFIX/"}
+
+	err := sink.Put(context.Background(), &DeadLetter{
+		FailedAt:   time.Date(2022, 11, 30, 11, 3, 56, 0, time.UTC),
+		Error:      "TEST_ERR",
+		RequestIDs: []string{"TEST_ID"},
+		Payload:    "{\"request_id\":\"TEST_ID\"}\n",
+	})
+	require.Nil(t, err)
+
+	require.Len(t, client.objects, 1)
+	for key, body := range client.objects {
+		assert.True(t, strings.HasPrefix(key, "TEST_PREFIX/2022/11/30/1669806236000000000-"), key)
+		assert.True(t, strings.HasSuffix(key, ".json"), key)
+		assert.Equal(
+			t,
+			"{\"failedAt\":\"2022-11-30T11:03:56Z\",\"error\":\"TEST_ERR\",\"apiUrl\":\"\",\"requestIds\":[\"TEST_ID\"],\"payload\":\"{\\\"request_id\\\":\\\"TEST_ID\\\"}\\n\"}",
+			string(body),
+		)
+	}
+}
+
+func TestS3DeadLetterSinkForEach(t *testing.T) {
+	client := &fakeS3Client{objects: map[string][]byte{
+		"OTHER_PREFIX/1.json": []byte(`{"error":"OTHER_ERR"}`),
+		"TEST_PREFIX/1.json":  []byte(`{"error":"TEST_ERR_1"}`),
+		"TEST_PREFIX/2.json":  []byte(`{"error":"TEST_ERR_2"}`),
+		"TEST_PREFIX/3.json":  []byte(`not json`),
+	}}
+	sink := &S3DeadLetterSink{Client: client, Bucket: "TEST_BUCKET", Prefix: "TEST_PREFIX/"}
+
+	seenErrors := []string{}
+	err := sink.ForEach(context.Background(), func(deadLetter *DeadLetter) error {
+		seenErrors = append(seenErrors, deadLetter.Error)
+		if deadLetter.Error == "TEST_ERR_2" {
+			return errors.New("TEST_REDRIVE_ERR")
+		}
+		return nil
+	})
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{"TEST_ERR_1", "TEST_ERR_2"}, seenErrors)
+	assert.NotContains(t, client.objects, "TEST_PREFIX/1.json")
+	assert.Contains(t, client.objects, "TEST_PREFIX/2.json")
+	assert.Contains(t, client.objects, "TEST_PREFIX/3.json")
+	assert.Contains(t, client.objects, "OTHER_PREFIX/1.json")
+}
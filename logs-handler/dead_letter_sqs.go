@@ -0,0 +1,73 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// The visibility timeout used when receiving dead letters to redrive. It should be long enough that
+// a message which fails to redrive isn't received again during the same redrive.
+const sqsDeadLetterVisibilityTimeout int32 = 300
+
+// sqsDeadLetterClient is the subset of the SQS client's methods used by SQSDeadLetterSink.
+type sqsDeadLetterClient interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// SQSDeadLetterSink stores each dead letter as a JSON message in an SQS queue. SQS messages are
+// limited to 256KiB, so FIRETAIL_MAX_CHUNK_BYTES should be set accordingly when using this sink.
+type SQSDeadLetterSink struct {
+	Client   sqsDeadLetterClient
+	QueueUrl string
+}
+
+func (s *SQSDeadLetterSink) Put(ctx context.Context, deadLetter *DeadLetter) error {
+	deadLetterBytes, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+	_, err = s.Client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.QueueUrl),
+		MessageBody: aws.String(string(deadLetterBytes)),
+	})
+	return err
+}
+
+func (s *SQSDeadLetterSink) ForEach(ctx context.Context, fn func(*DeadLetter) error) error {
+	for {
+		output, err := s.Client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.QueueUrl),
+			MaxNumberOfMessages: 10,
+			VisibilityTimeout:   sqsDeadLetterVisibilityTimeout,
+		})
+		if err != nil {
+			return errors.WithMessage(err, "err receiving dead letters")
+		}
+		if len(output.Messages) == 0 {
+			return nil
+		}
+		for _, message := range output.Messages {
+			var deadLetter DeadLetter
+			if err := json.Unmarshal([]byte(aws.ToString(message.Body)), &deadLetter); err != nil {
+				logger.Warn("Err unmarshalling dead letter, skipping", LogFields{"messageId": aws.ToString(message.MessageId), "error": err})
+				continue
+			}
+			if err := fn(&deadLetter); err != nil {
+				continue
+			}
+			_, err = s.Client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.QueueUrl),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				return errors.WithMessagef(err, "err deleting dead letter %s", aws.ToString(message.MessageId))
+			}
+		}
+	}
+}
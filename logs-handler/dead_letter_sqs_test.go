@@ -0,0 +1,106 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSQSClient is an in-memory stand-in for a single SQS queue. Received messages stay invisible
+// until they're deleted.
+type fakeSQSClient struct {
+	messages      []types.Message
+	nextMessageID int
+	received      map[string]bool
+}
+
+func (f *fakeSQSClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.nextMessageID++
+	messageID := fmt.Sprintf("TEST_MESSAGE_%d", f.nextMessageID)
+	f.messages = append(f.messages, types.Message{
+		MessageId:     aws.String(messageID),
+		ReceiptHandle: aws.String(messageID),
+		Body:          params.MessageBody,
+	})
+	return &sqs.SendMessageOutput{MessageId: aws.String(messageID)}, nil
+}
+
+func (f *fakeSQSClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if f.received == nil {
+		f.received = map[string]bool{}
+	}
+	output := &sqs.ReceiveMessageOutput{}
+	for _, message := range f.messages {
+		if len(output.Messages) >= int(params.MaxNumberOfMessages) {
+			break
+		}
+		if f.received[aws.ToString(message.MessageId)] {
+			continue
+		}
+		f.received[aws.ToString(message.MessageId)] = true
+		output.Messages = append(output.Messages, message)
+	}
+	return output, nil
+}
+
+func (f *fakeSQSClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	for i, message := range f.messages {
+		if aws.ToString(message.ReceiptHandle) == aws.ToString(params.ReceiptHandle) {
+			f.messages = append(f.messages[:i], f.messages[i+1:]...)
+			return &sqs.DeleteMessageOutput{}, nil
+		}
+	}
+	return nil, errors.New("ReceiptHandleIsInvalid")
+}
+
+func TestSQSDeadLetterSinkPut(t *testing.T) {
+	client := &fakeSQSClient{}
+	sink := &SQSDeadLetterSink{Client: client, QueueUrl: "TEST_QUEUE_URL"}
+
+	err := sink.Put(context.Background(), &DeadLetter{
+		FailedAt:   time.Date(2022, 11, 30, 11, 3, 56, 0, time.UTC),
+		Error:      "TEST_ERR",
+		RequestIDs: []string{"TEST_ID"},
+		Payload:    "{\"request_id\":\"TEST_ID\"}\n",
+	})
+	require.Nil(t, err)
+
+	require.Len(t, client.messages, 1)
+	assert.Equal(
+		t,
+		"{\"failedAt\":\"2022-11-30T11:03:56Z\",\"error\":\"TEST_ERR\",\"apiUrl\":\"\",\"requestIds\":[\"TEST_ID\"],\"payload\":\"{\\\"request_id\\\":\\\"TEST_ID\\\"}\\n\"}",
+		aws.ToString(client.messages[0].Body),
+	)
+}
+
+func TestSQSDeadLetterSinkForEach(t *testing.T) {
+	client := &fakeSQSClient{}
+	sink := &SQSDeadLetterSink{Client: client, QueueUrl: "TEST_QUEUE_URL"}
+	for i := 0; i < 15; i++ {
+		require.Nil(t, sink.Put(context.Background(), &DeadLetter{Error: fmt.Sprintf("TEST_ERR_%d", i)}))
+	}
+	client.SendMessage(context.Background(), &sqs.SendMessageInput{MessageBody: aws.String("not json")})
+
+	seenErrors := []string{}
+	err := sink.ForEach(context.Background(), func(deadLetter *DeadLetter) error {
+		seenErrors = append(seenErrors, deadLetter.Error)
+		if deadLetter.Error == "TEST_ERR_12" {
+			return errors.New("TEST_REDRIVE_ERR")
+		}
+		return nil
+	})
+	require.Nil(t, err)
+
+	assert.Len(t, seenErrors, 15)
+	require.Len(t, client.messages, 2)
+	assert.Equal(t, "{\"failedAt\":\"0001-01-01T00:00:00Z\",\"error\":\"TEST_ERR_12\",\"apiUrl\":\"\",\"requestIds\":null,\"payload\":\"\"}", aws.ToString(client.messages[0].Body))
+	assert.Equal(t, "not json", aws.ToString(client.messages[1].Body))
+}
@@ -0,0 +1,73 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryDeadLetterSink is an in-memory DeadLetterSink for use in tests.
+type memoryDeadLetterSink struct {
+	deadLetters []*DeadLetter
+	putErr      error
+}
+
+func (m *memoryDeadLetterSink) Put(ctx context.Context, deadLetter *DeadLetter) error {
+	if m.putErr != nil {
+		return m.putErr
+	}
+	m.deadLetters = append(m.deadLetters, deadLetter)
+	return nil
+}
+
+func (m *memoryDeadLetterSink) ForEach(ctx context.Context, fn func(*DeadLetter) error) error {
+	// fn may put new dead letters in the sink, which are kept along with those fn fails
+	deadLetters := m.deadLetters
+	m.deadLetters = []*DeadLetter{}
+	for _, deadLetter := range deadLetters {
+		if err := fn(deadLetter); err != nil {
+			m.deadLetters = append(m.deadLetters, deadLetter)
+		}
+	}
+	return nil
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	deadLetter := newDeadLetter(&ChunkResult{
+		Chunk: &logChunk{
+			RequestIDs: []string{"TEST_ID"},
+			Payload:    []byte("{\"request_id\":\"TEST_ID\"}\n"),
+		},
+		Err:    errors.New("TEST_ERR"),
+		ApiUrl: "TEST_URL",
+		Route:  "TEST_ROUTE",
+	})
+	assert.Equal(t, "TEST_ERR", deadLetter.Error)
+	assert.Equal(t, "TEST_URL", deadLetter.ApiUrl)
+	assert.Equal(t, "TEST_ROUTE", deadLetter.Route)
+	assert.Equal(t, []string{"TEST_ID"}, deadLetter.RequestIDs)
+	assert.Equal(t, "{\"request_id\":\"TEST_ID\"}\n", deadLetter.Payload)
+	assert.False(t, deadLetter.FailedAt.IsZero())
+}
+
+func TestDeadLetterFiretailLogs(t *testing.T) {
+	chunks, err := chunkFiretailLogs(makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2"), 0, 0)
+	require.Nil(t, err)
+	require.Len(t, chunks, 1)
+
+	deadLetter := &DeadLetter{Payload: string(chunks[0].Payload)}
+	firetailLogs, err := deadLetter.FiretailLogs()
+	require.Nil(t, err)
+	assert.Equal(t, makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2"), firetailLogs)
+}
+
+func TestDeadLetterFiretailLogsMalformed(t *testing.T) {
+	deadLetter := &DeadLetter{Payload: "{\"request_id\":\"TEST_ID\"}\nnot json\n"}
+	firetailLogs, err := deadLetter.FiretailLogs()
+	require.NotNil(t, err)
+	assert.Equal(t, "err unmarshalling firetail log from dead letter: invalid character 'o' in literal null (expecting 'u')", err.Error())
+	assert.Nil(t, firetailLogs)
+}
@@ -0,0 +1,55 @@
+package logshandler
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const DefaultDeadlineSafetyMargin = 3 * time.Second
+
+// deadlineSafetyMargin is how long before the Lambda's deadline Handler stops extracting and sending
+// logs, so that it has time to store what it couldn't send in the dead letter sink and return.
+var deadlineSafetyMargin = DefaultDeadlineSafetyMargin
+
+// withDeadlineSafetyMargin returns a context which is done deadlineSafetyMargin before ctx's
+// deadline. The margin never takes up more than half of the time remaining, so that a Lambda with a
+// short timeout still gets some work done. If ctx has no deadline, the returned context is only done
+// when ctx is.
+func withDeadlineSafetyMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		return context.WithCancel(ctx)
+	}
+	margin := deadlineSafetyMargin
+	if remaining := time.Until(deadline); margin > remaining/2 {
+		margin = remaining / 2
+	}
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// PartialFailureError is returned by Handler when the Lambda's deadline approached before all of the
+// log events in a batch could be processed and sent to Firetail. Err describes any chunks which
+// could neither be sent nor stored as dead letters.
+type PartialFailureError struct {
+	ProcessedEvents int
+	TotalEvents     int
+	SentChunks      int
+	TotalChunks     int
+	Err             error
+}
+
+func (e *PartialFailureError) Error() string {
+	message := fmt.Sprintf(
+		"lambda deadline approaching: processed %d of %d log events and sent %d of %d chunks to firetail",
+		e.ProcessedEvents, e.TotalEvents, e.SentChunks, e.TotalChunks,
+	)
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+func (e *PartialFailureError) Unwrap() error {
+	return e.Err
+}
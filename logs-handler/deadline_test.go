@@ -0,0 +1,55 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithDeadlineSafetyMarginNoDeadline(t *testing.T) {
+	workCtx, cancel := withDeadlineSafetyMargin(context.Background())
+	defer cancel()
+	_, hasDeadline := workCtx.Deadline()
+	assert.False(t, hasDeadline)
+}
+
+func TestWithDeadlineSafetyMargin(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	workCtx, cancelWork := withDeadlineSafetyMargin(ctx)
+	defer cancelWork()
+
+	workDeadline, hasDeadline := workCtx.Deadline()
+	require.True(t, hasDeadline)
+	assert.Equal(t, deadline.Add(-DefaultDeadlineSafetyMargin), workDeadline)
+}
+
+func TestWithDeadlineSafetyMarginShortDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	workCtx, cancelWork := withDeadlineSafetyMargin(ctx)
+	defer cancelWork()
+
+	// The margin is capped at half of the remaining time
+	workDeadline, hasDeadline := workCtx.Deadline()
+	require.True(t, hasDeadline)
+	assert.WithinDuration(t, deadline.Add(-500*time.Millisecond), workDeadline, 10*time.Millisecond)
+}
+
+func TestPartialFailureError(t *testing.T) {
+	err := &PartialFailureError{ProcessedEvents: 5, TotalEvents: 10, SentChunks: 1, TotalChunks: 2}
+	assert.Equal(t, "lambda deadline approaching: processed 5 of 10 log events and sent 1 of 2 chunks to firetail", err.Error())
+
+	testErr := errors.New("TEST_ERR")
+	err.Err = testErr
+	assert.Equal(t, "lambda deadline approaching: processed 5 of 10 log events and sent 1 of 2 chunks to firetail: TEST_ERR", err.Error())
+	assert.ErrorIs(t, err, testErr)
+}
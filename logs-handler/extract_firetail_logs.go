@@ -1,6 +1,7 @@
-package main
+package logshandler
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 
@@ -9,11 +10,54 @@ import (
 	"github.com/pkg/errors"
 )
 
-func ExtractFiretailLogs(logsData *events.CloudwatchLogsData) (map[string]*FiretailLog, error) {
+func ExtractFiretailLogs(ctx context.Context, logsData *events.CloudwatchLogsData) (map[string]*FiretailLog, error) {
+	firetailLogs, errs := extractAllFiretailLogs(ctx, logsData, nil)
+
+	// If nothing in a log was populated then we don't return it. This has to happen after all of the
+	// events have been added, as events such as Begin Request don't populate a log on their own.
+	removeUnpopulatedFiretailLogs(firetailLogs)
+
+	return firetailLogs, errs
+}
+
+func removeUnpopulatedFiretailLogs(firetailLogs map[string]*FiretailLog) {
+	for requestID, firetailLog := range firetailLogs {
+		if !firetailLog.IsPopulated() {
+			delete(firetailLogs, requestID)
+		}
+	}
+}
+
+// extractionStats describes what extractAllFiretailLogs did with the events it was given.
+// DroppedEvents counts the events of each type which were dropped because they aren't forwarded to
+// Firetail.
+type extractionStats struct {
+	ProcessedEvents int
+	DroppedEvents   map[LogMessageType]int
+}
+
+// extractAllFiretailLogs groups the events in logsData into a FiretailLog per request ID, including
+// those which aren't populated. If ctx is done before every event has been processed, the Firetail
+// logs extracted so far are returned along with an err. If stats is not nil, it is filled in.
+func extractAllFiretailLogs(ctx context.Context, logsData *events.CloudwatchLogsData, stats *extractionStats) (map[string]*FiretailLog, error) {
 	firetailLogs := map[string]*FiretailLog{}
 	var errs error
+	if stats == nil {
+		stats = &extractionStats{}
+	}
+	if stats.DroppedEvents == nil {
+		stats.DroppedEvents = map[LogMessageType]int{}
+	}
+
+	for i, logEvent := range logsData.LogEvents {
+		if err := ctx.Err(); err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(
+				err, "stopped extracting firetail logs after %d of %d log events", i, len(logsData.LogEvents),
+			))
+			break
+		}
+		stats.ProcessedEvents++
 
-	for _, logEvent := range logsData.LogEvents {
 		// All of the logs that we care about in JSON format have a `logType` and `requestId` field.
 		// We don't care about any of their other values.
 		type JsonLog struct {
@@ -55,12 +99,14 @@ func ExtractFiretailLogs(logsData *events.CloudwatchLogsData) (map[string]*Firet
 			continue
 		}
 
-		// If nothing in the log was populated then we don't add it to the map
-		if !firetailLog.IsPopulated() {
-			continue
-		}
-
 		firetailLogs[requestID] = firetailLog
+
+		if logType == Plaintext {
+			logType, _, _ = parsePlaintextLogMessage(logEvent.Message)
+		}
+		if !isForwardedLogType(logType) {
+			stats.DroppedEvents[logType]++
+		}
 	}
 
 	return firetailLogs, errs
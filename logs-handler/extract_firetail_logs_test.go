@@ -1,6 +1,7 @@
-package main
+package logshandler
 
 import (
+	"context"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -17,7 +18,7 @@ func TestExtractFiretailLogsSingleQueryEvent(t *testing.T) {
 		}},
 	}
 
-	logs, err := ExtractFiretailLogs(testData)
+	logs, err := ExtractFiretailLogs(context.Background(), testData)
 	require.Nil(t, err)
 
 	require.Contains(t, logs, "TEST_ID")
@@ -34,7 +35,7 @@ func TestExtractFiretailLogsSingleRequestMappingEvent(t *testing.T) {
 		}},
 	}
 
-	logs, err := ExtractFiretailLogs(testData)
+	logs, err := ExtractFiretailLogs(context.Background(), testData)
 	require.Nil(t, err)
 
 	require.Contains(t, logs, "TEST_ID")
@@ -52,8 +53,96 @@ func TestExtractFiretailLogsSingleMalformedEvent(t *testing.T) {
 		}},
 	}
 
-	logs, err := ExtractFiretailLogs(testData)
+	logs, err := ExtractFiretailLogs(context.Background(), testData)
 	assert.Len(t, logs, 0)
 	require.NotNil(t, err)
 	assert.Equal(t, "1 error occurred:\n\t* err adding event message to firetail log: plaintext logEventMessage matched no plaintext log prefixes: TEST_ID Invalid Prefix\n\n", err.Error())
 }
+
+func TestExtractFiretailLogsRequestTiming(t *testing.T) {
+	testData := &events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{
+				ID:        "TEST_ID",
+				Timestamp: 1000,
+				Message:   "TEST_ID Begin Request",
+			},
+			{
+				ID:        "TEST_ID",
+				Timestamp: 1001,
+				Message:   "TEST_ID GraphQL Query: TEST_QUERY",
+			},
+			{
+				ID:        "TEST_ID",
+				Timestamp: 1088,
+				Message:   "TEST_ID Tokens Consumed: 2",
+			},
+			{
+				ID:        "TEST_ID",
+				Timestamp: 1089,
+				Message:   "TEST_ID End Request",
+			},
+		},
+	}
+
+	logs, err := ExtractFiretailLogs(context.Background(), testData)
+	require.Nil(t, err)
+
+	require.Contains(t, logs, "TEST_ID")
+	assert.Equal(t, int64(1000), logs["TEST_ID"].BeginRequestTimestamp)
+	assert.Equal(t, int64(1089), logs["TEST_ID"].EndRequestTimestamp)
+	assert.Equal(t, 2, logs["TEST_ID"].TokensConsumed)
+}
+
+func TestExtractFiretailLogsTimingOnly(t *testing.T) {
+	testData := &events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{
+				ID:        "TEST_ID",
+				Timestamp: 1000,
+				Message:   "TEST_ID Begin Request",
+			},
+			{
+				ID:        "TEST_ID",
+				Timestamp: 1089,
+				Message:   "TEST_ID End Request",
+			},
+		},
+	}
+
+	logs, err := ExtractFiretailLogs(context.Background(), testData)
+	require.Nil(t, err)
+	assert.Len(t, logs, 0)
+}
+
+func TestExtractFiretailLogsContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	stats := &extractionStats{}
+	logs, err := extractAllFiretailLogs(ctx, &events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{{
+			Message: "TEST_ID GraphQL Query: TEST_QUERY",
+		}},
+	}, stats)
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* stopped extracting firetail logs after 0 of 1 log events: context canceled\n\n", err.Error())
+	assert.Len(t, logs, 0)
+	assert.Equal(t, 0, stats.ProcessedEvents)
+}
+
+func TestExtractFiretailLogsStats(t *testing.T) {
+	stats := &extractionStats{}
+	_, err := extractAllFiretailLogs(context.Background(), &events.CloudwatchLogsData{
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{Message: "TEST_ID GraphQL Query: TEST_QUERY"},
+			{Message: "TEST_ID Begin Tracing"},
+			{Message: `{"logType":"Unheard","requestId":"TEST_ID"}`},
+		},
+	}, stats)
+	require.Nil(t, err)
+	assert.Equal(t, &extractionStats{
+		ProcessedEvents: 3,
+		DroppedEvents:   map[LogMessageType]int{BeginTracing: 1, "Unheard": 1},
+	}, stats)
+}
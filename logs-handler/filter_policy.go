@@ -0,0 +1,273 @@
+package logshandler
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type FilterAction string
+
+const (
+	KeepAction   FilterAction = "keep"
+	DropAction   FilterAction = "drop"
+	SampleAction FilterAction = "sample"
+)
+
+// FilterRule matches FiretailLogs by the conditions which are set, all of which must match, and then
+// keeps, drops or samples them according to Action:
+//   - OperationNames and OperationTypes, such as "subscription", match the operation of the request.
+//   - StatusCodes match the status code in the request's RequestSummary.
+//   - MinLatencyMs and MaxLatencyMs match the latency in the request's RequestSummary, inclusively.
+//   - Headers maps request header names, which are case insensitive, to regular expressions which
+//     one of the header's values must match.
+//   - Introspection matches requests which do or don't only query the schema, such as "__schema".
+//
+// SampleRate is the fraction of matching logs kept by the sample action.
+type FilterRule struct {
+	Name           string            `json:"name"`
+	OperationNames []string          `json:"operationNames"`
+	OperationTypes []string          `json:"operationTypes"`
+	StatusCodes    []int             `json:"statusCodes"`
+	MinLatencyMs   *int64            `json:"minLatencyMs"`
+	MaxLatencyMs   *int64            `json:"maxLatencyMs"`
+	Headers        map[string]string `json:"headers"`
+	Introspection  *bool             `json:"introspection"`
+	Action         FilterAction      `json:"action"`
+	SampleRate     float64           `json:"sampleRate"`
+
+	headers map[string]*regexp.Regexp
+}
+
+// FilterPolicy decides which FiretailLogs are forwarded. Each log takes the action of the first rule
+// which matches it, or is kept if none match. Unless AlwaysKeepErrors is false, logs of requests which
+// failed are always kept regardless of the rules.
+type FilterPolicy struct {
+	Rules            []*FilterRule `json:"rules"`
+	AlwaysKeepErrors *bool         `json:"alwaysKeepErrors"`
+}
+
+// filterPolicy is applied to every FiretailLog if it is not nil.
+var filterPolicy *FilterPolicy
+
+// parseFilterPolicy parses and validates a FilterPolicy from its JSON representation.
+func parseFilterPolicy(value string) (*FilterPolicy, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	policy := &FilterPolicy{}
+	if err := decoder.Decode(policy); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling filter policy")
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// compile validates the rules of the policy and prepares them to be evaluated.
+func (p *FilterPolicy) compile() error {
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		switch rule.Action {
+		case KeepAction, DropAction:
+		case SampleAction:
+			if rule.SampleRate < 0 || rule.SampleRate > 1 {
+				return fmt.Errorf("filter rule %s has sample rate outside of 0 to 1: %v", rule.Name, rule.SampleRate)
+			}
+		default:
+			return fmt.Errorf("filter rule %s has unsupported action: %s", rule.Name, rule.Action)
+		}
+		rule.headers = map[string]*regexp.Regexp{}
+		for header, pattern := range rule.Headers {
+			compiledPattern, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.WithMessagef(err, "filter rule %s has invalid header pattern %q", rule.Name, pattern)
+			}
+			rule.headers[strings.ToLower(header)] = compiledPattern
+		}
+	}
+	return nil
+}
+
+// Evaluate returns true if the log should be forwarded, along with the name of the rule which decided
+// so, or an empty string if no rule matched.
+func (p *FilterPolicy) Evaluate(firetailLog *FiretailLog) (bool, string) {
+	if (p.AlwaysKeepErrors == nil || *p.AlwaysKeepErrors) && firetailLog.hasErrors() {
+		return true, ""
+	}
+	for _, rule := range p.Rules {
+		if !rule.matches(firetailLog) {
+			continue
+		}
+		switch rule.Action {
+		case DropAction:
+			return false, rule.Name
+		case SampleAction:
+			return isSampled(firetailLog.RequestID, rule.SampleRate), rule.Name
+		default:
+			return true, rule.Name
+		}
+	}
+	return true, ""
+}
+
+// FilterFiretailLogs deletes every log from firetailLogs which the policy drops, and returns how many
+// logs each rule dropped.
+func FilterFiretailLogs(policy *FilterPolicy, firetailLogs map[string]*FiretailLog) map[string]int {
+	droppedLogs := map[string]int{}
+	for requestID, firetailLog := range firetailLogs {
+		if keep, ruleName := policy.Evaluate(firetailLog); !keep {
+			droppedLogs[ruleName]++
+			delete(firetailLogs, requestID)
+		}
+	}
+	return droppedLogs
+}
+
+func (r *FilterRule) matches(firetailLog *FiretailLog) bool {
+	if len(r.OperationNames) > 0 {
+		if firetailLog.OperationName == nil || !containsString(r.OperationNames, *firetailLog.OperationName) {
+			return false
+		}
+	}
+	if len(r.OperationTypes) > 0 {
+		if firetailLog.GraphQL == nil || !containsString(r.OperationTypes, firetailLog.GraphQL.OperationType) {
+			return false
+		}
+	}
+
+	if len(r.StatusCodes) > 0 || r.MinLatencyMs != nil || r.MaxLatencyMs != nil {
+		summary, hasSummary := firetailLog.requestSummary()
+		if !hasSummary {
+			return false
+		}
+		if len(r.StatusCodes) > 0 && !containsInt(r.StatusCodes, summary.StatusCode) {
+			return false
+		}
+		// AppSync logs latency in nanoseconds
+		latencyMs := summary.Latency / 1000000
+		if r.MinLatencyMs != nil && latencyMs < *r.MinLatencyMs {
+			return false
+		}
+		if r.MaxLatencyMs != nil && latencyMs > *r.MaxLatencyMs {
+			return false
+		}
+	}
+
+	if len(r.headers) > 0 {
+		requestHeaders := map[string][]string{}
+		if firetailLog.RequestHeaders == nil || json.Unmarshal(*firetailLog.RequestHeaders, &requestHeaders) != nil {
+			return false
+		}
+		lowerRequestHeaders := map[string][]string{}
+		for header, values := range requestHeaders {
+			lowerRequestHeaders[strings.ToLower(header)] = append(lowerRequestHeaders[strings.ToLower(header)], values...)
+		}
+		for header, pattern := range r.headers {
+			headerMatches := false
+			for _, value := range lowerRequestHeaders[header] {
+				if pattern.MatchString(value) {
+					headerMatches = true
+					break
+				}
+			}
+			if !headerMatches {
+				return false
+			}
+		}
+	}
+
+	if r.Introspection != nil && firetailLog.isIntrospection() != *r.Introspection {
+		return false
+	}
+	return true
+}
+
+// filterRequestSummary holds the fields of an AppSync RequestSummary log which rules can match.
+type filterRequestSummary struct {
+	StatusCode int   `json:"statusCode"`
+	Latency    int64 `json:"latency"`
+}
+
+func (f *FiretailLog) requestSummary() (*filterRequestSummary, bool) {
+	if f.RequestSummary == nil {
+		return nil, false
+	}
+	summary := &filterRequestSummary{}
+	if err := json.Unmarshal(*f.RequestSummary, summary); err != nil {
+		return nil, false
+	}
+	return summary, true
+}
+
+// hasErrors returns true if the request failed, or if any of its resolvers returned errors.
+func (f *FiretailLog) hasErrors() bool {
+	if summary, hasSummary := f.requestSummary(); hasSummary && summary.StatusCode >= 400 {
+		return true
+	}
+	for _, mappings := range []*[]json.RawMessage{f.RequestMappings, f.ResponseMappings} {
+		if mappings == nil {
+			continue
+		}
+		for _, mapping := range *mappings {
+			var message struct {
+				Errors []json.RawMessage `json:"errors"`
+			}
+			if err := json.Unmarshal(mapping, &message); err == nil && len(message.Errors) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isIntrospection returns true if every root field the request selects is an introspection field,
+// such as "__schema" or "__type".
+func (f *FiretailLog) isIntrospection() bool {
+	if f.GraphQL == nil || len(f.GraphQL.RootFields) == 0 {
+		return false
+	}
+	for _, rootField := range f.GraphQL.RootFields {
+		if !strings.HasPrefix(rootField, "__") {
+			return false
+		}
+	}
+	return true
+}
+
+// isSampled deterministically decides whether to keep a request's log, so that every part of the
+// same request is consistently kept or dropped, with a probability of sampleRate.
+func isSampled(requestID string, sampleRate float64) bool {
+	if sampleRate >= 1 {
+		return true
+	}
+	// SHA-256 is evenly distributed even for request IDs which only differ in their last few characters
+	hash := sha256.Sum256([]byte(requestID))
+	return float64(binary.BigEndian.Uint64(hash[:8]))/float64(math.MaxUint64) < sampleRate
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
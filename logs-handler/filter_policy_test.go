@@ -0,0 +1,175 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestFilterLog creates a FiretailLog with the given operation, status code and latency in
+// milliseconds.
+func makeTestFilterLog(requestID, operationName, operationType string, statusCode int, latencyMs int64) *FiretailLog {
+	requestSummary := json.RawMessage(fmt.Sprintf(`{"logType":"RequestSummary","statusCode":%d,"latency":%d}`, statusCode, latencyMs*1000000))
+	return &FiretailLog{
+		RequestID:      requestID,
+		OperationName:  &operationName,
+		GraphQL:        &GraphQLMetadata{OperationType: operationType, RootFields: []string{"getPost"}},
+		RequestSummary: &requestSummary,
+	}
+}
+
+func TestParseFilterPolicyInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		policy        string
+		expectedError string
+	}{
+		{`{"rules":[{"action":"drop","operationName":"HealthCheck"}]}`, "err unmarshalling filter policy: json: unknown field \"operationName\""},
+		{`{"rules":[{"action":"ignore"}]}`, "filter rule rule1 has unsupported action: ignore"},
+		{`{"rules":[{"name":"subscriptions","action":"sample","sampleRate":1.5}]}`, "filter rule subscriptions has sample rate outside of 0 to 1: 1.5"},
+		{`{"rules":[{"action":"drop","headers":{"user-agent":"("}}]}`, "filter rule rule1 has invalid header pattern \"(\": error parsing regexp: missing closing ): `(`"},
+	} {
+		policy, err := parseFilterPolicy(testCase.policy)
+		require.NotNil(t, err, testCase.policy)
+		assert.Equal(t, testCase.expectedError, err.Error())
+		assert.Nil(t, policy)
+	}
+}
+
+func TestFilterPolicyOperationName(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"name":"healthChecks","operationNames":["HealthCheck"],"action":"drop"}]}`)
+	require.Nil(t, err)
+
+	keep, ruleName := policy.Evaluate(makeTestFilterLog("TEST_ID", "HealthCheck", "query", 200, 10))
+	assert.False(t, keep)
+	assert.Equal(t, "healthChecks", ruleName)
+
+	keep, ruleName = policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 10))
+	assert.True(t, keep)
+	assert.Equal(t, "", ruleName)
+}
+
+func TestFilterPolicyOperationTypeAndLatency(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[
+		{"operationTypes":["query"],"minLatencyMs":1000,"action":"keep"},
+		{"operationTypes":["query"],"action":"drop"}
+	]}`)
+	require.Nil(t, err)
+
+	keep, ruleName := policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 1500))
+	assert.True(t, keep)
+	assert.Equal(t, "rule1", ruleName)
+
+	keep, ruleName = policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 999))
+	assert.False(t, keep)
+	assert.Equal(t, "rule2", ruleName)
+
+	keep, _ = policy.Evaluate(makeTestFilterLog("TEST_ID", "CreatePost", "mutation", 200, 10))
+	assert.True(t, keep)
+}
+
+func TestFilterPolicyStatusCode(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"statusCodes":[200],"maxLatencyMs":100,"action":"drop"}]}`)
+	require.Nil(t, err)
+
+	keep, _ := policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 100))
+	assert.False(t, keep)
+	keep, _ = policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 101))
+	assert.True(t, keep)
+	keep, _ = policy.Evaluate(&FiretailLog{RequestID: "TEST_ID"})
+	assert.True(t, keep)
+}
+
+func TestFilterPolicyHeaders(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"headers":{"User-Agent":"^ELB-HealthChecker/"},"action":"drop"}]}`)
+	require.Nil(t, err)
+
+	firetailLog := makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 10)
+	requestHeaders := json.RawMessage(`{"user-agent":["ELB-HealthChecker/2.0"]}`)
+	firetailLog.RequestHeaders = &requestHeaders
+	keep, _ := policy.Evaluate(firetailLog)
+	assert.False(t, keep)
+
+	requestHeaders = json.RawMessage(`{"user-agent":["Mozilla/5.0"]}`)
+	keep, _ = policy.Evaluate(firetailLog)
+	assert.True(t, keep)
+}
+
+func TestFilterPolicyIntrospection(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"introspection":true,"action":"drop"}]}`)
+	require.Nil(t, err)
+
+	firetailLog := makeTestFilterLog("TEST_ID", "IntrospectionQuery", "query", 200, 10)
+	firetailLog.GraphQL.RootFields = []string{"__schema"}
+	keep, _ := policy.Evaluate(firetailLog)
+	assert.False(t, keep)
+
+	firetailLog.GraphQL.RootFields = []string{"__schema", "getPost"}
+	keep, _ = policy.Evaluate(firetailLog)
+	assert.True(t, keep)
+}
+
+func TestFilterPolicyAlwaysKeepsErrors(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"action":"drop"}]}`)
+	require.Nil(t, err)
+
+	keep, _ := policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 500, 10))
+	assert.True(t, keep)
+
+	firetailLog := makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 10)
+	responseMapping := json.RawMessage(`{"logType":"ResponseMapping","errors":[{"message":"Not Authorized"}]}`)
+	firetailLog.ResponseMappings = &[]json.RawMessage{responseMapping}
+	keep, _ = policy.Evaluate(firetailLog)
+	assert.True(t, keep)
+
+	keep, _ = policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 200, 10))
+	assert.False(t, keep)
+}
+
+func TestFilterPolicyAlwaysKeepErrorsDisabled(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"action":"drop"}],"alwaysKeepErrors":false}`)
+	require.Nil(t, err)
+
+	keep, _ := policy.Evaluate(makeTestFilterLog("TEST_ID", "GetPost", "query", 500, 10))
+	assert.False(t, keep)
+}
+
+func TestFilterPolicySampling(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"operationTypes":["subscription"],"action":"sample","sampleRate":0.25}]}`)
+	require.Nil(t, err)
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		firetailLog := makeTestFilterLog(fmt.Sprintf("TEST_ID_%d", i), "OnPost", "subscription", 200, 10)
+		keep, _ := policy.Evaluate(firetailLog)
+		// The same request must always get the same decision
+		keepAgain, _ := policy.Evaluate(firetailLog)
+		assert.Equal(t, keep, keepAgain)
+		if keep {
+			kept++
+		}
+	}
+	assert.InDelta(t, 250, kept, 50)
+}
+
+func TestIsSampledBounds(t *testing.T) {
+	assert.False(t, isSampled("TEST_ID", 0))
+	assert.True(t, isSampled("TEST_ID", 1))
+}
+
+func TestFilterFiretailLogs(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"name":"healthChecks","operationNames":["HealthCheck"],"action":"drop"}]}`)
+	require.Nil(t, err)
+
+	firetailLogs := map[string]*FiretailLog{
+		"TEST_ID_1": makeTestFilterLog("TEST_ID_1", "HealthCheck", "query", 200, 10),
+		"TEST_ID_2": makeTestFilterLog("TEST_ID_2", "HealthCheck", "query", 200, 10),
+		"TEST_ID_3": makeTestFilterLog("TEST_ID_3", "GetPost", "query", 200, 10),
+	}
+	droppedLogs := FilterFiretailLogs(policy, firetailLogs)
+	assert.Equal(t, map[string]int{"healthChecks": 2}, droppedLogs)
+	assert.Len(t, firetailLogs, 1)
+	assert.Contains(t, firetailLogs, "TEST_ID_3")
+}
@@ -0,0 +1,102 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxFirehoseResponseBytes is the most a Lambda may return, which for a Firehose transformation
+// includes the base64 encoding of every record's data.
+const maxFirehoseResponseBytes = 6 * 1024 * 1024
+
+// firehoseRecordOverheadBytes is a generous estimate of how much the JSON encoding of a response record
+// adds to its ID and data, and of how much the response itself adds to its records.
+const firehoseRecordOverheadBytes = 128
+
+// FirehoseHandler is a Kinesis Data Firehose data transformation which turns records written by a
+// Cloudwatch log subscription into Firetail logs as NDJSON, so that Firehose can deliver them to
+// Firetail and retry on the Lambda's behalf. Each record is transformed independently:
+//   - Records which produce Firetail logs are Ok, with the logs as their data.
+//   - Records which produce no Firetail logs, such as control messages, are Dropped.
+//   - Records which can't be decoded, which couldn't be fully processed before the Lambda's
+//     deadline, or whose Firetail logs would take the response over Lambda's response size limit,
+//     are ProcessingFailed.
+//
+// Records are transformed without the requestStateStore, as Firehose needs a result for every record
+// in the invocation it was delivered in, so logs of the same request in different records aren't
+// correlated.
+func FirehoseHandler(ctx context.Context, event events.KinesisFirehoseEvent) (events.KinesisFirehoseResponse, error) {
+	handlerLogger := invocationLogger(ctx)
+	response := events.KinesisFirehoseResponse{Records: make([]events.KinesisFirehoseResponseRecord, 0, len(event.Records))}
+	responseBytes := firehoseRecordOverheadBytes
+	for _, record := range event.Records {
+		recordLogger := handlerLogger.With(LogFields{"recordId": record.RecordID})
+		result := transformFirehoseRecord(ctx, recordLogger, record)
+		recordBytes := len(result.RecordID) + base64.StdEncoding.EncodedLen(len(result.Data)) + firehoseRecordOverheadBytes
+		if result.Data != nil && responseBytes+recordBytes > maxFirehoseResponseBytes {
+			recordLogger.Error("Firetail logs would exceed the Lambda response size limit", LogFields{
+				"bytes": len(result.Data), "responseBytes": responseBytes,
+			})
+			result.Result = events.KinesisFirehoseTransformedStateProcessingFailed
+			result.Data = nil
+			recordBytes = len(result.RecordID) + firehoseRecordOverheadBytes
+		}
+		responseBytes += recordBytes
+		response.Records = append(response.Records, result)
+	}
+	return response, nil
+}
+
+func transformFirehoseRecord(ctx context.Context, recordLogger *Logger, record events.KinesisFirehoseEventRecord) events.KinesisFirehoseResponseRecord {
+	result := events.KinesisFirehoseResponseRecord{RecordID: record.RecordID}
+
+	logsData, err := decodeSubscriptionRecord(record.Data)
+	if err != nil {
+		recordLogger.Error("Err decoding Firehose record", LogFields{"error": err})
+		result.Result = events.KinesisFirehoseTransformedStateProcessingFailed
+		return result
+	}
+	if logsData.MessageType == cloudwatchControlMessageType {
+		result.Result = events.KinesisFirehoseTransformedStateDropped
+		return result
+	}
+
+	var metrics *Metrics
+	if metricsNamespace != "" {
+		metrics = newHandlerMetrics(logsData)
+		defer func() {
+			if err := metrics.Write(nil, time.Now()); err != nil {
+				recordLogger.Warn("Err writing metrics", LogFields{"error": err})
+			}
+		}()
+	}
+
+	workCtx, cancel := withDeadlineSafetyMargin(ctx)
+	defer cancel()
+
+	stats := &extractionStats{}
+	firetailLogs := buildFiretailLogs(workCtx, recordLogger, metrics, nil, logsData, stats)
+	if err := partialFailureErr(workCtx, logsData, stats, nil, nil); err != nil {
+		recordLogger.Error("Err transforming Firehose record", LogFields{"error": err})
+		result.Result = events.KinesisFirehoseTransformedStateProcessingFailed
+		return result
+	}
+	if len(firetailLogs) == 0 {
+		result.Result = events.KinesisFirehoseTransformedStateDropped
+		return result
+	}
+
+	// Without any limits, chunkFiretailLogs returns all of the logs in one NDJSON chunk
+	chunks, err := chunkFiretailLogs(firetailLogs, 0, 0)
+	if err != nil {
+		recordLogger.Error("Err encoding Firetail logs", LogFields{"error": err})
+		result.Result = events.KinesisFirehoseTransformedStateProcessingFailed
+		return result
+	}
+	result.Result = events.KinesisFirehoseTransformedStateOk
+	result.Data = chunks[0].Payload
+	return result
+}
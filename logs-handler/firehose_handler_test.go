@@ -0,0 +1,138 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirehoseHandler(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := FirehoseHandler(ctx, events.KinesisFirehoseEvent{Records: []events.KinesisFirehoseEventRecord{
+		{RecordID: "1", Data: gzipTestData(t, `{
+			"messageType": "DATA_MESSAGE",
+			"logGroup": "/aws/appsync/apis/TEST_API_ID",
+			"logEvents": [
+				{"id": "1", "message": "TEST_ID_1 GraphQL Query: TEST_QUERY"},
+				{"id": "2", "message": "TEST_ID_2 GraphQL Query: TEST_QUERY"}
+			]
+		}`)},
+		{RecordID: "2", Data: gzipTestData(t, `{
+			"messageType": "CONTROL_MESSAGE",
+			"logEvents": [{"id": "1", "message": "CWL CONTROL MESSAGE: Checking health of destination Firehose."}]
+		}`)},
+		{RecordID: "3", Data: []byte(`{
+			"messageType": "DATA_MESSAGE",
+			"logGroup": "/aws/appsync/apis/TEST_API_ID",
+			"logEvents": [{"id": "1", "message": "TEST_ID_3 GraphQL Query: TEST_QUERY"}]
+		}`)},
+		{RecordID: "4", Data: []byte("not json")},
+	}})
+	require.Nil(t, err)
+	require.Len(t, response.Records, 4)
+
+	assert.Equal(t, "1", response.Records[0].RecordID)
+	assert.Equal(t, events.KinesisFirehoseTransformedStateOk, response.Records[0].Result)
+	assert.Equal(t,
+		`{"metadata":{"region":"eu-west-1","apiId":"TEST_API_ID","logGroup":"/aws/appsync/apis/TEST_API_ID","forwarderVersion":"dev"},"query":"TEST_QUERY","request_id":"TEST_ID_1"}`+"\n"+
+			`{"metadata":{"region":"eu-west-1","apiId":"TEST_API_ID","logGroup":"/aws/appsync/apis/TEST_API_ID","forwarderVersion":"dev"},"query":"TEST_QUERY","request_id":"TEST_ID_2"}`+"\n",
+		string(response.Records[0].Data),
+	)
+
+	assert.Equal(t, "2", response.Records[1].RecordID)
+	assert.Equal(t, events.KinesisFirehoseTransformedStateDropped, response.Records[1].Result)
+	assert.Nil(t, response.Records[1].Data)
+
+	assert.Equal(t, "3", response.Records[2].RecordID)
+	assert.Equal(t, events.KinesisFirehoseTransformedStateOk, response.Records[2].Result)
+	assert.Contains(t, string(response.Records[2].Data), `"request_id":"TEST_ID_3"`)
+
+	assert.Equal(t, "4", response.Records[3].RecordID)
+	assert.Equal(t, events.KinesisFirehoseTransformedStateProcessingFailed, response.Records[3].Result)
+	assert.Nil(t, response.Records[3].Data)
+}
+
+func TestFirehoseHandlerDropsFilteredRecords(t *testing.T) {
+	policy, err := parseFilterPolicy(`{"rules":[{"action":"drop"}]}`)
+	require.Nil(t, err)
+	filterPolicy = policy
+	defer func() { filterPolicy = nil }()
+
+	response, err := FirehoseHandler(context.Background(), events.KinesisFirehoseEvent{Records: []events.KinesisFirehoseEventRecord{
+		{RecordID: "1", Data: gzipTestData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]}`)},
+	}})
+	require.Nil(t, err)
+	assert.Equal(t, events.KinesisFirehoseResponse{Records: []events.KinesisFirehoseResponseRecord{
+		{RecordID: "1", Result: events.KinesisFirehoseTransformedStateDropped},
+	}}, response)
+}
+
+func TestFirehoseHandlerDeadlineApproaching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	response, err := FirehoseHandler(ctx, events.KinesisFirehoseEvent{Records: []events.KinesisFirehoseEventRecord{
+		{RecordID: "1", Data: gzipTestData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]}`)},
+	}})
+	require.Nil(t, err)
+	assert.Equal(t, events.KinesisFirehoseResponse{Records: []events.KinesisFirehoseResponseRecord{
+		{RecordID: "1", Result: events.KinesisFirehoseTransformedStateProcessingFailed},
+	}}, response)
+}
+
+func TestFirehoseHandlerSkipsCorrelation(t *testing.T) {
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() { requestStateStore = nil }()
+
+	// The request has no End Request, but its log isn't buffered
+	response, err := FirehoseHandler(context.Background(), events.KinesisFirehoseEvent{Records: []events.KinesisFirehoseEventRecord{
+		{RecordID: "1", Data: gzipTestData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]}`)},
+	}})
+	require.Nil(t, err)
+	require.Len(t, response.Records, 1)
+	assert.Equal(t, events.KinesisFirehoseTransformedStateOk, response.Records[0].Result)
+	assert.Contains(t, string(response.Records[0].Data), `"query":"TEST_QUERY","request_id":"TEST_ID"`)
+
+	firetailLog, _, err := requestStateStore.Get(context.Background(), "TEST_ID")
+	require.Nil(t, err)
+	assert.Nil(t, firetailLog)
+}
+
+func TestFirehoseHandlerResponseTooLarge(t *testing.T) {
+	// Each record decompresses to Firetail logs whose base64 encoding is over half the response limit
+	testQuery := strings.Repeat("a", 3*1024*1024)
+	record := func(recordID string) events.KinesisFirehoseEventRecord {
+		return events.KinesisFirehoseEventRecord{RecordID: recordID, Data: gzipTestData(t, fmt.Sprintf(
+			`{"logEvents": [{"id": "1", "message": "TEST_ID_%s GraphQL Query: %s"}]}`, recordID, testQuery,
+		))}
+	}
+	response, err := FirehoseHandler(context.Background(), events.KinesisFirehoseEvent{Records: []events.KinesisFirehoseEventRecord{
+		record("1"),
+		record("2"),
+		{RecordID: "3", Data: gzipTestData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID_3 GraphQL Query: TEST_QUERY"}]}`)},
+	}})
+	require.Nil(t, err)
+	require.Len(t, response.Records, 3)
+
+	assert.Equal(t, events.KinesisFirehoseTransformedStateOk, response.Records[0].Result)
+	assert.Contains(t, string(response.Records[0].Data), `"request_id":"TEST_ID_1"`)
+
+	// The second record would take the response over the limit, but the third still fits
+	assert.Equal(t, events.KinesisFirehoseResponseRecord{
+		RecordID: "2", Result: events.KinesisFirehoseTransformedStateProcessingFailed,
+	}, response.Records[1])
+	assert.Equal(t, events.KinesisFirehoseTransformedStateOk, response.Records[2].Result)
+	assert.Contains(t, string(response.Records[2].Data), `"request_id":"TEST_ID_3"`)
+
+	responseBytes, err := json.Marshal(response)
+	require.Nil(t, err)
+	assert.Less(t, len(responseBytes), maxFirehoseResponseBytes)
+}
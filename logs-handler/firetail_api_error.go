@@ -0,0 +1,90 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxResponseBodyBytes is the most of a response body from the Firetail API that we read.
+const maxResponseBodyBytes = 64 * 1024
+
+// maxBodySnippetBytes is the most of a response body from the Firetail API included in a
+// FiretailAPIError.
+const maxBodySnippetBytes = 256
+
+// FiretailAPIError describes a response from the Firetail logging API which didn't confirm that our
+// logs were accepted. Message is the message from the response if it was JSON, and BodySnippet holds
+// the start of the response body. RequestID is the ID the API gave the request, if it had one.
+type FiretailAPIError struct {
+	StatusCode  int
+	Message     string
+	BodySnippet string
+	RequestID   string
+	Retryable   bool
+	RetryAfter  time.Duration
+}
+
+func (e *FiretailAPIError) Error() string {
+	message := fmt.Sprintf("got %d response from firetail api", e.StatusCode)
+	if e.Message != "" {
+		message += ": " + e.Message
+	} else if e.BodySnippet != "" {
+		message += ": " + e.BodySnippet
+	}
+	if e.RequestID != "" {
+		message += fmt.Sprintf(" (request ID %s)", e.RequestID)
+	}
+	return message
+}
+
+// checkFiretailResponse reads resp and returns a *FiretailAPIError unless it is a successful
+// response from the Firetail API with the message "success".
+func checkFiretailResponse(resp *http.Response, now time.Time) error {
+	bodyBytes, readErr := io.ReadAll(io.LimitReader(resp.Body, maxResponseBodyBytes))
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	decodeErr := json.Unmarshal(bodyBytes, &body)
+	if readErr == nil && decodeErr == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 && body.Message == "success" {
+		return nil
+	}
+
+	apiErr := &FiretailAPIError{
+		StatusCode:  resp.StatusCode,
+		BodySnippet: bodySnippet(bodyBytes),
+		RequestID:   firetailRequestID(resp.Header),
+		Retryable:   isRetryableStatusCode(resp.StatusCode),
+	}
+	if decodeErr == nil {
+		apiErr.Message = body.Message
+	}
+	if apiErr.Retryable {
+		apiErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	}
+	return apiErr
+}
+
+// bodySnippet returns the start of a response body, with its whitespace collapsed so that it fits
+// on one line.
+func bodySnippet(bodyBytes []byte) string {
+	snippet := strings.Join(strings.Fields(string(bodyBytes)), " ")
+	if len(snippet) > maxBodySnippetBytes {
+		snippet = strings.ToValidUTF8(snippet[:maxBodySnippetBytes], "") + "..."
+	}
+	return snippet
+}
+
+// firetailRequestID returns the ID of a request from the headers of the Firetail API's response.
+func firetailRequestID(header http.Header) string {
+	for _, name := range []string{"x-amzn-requestid", "x-request-id"} {
+		if requestID := header.Get(name); requestID != "" {
+			return requestID
+		}
+	}
+	return ""
+}
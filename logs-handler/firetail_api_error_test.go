@@ -0,0 +1,73 @@
+package logshandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestResponse(statusCode int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestCheckFiretailResponseSuccess(t *testing.T) {
+	err := checkFiretailResponse(makeTestResponse(200, nil, `{"message":"success"}`), time.Now())
+	assert.Nil(t, err)
+}
+
+func TestCheckFiretailResponseErrs(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		resp        *http.Response
+		expectedErr *FiretailAPIError
+	}{
+		{
+			makeTestResponse(200, nil, `{"message":"fail"}`),
+			&FiretailAPIError{StatusCode: 200, Message: "fail", BodySnippet: `{"message":"fail"}`},
+		},
+		{
+			makeTestResponse(201, nil, ""),
+			&FiretailAPIError{StatusCode: 201},
+		},
+		{
+			makeTestResponse(401, http.Header{"X-Request-Id": {"TEST_REQUEST_ID"}}, `{"message":"unauthorized"}`),
+			&FiretailAPIError{StatusCode: 401, Message: "unauthorized", BodySnippet: `{"message":"unauthorized"}`, RequestID: "TEST_REQUEST_ID"},
+		},
+		{
+			makeTestResponse(429, http.Header{"Retry-After": {"3"}}, "Slow down"),
+			&FiretailAPIError{StatusCode: 429, BodySnippet: "Slow down", Retryable: true, RetryAfter: 3 * time.Second},
+		},
+		{
+			makeTestResponse(503, nil, strings.Repeat("a", 300)),
+			&FiretailAPIError{StatusCode: 503, BodySnippet: strings.Repeat("a", 256) + "...", Retryable: true},
+		},
+	}
+	for _, testCase := range testCases {
+		err := checkFiretailResponse(testCase.resp, now)
+		require.NotNil(t, err)
+		assert.Equal(t, testCase.expectedErr, err)
+	}
+}
+
+func TestFiretailAPIErrorMessage(t *testing.T) {
+	assert.Equal(t, "got 500 response from firetail api", (&FiretailAPIError{StatusCode: 500}).Error())
+	assert.Equal(t, "got 500 response from firetail api: TEST_BODY", (&FiretailAPIError{StatusCode: 500, BodySnippet: "TEST_BODY"}).Error())
+	assert.Equal(t, "got 500 response from firetail api: TEST_MESSAGE (request ID TEST_REQUEST_ID)", (&FiretailAPIError{
+		StatusCode:  500,
+		Message:     "TEST_MESSAGE",
+		BodySnippet: `{"message":"TEST_MESSAGE"}`,
+		RequestID:   "TEST_REQUEST_ID",
+	}).Error())
+}
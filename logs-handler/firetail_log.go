@@ -1,9 +1,10 @@
-package main
+package logshandler
 
 import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -29,20 +30,35 @@ const (
 	Plaintext         LogMessageType = "Plaintext"
 )
 
+// FiretailLog holds everything we forward to Firetail for a single AppSync request. IsPopulated only
+// considers the pointer fields, so the non-pointer fields such as timestamps are never enough on their
+// own for a FiretailLog to be sent. Metadata is added once the log is extracted from a delivery,
+// before it's correlated with logs for the same request from other deliveries, and is never enough
+// on its own either.
 type FiretailLog struct {
-	ExecutionSummary *json.RawMessage   `json:"executionSummary,omitempty"`
-	Query            *string            `json:"query,omitempty"`
-	RequestID        string             `json:"request_id"`
-	RequestHeaders   *json.RawMessage   `json:"requestHeaders,omitempty"`
-	RequestMappings  *[]json.RawMessage `json:"requestMappings,omitempty"`
-	RequestSummary   *json.RawMessage   `json:"requestSummary,omitempty"`
-	ResponseHeaders  *json.RawMessage   `json:"responseHeaders,omitempty"`
-	ResponseMappings *[]json.RawMessage `json:"responseMappings,omitempty"`
+	BeginRequestTimestamp int64                `json:"beginRequestTimestamp,omitempty"`
+	EndRequestTimestamp   int64                `json:"endRequestTimestamp,omitempty"`
+	ExecutionSummary      *json.RawMessage     `json:"executionSummary,omitempty"`
+	GraphQL               *GraphQLMetadata     `json:"graphQL,omitempty"`
+	Metadata              *FiretailLogMetadata `json:"metadata,omitempty"`
+	OperationName         *string              `json:"operationName,omitempty"`
+	Query                 *string              `json:"query,omitempty"`
+	RequestID             string               `json:"request_id"`
+	RequestHeaders        *json.RawMessage     `json:"requestHeaders,omitempty"`
+	RequestMappings       *[]json.RawMessage   `json:"requestMappings,omitempty"`
+	RequestSummary        *json.RawMessage     `json:"requestSummary,omitempty"`
+	ResponseHeaders       *json.RawMessage     `json:"responseHeaders,omitempty"`
+	ResponseMappings      *[]json.RawMessage   `json:"responseMappings,omitempty"`
+	TokensConsumed        int                  `json:"tokensConsumed,omitempty"`
+	Variables             *json.RawMessage     `json:"variables,omitempty"`
 }
 
 func (f *FiretailLog) IsPopulated() bool {
 	fValue := reflect.ValueOf(*f)
 	for i := 0; i < fValue.NumField(); i++ {
+		if fValue.Type().Field(i).Name == "Metadata" {
+			continue
+		}
 		if fValue.Field(i).Kind() == reflect.Pointer && !fValue.Field(i).IsNil() {
 			return true
 		}
@@ -50,6 +66,59 @@ func (f *FiretailLog) IsPopulated() bool {
 	return false
 }
 
+// Merge adds the fields of later, a FiretailLog for the same request built from events which came
+// after those of f, into f. Lists are appended to f's, and any other fields which are populated in
+// later replace those in f, except for Metadata, which f keeps if it has any.
+func (f *FiretailLog) Merge(later *FiretailLog) {
+	fValue := reflect.ValueOf(f).Elem()
+	laterValue := reflect.ValueOf(later).Elem()
+	for i := 0; i < fValue.NumField(); i++ {
+		field, laterField := fValue.Field(i), laterValue.Field(i)
+		if laterField.IsZero() {
+			continue
+		}
+		if fValue.Type().Field(i).Name == "Metadata" && !field.IsNil() {
+			continue
+		}
+		if field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Slice && !field.IsNil() {
+			mergedSlice := reflect.New(field.Type().Elem())
+			mergedSlice.Elem().Set(reflect.AppendSlice(field.Elem(), laterField.Elem()))
+			field.Set(mergedSlice)
+			continue
+		}
+		field.Set(laterField)
+	}
+}
+
+// GraphQLAPIId returns the ID of the AppSync API the request was made to, which AppSync includes in
+// its JSON log events, or an empty string if none of the log's events had it.
+func (f *FiretailLog) GraphQLAPIId() string {
+	rawMessages := []*json.RawMessage{f.RequestSummary, f.ExecutionSummary}
+	for _, mappings := range []*[]json.RawMessage{f.RequestMappings, f.ResponseMappings} {
+		if mappings != nil && len(*mappings) > 0 {
+			rawMessages = append(rawMessages, &(*mappings)[0])
+		}
+	}
+	for _, rawMessage := range rawMessages {
+		if rawMessage == nil {
+			continue
+		}
+		var message struct {
+			GraphQLAPIId string `json:"graphQLAPIId"`
+		}
+		if err := json.Unmarshal(*rawMessage, &message); err == nil && message.GraphQLAPIId != "" {
+			return message.GraphQLAPIId
+		}
+	}
+	return ""
+}
+
+// IsComplete returns true if the FiretailLog contains the events AppSync logs at the end of a
+// request, so no more events should be expected for it.
+func (f *FiretailLog) IsComplete() bool {
+	return f.EndRequestTimestamp != 0 || f.RequestSummary != nil
+}
+
 func (f *FiretailLog) AddEventMessage(logType LogMessageType, logEvent *events.CloudwatchLogsLogEvent) error {
 	var rawMessage json.RawMessage
 	if logType != Plaintext {
@@ -88,47 +157,47 @@ func (f *FiretailLog) AddEventMessage(logType LogMessageType, logEvent *events.C
 	return nil
 }
 
-func (f *FiretailLog) addPlaintextEventMessage(logEvent *events.CloudwatchLogsLogEvent) error {
-	// Make sure it has enough parts
-	logParts := strings.SplitN(logEvent.Message, " ", 2)
-	if len(logParts) < 2 {
-		return fmt.Errorf("plaintext logEventMessage had %d parts when split by ' ' but needs >= 2", len(logParts))
+// isForwardedLogType returns true for the types of log event which AddEventMessage adds to a
+// FiretailLog. Events of any other type are dropped.
+func isForwardedLogType(logType LogMessageType) bool {
+	switch logType {
+	case RequestMapping, ResponseMapping, ExecutionSummary, RequestSummary, BeginRequest, EndRequest,
+		TokensConsumed, GraphQLQuery, RequestHeaders, ResponseHeaders:
+		return true
+	default:
+		return false
 	}
+}
 
-	// Determine its type from its prefix & extract its payload
-	plaintextLogPrefixes := map[string]LogMessageType{
-		"Begin Request":       BeginRequest,
-		"GraphQL Query: ":     GraphQLQuery,
-		"Begin Execution - ":  BeginExecution,
-		"End Field Execution": EndFieldExecution,
-		"Begin Tracing":       BeginTracing,
-		"End Tracing":         EndTracing,
-		"Request Headers: ":   RequestHeaders,
-		"Response Headers: ":  ResponseHeaders,
-		"Tokens Consumed: ":   TokensConsumed,
-		"End Request":         EndRequest,
-	}
-	var logType LogMessageType
-	var logPayload string
-	for logPrefix, potentialLogType := range plaintextLogPrefixes {
-		if strings.HasPrefix(logParts[1], logPrefix) {
-			logType = potentialLogType
-			logParts = strings.SplitN(logEvent.Message, logPrefix, 2)
-			if len(logParts) < 2 {
-				logPayload = ""
-			} else {
-				logPayload = logParts[1]
-			}
-			break
-		}
-	}
-	if logType == "" {
-		return fmt.Errorf("plaintext logEventMessage matched no plaintext log prefixes: %s", logEvent.Message)
+func (f *FiretailLog) addPlaintextEventMessage(logEvent *events.CloudwatchLogsLogEvent) error {
+	logType, logPayload, err := parsePlaintextLogMessage(logEvent.Message)
+	if err != nil {
+		return err
 	}
 
 	switch logType {
+	case BeginRequest:
+		f.BeginRequestTimestamp = logEvent.Timestamp
+		break
+
+	case EndRequest:
+		f.EndRequestTimestamp = logEvent.Timestamp
+		break
+
+	case TokensConsumed:
+		tokensConsumed, err := strconv.Atoi(strings.TrimSpace(logPayload))
+		if err != nil {
+			return fmt.Errorf("tokens consumed log had invalid payload: %s", logPayload)
+		}
+		f.TokensConsumed = tokensConsumed
+		break
+
 	case GraphQLQuery:
-		f.Query = &logParts[1]
+		query, operationName, variables := parseGraphQLQueryLog(logPayload)
+		f.Query = &query
+		f.OperationName = operationName
+		f.Variables = variables
+		f.GraphQL = analyseGraphQLQuery(query, operationName)
 		break
 
 	case RequestHeaders:
@@ -163,3 +232,43 @@ func (f *FiretailLog) addPlaintextEventMessage(logEvent *events.CloudwatchLogsLo
 
 	return nil
 }
+
+// parsePlaintextLogMessage determines the type of a plaintext log message from its prefix, and
+// extracts its payload.
+func parsePlaintextLogMessage(message string) (logType LogMessageType, logPayload string, err error) {
+	// Make sure it has enough parts
+	logParts := strings.SplitN(message, " ", 2)
+	if len(logParts) < 2 {
+		return "", "", fmt.Errorf("plaintext logEventMessage had %d parts when split by ' ' but needs >= 2", len(logParts))
+	}
+
+	// Determine its type from its prefix & extract its payload
+	plaintextLogPrefixes := map[string]LogMessageType{
+		"Begin Request":       BeginRequest,
+		"GraphQL Query: ":     GraphQLQuery,
+		"Begin Execution - ":  BeginExecution,
+		"End Field Execution": EndFieldExecution,
+		"Begin Tracing":       BeginTracing,
+		"End Tracing":         EndTracing,
+		"Request Headers: ":   RequestHeaders,
+		"Response Headers: ":  ResponseHeaders,
+		"Tokens Consumed: ":   TokensConsumed,
+		"End Request":         EndRequest,
+	}
+	for logPrefix, potentialLogType := range plaintextLogPrefixes {
+		if strings.HasPrefix(logParts[1], logPrefix) {
+			logType = potentialLogType
+			logParts = strings.SplitN(message, logPrefix, 2)
+			if len(logParts) < 2 {
+				logPayload = ""
+			} else {
+				logPayload = logParts[1]
+			}
+			break
+		}
+	}
+	if logType == "" {
+		return "", "", fmt.Errorf("plaintext logEventMessage matched no plaintext log prefixes: %s", message)
+	}
+	return logType, logPayload, nil
+}
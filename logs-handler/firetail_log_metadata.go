@@ -0,0 +1,87 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// forwarderVersion is the version of this Lambda, which is set at build time with
+// -ldflags "-X aws-golang-simple-http-endpoint/logs-handler.forwarderVersion=...".
+var forwarderVersion = "dev"
+
+// FiretailLogMetadata describes where a FiretailLog came from, so that Firetail can attribute the
+// traffic of many AppSync APIs sent with the same token.
+type FiretailLogMetadata struct {
+	AccountID          string `json:"accountId,omitempty"`
+	Region             string `json:"region,omitempty"`
+	ApiID              string `json:"apiId,omitempty"`
+	LogGroup           string `json:"logGroup,omitempty"`
+	LogStream          string `json:"logStream,omitempty"`
+	SubscriptionFilter string `json:"subscriptionFilter,omitempty"`
+	ForwarderVersion   string `json:"forwarderVersion,omitempty"`
+}
+
+// AnnotateFiretailLogs sets the Metadata of each of firetailLogs from the Cloudwatch logs they were
+// extracted from, and the resolver ARNs within the logs themselves. The account ID and region are
+// taken from the resolver ARNs if logsData doesn't have them. Logs which already have Metadata, such
+// as those buffered by an earlier invocation, keep it, as logsData may not be where they came from.
+func AnnotateFiretailLogs(firetailLogs map[string]*FiretailLog, logsData *events.CloudwatchLogsData) {
+	subscriptionFilter := ""
+	if len(logsData.SubscriptionFilters) > 0 {
+		subscriptionFilter = logsData.SubscriptionFilters[0]
+	}
+	for _, firetailLog := range firetailLogs {
+		if firetailLog.Metadata != nil {
+			continue
+		}
+		arnAccountID, arnRegion := firetailLog.resolverArnAccountAndRegion()
+		metadata := &FiretailLogMetadata{
+			AccountID:          logsData.Owner,
+			Region:             arnRegion,
+			ApiID:              firetailLog.GraphQLAPIId(),
+			LogGroup:           logsData.LogGroup,
+			LogStream:          logsData.LogStream,
+			SubscriptionFilter: subscriptionFilter,
+			ForwarderVersion:   forwarderVersion,
+		}
+		if metadata.AccountID == "" {
+			metadata.AccountID = arnAccountID
+		}
+		if metadata.Region == "" {
+			// The logs are usually forwarded by a Lambda in the same region as the API
+			metadata.Region = os.Getenv("AWS_REGION")
+		}
+		if metadata.ApiID == "" {
+			metadata.ApiID = appSyncApiIdFromLogGroup(logsData.LogGroup)
+		}
+		firetailLog.Metadata = metadata
+	}
+}
+
+// resolverArnAccountAndRegion returns the account ID and region from the resolver ARN of the first
+// of the log's request or response mappings which has one, such as
+// "arn:aws:appsync:eu-west-1:123456789012:apis/{api_id}/types/Query/resolvers/getPost".
+func (f *FiretailLog) resolverArnAccountAndRegion() (string, string) {
+	for _, mappings := range []*[]json.RawMessage{f.RequestMappings, f.ResponseMappings} {
+		if mappings == nil {
+			continue
+		}
+		for _, mapping := range *mappings {
+			var message struct {
+				ResolverArn string `json:"resolverArn"`
+			}
+			if err := json.Unmarshal(mapping, &message); err != nil || message.ResolverArn == "" {
+				continue
+			}
+			// ARNs have the format arn:partition:service:region:account-id:resource
+			arnParts := strings.SplitN(message.ResolverArn, ":", 6)
+			if len(arnParts) == 6 && arnParts[0] == "arn" {
+				return arnParts[4], arnParts[3]
+			}
+		}
+	}
+	return "", ""
+}
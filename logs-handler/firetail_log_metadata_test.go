@@ -0,0 +1,62 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotateFiretailLogs(t *testing.T) {
+	requestMapping := json.RawMessage(`{"logType":"RequestMapping","resolverArn":"arn:aws:appsync:us-east-2:123456789012:apis/ARN_API_ID/types/Query/resolvers/getPost","graphQLAPIId":"TEST_API_ID"}`)
+	firetailLogs := makeTestFiretailLogs("TEST_ID")
+	firetailLogs["TEST_ID"].RequestMappings = &[]json.RawMessage{requestMapping}
+
+	AnnotateFiretailLogs(firetailLogs, &events.CloudwatchLogsData{
+		Owner:               "TEST_ACCOUNT_ID",
+		LogGroup:            "/aws/appsync/apis/LOG_GROUP_API_ID",
+		LogStream:           "TEST_LOG_STREAM",
+		SubscriptionFilters: []string{"TEST_SUBSCRIPTION_FILTER"},
+	})
+
+	assert.Equal(t, &FiretailLogMetadata{
+		AccountID:          "TEST_ACCOUNT_ID",
+		Region:             "us-east-2",
+		ApiID:              "TEST_API_ID",
+		LogGroup:           "/aws/appsync/apis/LOG_GROUP_API_ID",
+		LogStream:          "TEST_LOG_STREAM",
+		SubscriptionFilter: "TEST_SUBSCRIPTION_FILTER",
+		ForwarderVersion:   forwarderVersion,
+	}, firetailLogs["TEST_ID"].Metadata)
+}
+
+func TestAnnotateFiretailLogsFallbacks(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	responseMapping := json.RawMessage(`{"logType":"ResponseMapping","resolverArn":"arn:aws:appsync:us-east-2:123456789012:apis/ARN_API_ID/types/Query/resolvers/getPost"}`)
+	firetailLogs := makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2")
+	firetailLogs["TEST_ID_1"].ResponseMappings = &[]json.RawMessage{responseMapping}
+
+	AnnotateFiretailLogs(firetailLogs, &events.CloudwatchLogsData{LogGroup: "/aws/appsync/apis/LOG_GROUP_API_ID"})
+
+	require.NotNil(t, firetailLogs["TEST_ID_1"].Metadata)
+	assert.Equal(t, "123456789012", firetailLogs["TEST_ID_1"].Metadata.AccountID)
+	assert.Equal(t, "us-east-2", firetailLogs["TEST_ID_1"].Metadata.Region)
+	assert.Equal(t, "LOG_GROUP_API_ID", firetailLogs["TEST_ID_1"].Metadata.ApiID)
+	assert.Equal(t, "", firetailLogs["TEST_ID_1"].Metadata.SubscriptionFilter)
+
+	require.NotNil(t, firetailLogs["TEST_ID_2"].Metadata)
+	assert.Equal(t, "", firetailLogs["TEST_ID_2"].Metadata.AccountID)
+	assert.Equal(t, "eu-west-1", firetailLogs["TEST_ID_2"].Metadata.Region)
+	assert.Equal(t, "LOG_GROUP_API_ID", firetailLogs["TEST_ID_2"].Metadata.ApiID)
+}
+
+func TestAnnotateFiretailLogsKeepsExistingMetadata(t *testing.T) {
+	firetailLogs := makeTestFiretailLogs("TEST_ID")
+	firetailLogs["TEST_ID"].Metadata = &FiretailLogMetadata{LogGroup: "/aws/appsync/apis/BUFFERED_API_ID"}
+
+	AnnotateFiretailLogs(firetailLogs, &events.CloudwatchLogsData{LogGroup: "/aws/appsync/apis/LOG_GROUP_API_ID"})
+
+	assert.Equal(t, &FiretailLogMetadata{LogGroup: "/aws/appsync/apis/BUFFERED_API_ID"}, firetailLogs["TEST_ID"].Metadata)
+}
@@ -1,4 +1,4 @@
-package main
+package logshandler
 
 import (
 	"encoding/json"
@@ -27,6 +27,15 @@ func TestIsPopulatedPopulated(t *testing.T) {
 	assert.True(t, isPopulated)
 }
 
+func TestIsPopulatedMetadataOnly(t *testing.T) {
+	firetailLog := FiretailLog{
+		RequestID: "TEST_REQUEST",
+		Metadata:  &FiretailLogMetadata{ForwarderVersion: "TEST_VERSION"},
+	}
+	isPopulated := firetailLog.IsPopulated()
+	assert.False(t, isPopulated)
+}
+
 func TestAddEventMessageRequestMapping(t *testing.T) {
 	testEvent := events.CloudwatchLogsLogEvent{
 		ID:        "TEST_ID",
@@ -114,6 +123,23 @@ func TestAddPlaintextEventMessageQuery(t *testing.T) {
 	assert.Equal(t, "TEST_QUERY", *testLog.Query)
 }
 
+func TestAddPlaintextEventMessageQueryWithOperationAndVariables(t *testing.T) {
+	testEvent := &events.CloudwatchLogsLogEvent{
+		ID:        "TEST_ID",
+		Timestamp: 3142,
+		Message:   "TEST_ID GraphQL Query: query MyQuery { getPost(id: $id) { id } }, Operation: MyQuery, Variables: {\"id\":1}",
+	}
+	testLog := &FiretailLog{}
+	err := testLog.addPlaintextEventMessage(testEvent)
+	require.Nil(t, err)
+	require.NotNil(t, testLog.Query)
+	assert.Equal(t, "query MyQuery { getPost(id: $id) { id } }", *testLog.Query)
+	require.NotNil(t, testLog.OperationName)
+	assert.Equal(t, "MyQuery", *testLog.OperationName)
+	require.NotNil(t, testLog.Variables)
+	assert.Equal(t, "{\"id\":1}", string(*testLog.Variables))
+}
+
 func TestAddPlaintextEventRequestHeaders(t *testing.T) {
 	testEvent := &events.CloudwatchLogsLogEvent{
 		ID:        "TEST_ID",
@@ -124,7 +150,7 @@ func TestAddPlaintextEventRequestHeaders(t *testing.T) {
 	err := testLog.addPlaintextEventMessage(testEvent)
 	require.Nil(t, err)
 	require.NotNil(t, testLog.RequestHeaders)
-	assert.Equal(t, "{\"TEST_HEADER\":[\"TEST_VALUE_1, TEST_VALUE_2\"]}", string(*testLog.RequestHeaders))
+	assert.Equal(t, "{\"TEST_HEADER\":[\"TEST_VALUE_1\",\"TEST_VALUE_2\"]}", string(*testLog.RequestHeaders))
 }
 
 func TestAddPlaintextEventResponseHeaders(t *testing.T) {
@@ -149,7 +175,7 @@ func TestAddPlaintextEventBrokenRequestHeaders(t *testing.T) {
 	testLog := &FiretailLog{}
 	err := testLog.addPlaintextEventMessage(testEvent)
 	require.NotNil(t, err)
-	assert.Equal(t, "multivalue header had !=2 subparts when split by first '=[': TEST_HEADER=TEST_VALUE]", err.Error())
+	assert.Equal(t, "expected '[' at offset 12 of headers string: TEST_HEADER=TEST_VALUE]", err.Error())
 	assert.Nil(t, testLog.RequestHeaders)
 }
 
@@ -157,15 +183,28 @@ func TestAddPlaintextEventBrokenResponseHeaders(t *testing.T) {
 	testEvent := &events.CloudwatchLogsLogEvent{
 		ID:        "TEST_ID",
 		Timestamp: 3142,
-		Message:   "TEST_ID Response Headers: {TEST_HEADER=[TEST_VALUE_1, TEST_VALUE_2]}",
+		Message:   "TEST_ID Response Headers: {TEST_HEADER}",
 	}
 	testLog := &FiretailLog{}
 	err := testLog.addPlaintextEventMessage(testEvent)
 	require.NotNil(t, err)
-	assert.Equal(t, "header had !=2 subparts when split by first '=':  TEST_VALUE_2]", err.Error())
+	assert.Equal(t, "expected header name followed by '=' at offset 0 of headers string: TEST_HEADER", err.Error())
 	assert.Nil(t, testLog.ResponseHeaders)
 }
 
+func TestAddPlaintextEventResponseHeadersWithCommas(t *testing.T) {
+	testEvent := &events.CloudwatchLogsLogEvent{
+		ID:        "TEST_ID",
+		Timestamp: 3142,
+		Message:   "TEST_ID Response Headers: {TEST_HEADER=[TEST_VALUE_1, TEST_VALUE_2]}",
+	}
+	testLog := &FiretailLog{}
+	err := testLog.addPlaintextEventMessage(testEvent)
+	require.Nil(t, err)
+	require.NotNil(t, testLog.ResponseHeaders)
+	assert.Equal(t, "{\"TEST_HEADER\":\"[TEST_VALUE_1, TEST_VALUE_2]\"}", string(*testLog.ResponseHeaders))
+}
+
 func TestAddPlaintextEventBeginRequest(t *testing.T) {
 	testEvent := &events.CloudwatchLogsLogEvent{
 		ID:        "TEST_ID",
@@ -175,9 +214,49 @@ func TestAddPlaintextEventBeginRequest(t *testing.T) {
 	testLog := &FiretailLog{}
 	err := testLog.addPlaintextEventMessage(testEvent)
 	require.Nil(t, err)
+	assert.Equal(t, int64(3142), testLog.BeginRequestTimestamp)
+	assert.False(t, testLog.IsPopulated())
+}
+
+func TestAddPlaintextEventEndRequest(t *testing.T) {
+	testEvent := &events.CloudwatchLogsLogEvent{
+		ID:        "TEST_ID",
+		Timestamp: 3142,
+		Message:   "TEST_ID End Request",
+	}
+	testLog := &FiretailLog{}
+	err := testLog.addPlaintextEventMessage(testEvent)
+	require.Nil(t, err)
+	assert.Equal(t, int64(3142), testLog.EndRequestTimestamp)
 	assert.False(t, testLog.IsPopulated())
 }
 
+func TestAddPlaintextEventTokensConsumed(t *testing.T) {
+	testEvent := &events.CloudwatchLogsLogEvent{
+		ID:        "TEST_ID",
+		Timestamp: 3142,
+		Message:   "TEST_ID Tokens Consumed: 3",
+	}
+	testLog := &FiretailLog{}
+	err := testLog.addPlaintextEventMessage(testEvent)
+	require.Nil(t, err)
+	assert.Equal(t, 3, testLog.TokensConsumed)
+	assert.False(t, testLog.IsPopulated())
+}
+
+func TestAddPlaintextEventMalformedTokensConsumed(t *testing.T) {
+	testEvent := &events.CloudwatchLogsLogEvent{
+		ID:        "TEST_ID",
+		Timestamp: 3142,
+		Message:   "TEST_ID Tokens Consumed: many",
+	}
+	testLog := &FiretailLog{}
+	err := testLog.addPlaintextEventMessage(testEvent)
+	require.NotNil(t, err)
+	assert.Equal(t, "tokens consumed log had invalid payload: many", err.Error())
+	assert.Zero(t, testLog.TokensConsumed)
+}
+
 func TestAddPlaintextEventNoMatches(t *testing.T) {
 	testEvent := &events.CloudwatchLogsLogEvent{
 		ID:        "TEST_ID",
@@ -189,3 +268,63 @@ func TestAddPlaintextEventNoMatches(t *testing.T) {
 	require.NotNil(t, err)
 	assert.Equal(t, "plaintext logEventMessage matched no plaintext log prefixes: TEST_ID Test Event", err.Error())
 }
+
+func TestMerge(t *testing.T) {
+	testQuery := "TEST_QUERY"
+	testRequestHeaders := json.RawMessage(`{"TEST_HEADER":["TEST_VALUE"]}`)
+	earlierLog := &FiretailLog{
+		RequestID:             "TEST_ID",
+		BeginRequestTimestamp: 1000,
+		Query:                 &testQuery,
+		RequestMappings:       &[]json.RawMessage{json.RawMessage(`"TEST_MAPPING_1"`)},
+	}
+	laterLog := &FiretailLog{
+		RequestID:           "TEST_ID",
+		EndRequestTimestamp: 1089,
+		RequestHeaders:      &testRequestHeaders,
+		RequestMappings:     &[]json.RawMessage{json.RawMessage(`"TEST_MAPPING_2"`)},
+		ResponseMappings:    &[]json.RawMessage{json.RawMessage(`"TEST_MAPPING_3"`)},
+	}
+
+	earlierLog.Merge(laterLog)
+
+	assert.Equal(t, &FiretailLog{
+		RequestID:             "TEST_ID",
+		BeginRequestTimestamp: 1000,
+		EndRequestTimestamp:   1089,
+		Query:                 &testQuery,
+		RequestHeaders:        &testRequestHeaders,
+		RequestMappings:       &[]json.RawMessage{json.RawMessage(`"TEST_MAPPING_1"`), json.RawMessage(`"TEST_MAPPING_2"`)},
+		ResponseMappings:      &[]json.RawMessage{json.RawMessage(`"TEST_MAPPING_3"`)},
+	}, earlierLog)
+	assert.Equal(t, &[]json.RawMessage{json.RawMessage(`"TEST_MAPPING_2"`)}, laterLog.RequestMappings)
+}
+
+func TestMergeKeepsMetadata(t *testing.T) {
+	earlierLog := &FiretailLog{RequestID: "TEST_ID", Metadata: &FiretailLogMetadata{LogStream: "TEST_LOG_STREAM_1"}}
+	laterLog := &FiretailLog{RequestID: "TEST_ID", Metadata: &FiretailLogMetadata{LogStream: "TEST_LOG_STREAM_2"}}
+
+	earlierLog.Merge(laterLog)
+
+	assert.Equal(t, &FiretailLogMetadata{LogStream: "TEST_LOG_STREAM_1"}, earlierLog.Metadata)
+}
+
+func TestIsComplete(t *testing.T) {
+	testRequestSummary := json.RawMessage(`{}`)
+	assert.False(t, (&FiretailLog{BeginRequestTimestamp: 1000}).IsComplete())
+	assert.True(t, (&FiretailLog{EndRequestTimestamp: 1089}).IsComplete())
+	assert.True(t, (&FiretailLog{RequestSummary: &testRequestSummary}).IsComplete())
+}
+
+func TestGraphQLAPIId(t *testing.T) {
+	requestMapping := json.RawMessage(`{"logType":"RequestMapping","graphQLAPIId":"TEST_API_ID"}`)
+	testLog := &FiretailLog{RequestMappings: &[]json.RawMessage{requestMapping}}
+	assert.Equal(t, "TEST_API_ID", testLog.GraphQLAPIId())
+}
+
+func TestGraphQLAPIIdMissing(t *testing.T) {
+	requestSummary := json.RawMessage(`{"logType":"RequestSummary"}`)
+	testQuery := "TEST_QUERY"
+	testLog := &FiretailLog{RequestSummary: &requestSummary, Query: &testQuery}
+	assert.Equal(t, "", testLog.GraphQLAPIId())
+}
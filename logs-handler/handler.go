@@ -1,11 +1,12 @@
-package main
+package logshandler
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 )
 
@@ -14,24 +15,258 @@ func Handler(ctx context.Context, event events.CloudwatchLogsEvent) error {
 	if err != nil {
 		return errors.WithMessage(err, "err parsing CloudwatchLogsEvent")
 	}
+	return handleLogsData(ctx, &logsData)
+}
 
-	firetailLogs, err := ExtractFiretailLogs(&logsData)
-	if err != nil {
-		log.Println("Errs extracting Firetail logs:", err.Error())
+// invocationLogger returns a Logger which adds the ID of the Lambda invocation in ctx, if there is
+// one, to every line.
+func invocationLogger(ctx context.Context) *Logger {
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok {
+		return logger.With(LogFields{"awsRequestId": lambdaContext.AwsRequestID})
+	}
+	return logger
+}
+
+// handleLogsData extracts Firetail logs from a batch of Cloudwatch logs and sends them to Firetail,
+// however the batch was delivered to the Lambda.
+func handleLogsData(ctx context.Context, logsData *events.CloudwatchLogsData) error {
+	startTime := time.Now()
+	handlerLogger := invocationLogger(ctx)
+
+	var metrics *Metrics
+	if metricsNamespace != "" {
+		metrics = newHandlerMetrics(logsData)
+		defer func() {
+			if err := metrics.Write(nil, time.Now()); err != nil {
+				handlerLogger.Warn("Err writing metrics", LogFields{"error": err})
+			}
+		}()
 	}
+
+	// Extracting and sending logs stops deadlineSafetyMargin before the Lambda's deadline, so that
+	// there's still time to store any logs we couldn't send in the dead letter sink.
+	workCtx, cancel := withDeadlineSafetyMargin(ctx)
+	defer cancel()
+
+	stats := &extractionStats{}
+	firetailLogs := buildFiretailLogs(workCtx, handlerLogger, metrics, requestStateStore, logsData, stats)
 	if firetailLogs == nil || len(firetailLogs) == 0 {
-		log.Println("Generated no Firetail logs from this batch. Exiting...")
-		return nil
+		handlerLogger.Info("Generated no Firetail logs from this batch. Exiting...", LogFields{
+			"logEvents": len(logsData.LogEvents),
+		})
+		return partialFailureErr(workCtx, logsData, stats, nil, nil)
 	}
 
-	for requestID, firetailLog := range firetailLogs {
-		logBytes, err := json.Marshal(firetailLog)
+	// Payloads are only logged at debug level, as they contain the same potentially sensitive data
+	// we're sending to Firetail and would otherwise double the size of what we ingest into Cloudwatch.
+	if handlerLogger.Enabled(LevelDebug) {
+		for requestID, firetailLog := range firetailLogs {
+			handlerLogger.Debug("Generated Firetail log", LogFields{"requestId": requestID, "firetailLog": firetailLog})
+		}
+	}
+
+	chunkResults, err := sendRoutedFiretailLogs(workCtx, routingTable, logsData.LogGroup, firetailLogs)
+	if metrics != nil {
+		recordChunkMetrics(metrics, chunkResults)
+	}
+	handlerLogger.Info("Sent Firetail logs", summariseChunkResults(chunkResults, LogFields{
+		"logEvents":    len(logsData.LogEvents),
+		"firetailLogs": len(firetailLogs),
+		"durationMs":   time.Since(startTime).Milliseconds(),
+	}))
+	if err != nil {
+		err = handleFailedChunks(ctx, handlerLogger, chunkResults, err)
+	}
+	return partialFailureErr(workCtx, logsData, stats, chunkResults, err)
+}
+
+// buildFiretailLogs runs a batch of Cloudwatch logs through every stage of building Firetail logs:
+// extraction, redaction, annotation, correlation and filtering. Logs are annotated before they're
+// correlated so that those which are buffered keep the metadata of the invocation they came from. Errs
+// along the way are logged rather than returned, and the logs they affect are left out. metrics may be
+// nil, and logs are only correlated if store isn't nil.
+func buildFiretailLogs(workCtx context.Context, handlerLogger *Logger, metrics *Metrics, store RequestStateStore, logsData *events.CloudwatchLogsData, stats *extractionStats) map[string]*FiretailLog {
+	firetailLogs, err := extractAllFiretailLogs(workCtx, logsData, stats)
+	if err != nil {
+		handlerLogger.Warn("Errs extracting Firetail logs", LogFields{"error": err})
+	}
+	if store == nil {
+		removeUnpopulatedFiretailLogs(firetailLogs)
+	}
+	if metrics != nil {
+		recordExtractionMetrics(metrics, logsData, stats, err)
+	}
+	if redactionPolicy != nil {
+		if err := RedactFiretailLogs(redactionPolicy, firetailLogs); err != nil {
+			handlerLogger.Warn("Errs redacting Firetail logs", LogFields{"error": err})
+		}
+	}
+	AnnotateFiretailLogs(firetailLogs, logsData)
+	if store != nil {
+		firetailLogs, err = CorrelateFiretailLogs(workCtx, store, firetailLogs, time.Now())
 		if err != nil {
-			log.Printf("Err marshalling firetail log for request ID %s: %s", requestID, err.Error())
+			handlerLogger.Warn("Errs correlating Firetail logs", LogFields{"error": err})
+		}
+	}
+	if filterPolicy != nil {
+		droppedLogs := FilterFiretailLogs(filterPolicy, firetailLogs)
+		if metrics != nil {
+			for ruleName, count := range droppedLogs {
+				metrics.AddWithDimensions("FilteredLogs", UnitCount, float64(count), map[string]string{"Rule": ruleName})
+			}
+		}
+	}
+	if metrics != nil {
+		metrics.Add("FiretailLogs", UnitCount, float64(len(firetailLogs)))
+	}
+	return firetailLogs
+}
+
+// partialFailureErr returns a *PartialFailureError wrapping err if workCtx is done and not everything
+// was handled, either because not every log event was processed or because err is not nil.
+// Otherwise, it returns err.
+func partialFailureErr(workCtx context.Context, logsData *events.CloudwatchLogsData, stats *extractionStats, chunkResults []*ChunkResult, err error) error {
+	if workCtx.Err() == nil || (err == nil && stats.ProcessedEvents == len(logsData.LogEvents)) {
+		return err
+	}
+	sentChunks := 0
+	for _, chunkResult := range chunkResults {
+		if chunkResult.Err == nil {
+			sentChunks++
+		}
+	}
+	return &PartialFailureError{
+		ProcessedEvents: stats.ProcessedEvents,
+		TotalEvents:     len(logsData.LogEvents),
+		SentChunks:      sentChunks,
+		TotalChunks:     len(chunkResults),
+		Err:             err,
+	}
+}
+
+// handleFailedChunks logs the chunks which failed to send to Firetail and stores them in the dead
+// letter sink, if there is one. It returns sendErr if the chunks couldn't be stored anywhere.
+func handleFailedChunks(ctx context.Context, handlerLogger *Logger, chunkResults []*ChunkResult, sendErr error) error {
+	if chunkResults == nil || deadLetterSink == nil {
+		for i, chunkResult := range chunkResults {
+			if chunkResult.Err != nil {
+				handlerLogger.Error("Failed to send chunk to Firetail", chunkLogFields(i, chunkResults))
+			}
+		}
+		return sendErr
+	}
+
+	// If we have a dead letter sink then the failed chunks can be redriven later, so we only return an
+	// err if we failed to put any of them in the dead letter sink.
+	var deadLetterErrs error
+	for i, chunkResult := range chunkResults {
+		if chunkResult.Err == nil {
 			continue
 		}
-		log.Println(string(logBytes))
+		handlerLogger.Warn("Failed to send chunk to Firetail, sending to dead letter sink", chunkLogFields(i, chunkResults))
+		if err := deadLetterSink.Put(ctx, newDeadLetter(chunkResult)); err != nil {
+			deadLetterErrs = multierror.Append(deadLetterErrs, errors.WithMessagef(
+				chunkResult.Err, "err sending chunk %d of %d to firetail and to dead letter sink (%s)", i+1, len(chunkResults), err.Error(),
+			))
+		}
+	}
+	return deadLetterErrs
+}
+
+// summariseChunkResults adds the number of chunks and bytes which were sent and failed to fields.
+func summariseChunkResults(chunkResults []*ChunkResult, fields LogFields) LogFields {
+	sentChunks, sentBytes, failedChunks, failedBytes := 0, 0, 0, 0
+	for _, chunkResult := range chunkResults {
+		if chunkResult.Err == nil {
+			sentChunks++
+			sentBytes += len(chunkResult.Chunk.Payload)
+		} else {
+			failedChunks++
+			failedBytes += len(chunkResult.Chunk.Payload)
+		}
+	}
+	fields["sentChunks"] = sentChunks
+	fields["sentBytes"] = sentBytes
+	fields["failedChunks"] = failedChunks
+	fields["failedBytes"] = failedBytes
+	return fields
+}
+
+// chunkLogFields describes the i-th of chunkResults for a log line.
+func chunkLogFields(i int, chunkResults []*ChunkResult) LogFields {
+	return LogFields{
+		"chunk":      i + 1,
+		"chunks":     len(chunkResults),
+		"requestIds": chunkResults[i].Chunk.RequestIDs,
+		"bytes":      len(chunkResults[i].Chunk.Payload),
+		"error":      chunkResults[i].Err,
+		"route":      chunkResults[i].Route,
 	}
+}
 
-	return SendToFiretail(firetailLogs, firetailApiUrl, firetailApiToken)
+// newHandlerMetrics creates the Metrics for an invocation of Handler, dimensioned by the AppSync API
+// the logs came from. Every distinct set of dimension values is charged for as a separate metric, so
+// log streams are never used as dimensions, and the log group is only an optional dimension if
+// metricsLogGroupDimension is set.
+func newHandlerMetrics(logsData *events.CloudwatchLogsData) *Metrics {
+	apiId := appSyncApiIdFromLogGroup(logsData.LogGroup)
+	if apiId == "" {
+		apiId = "Unknown"
+	}
+	metrics := NewMetrics(metricsNamespace, map[string]string{"ApiId": apiId})
+	if metricsLogGroupDimension {
+		metrics.OptionalDimensions = map[string]string{"LogGroup": logsData.LogGroup}
+	}
+	return metrics
+}
+
+// recordExtractionMetrics records how many log events were received, how many were dropped for each
+// LogMessageType, and how many errs were encountered parsing them.
+func recordExtractionMetrics(metrics *Metrics, logsData *events.CloudwatchLogsData, stats *extractionStats, extractionErr error) {
+	metrics.Add("LogEvents", UnitCount, float64(len(logsData.LogEvents)))
+	for logType, count := range stats.DroppedEvents {
+		if logType == "" {
+			logType = "Unknown"
+		}
+		metrics.AddWithDimensions("DroppedEvents", UnitCount, float64(count), map[string]string{"LogMessageType": string(logType)})
+	}
+	// Running out of time isn't a parse error
+	parseErrors := 0
+	if multiErr, isMultiErr := extractionErr.(*multierror.Error); isMultiErr {
+		for _, err := range multiErr.Errors {
+			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				parseErrors++
+			}
+		}
+	}
+	metrics.Add("ParseErrors", UnitCount, float64(parseErrors))
+}
+
+// recordChunkMetrics records the bytes sent, latency, retries and responses of each chunk sent to
+// Firetail.
+func recordChunkMetrics(metrics *Metrics, chunkResults []*ChunkResult) {
+	bytesSent, retries, failedChunks := 0, 0, 0
+	responses := map[string]int{}
+	for _, chunkResult := range chunkResults {
+		if chunkResult.Err == nil {
+			bytesSent += len(chunkResult.Chunk.Payload)
+		} else {
+			failedChunks++
+		}
+		if chunkResult.Attempts > 1 {
+			retries += chunkResult.Attempts - 1
+		}
+		for _, statusCode := range chunkResult.StatusCodes {
+			responses[statusClass(statusCode)]++
+		}
+		if chunkResult.Attempts > 0 {
+			metrics.Add("SendLatency", UnitMilliseconds, float64(chunkResult.Duration.Milliseconds()))
+		}
+	}
+	metrics.Add("BytesSent", UnitBytes, float64(bytesSent))
+	metrics.Add("Retries", UnitCount, float64(retries))
+	metrics.Add("FailedChunks", UnitCount, float64(failedChunks))
+	for class, count := range responses {
+		metrics.AddWithDimensions("Responses", UnitCount, float64(count), map[string]string{"StatusClass": class})
+	}
 }
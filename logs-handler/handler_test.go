@@ -1,26 +1,31 @@
-package main
+package logshandler
 
 import (
 	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestHandler(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
 	testData := "H4sIAAAAAAAAAO1ae3PbNhL/Kjj9lXRECS8SpDKcjuM4ridx01Zum6uUyUAkJNHmQwVBO7bH3/0WFCVbku3Kj2smvbM9EogFFovfPgHzspWpspQTdXQ+U61e683O0c7nw71+f2d/r9VuFWe50tDNXeYJQgnm3IXutJjs66KaAaUrz8qunM3K8zyC76TsptH5l/NTqqt8MhWTeGrEeaqruDw+n8/sG61kBlOxwMwdK48LaHiuT+KxckfCi9WIc8ZGeMRlFMR8FKuIR5SNY6UkAaIngoDHGNiV1aiMdDIzSZG/TVKjdNnqDVrjRCsjk9RpBHNSmY1i6cTq1HlfTMo3spxOZR6nStvH/gaX3bSo4t+liaZAJ86ZSw05xvLs4req9anexd6pyo1d7LKVxLAZJigTAWUcY8KIH/gupQwHxIMWdFMPU9+1zYBjV1AqfOHDWLsJk4AOjMwATuLBeOxR5mHstxe6sVip8dj1RthxIzl2uJC+Eyg/doQkgquAST8eoddqkuToF/VnBfxaV+1N0ajnCkyDgLkYsGcuLOYTnwji+ZT6PsOCg/Tc8zweiDtFI/zBou1rOZv+/B79XCl93kNZZaRFGx2eHy6al8McoQhsw6ifitK8SPJZZXro0iQmVT00bO2gIxAGWeKwdfVyPgGhJLbfV8Mc/ob5n3YBYFsvNB8yUWbOMLZcpMsBfeE7YGuxw0c0cPyIeg5WnMuAEjmSZNha445QLUWzEEJpUtY8yxdpkiUgJcHXM4zKysXDNYOraynb6MNM6XrXvYWobfSb1IkcpaqEPV/dqj0BH8T3OAVV8MDzwIBcjj1BXRK4nHOPMWte1HVh+J3aY+4jDWvvi4qqWlUOsuEC/SgzUMwcafAm9DZRadz0NqA/eR/ulvu4HFqvtGINW71hq3GCQwgAST4ZttrD1kyaKdAGw1Yj2xBceQixAoS2MtfzliSgaFUW6anSOzqvaVLnPYh2vSao9FTlnMEaDundDI+9vwiCXQMylt0ate5iibK7unAt/EFcL7uNhuppUZEb9QVY9C6tsJMqsyFq/pjMeW1n/FfADPAuLVyX9qGozJ7WhbbMBp+uFqgd5HUvdI5lWiroVtejasQ1SLDUSb3lWtLJPBrs/HTQ7PFuuOrxRsu8HBc6U/GRymYphIh62uXQOtVwOGxZDMEybbNXd1BMhIOpQ3371F4OLBaedz10X5kD8NnVcSfqfD5ivsa8E1Bc9A1b/bptP7ZCdVjjWgcB+3UFj092Du8rO/kyDD55J3cnm8e7+VK62xz9BvHvdvX1pZ/d2eucBE2C/8c8uR/JfHXQuC7n5iNQXqUpuqbNYapJBF935wDrUXGiGr520n0OSzEV3LN2TnxOBfWpRz1GmB8QIjwfu4RB3eULQgLm3e2wAbvXzMtZkZfq/+nssekMJKtS84jJ1mbr0s9OWa1AvxnfSuJwm82250VueGOXz2L0d8f2VaPfKkvtLVPQMlPdKiAh9hDjczjH+Cxw4Ujm04DCUcfncA7zOAf5GQETJ5jRuwUUj/bK/2cfvOF49mRk0XlOJ7zmhWMplcdAcE+OHKteB+TljqIR86QYY6xGG7z6CvYSr7C06iohk+Qq3i2q3ApPvyFntyCHg6c4fRvZ2dvAeT17HUdAES0zaVgnUXQT1JDCs5HaqHjH1PQ7Y81DXJlt6cpfLdbcfS7fiDVx1dQ3rZ5HIaxC5dxejUBLsfpVlsnGkh7p0rUyjpImQEGApw4hDsNHhPQw67leB0pxQr0/6tEqj+8fGwiG6R9NTISKzsZHGwPqZT6Mx6WyfuVCriDtla3ygLie9adFIQgg2SeZJvFizAYfwqgI8CojwYQrrh7qWk83wbtvLB5hgvND2ZGWESD4ZNHuKT/vMT7Xp76HfbJmfI1QjytG19Tnupzxb7BGvTOca2UqnS8Jy3X+Zlu8p/S6R+FcCPEwZbfnSXhT57Z3Q92ubyV02bPhfkONK7AfvPnX10DdfxTqlHjr8f2vUW9KmU3gG8Jt2AtOXPxfx75vNIj+VfAPHpdjIQrBIcbdSgcPqO7X8IdTEWXfZNH/kGC3W0ClF82R/dsNgN/9X7V78xzx/Icqv7081dwS++aEDROAYg5TTsSzuuAa4GsqGdghn76GKsjjYiFn28XCW1XRxg/LR6AQCnuh/9B8xB9wv3FDB8QTT3CHNnmwDhicBYJ/qg6e/WD6TGcC/oAD6S3/eXmGg+dDbz5AUFOVu0VsBaHY+rq9/cgjIPf8ANc/T1fYsx7jGrTQD0rGkI976LK+QcuNk6p8YqbhgOHgUxtpNVZa6XAwNWZW9rrdZRXQgQmQzVUHaoSOzORFkUNX1oVJkX1ZZayBoXOaqDOlncjesOjzcPDje6CXKnLGykRTpwTnDAeRLsqybgPxiyOzi9xpdJfE4WCbDcHEQidwNN1e0sVaTlWChIBdbsLBzu99Z3c+3NmZzfr2JaJ64LjQZ1LHKnZmhYaBnDPoP01kOKAdjKQ/8nw4QiiiqCtcwtk4EIL74/FoRAOJO9eYdHJl0Iv6hZ639vllgwjAUUknK0ZJCph8j28FUpawQ0KYt0pNSidW5YkpZs3AcGB0ZeGcQtQBhN34gqliZI4jJWZcwSrspEhOZ7KzeCMJ6rjONWRzmCxgc6QW1mGruXAAc9IkquNy97gs8hWdZuAIsGKhy3XgdGGKRj9AklGkZmBvMp9UgH44ULmz/7oNn7/2X/0Z4k4A7brhrzGCVjgQokME69AA/tqIuB3i+h2OoXPJe1PQNrK3xN1ZKhNof9f9bgPGEqKHMadLGOtb05saCiHB7BfFJFVod6oLm0JenYbDFsECogEaturepMrW+38sTLjz/Wst87ghUW6z0cLiDcRP5ViD/6WAocTxmC+YH4wcwWLw85HgsRsHYyi9PSGk9OWG8Ma+rmM2ZP9ileucKPC/7+AnmySxTlaszl7X2rtbu7lMRh/6tWA3mP+VFiHaFTFE/3AwuUhmbRSrsY2BbTTSSz+LxvXupqf8Y5p93DkxR95v7gU9m73bOzu+iPRH/W7n6Dh+Y/59nJrZ++hg//MPb7LXUfzlon8WhsDnpqceFhdJmsquC9734tCmHlOU01foAAw1RdCBPvTRR0TwZ+J+Fi8ReHOqflejd4npukx0mIdevPvh6PB9G6XJiUL7KjopXjY67YLWOtj+or4cS500UzYQn7vrrdYy9wZwSxBWZTNz/unpOWDb+7Itc8D830U3ksBu4+Y2q4brzvMKRVOpoToKfz166/hP3822l0Fb7aa+1y+RDd5VpuIeIk+Wb9trk61LpOWbkJ+u/gM4Pc+p6CoAAA=="
-	expectedPayload := "{\"executionSummary\":{\"duration\":62176672,\"logType\":\"ExecutionSummary\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"startTime\":\"2022-11-30T11:03:56.035126Z\",\"endTime\":\"2022-11-30T11:03:56.097302Z\",\"parsing\":{\"startOffset\":56801,\"duration\":49156},\"version\":1,\"validation\":{\"startOffset\":132790,\"duration\":73757},\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\"},\"query\":\"mutation MyMutation {\\n  createPost(input: {title: \\\"A Test Post\\\"}) {\\n    id\\n  }\\n}\\n\\nquery MyQuery {\\n  getPost(id: \\\"a5422778-e5bd-4b29-8c26-0e44a921aba1\\\") {\\n    id\\n    title\\n  }\\n  listPosts(limit: 10) {\\n    items {\\n      id\\n    }\\n  }\\n}\\n, Operation: MyQuery, Variables: {}\",\"request_id\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"requestHeaders\":{\"accept\":[\"application/json, text/plain, */*\"],\"accept-encoding\":[\"gzip, deflate, br\"],\"accept-language\":[\"en-GB,en-US;q=0.9,en;q=0.8\"],\"cloudfront-forwarded-proto\":[\"https\"],\"cloudfront-is-desktop-viewer\":[\"true\"],\"cloudfront-is-mobile-viewer\":[\"false\"],\"cloudfront-is-smarttv-viewer\":[\"false\"],\"cloudfront-is-tablet-viewer\":[\"false\"],\"cloudfront-viewer-asn\":[\"1136\"],\"cloudfront-viewer-country\":[\"NL\"],\"content-length\":[\"309\"],\"content-type\":[\"application/json\"],\"host\":[\"c5dz3eobtjce7p4emob3koivpa.appsync-api.eu-west-1.amazonaws.com\"],\"origin\":[\"https://eu-west-1.console.aws.amazon.com\"],\"referer\":[\"https://eu-west-1.console.aws.amazon.com/\"],\"sec-ch-ua\":[\"\\\"Google Chrome\\\";v=\\\"107\\\", \\\"Chromium\\\";v=\\\"107\\\", \\\"Not=A?Brand\\\";v=\\\"24\\\"\"],\"sec-ch-ua-mobile\":[\"?0\"],\"sec-ch-ua-platform\":[\"\\\"macOS\\\"\"],\"sec-fetch-dest\":[\"empty\"],\"sec-fetch-mode\":[\"cors\"],\"sec-fetch-site\":[\"cross-site\"],\"user-agent\":[\"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36\"],\"via\":[\"2.0 a8b68315e1e2575143f97748ffbb29a0.cloudfront.net (CloudFront)\"],\"x-amz-cf-id\":[\"hv4XlmXAktT6V5z2wpKEwjzcrXrKATjdDtYjltpLcIG_HDmBcdxzSw==\"],\"x-amz-user-agent\":[\"AWS-Console-AppSync/\"],\"x-amzn-requestid\":[\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\"],\"x-amzn-trace-id\":[\"Root=1-6387389b-73d623b74d5d9f671677aa8a\"],\"x-api-key\":[\"****mgidri\"],\"x-forwarded-for\":[\"77.173.29.29, 15.158.40.17\"],\"x-forwarded-port\":[\"443\"],\"x-forwarded-proto\":[\"https\"]},\"requestMappings\":[{\"logType\":\"RequestMapping\",\"path\":[\"getPost\"],\"fieldName\":\"getPost\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/getPost\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\"},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{\\n  \\\"version\\\": \\\"2017-02-28\\\",\\n  \\\"operation\\\": \\\"GetItem\\\",\\n  \\\"key\\\": {\\n    \\\"id\\\": {\\\"S\\\":\\\"a5422778-e5bd-4b29-8c26-0e44a921aba1\\\"},\\n  },\\n}\"},{\"logType\":\"RequestMapping\",\"path\":[\"listPosts\"],\"fieldName\":\"listPosts\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/listPosts\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"limit\":10},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{\\n  \\\"version\\\": \\\"2017-02-28\\\",\\n  \\\"operation\\\": \\\"Scan\\\",\\n  \\\"filter\\\":  null ,\\n  \\\"limit\\\": 10,\\n  \\\"nextToken\\\": null,\\n}\"}],\"requestSummary\":{\"logType\":\"RequestSummary\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"statusCode\":200,\"latency\":89000000},\"responseHeaders\":{\"Content-Type\":\"application/json; charset=UTF-8\"},\"responseMappings\":[{\"logType\":\"ResponseMapping\",\"path\":[\"getPost\"],\"fieldName\":\"getPost\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/getPost\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\"},\"result\":{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\",\"title\":\"A Test Post\"},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{id=a5422778-e5bd-4b29-8c26-0e44a921aba1, title=A Test Post}\"},{\"logType\":\"ResponseMapping\",\"path\":[\"listPosts\"],\"fieldName\":\"listPosts\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/listPosts\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"limit\":10},\"result\":{\"items\":[{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\",\"title\":\"A Test Post\"},{\"id\":\"0daae63f-46ab-4631-8db4-e2c36a7f00eb\",\"title\":\"A Second Test Post\"}],\"scannedCount\":2},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{items=[{id=a5422778-e5bd-4b29-8c26-0e44a921aba1, title=A Test Post}, {id=0daae63f-46ab-4631-8db4-e2c36a7f00eb, title=A Second Test Post}], nextToken=null, scannedCount=2, startedAt=null}\"}]}\n"
+	expectedPayload := "{\"beginRequestTimestamp\":1669806236008,\"endRequestTimestamp\":1669806236097,\"executionSummary\":{\"duration\":62176672,\"logType\":\"ExecutionSummary\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"startTime\":\"2022-11-30T11:03:56.035126Z\",\"endTime\":\"2022-11-30T11:03:56.097302Z\",\"parsing\":{\"startOffset\":56801,\"duration\":49156},\"version\":1,\"validation\":{\"startOffset\":132790,\"duration\":73757},\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\"},\"graphQL\":{\"operationType\":\"query\",\"rootFields\":[\"getPost\",\"listPosts\"],\"inlineFragments\":0,\"aliasCount\":0,\"maxDepth\":3,\"complexity\":6},\"metadata\":{\"accountId\":\"453671210445\",\"region\":\"eu-west-1\",\"apiId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"logGroup\":\"/aws/appsync/apis/lcyxyv2rungh7gdht7ylrudsjy\",\"logStream\":\"07035fe6477036581dfe5b76deb4433b0b4ac9d4bdec4c23fdeea1eb467994d0\",\"subscriptionFilter\":\"firetail-appsync-lambda-dev-LogsDashhandlerLogsSubscriptionFilterCloudWatchLog1-w52t1j0awzVu\",\"forwarderVersion\":\"dev\"},\"operationName\":\"MyQuery\",\"query\":\"mutation MyMutation {\\n  createPost(input: {title: \\\"A Test Post\\\"}) {\\n    id\\n  }\\n}\\n\\nquery MyQuery {\\n  getPost(id: \\\"a5422778-e5bd-4b29-8c26-0e44a921aba1\\\") {\\n    id\\n    title\\n  }\\n  listPosts(limit: 10) {\\n    items {\\n      id\\n    }\\n  }\\n}\\n\",\"request_id\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"requestHeaders\":{\"accept\":[\"application/json\",\"text/plain\",\"*/*\"],\"accept-encoding\":[\"gzip\",\"deflate\",\"br\"],\"accept-language\":[\"en-GB,en-US;q=0.9,en;q=0.8\"],\"cloudfront-forwarded-proto\":[\"https\"],\"cloudfront-is-desktop-viewer\":[\"true\"],\"cloudfront-is-mobile-viewer\":[\"false\"],\"cloudfront-is-smarttv-viewer\":[\"false\"],\"cloudfront-is-tablet-viewer\":[\"false\"],\"cloudfront-viewer-asn\":[\"1136\"],\"cloudfront-viewer-country\":[\"NL\"],\"content-length\":[\"309\"],\"content-type\":[\"application/json\"],\"host\":[\"c5dz3eobtjce7p4emob3koivpa.appsync-api.eu-west-1.amazonaws.com\"],\"origin\":[\"https://eu-west-1.console.aws.amazon.com\"],\"referer\":[\"https://eu-west-1.console.aws.amazon.com/\"],\"sec-ch-ua\":[\"\\\"Google Chrome\\\";v=\\\"107\\\"\",\"\\\"Chromium\\\";v=\\\"107\\\"\",\"\\\"Not=A?Brand\\\";v=\\\"24\\\"\"],\"sec-ch-ua-mobile\":[\"?0\"],\"sec-ch-ua-platform\":[\"\\\"macOS\\\"\"],\"sec-fetch-dest\":[\"empty\"],\"sec-fetch-mode\":[\"cors\"],\"sec-fetch-site\":[\"cross-site\"],\"user-agent\":[\"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36\"],\"via\":[\"2.0 a8b68315e1e2575143f97748ffbb29a0.cloudfront.net (CloudFront)\"],\"x-amz-cf-id\":[\"hv4XlmXAktT6V5z2wpKEwjzcrXrKATjdDtYjltpLcIG_HDmBcdxzSw==\"],\"x-amz-user-agent\":[\"AWS-Console-AppSync/\"],\"x-amzn-requestid\":[\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\"],\"x-amzn-trace-id\":[\"Root=1-6387389b-73d623b74d5d9f671677aa8a\"],\"x-api-key\":[\"****mgidri\"],\"x-forwarded-for\":[\"77.173.29.29\",\"15.158.40.17\"],\"x-forwarded-port\":[\"443\"],\"x-forwarded-proto\":[\"https\"]},\"requestMappings\":[{\"logType\":\"RequestMapping\",\"path\":[\"getPost\"],\"fieldName\":\"getPost\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/getPost\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\"},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{\\n  \\\"version\\\": \\\"2017-02-28\\\",\\n  \\\"operation\\\": \\\"GetItem\\\",\\n  \\\"key\\\": {\\n    \\\"id\\\": {\\\"S\\\":\\\"a5422778-e5bd-4b29-8c26-0e44a921aba1\\\"},\\n  },\\n}\"},{\"logType\":\"RequestMapping\",\"path\":[\"listPosts\"],\"fieldName\":\"listPosts\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/listPosts\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"limit\":10},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{\\n  \\\"version\\\": \\\"2017-02-28\\\",\\n  \\\"operation\\\": \\\"Scan\\\",\\n  \\\"filter\\\":  null ,\\n  \\\"limit\\\": 10,\\n  \\\"nextToken\\\": null,\\n}\"}],\"requestSummary\":{\"logType\":\"RequestSummary\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"statusCode\":200,\"latency\":89000000},\"responseHeaders\":{\"Content-Type\":\"application/json; charset=UTF-8\"},\"responseMappings\":[{\"logType\":\"ResponseMapping\",\"path\":[\"getPost\"],\"fieldName\":\"getPost\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/getPost\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\"},\"result\":{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\",\"title\":\"A Test Post\"},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{id=a5422778-e5bd-4b29-8c26-0e44a921aba1, title=A Test Post}\"},{\"logType\":\"ResponseMapping\",\"path\":[\"listPosts\"],\"fieldName\":\"listPosts\",\"resolverArn\":\"arn:aws:appsync:eu-west-1:453671210445:apis/lcyxyv2rungh7gdht7ylrudsjy/types/Query/resolvers/listPosts\",\"requestId\":\"0eff56b0-5caf-47a8-9e8d-7a174e93a8db\",\"context\":{\"arguments\":{\"limit\":10},\"result\":{\"items\":[{\"id\":\"a5422778-e5bd-4b29-8c26-0e44a921aba1\",\"title\":\"A Test Post\"},{\"id\":\"0daae63f-46ab-4631-8db4-e2c36a7f00eb\",\"title\":\"A Second Test Post\"}],\"scannedCount\":2},\"stash\":{},\"outErrors\":[]},\"fieldInError\":false,\"errors\":[],\"parentType\":\"Query\",\"graphQLAPIId\":\"lcyxyv2rungh7gdht7ylrudsjy\",\"transformedTemplate\":\"{items=[{id=a5422778-e5bd-4b29-8c26-0e44a921aba1, title=A Test Post}, {id=0daae63f-46ab-4631-8db4-e2c36a7f00eb, title=A Second Test Post}], nextToken=null, scannedCount=2, startedAt=null}\"}],\"tokensConsumed\":1,\"variables\":{}}\n"
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -128,6 +133,554 @@ func TestHandlerWithMalformedData(t *testing.T) {
 	})
 	require.Nil(t, err)
 
-	assert.Contains(t, string(logOutput.Bytes()), "Errs extracting Firetail logs: 1 error occurred:\n\t* err adding event message to firetail log: multivalue header had !=2 subparts when split by first '=[': TEST_HEADER=TEST_VALUE")
+	assert.Contains(t, string(logOutput.Bytes()), `"error":"1 error occurred:\n\t* err adding event message to firetail log: expected '[' at offset 12 of headers string: TEST_HEADER=TEST_VALUE\n\n","level":"warn","msg":"Errs extracting Firetail logs"`)
 	assert.Contains(t, string(logOutput.Bytes()), "Generated no Firetail logs from this batch. Exiting...")
 }
+
+// encodeTestLogsData gzips and base64 encodes logsData in the same way as Cloudwatch
+func encodeTestLogsData(t *testing.T, logsData string) string {
+	var gzipBytes bytes.Buffer
+	gzipper := gzip.NewWriter(&gzipBytes)
+	_, err := gzipper.Write([]byte(logsData))
+	require.Nil(t, err)
+	err = gzipper.Close()
+	require.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(gzipBytes.Bytes())
+}
+
+func TestHandlerSendsFailedChunksToDeadLetterSink(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	sink := &memoryDeadLetterSink{}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logEvents": [{
+					"id": "TEST_ID",
+					"message": "TEST_ID GraphQL Query: TEST_QUERY"
+				}]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, "got 200 response from firetail api: fail", sink.deadLetters[0].Error)
+	assert.Equal(t, testServer.URL, sink.deadLetters[0].ApiUrl)
+	assert.Equal(t, []string{"TEST_ID"}, sink.deadLetters[0].RequestIDs)
+	assert.Equal(t, "{\"metadata\":{\"region\":\"eu-west-1\",\"forwarderVersion\":\"dev\"},\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID\"}\n", sink.deadLetters[0].Payload)
+}
+
+func TestHandlerDeadLetterSinkFails(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	deadLetterSink = &memoryDeadLetterSink{putErr: errors.New("TEST_PUT_ERR")}
+	defer func() { deadLetterSink = nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logEvents": [{
+					"id": "TEST_ID",
+					"message": "TEST_ID GraphQL Query: TEST_QUERY"
+				}]
+			}`),
+		},
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* err sending chunk 1 of 1 to firetail and to dead letter sink (TEST_PUT_ERR): got 200 response from firetail api: fail\n\n", err.Error())
+}
+
+func TestHandlerCorrelatesRequestsAcrossInvocations(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(bodyBytes))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() { requestStateStore = nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logEvents": [
+					{"id": "1", "timestamp": 1000, "message": "TEST_ID Begin Request"},
+					{"id": "2", "timestamp": 1001, "message": "TEST_ID GraphQL Query: TEST_QUERY"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.Len(t, requestBodies, 0)
+
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logEvents": [
+					{"id": "3", "timestamp": 1088, "message": "TEST_ID Tokens Consumed: 1"},
+					{"id": "4", "timestamp": 1089, "message": "TEST_ID End Request"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"{\"beginRequestTimestamp\":1000,\"endRequestTimestamp\":1089,\"metadata\":{\"region\":\"eu-west-1\",\"forwarderVersion\":\"dev\"},\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID\",\"tokensConsumed\":1}\n",
+	}, requestBodies)
+}
+
+func TestHandlerRedactsLogs(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	var requestBody string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBody = string(bodyBytes)
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	policy, err := parseRedactionPolicy(`{"headerDenylist":["authorization"],"fieldPaths":["$.context.arguments.password"]}`)
+	require.Nil(t, err)
+	redactionPolicy = policy
+	defer func() { redactionPolicy = nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logEvents": [
+					{"id": "1", "message": "TEST_ID Request Headers: {authorization=[Bearer TEST_TOKEN], host=[example.com]}"},
+					{"id": "2", "message": "{\"logType\":\"RequestMapping\",\"requestId\":\"TEST_ID\",\"context\":{\"arguments\":{\"password\":\"TEST_PASSWORD\"}}}"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "{\"metadata\":{\"region\":\"eu-west-1\",\"forwarderVersion\":\"dev\"},\"request_id\":\"TEST_ID\",\"requestHeaders\":{\"authorization\":[\"[REDACTED]\"],\"host\":[\"example.com\"]},\"requestMappings\":[{\"context\":{\"arguments\":{\"password\":\"[REDACTED]\"}},\"logType\":\"RequestMapping\",\"requestId\":\"TEST_ID\"}]}\n", requestBody)
+}
+
+func TestHandlerOnlyLogsPayloadsAtDebugLevel(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+	defer func() { logger.Level = LevelInfo }()
+
+	for _, level := range []LogLevel{LevelInfo, LevelDebug} {
+		var logOutput bytes.Buffer
+		log.SetOutput(&logOutput)
+		logger.Level = level
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := Handler(lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "TEST_AWS_REQUEST_ID"}), events.CloudwatchLogsEvent{
+			AWSLogs: events.CloudwatchLogsRawData{
+				Data: encodeTestLogsData(t, `{
+					"logEvents": [{
+						"id": "TEST_ID",
+						"message": "TEST_ID GraphQL Query: TEST_QUERY"
+					}]
+				}`),
+			},
+		})
+		require.Nil(t, err)
+
+		assert.Contains(t, logOutput.String(), `"awsRequestId":"TEST_AWS_REQUEST_ID"`)
+		assert.Contains(t, logOutput.String(), `"failedBytes":0,"failedChunks":0,"firetailLogs":1,"level":"info","logEvents":1,"msg":"Sent Firetail logs","sentBytes":105,"sentChunks":1`)
+		if level == LevelDebug {
+			assert.Contains(t, logOutput.String(), `"firetailLog":{"metadata":{"region":"eu-west-1","forwarderVersion":"dev"},"query":"TEST_QUERY","request_id":"TEST_ID"},"level":"debug","msg":"Generated Firetail log","requestId":"TEST_ID"`)
+		} else {
+			assert.NotContains(t, logOutput.String(), "TEST_QUERY")
+		}
+	}
+}
+
+func TestHandlerWritesMetrics(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	metricsNamespace = "TEST_NAMESPACE"
+	defer func() { metricsNamespace = "" }()
+	retryPolicy = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/TEST_API_ID",
+				"logEvents": [
+					{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"},
+					{"id": "2", "message": "TEST_ID Begin Tracing"},
+					{"id": "3", "message": "TEST_ID End Tracing"},
+					{"id": "4", "message": "TEST_ID Tokens Consumed: NaN"},
+					{"id": "5", "message": "{\"logType\":\"Unheard\",\"requestId\":\"TEST_ID\"}"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+
+	assert.Contains(t, logOutput.String(), `"ApiId":"TEST_API_ID"`)
+	assert.NotContains(t, logOutput.String(), `"LogGroup"`)
+	metrics := parseTestMetrics(t, logOutput.String(), "ApiId")
+	assert.Equal(t, float64(5), metrics["LogEvents"])
+	assert.Equal(t, float64(2), metrics["DroppedEvents/BeginTracing"].(float64)+metrics["DroppedEvents/EndTracing"].(float64))
+	assert.Equal(t, float64(1), metrics["DroppedEvents/Unheard"])
+	assert.Equal(t, float64(1), metrics["ParseErrors"])
+	assert.Equal(t, float64(1), metrics["FiretailLogs"])
+	assert.Equal(t, float64(170), metrics["BytesSent"])
+	assert.Equal(t, float64(1), metrics["Retries"])
+	assert.Equal(t, float64(0), metrics["FailedChunks"])
+	assert.Equal(t, float64(1), metrics["Responses/5xx"])
+	assert.Equal(t, float64(1), metrics["Responses/2xx"])
+	assert.Contains(t, metrics, "SendLatency")
+}
+
+func TestHandlerMetricsLogGroupDimension(t *testing.T) {
+	metricsNamespace = "TEST_NAMESPACE"
+	metricsLogGroupDimension = true
+	defer func() {
+		metricsNamespace = ""
+		metricsLogGroupDimension = false
+	}()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/TEST_API_ID",
+				"logEvents": [{"id": "1", "message": "TEST_ID Begin Request"}]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.Contains(t, logOutput.String(), `"LogGroup":"/aws/appsync/apis/TEST_API_ID"`)
+	assert.Contains(t, logOutput.String(), `"Dimensions":[["ApiId"],["ApiId","LogGroup"]]`)
+}
+
+func TestHandlerMetricsDisabled(t *testing.T) {
+	// Metrics are disabled unless a namespace is configured
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID Begin Request"}]}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.NotContains(t, logOutput.String(), `"_aws"`)
+}
+
+func TestHandlerDeadlineApproaching(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request's context is only done when the client gives up once its body has been read
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer testServer.Close()
+	firetailApiUrl = testServer.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]}`),
+		},
+	})
+	require.NotNil(t, err)
+
+	// The handler should give up before the Lambda's own deadline
+	assert.Nil(t, ctx.Err())
+	var partialFailureErr *PartialFailureError
+	require.ErrorAs(t, err, &partialFailureErr)
+	assert.Equal(t, 1, partialFailureErr.ProcessedEvents)
+	assert.Equal(t, 0, partialFailureErr.SentChunks)
+	assert.Equal(t, 1, partialFailureErr.TotalChunks)
+	assert.Contains(t, err.Error(), "lambda deadline approaching: processed 1 of 1 log events and sent 0 of 1 chunks to firetail: 1 error occurred:")
+}
+
+func TestHandlerDeadlineApproachingDeadLetters(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request's context is only done when the client gives up once its body has been read
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer testServer.Close()
+	firetailApiUrl = testServer.URL
+
+	sink := &memoryDeadLetterSink{}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{"logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]}`),
+		},
+	})
+
+	// Every event was processed and the chunk which couldn't be sent was stored, so nothing was lost
+	require.Nil(t, err)
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, []string{"TEST_ID"}, sink.deadLetters[0].RequestIDs)
+}
+
+func TestHandlerKeepsMetadataOfExpiredLogs(t *testing.T) {
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(bodyBytes))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() { requestStateStore = nil }()
+	requestStateTTL = 50 * time.Millisecond
+	defer func() { requestStateTTL = DefaultRequestStateTTL }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/FIRST_API_ID",
+				"logStream": "FIRST_LOG_STREAM",
+				"logEvents": [{"id": "1", "timestamp": 1000, "message": "TEST_ID_1 GraphQL Query: TEST_QUERY"}]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.Len(t, requestBodies, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/SECOND_API_ID",
+				"logStream": "SECOND_LOG_STREAM",
+				"logEvents": [
+					{"id": "2", "timestamp": 2000, "message": "TEST_ID_2 Begin Request"},
+					{"id": "3", "timestamp": 2001, "message": "TEST_ID_2 GraphQL Query: TEST_QUERY"},
+					{"id": "4", "timestamp": 2002, "message": "TEST_ID_2 End Request"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+
+	require.Len(t, requestBodies, 1)
+	logMetadata := map[string]*FiretailLogMetadata{}
+	for _, line := range strings.Split(strings.TrimSpace(requestBodies[0]), "\n") {
+		var firetailLog FiretailLog
+		require.Nil(t, json.Unmarshal([]byte(line), &firetailLog))
+		logMetadata[firetailLog.RequestID] = firetailLog.Metadata
+	}
+	require.Contains(t, logMetadata, "TEST_ID_1")
+	assert.Equal(t, "/aws/appsync/apis/FIRST_API_ID", logMetadata["TEST_ID_1"].LogGroup)
+	assert.Equal(t, "FIRST_LOG_STREAM", logMetadata["TEST_ID_1"].LogStream)
+	assert.Equal(t, "FIRST_API_ID", logMetadata["TEST_ID_1"].ApiID)
+	require.Contains(t, logMetadata, "TEST_ID_2")
+	assert.Equal(t, "/aws/appsync/apis/SECOND_API_ID", logMetadata["TEST_ID_2"].LogGroup)
+}
+
+func TestHandlerRoutesLogs(t *testing.T) {
+	apiKeys := map[string]string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		apiKeys[r.URL.Path] = r.Header.Get("x-ft-api-key")
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	table, err := parseRoutingTable([]byte(`{"routes": [{
+		"name": "orders",
+		"logGroups": ["/aws/appsync/apis/ORDERS_API_ID"],
+		"apiUrl": "`+testServer.URL+`/orders",
+		"apiToken": "ORDERS_TOKEN"
+	}]}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+	routingTable = table
+	defer func() { routingTable = nil }()
+
+	sink := &memoryDeadLetterSink{}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/ORDERS_API_ID",
+				"logEvents": [{
+					"id": "TEST_ID",
+					"message": "TEST_ID GraphQL Query: TEST_QUERY"
+				}]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string]string{"/orders": "ORDERS_TOKEN"}, apiKeys)
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, "orders", sink.deadLetters[0].Route)
+	assert.Equal(t, testServer.URL+"/orders", sink.deadLetters[0].ApiUrl)
+}
+
+func TestHandlerRoutesExpiredLogsByTheirOwnLogGroup(t *testing.T) {
+	requestIDs := map[string][]string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(bodyBytes)), "\n") {
+			var firetailLog FiretailLog
+			require.Nil(t, json.Unmarshal([]byte(line), &firetailLog))
+			requestIDs[r.URL.Path] = append(requestIDs[r.URL.Path], firetailLog.RequestID)
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	table, err := parseRoutingTable([]byte(`{"routes": [{
+		"name": "first",
+		"logGroups": ["/aws/appsync/apis/FIRST_API_ID"],
+		"apiUrl": "`+testServer.URL+`/first",
+		"apiToken": "FIRST_TOKEN"
+	}, {
+		"name": "second",
+		"logGroups": ["/aws/appsync/apis/SECOND_API_ID"],
+		"apiUrl": "`+testServer.URL+`/second",
+		"apiToken": "SECOND_TOKEN"
+	}]}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+	routingTable = table
+	defer func() { routingTable = nil }()
+
+	requestStateStore = NewMemoryRequestStateStore()
+	defer func() { requestStateStore = nil }()
+	requestStateTTL = 50 * time.Millisecond
+	defer func() { requestStateTTL = DefaultRequestStateTTL }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/FIRST_API_ID",
+				"logEvents": [{"id": "1", "timestamp": 1000, "message": "TEST_ID_1 GraphQL Query: TEST_QUERY"}]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+	assert.Len(t, requestIDs, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logGroup": "/aws/appsync/apis/SECOND_API_ID",
+				"logEvents": [
+					{"id": "2", "timestamp": 2000, "message": "TEST_ID_2 Begin Request"},
+					{"id": "3", "timestamp": 2001, "message": "TEST_ID_2 GraphQL Query: TEST_QUERY"},
+					{"id": "4", "timestamp": 2002, "message": "TEST_ID_2 End Request"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"/first":  {"TEST_ID_1"},
+		"/second": {"TEST_ID_2"},
+	}, requestIDs)
+}
+
+func TestHandlerFiltersLogs(t *testing.T) {
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(bodyBytes))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	policy, err := parseFilterPolicy(`{"rules":[{"name":"healthChecks","operationNames":["HealthCheck"],"action":"drop"}]}`)
+	require.Nil(t, err)
+	filterPolicy = policy
+	defer func() { filterPolicy = nil }()
+	metricsNamespace = "TEST_NAMESPACE"
+	defer func() { metricsNamespace = "" }()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = Handler(ctx, events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: encodeTestLogsData(t, `{
+				"logEvents": [
+					{"id": "1", "message": "TEST_ID_1 GraphQL Query: query HealthCheck { __typename }, Operation: HealthCheck, Variables: {}"},
+					{"id": "2", "message": "TEST_ID_2 GraphQL Query: query GetPost { getPost { id } }, Operation: GetPost, Variables: {}"}
+				]
+			}`),
+		},
+	})
+	require.Nil(t, err)
+
+	require.Len(t, requestBodies, 1)
+	assert.Contains(t, requestBodies[0], `"request_id":"TEST_ID_2"`)
+	assert.NotContains(t, requestBodies[0], "TEST_ID_1")
+	metrics := parseTestMetrics(t, logOutput.String(), "ApiId")
+	assert.Equal(t, float64(1), metrics["FilteredLogs/healthChecks"])
+	assert.Equal(t, float64(1), metrics["FiretailLogs"])
+}
@@ -0,0 +1,130 @@
+package logshandler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultHttpTimeout = 10 * time.Second
+
+// HttpClientConfig describes how to connect to the Firetail logging API. CABundle, ClientCert and
+// ClientKey may each either be PEM or the path to a PEM file. If ProxyUrl is empty, the proxy is
+// taken from the HTTPS_PROXY and HTTP_PROXY environment variables as usual.
+type HttpClientConfig struct {
+	CABundle      string
+	ClientCert    string
+	ClientKey     string
+	ProxyUrl      string
+	TLSMinVersion string
+	Timeout       time.Duration
+}
+
+var DefaultHttpClientConfig = HttpClientConfig{Timeout: DefaultHttpTimeout}
+
+// httpClient is used for every request to the Firetail logging API. It's shared across warm
+// invocations of the Lambda so that connections to the API are reused.
+var httpClient = mustNewHttpClient(DefaultHttpClientConfig)
+
+// NewHttpClient creates a HTTP client which keeps a pool of idle connections to the Firetail API.
+func NewHttpClient(config HttpClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 10
+	transport.IdleConnTimeout = 90 * time.Second
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSMinVersion != "" {
+		minVersion, err := parseTLSVersion(config.TLSMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = minVersion
+	}
+
+	if config.CABundle != "" {
+		caBundle, err := readPEM(config.CABundle)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err reading CA bundle")
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("CA bundle contained no certificates")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, errors.New("client cert and client key must both be set")
+		}
+		clientCert, err := readPEM(config.ClientCert)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err reading client cert")
+		}
+		clientKey, err := readPEM(config.ClientKey)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err reading client key")
+		}
+		keyPair, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err loading client cert and key")
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if config.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(config.ProxyUrl)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err parsing proxy URL")
+		}
+		if proxyUrl.Scheme == "" || proxyUrl.Host == "" {
+			return nil, fmt.Errorf("proxy URL must have a scheme and host: %s", config.ProxyUrl)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	return &http.Client{Transport: transport, Timeout: config.Timeout}, nil
+}
+
+func mustNewHttpClient(config HttpClientConfig) *http.Client {
+	client, err := NewHttpClient(config)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// parseTLSVersion parses a TLS version such as "1.2".
+func parseTLSVersion(value string) (uint16, error) {
+	switch value {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version: %s", value)
+	}
+}
+
+// readPEM returns value if it is PEM, or otherwise reads the file at the path value.
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
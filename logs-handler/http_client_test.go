@@ -0,0 +1,165 @@
+package logshandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestClientCert creates a self-signed client certificate and key, PEM encoded.
+func makeTestClientCert(t *testing.T) (certPEM, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "TEST_CLIENT"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}))
+}
+
+// testServerCABundle returns the certificate of a TLS test server, PEM encoded.
+func testServerCABundle(testServer *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testServer.Certificate().Raw}))
+}
+
+func TestNewHttpClientCABundle(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	// Without the test server's certificate, the request should fail
+	client, err := NewHttpClient(HttpClientConfig{})
+	require.Nil(t, err)
+	_, err = client.Get(testServer.URL)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+
+	// Inline
+	client, err = NewHttpClient(HttpClientConfig{CABundle: testServerCABundle(testServer)})
+	require.Nil(t, err)
+	resp, err := client.Get(testServer.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	// From a file
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caBundlePath, []byte(testServerCABundle(testServer)), 0600))
+	client, err = NewHttpClient(HttpClientConfig{CABundle: caBundlePath})
+	require.Nil(t, err)
+	resp, err = client.Get(testServer.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+}
+
+func TestNewHttpClientMTLS(t *testing.T) {
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Len(t, r.TLS.PeerCertificates, 1)
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	testServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	certPEM, keyPEM := makeTestClientCert(t)
+	client, err := NewHttpClient(HttpClientConfig{
+		CABundle:   testServerCABundle(testServer),
+		ClientCert: certPEM,
+		ClientKey:  keyPEM,
+	})
+	require.Nil(t, err)
+
+	resp, err := client.Get(testServer.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body := make([]byte, 64)
+	n, _ := resp.Body.Read(body)
+	assert.Equal(t, "TEST_CLIENT", string(body[:n]))
+}
+
+func TestNewHttpClientProxy(t *testing.T) {
+	var proxiedHost string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer proxyServer.Close()
+
+	client, err := NewHttpClient(HttpClientConfig{ProxyUrl: proxyServer.URL})
+	require.Nil(t, err)
+
+	resp, err := client.Get("http://firetail.example.com/logs")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "firetail.example.com", proxiedHost)
+}
+
+func TestNewHttpClientTLSMinVersion(t *testing.T) {
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	testServer.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	client, err := NewHttpClient(HttpClientConfig{CABundle: testServerCABundle(testServer), TLSMinVersion: "1.3"})
+	require.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), client.Transport.(*http.Transport).TLSClientConfig.MinVersion)
+
+	_, err = client.Get(testServer.URL)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "protocol version")
+}
+
+func TestNewHttpClientTimeout(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer testServer.Close()
+
+	client, err := NewHttpClient(HttpClientConfig{Timeout: 10 * time.Millisecond})
+	require.Nil(t, err)
+
+	_, err = client.Get(testServer.URL)
+	require.NotNil(t, err)
+	assert.True(t, isRetryableNetworkError(err))
+}
+
+func TestNewHttpClientErrs(t *testing.T) {
+	certPEM, _ := makeTestClientCert(t)
+	testCases := map[string]HttpClientConfig{
+		"unsupported TLS version: 1.4": {TLSMinVersion: "1.4"},
+		"err reading CA bundle: open /nonexistent/ca.pem: no such file or directory": {CABundle: "/nonexistent/ca.pem"},
+		"CA bundle contained no certificates":                                        {CABundle: "-----BEGIN NOTHING-----"},
+		"client cert and client key must both be set":                                {ClientCert: certPEM},
+		"err loading client cert and key: tls: failed to find any PEM data in key input": {
+			ClientCert: certPEM,
+			ClientKey:  "-----BEGIN NOTHING-----",
+		},
+		"proxy URL must have a scheme and host: proxy.example.com": {ProxyUrl: "proxy.example.com"},
+	}
+	for expectedErr, config := range testCases {
+		client, err := NewHttpClient(config)
+		require.NotNil(t, err, expectedErr)
+		assert.Equal(t, expectedErr, err.Error())
+		assert.Nil(t, client)
+	}
+}
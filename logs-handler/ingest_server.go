@@ -0,0 +1,370 @@
+package logshandler
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+const DefaultIngestServerAddr = ":8080"
+const DefaultIngestFlushInterval = 5 * time.Second
+const DefaultIngestMaxBufferedEvents int = 10000
+const DefaultIngestShutdownTimeout = 25 * time.Second
+
+// maxIngestBodyBytes is the largest request body the ingest endpoint accepts. Firehose delivers at most
+// 64MiB per request.
+const maxIngestBodyBytes = 64 * 1024 * 1024
+
+// firehoseRequestIdHeader is set on every request Firehose makes to an HTTP endpoint destination.
+const firehoseRequestIdHeader = "X-Amz-Firehose-Request-Id"
+
+// IngestServerConfig configures an IngestServer. Log events are buffered for up to FlushInterval, or
+// until MaxBufferedEvents are buffered. If AccessKey is set, requests must include it in the
+// X-Amz-Firehose-Access-Key header or as a bearer token. ShutdownTimeout bounds how long the server
+// takes to shut down, including its final flush.
+type IngestServerConfig struct {
+	Addr              string
+	FlushInterval     time.Duration
+	MaxBufferedEvents int
+	AccessKey         string
+	ShutdownTimeout   time.Duration
+}
+
+var DefaultIngestServerConfig = IngestServerConfig{
+	Addr:              DefaultIngestServerAddr,
+	FlushInterval:     DefaultIngestFlushInterval,
+	MaxBufferedEvents: DefaultIngestMaxBufferedEvents,
+	ShutdownTimeout:   DefaultIngestShutdownTimeout,
+}
+
+// IngestServer receives Cloudwatch logs over HTTP, for running outside of Lambda as a long-lived
+// service. Log events are buffered by log group and stream, and forwarded to Firetail through the same
+// pipeline as the Lambda every FlushInterval, or sooner once MaxBufferedEvents are buffered. Requests
+// are rejected with a 503 while twice MaxBufferedEvents are buffered, so that senders back off.
+type IngestServer struct {
+	Config IngestServerConfig
+
+	mu             sync.Mutex
+	buffer         map[ingestBufferKey]*events.CloudwatchLogsData
+	bufferedEvents int
+	shuttingDown   bool
+	flushNow       chan struct{}
+}
+
+type ingestBufferKey struct {
+	LogGroup  string
+	LogStream string
+}
+
+// firehoseDeliveryRequest is the body of a request made by Firehose to an HTTP endpoint destination.
+type firehoseDeliveryRequest struct {
+	RequestID string `json:"requestId"`
+	Timestamp int64  `json:"timestamp"`
+	Records   []struct {
+		Data []byte `json:"data"`
+	} `json:"records"`
+}
+
+// firehoseDeliveryResponse is the body Firehose expects in response to its requests.
+type firehoseDeliveryResponse struct {
+	RequestID    string `json:"requestId"`
+	Timestamp    int64  `json:"timestamp"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+func NewIngestServer(config IngestServerConfig) *IngestServer {
+	return &IngestServer{
+		Config:   config,
+		buffer:   map[ingestBufferKey]*events.CloudwatchLogsData{},
+		flushNow: make(chan struct{}, 1),
+	}
+}
+
+// Handler returns the server's HTTP endpoints:
+//   - POST /ingest accepts a Cloudwatch subscription event, as delivered to a Lambda, or a delivery
+//     from a Firehose HTTP endpoint destination whose records were written by a Cloudwatch subscription.
+//   - GET /healthz responds 200 while the server is running.
+//   - GET /readyz responds 200 until the server starts shutting down, and 503 after.
+func (s *IngestServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ingest", s.handleIngest)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		shuttingDown := s.shuttingDown
+		s.mu.Unlock()
+		if shuttingDown {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+func (s *IngestServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	firehoseRequestID := r.Header.Get(firehoseRequestIdHeader)
+	respond := func(statusCode int, errorMessage string) {
+		if firehoseRequestID == "" {
+			if errorMessage != "" {
+				http.Error(w, errorMessage, statusCode)
+			} else {
+				w.WriteHeader(statusCode)
+			}
+			return
+		}
+		// Firehose expects every response to be JSON echoing its request ID, and retries anything but a 200
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(firehoseDeliveryResponse{
+			RequestID:    firehoseRequestID,
+			Timestamp:    time.Now().UnixMilli(),
+			ErrorMessage: errorMessage,
+		})
+	}
+
+	if r.Method != http.MethodPost {
+		respond(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.authorised(r) {
+		respond(http.StatusUnauthorized, "unauthorised")
+		return
+	}
+	if s.full() {
+		respond(http.StatusServiceUnavailable, "buffer full")
+		return
+	}
+
+	body, err := readIngestBody(w, r)
+	if err != nil {
+		respond(http.StatusBadRequest, err.Error())
+		return
+	}
+	var batches []*events.CloudwatchLogsData
+	if firehoseRequestID != "" {
+		batches, err = decodeFirehoseDelivery(body)
+	} else {
+		batches, err = decodeSubscriptionEvent(body)
+	}
+	if err != nil {
+		respond(http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, logsData := range batches {
+		s.add(logsData)
+	}
+	if firehoseRequestID != "" {
+		respond(http.StatusOK, "")
+	} else {
+		respond(http.StatusAccepted, "")
+	}
+}
+
+// authorised returns true if the request has the server's access key, or if it has none.
+func (s *IngestServer) authorised(r *http.Request) bool {
+	if s.Config.AccessKey == "" {
+		return true
+	}
+	accessKey := r.Header.Get("X-Amz-Firehose-Access-Key")
+	if authorization := r.Header.Get("Authorization"); accessKey == "" && strings.HasPrefix(authorization, "Bearer ") {
+		accessKey = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(accessKey), []byte(s.Config.AccessKey)) == 1
+}
+
+// readIngestBody reads the request's body, decompressing it if it's gzipped.
+func readIngestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, maxIngestBodyBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err decompressing body")
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.WithMessage(err, "err reading body")
+	}
+	return body, nil
+}
+
+// decodeSubscriptionEvent decodes a CloudwatchLogsEvent, in the form a Cloudwatch subscription delivers
+// it to a Lambda.
+func decodeSubscriptionEvent(body []byte) ([]*events.CloudwatchLogsData, error) {
+	var event events.CloudwatchLogsEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling CloudwatchLogsEvent")
+	}
+	logsData, err := event.AWSLogs.Parse()
+	if err != nil {
+		return nil, errors.WithMessage(err, "err parsing CloudwatchLogsEvent")
+	}
+	if logsData.MessageType == cloudwatchControlMessageType {
+		return nil, nil
+	}
+	return []*events.CloudwatchLogsData{&logsData}, nil
+}
+
+// decodeFirehoseDelivery decodes the records of a delivery from Firehose, each of which holds a batch
+// of Cloudwatch logs. Records which can't be decoded are never going to succeed, so they're logged and
+// skipped rather than failing the whole delivery.
+func decodeFirehoseDelivery(body []byte) ([]*events.CloudwatchLogsData, error) {
+	var request firehoseDeliveryRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling Firehose delivery")
+	}
+	batches := []*events.CloudwatchLogsData{}
+	for i, record := range request.Records {
+		logsData, err := decodeSubscriptionRecord(record.Data)
+		if err != nil {
+			logger.Error("Err decoding Firehose record, skipping it", LogFields{
+				"firehoseRequestId": request.RequestID,
+				"record":            i,
+				"error":             err,
+			})
+			continue
+		}
+		if logsData.MessageType == cloudwatchControlMessageType {
+			continue
+		}
+		batches = append(batches, logsData)
+	}
+	return batches, nil
+}
+
+// add buffers the log events of logsData, and triggers a flush if there are now MaxBufferedEvents.
+func (s *IngestServer) add(logsData *events.CloudwatchLogsData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ingestBufferKey{LogGroup: logsData.LogGroup, LogStream: logsData.LogStream}
+	bufferedLogsData, exists := s.buffer[key]
+	if !exists {
+		bufferedLogsData = &events.CloudwatchLogsData{
+			Owner:               logsData.Owner,
+			LogGroup:            logsData.LogGroup,
+			LogStream:           logsData.LogStream,
+			SubscriptionFilters: logsData.SubscriptionFilters,
+			MessageType:         logsData.MessageType,
+		}
+		s.buffer[key] = bufferedLogsData
+	}
+	bufferedLogsData.LogEvents = append(bufferedLogsData.LogEvents, logsData.LogEvents...)
+	s.bufferedEvents += len(logsData.LogEvents)
+	if s.bufferedEvents >= s.Config.MaxBufferedEvents {
+		select {
+		case s.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// full returns true if twice MaxBufferedEvents are buffered, which means flushes can't keep up.
+func (s *IngestServer) full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bufferedEvents >= 2*s.Config.MaxBufferedEvents
+}
+
+// Flush forwards every buffered log event to Firetail. Chunks which fail to send are handled the same
+// as in the Lambda, so they're only lost if there's no dead letter sink or it fails too.
+func (s *IngestServer) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	buffer := s.buffer
+	s.buffer = map[ingestBufferKey]*events.CloudwatchLogsData{}
+	s.bufferedEvents = 0
+	s.mu.Unlock()
+
+	var errs error
+	for key, logsData := range buffer {
+		if err := handleLogsData(ctx, logsData); err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "err flushing logs of %s/%s", key.LogGroup, key.LogStream))
+		}
+	}
+	return errs
+}
+
+// Run flushes the buffer every FlushInterval, or when it fills up, until ctx is done. A flush which is in
+// progress when ctx is done is allowed to finish, so that its logs aren't lost, unless flushCtx is done
+// too.
+func (s *IngestServer) Run(ctx, flushCtx context.Context) {
+	ticker := time.NewTicker(s.Config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.flushNow:
+		}
+		if err := s.Flush(flushCtx); err != nil {
+			logger.Error("Err flushing buffered logs", LogFields{"error": err})
+		}
+	}
+}
+
+// ListenAndServe serves the server's endpoints on Addr until ctx is done. It then stops being ready,
+// waits for in-flight requests to finish, and flushes anything still buffered, taking no longer than
+// ShutdownTimeout in total.
+func (s *IngestServer) ListenAndServe(ctx context.Context) error {
+	httpServer := &http.Server{
+		Addr:              s.Config.Addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	flushCtx, cancelFlush := context.WithCancel(context.Background())
+	defer cancelFlush()
+	runDone := make(chan struct{})
+	go func() {
+		s.Run(runCtx, flushCtx)
+		close(runDone)
+	}()
+	logger.Info("Ingest server listening", LogFields{"addr": s.Config.Addr})
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+	}
+
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+	logger.Info("Ingest server shutting down", nil)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownTimeout)
+	defer cancel()
+	// A flush which is already in progress is bounded by the shutdown timeout too
+	go func() {
+		<-shutdownCtx.Done()
+		cancelFlush()
+	}()
+	if shutdownErr := httpServer.Shutdown(shutdownCtx); shutdownErr != nil {
+		err = multierror.Append(err, errors.WithMessage(shutdownErr, "err shutting down http server"))
+	}
+	stopRunning()
+	<-runDone
+	if flushErr := s.Flush(shutdownCtx); flushErr != nil {
+		err = multierror.Append(err, flushErr)
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package logshandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeTestIngestFiretailServer returns a test server which sends the body of every request made to it
+// down the returned channel, and configures it as the Firetail API.
+func makeTestIngestFiretailServer(t *testing.T) (*httptest.Server, chan string) {
+	requestBodies := make(chan string, 10)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies <- string(bodyBytes)
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+	return testServer, requestBodies
+}
+
+func makeTestSubscriptionEvent(t *testing.T, requestID string) string {
+	return fmt.Sprintf(`{"awslogs":{"data":%q}}`, encodeTestLogsData(t, fmt.Sprintf(`{
+		"messageType": "DATA_MESSAGE",
+		"logGroup": "/aws/appsync/apis/TEST_API_ID",
+		"logStream": "TEST_STREAM",
+		"logEvents": [{"id": "1", "message": "%s GraphQL Query: TEST_QUERY"}]
+	}`, requestID)))
+}
+
+func TestIngestServerHealth(t *testing.T) {
+	server := NewIngestServer(DefaultIngestServerConfig)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, path)
+		assert.Equal(t, "ok", recorder.Body.String(), path)
+	}
+
+	server.shuttingDown = true
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestIngestServerSubscriptionEvent(t *testing.T) {
+	testServer, requestBodies := makeTestIngestFiretailServer(t)
+	defer testServer.Close()
+	server := NewIngestServer(DefaultIngestServerConfig)
+
+	for _, requestID := range []string{"TEST_ID_1", "TEST_ID_2"} {
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(makeTestSubscriptionEvent(t, requestID))))
+		assert.Equal(t, http.StatusAccepted, recorder.Code)
+	}
+	assert.Equal(t, 2, server.bufferedEvents)
+	require.Len(t, server.buffer, 1)
+
+	require.Nil(t, server.Flush(context.Background()))
+	assert.Equal(t, 0, server.bufferedEvents)
+	assert.Len(t, server.buffer, 0)
+	require.Len(t, requestBodies, 1)
+	requestBody := <-requestBodies
+	assert.Contains(t, requestBody, `"request_id":"TEST_ID_1"`)
+	assert.Contains(t, requestBody, `"request_id":"TEST_ID_2"`)
+	assert.Contains(t, requestBody, `"logStream":"TEST_STREAM"`)
+}
+
+func TestIngestServerFirehoseDelivery(t *testing.T) {
+	testServer, requestBodies := makeTestIngestFiretailServer(t)
+	defer testServer.Close()
+	server := NewIngestServer(DefaultIngestServerConfig)
+
+	deliveryBytes, err := json.Marshal(firehoseDeliveryRequest{
+		RequestID: "TEST_FIREHOSE_REQUEST_ID",
+		Records: []struct {
+			Data []byte `json:"data"`
+		}{
+			{Data: gzipTestData(t, `{"logGroup": "TEST_LOG_GROUP", "logEvents": [{"id": "1", "message": "TEST_ID GraphQL Query: TEST_QUERY"}]}`)},
+			{Data: gzipTestData(t, `{"messageType": "CONTROL_MESSAGE", "logEvents": [{"id": "1", "message": "CWL CONTROL MESSAGE"}]}`)},
+			{Data: []byte("not json")},
+		},
+	})
+	require.Nil(t, err)
+	request := httptest.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(gzipTestData(t, string(deliveryBytes))))
+	request.Header.Set("X-Amz-Firehose-Request-Id", "TEST_FIREHOSE_REQUEST_ID")
+	request.Header.Set("Content-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var response firehoseDeliveryResponse
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "TEST_FIREHOSE_REQUEST_ID", response.RequestID)
+	assert.Equal(t, "", response.ErrorMessage)
+	assert.Equal(t, 1, server.bufferedEvents)
+
+	require.Nil(t, server.Flush(context.Background()))
+	require.Len(t, requestBodies, 1)
+	assert.Contains(t, <-requestBodies, `"request_id":"TEST_ID"`)
+}
+
+func TestIngestServerInvalidRequests(t *testing.T) {
+	server := NewIngestServer(DefaultIngestServerConfig)
+
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ingest", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader("not json")))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "err unmarshalling CloudwatchLogsEvent: invalid character 'o' in literal null (expecting 'u')\n", recorder.Body.String())
+
+	request := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader("not json"))
+	request.Header.Set("X-Amz-Firehose-Request-Id", "TEST_FIREHOSE_REQUEST_ID")
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	var response firehoseDeliveryResponse
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "TEST_FIREHOSE_REQUEST_ID", response.RequestID)
+	assert.Equal(t, "err unmarshalling Firehose delivery: invalid character 'o' in literal null (expecting 'u')", response.ErrorMessage)
+
+	assert.Equal(t, 0, server.bufferedEvents)
+}
+
+func TestIngestServerAccessKey(t *testing.T) {
+	config := DefaultIngestServerConfig
+	config.AccessKey = "TEST_ACCESS_KEY"
+	server := NewIngestServer(config)
+
+	for _, testCase := range []struct {
+		header       string
+		value        string
+		expectedCode int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"Authorization", "Bearer WRONG_ACCESS_KEY", http.StatusUnauthorized},
+		{"Authorization", "TEST_ACCESS_KEY", http.StatusUnauthorized},
+		{"Authorization", "Bearer TEST_ACCESS_KEY", http.StatusAccepted},
+		{"X-Amz-Firehose-Access-Key", "TEST_ACCESS_KEY", http.StatusAccepted},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(makeTestSubscriptionEvent(t, "TEST_ID")))
+		if testCase.header != "" {
+			request.Header.Set(testCase.header, testCase.value)
+		}
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, request)
+		assert.Equal(t, testCase.expectedCode, recorder.Code, testCase.value)
+	}
+}
+
+func TestIngestServerBufferFull(t *testing.T) {
+	config := DefaultIngestServerConfig
+	config.MaxBufferedEvents = 1
+	server := NewIngestServer(config)
+
+	for _, expectedCode := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusServiceUnavailable} {
+		recorder := httptest.NewRecorder()
+		server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(makeTestSubscriptionEvent(t, "TEST_ID"))))
+		assert.Equal(t, expectedCode, recorder.Code)
+	}
+	assert.Equal(t, 2, server.bufferedEvents)
+	// Reaching MaxBufferedEvents should have triggered a flush
+	assert.Len(t, server.flushNow, 1)
+}
+
+func TestIngestServerRunFlushesOnInterval(t *testing.T) {
+	testServer, requestBodies := makeTestIngestFiretailServer(t)
+	defer testServer.Close()
+	config := DefaultIngestServerConfig
+	config.FlushInterval = 10 * time.Millisecond
+	server := NewIngestServer(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx, context.Background())
+
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(makeTestSubscriptionEvent(t, "TEST_ID"))))
+	require.Equal(t, http.StatusAccepted, recorder.Code)
+
+	select {
+	case requestBody := <-requestBodies:
+		assert.Contains(t, requestBody, `"request_id":"TEST_ID"`)
+	case <-time.After(time.Second):
+		t.Fatal("buffered logs were not flushed")
+	}
+}
+
+func TestIngestServerListenAndServeFlushesOnShutdown(t *testing.T) {
+	testServer, requestBodies := makeTestIngestFiretailServer(t)
+	defer testServer.Close()
+	config := DefaultIngestServerConfig
+	config.Addr = "127.0.0.1:0"
+	config.FlushInterval = time.Hour
+	config.ShutdownTimeout = time.Second
+	server := NewIngestServer(config)
+
+	logsData, err := decodeSubscriptionEvent([]byte(makeTestSubscriptionEvent(t, "TEST_ID")))
+	require.Nil(t, err)
+	server.add(logsData[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- server.ListenAndServe(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-served:
+		require.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	assert.True(t, server.shuttingDown)
+	require.Len(t, requestBodies, 1)
+	assert.Contains(t, <-requestBodies, `"request_id":"TEST_ID"`)
+}
+
+func TestIngestServerListenAndServeBoundsInProgressFlush(t *testing.T) {
+	requestReceived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestReceived <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer testServer.Close()
+	defer close(release)
+	firetailApiUrl = testServer.URL
+	config := DefaultIngestServerConfig
+	config.Addr = "127.0.0.1:0"
+	config.FlushInterval = time.Hour
+	config.ShutdownTimeout = 100 * time.Millisecond
+	server := NewIngestServer(config)
+
+	logsData, err := decodeSubscriptionEvent([]byte(makeTestSubscriptionEvent(t, "TEST_ID")))
+	require.Nil(t, err)
+	server.add(logsData[0])
+	server.flushNow <- struct{}{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- server.ListenAndServe(ctx)
+	}()
+	select {
+	case <-requestReceived:
+	case <-time.After(time.Second):
+		t.Fatal("buffered logs were not flushed")
+	}
+	cancel()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("server did not shut down within its shutdown timeout")
+	}
+}
+
+func TestIngestServerListenAndServeInvalidAddr(t *testing.T) {
+	config := DefaultIngestServerConfig
+	config.Addr = "TEST_INVALID_ADDR"
+	err := NewIngestServer(config).ListenAndServe(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "listen tcp: address TEST_INVALID_ADDR: missing port in address", err.Error())
+}
@@ -0,0 +1,78 @@
+package logshandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+// cloudwatchControlMessageType is the messageType of the messages Cloudwatch sends to check that a
+// subscription's destination is reachable. They contain no logs.
+const cloudwatchControlMessageType = "CONTROL_MESSAGE"
+
+var gzipMagicBytes = []byte{0x1f, 0x8b}
+
+// KinesisHandler handles a batch of records from a Kinesis Data Stream which Cloudwatch log
+// subscriptions deliver to. Each record holds a gzipped batch of Cloudwatch logs, which are handled
+// the same as the logs of a CloudwatchLogsEvent. The response's BatchItemFailures is used to make
+// Lambda retry failed records, which requires the event source mapping to have
+// ReportBatchItemFailures enabled. Lambda retries from the lowest failed sequence number, so the
+// first record which fails stops the batch, and it and every record after it are reported, rather
+// than sending later records which would be sent again by the retry. Records which can't be decoded
+// are never going to succeed, so they're logged and skipped instead.
+func KinesisHandler(ctx context.Context, event events.KinesisEvent) (events.KinesisEventResponse, error) {
+	handlerLogger := invocationLogger(ctx)
+	response := events.KinesisEventResponse{BatchItemFailures: []events.KinesisBatchItemFailure{}}
+	for i, record := range event.Records {
+		recordLogger := handlerLogger.With(LogFields{
+			"eventId":        record.EventID,
+			"sequenceNumber": record.Kinesis.SequenceNumber,
+		})
+		logsData, err := decodeSubscriptionRecord(record.Kinesis.Data)
+		if err != nil {
+			recordLogger.Error("Err decoding Kinesis record, skipping it", LogFields{"error": err})
+			continue
+		}
+		if logsData.MessageType == cloudwatchControlMessageType {
+			continue
+		}
+		if err := handleLogsData(ctx, logsData); err != nil {
+			recordLogger.Error("Err handling Kinesis record, retrying it and the rest of the batch", LogFields{
+				"error":          err,
+				"remainingCount": len(event.Records) - i - 1,
+			})
+			for _, failedRecord := range event.Records[i:] {
+				response.BatchItemFailures = append(response.BatchItemFailures, events.KinesisBatchItemFailure{
+					ItemIdentifier: failedRecord.Kinesis.SequenceNumber,
+				})
+			}
+			break
+		}
+	}
+	return response, nil
+}
+
+// decodeSubscriptionRecord decodes the data of a Kinesis or Firehose record written by a Cloudwatch
+// log subscription, which is gzipped JSON. Firehose can be configured to decompress records before
+// they're transformed, so JSON which isn't gzipped is accepted too.
+func decodeSubscriptionRecord(data []byte) (*events.CloudwatchLogsData, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, gzipMagicBytes) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.WithMessage(err, "err decompressing record")
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	logsData := &events.CloudwatchLogsData{}
+	if err := json.NewDecoder(reader).Decode(logsData); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling record")
+	}
+	return logsData, nil
+}
@@ -0,0 +1,121 @@
+package logshandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipTestData(t *testing.T, data string) []byte {
+	var gzipBytes bytes.Buffer
+	gzipper := gzip.NewWriter(&gzipBytes)
+	_, err := gzipper.Write([]byte(data))
+	require.Nil(t, err)
+	require.Nil(t, gzipper.Close())
+	return gzipBytes.Bytes()
+}
+
+func makeTestKinesisRecord(sequenceNumber string, data []byte) events.KinesisEventRecord {
+	return events.KinesisEventRecord{
+		EventID:     "shardId-000000000000:" + sequenceNumber,
+		EventSource: "aws:kinesis",
+		Kinesis: events.KinesisRecord{
+			SequenceNumber: sequenceNumber,
+			Data:           data,
+		},
+	}
+}
+
+func TestKinesisHandler(t *testing.T) {
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(bodyBytes))
+		if strings.Contains(string(bodyBytes), "TEST_ID_3") {
+			w.Write([]byte(`{"message":"fail"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	response, err := KinesisHandler(ctx, events.KinesisEvent{Records: []events.KinesisEventRecord{
+		makeTestKinesisRecord("1", gzipTestData(t, `{
+			"messageType": "DATA_MESSAGE",
+			"logGroup": "/aws/appsync/apis/TEST_API_ID",
+			"logEvents": [{"id": "1", "message": "TEST_ID_1 GraphQL Query: TEST_QUERY"}]
+		}`)),
+		makeTestKinesisRecord("2", gzipTestData(t, `{
+			"messageType": "CONTROL_MESSAGE",
+			"logEvents": [{"id": "1", "message": "CWL CONTROL MESSAGE: Checking health of destination Kinesis stream."}]
+		}`)),
+		makeTestKinesisRecord("3", []byte("not gzip")),
+		makeTestKinesisRecord("4", gzipTestData(t, `{
+			"messageType": "DATA_MESSAGE",
+			"logGroup": "/aws/appsync/apis/TEST_API_ID",
+			"logEvents": [{"id": "1", "message": "TEST_ID_3 GraphQL Query: TEST_QUERY"}]
+		}`)),
+		makeTestKinesisRecord("5", gzipTestData(t, `{
+			"messageType": "DATA_MESSAGE",
+			"logGroup": "/aws/appsync/apis/TEST_API_ID",
+			"logEvents": [{"id": "1", "message": "TEST_ID_5 GraphQL Query: TEST_QUERY"}]
+		}`)),
+		makeTestKinesisRecord("6", []byte("not gzip")),
+	}})
+	require.Nil(t, err)
+	// Lambda retries from the first failure, so it and every later record are reported, and the
+	// records after it aren't sent
+	assert.Equal(t, []events.KinesisBatchItemFailure{{ItemIdentifier: "4"}, {ItemIdentifier: "5"}, {ItemIdentifier: "6"}}, response.BatchItemFailures)
+	require.Len(t, requestBodies, 2)
+	assert.Contains(t, requestBodies[0], `"request_id":"TEST_ID_1"`)
+	assert.Contains(t, requestBodies[1], `"request_id":"TEST_ID_3"`)
+}
+
+func TestDecodeSubscriptionRecord(t *testing.T) {
+	logsData, err := decodeSubscriptionRecord(gzipTestData(t, `{
+		"owner": "123456789012",
+		"logGroup": "/aws/appsync/apis/TEST_API_ID",
+		"logStream": "TEST_LOG_STREAM",
+		"subscriptionFilters": ["TEST_SUBSCRIPTION_FILTER"],
+		"messageType": "DATA_MESSAGE",
+		"logEvents": [{"id": "1", "timestamp": 1000, "message": "TEST_MESSAGE"}]
+	}`))
+	require.Nil(t, err)
+	assert.Equal(t, &events.CloudwatchLogsData{
+		Owner:               "123456789012",
+		LogGroup:            "/aws/appsync/apis/TEST_API_ID",
+		LogStream:           "TEST_LOG_STREAM",
+		SubscriptionFilters: []string{"TEST_SUBSCRIPTION_FILTER"},
+		MessageType:         "DATA_MESSAGE",
+		LogEvents:           []events.CloudwatchLogsLogEvent{{ID: "1", Timestamp: 1000, Message: "TEST_MESSAGE"}},
+	}, logsData)
+}
+
+func TestDecodeSubscriptionRecordUncompressed(t *testing.T) {
+	logsData, err := decodeSubscriptionRecord([]byte(`{"logGroup": "/aws/appsync/apis/TEST_API_ID", "logEvents": []}`))
+	require.Nil(t, err)
+	assert.Equal(t, "/aws/appsync/apis/TEST_API_ID", logsData.LogGroup)
+}
+
+func TestDecodeSubscriptionRecordMalformed(t *testing.T) {
+	_, err := decodeSubscriptionRecord([]byte{0x1f, 0x8b, 0x00})
+	require.NotNil(t, err)
+	assert.Equal(t, "err decompressing record: unexpected EOF", err.Error())
+
+	_, err = decodeSubscriptionRecord(gzipTestData(t, "not json"))
+	require.NotNil(t, err)
+	assert.Equal(t, "err unmarshalling record: invalid character 'o' in literal null (expecting 'u')", err.Error())
+}
@@ -0,0 +1,136 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a line written by a Logger. Lines below a Logger's level are dropped.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel parses the value of the LOG_LEVEL environment variable. An empty value is info.
+func parseLogLevel(value string) (LogLevel, error) {
+	if value == "" {
+		return LevelInfo, nil
+	}
+	for level, name := range logLevelNames {
+		if strings.EqualFold(value, name) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unsupported log level: %s", value)
+}
+
+// LogFields are the structured fields of a line written by a Logger, in addition to its time, level
+// and message.
+type LogFields map[string]interface{}
+
+// Logger writes leveled, structured log lines as JSON. If Output is nil, lines are written to the
+// output of the standard library's log package.
+type Logger struct {
+	Level  LogLevel
+	Output io.Writer
+	fields LogFields
+}
+
+// logger is used for all of the Lambda's own logging.
+var logger = &Logger{Level: LevelInfo}
+
+// loggerMu stops lines written concurrently by different Loggers from being interleaved.
+var loggerMu sync.Mutex
+
+// With returns a Logger which adds fields to every line it writes.
+func (l *Logger) With(fields LogFields) *Logger {
+	mergedFields := LogFields{}
+	for key, value := range l.fields {
+		mergedFields[key] = value
+	}
+	for key, value := range fields {
+		mergedFields[key] = value
+	}
+	return &Logger{Level: l.Level, Output: l.Output, fields: mergedFields}
+}
+
+// Enabled returns true if the Logger writes lines at the given level. It should be checked before
+// doing any expensive work to build a line's fields.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.Level
+}
+
+func (l *Logger) Debug(msg string, fields LogFields) {
+	l.write(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields LogFields) {
+	l.write(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields LogFields) {
+	l.write(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields LogFields) {
+	l.write(LevelError, msg, fields)
+}
+
+func (l *Logger) write(level LogLevel, msg string, fields LogFields) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	line := LogFields{}
+	for key, value := range l.fields {
+		line[key] = value
+	}
+	for key, value := range fields {
+		if err, isErr := value.(error); isErr {
+			value = err.Error()
+		}
+		line[key] = value
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+
+	lineBytes, err := json.Marshal(line)
+	if err != nil {
+		lineBytes, _ = json.Marshal(LogFields{
+			"time":  line["time"],
+			"level": LevelError.String(),
+			"msg":   "Err marshalling log line",
+			"error": err.Error(),
+			"line":  msg,
+		})
+	}
+
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	output := l.Output
+	if output == nil {
+		output = log.Writer()
+	}
+	output.Write(append(lineBytes, '\n'))
+}
@@ -0,0 +1,67 @@
+package logshandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	testCases := map[string]LogLevel{
+		"":      LevelInfo,
+		"debug": LevelDebug,
+		"INFO":  LevelInfo,
+		"Warn":  LevelWarn,
+		"error": LevelError,
+	}
+	for value, expectedLevel := range testCases {
+		level, err := parseLogLevel(value)
+		require.Nil(t, err, value)
+		assert.Equal(t, expectedLevel, level, value)
+	}
+
+	level, err := parseLogLevel("verbose")
+	require.NotNil(t, err)
+	assert.Equal(t, "unsupported log level: verbose", err.Error())
+	assert.Equal(t, LevelInfo, level)
+}
+
+func TestLogger(t *testing.T) {
+	var output bytes.Buffer
+	testLogger := &Logger{Level: LevelWarn, Output: &output}
+
+	testLogger.Info("TEST_INFO", nil)
+	testLogger.With(LogFields{"requestId": "TEST_ID"}).Warn("TEST_WARN", LogFields{
+		"count": 1,
+		"error": errors.New("TEST_ERR"),
+	})
+
+	var line map[string]interface{}
+	require.Nil(t, json.Unmarshal(output.Bytes(), &line))
+	assert.NotEmpty(t, line["time"])
+	delete(line, "time")
+	assert.Equal(t, map[string]interface{}{
+		"level":     "warn",
+		"msg":       "TEST_WARN",
+		"requestId": "TEST_ID",
+		"count":     float64(1),
+		"error":     "TEST_ERR",
+	}, line)
+}
+
+func TestLoggerUnmarshallableField(t *testing.T) {
+	var output bytes.Buffer
+	testLogger := &Logger{Level: LevelInfo, Output: &output}
+
+	testLogger.Info("TEST_INFO", LogFields{"channel": make(chan int)})
+
+	var line map[string]interface{}
+	require.Nil(t, json.Unmarshal(output.Bytes(), &line))
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "Err marshalling log line", line["msg"])
+	assert.Equal(t, "TEST_INFO", line["line"])
+}
@@ -1,9 +1,23 @@
-package main
+package logshandler
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
 const DefaultFiretailApiUrl string = "https://api.logging.eu-west-1.prod.firetail.app/logs/aws/appsync"
@@ -12,15 +26,383 @@ var firetailApiUrl string
 var firetailApiToken string
 
 func loadEnvVars() {
+	var err error
+	logger.Level, err = parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		logger.Warn("Invalid value for LOG_LEVEL, using info", LogFields{"error": err})
+	}
+
 	var firetailApiUrlSet bool
 	firetailApiUrl, firetailApiUrlSet = os.LookupEnv("FIRETAIL_API_URL")
 	if !firetailApiUrlSet {
 		firetailApiUrl = DefaultFiretailApiUrl
 	}
-	firetailApiToken = os.Getenv("FIRETAIL_API_TOKEN")	
+	firetailApiToken = os.Getenv("FIRETAIL_API_TOKEN")
+	maxChunkBytes = getIntEnvVar("FIRETAIL_MAX_CHUNK_BYTES", DefaultMaxChunkBytes)
+	maxChunkRecords = getIntEnvVar("FIRETAIL_MAX_CHUNK_RECORDS", DefaultMaxChunkRecords)
+	deadlineSafetyMargin = time.Duration(getIntEnvVar("FIRETAIL_DEADLINE_SAFETY_MARGIN_MS", int(DefaultDeadlineSafetyMargin/time.Millisecond))) * time.Millisecond
+
+	metricsNamespace = os.Getenv("FIRETAIL_METRICS_NAMESPACE")
+	metricsLogGroupDimension = os.Getenv("FIRETAIL_METRICS_LOG_GROUP_DIMENSION") == "true"
+
+	compressionType, err = parseCompressionType(os.Getenv("FIRETAIL_COMPRESSION"))
+	if err != nil {
+		logger.Warn("Invalid value for FIRETAIL_COMPRESSION, sending uncompressed logs", LogFields{"error": err})
+	}
+}
+
+// getIntEnvVar returns the value of the named environment variable as an int, or defaultValue if it
+// is unset or isn't a valid int.
+func getIntEnvVar(name string, defaultValue int) int {
+	value, valueSet := os.LookupEnv(name)
+	if !valueSet {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Warn("Invalid value for environment variable, using default", LogFields{
+			"name":         name,
+			"defaultValue": defaultValue,
+			"error":        err,
+		})
+		return defaultValue
+	}
+	return intValue
+}
+
+// loadDeadLetterSink configures the dead letter sink from the FIRETAIL_DEAD_LETTER_S3_BUCKET or
+// FIRETAIL_DEAD_LETTER_SQS_QUEUE_URL environment variables. If neither is set, no dead letter sink
+// is used.
+func loadDeadLetterSink(ctx context.Context) error {
+	s3Bucket, s3BucketSet := os.LookupEnv("FIRETAIL_DEAD_LETTER_S3_BUCKET")
+	sqsQueueUrl, sqsQueueUrlSet := os.LookupEnv("FIRETAIL_DEAD_LETTER_SQS_QUEUE_URL")
+	if !s3BucketSet && !sqsQueueUrlSet {
+		deadLetterSink = nil
+		return nil
+	}
+	if s3BucketSet && sqsQueueUrlSet {
+		return errors.New("only one of FIRETAIL_DEAD_LETTER_S3_BUCKET and FIRETAIL_DEAD_LETTER_SQS_QUEUE_URL may be set")
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if s3BucketSet {
+		deadLetterSink = &S3DeadLetterSink{
+			Client: s3.NewFromConfig(awsConfig),
+			Bucket: s3Bucket,
+			Prefix: os.Getenv("FIRETAIL_DEAD_LETTER_S3_PREFIX"),
+		}
+	} else {
+		deadLetterSink = &SQSDeadLetterSink{
+			Client:   sqs.NewFromConfig(awsConfig),
+			QueueUrl: sqsQueueUrl,
+		}
+	}
+	return nil
+}
+
+// loadRequestStateStore configures the store used to correlate the events of requests which span
+// multiple Cloudwatch deliveries from the FIRETAIL_REQUEST_STATE_STORE environment variable, which
+// may be "memory" or "dynamodb". If it's unset, events are not correlated across deliveries.
+func loadRequestStateStore(ctx context.Context) error {
+	requestStateTTL = time.Duration(getIntEnvVar("FIRETAIL_REQUEST_STATE_TTL_SECONDS", int(DefaultRequestStateTTL/time.Second))) * time.Second
+
+	switch storeType := os.Getenv("FIRETAIL_REQUEST_STATE_STORE"); storeType {
+	case "":
+		requestStateStore = nil
+
+	case "memory":
+		requestStateStore = NewMemoryRequestStateStore()
+
+	case "dynamodb":
+		tableName, tableNameSet := os.LookupEnv("FIRETAIL_REQUEST_STATE_TABLE")
+		if !tableNameSet {
+			return errors.New("FIRETAIL_REQUEST_STATE_TABLE must be set when FIRETAIL_REQUEST_STATE_STORE is dynamodb")
+		}
+		indexName, indexNameSet := os.LookupEnv("FIRETAIL_REQUEST_STATE_INDEX")
+		if !indexNameSet {
+			indexName = DefaultRequestStateIndex
+		}
+		awsConfig, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return err
+		}
+		var optFns []func(*dynamodb.Options)
+		if endpoint, endpointSet := os.LookupEnv("FIRETAIL_REQUEST_STATE_DYNAMODB_ENDPOINT"); endpointSet {
+			optFns = append(optFns, dynamodb.WithEndpointResolver(dynamodb.EndpointResolverFromURL(endpoint)))
+		}
+		requestStateStore = &DynamoDBRequestStateStore{
+			Client:    dynamodb.NewFromConfig(awsConfig, optFns...),
+			TableName: tableName,
+			IndexName: indexName,
+		}
+
+	default:
+		return fmt.Errorf("unsupported FIRETAIL_REQUEST_STATE_STORE: %s", storeType)
+	}
+	return nil
+}
+
+// loadHttpClient configures the HTTP client used to send logs to Firetail from the FIRETAIL_CA_BUNDLE,
+// FIRETAIL_CLIENT_CERT, FIRETAIL_CLIENT_KEY, FIRETAIL_PROXY_URL, FIRETAIL_TLS_MIN_VERSION and
+// FIRETAIL_HTTP_TIMEOUT_MS environment variables.
+func loadHttpClient() error {
+	client, err := NewHttpClient(HttpClientConfig{
+		CABundle:      os.Getenv("FIRETAIL_CA_BUNDLE"),
+		ClientCert:    os.Getenv("FIRETAIL_CLIENT_CERT"),
+		ClientKey:     os.Getenv("FIRETAIL_CLIENT_KEY"),
+		ProxyUrl:      os.Getenv("FIRETAIL_PROXY_URL"),
+		TLSMinVersion: os.Getenv("FIRETAIL_TLS_MIN_VERSION"),
+		Timeout:       time.Duration(getIntEnvVar("FIRETAIL_HTTP_TIMEOUT_MS", int(DefaultHttpTimeout/time.Millisecond))) * time.Millisecond,
+	})
+	if err != nil {
+		return err
+	}
+	httpClient = client
+	return nil
+}
+
+// loadTokenProvider configures where the Firetail API token comes from. If FIRETAIL_API_TOKEN_SECRET_ARN
+// or FIRETAIL_API_TOKEN_SSM_PARAM is set, the token is fetched from Secrets Manager or SSM and cached
+// for FIRETAIL_API_TOKEN_REFRESH_SECONDS. Otherwise, the value of FIRETAIL_API_TOKEN is used. The
+// token is fetched immediately so that a misconfigured Lambda fails at cold start.
+func loadTokenProvider(ctx context.Context) error {
+	secretArn, secretArnSet := os.LookupEnv("FIRETAIL_API_TOKEN_SECRET_ARN")
+	ssmParam, ssmParamSet := os.LookupEnv("FIRETAIL_API_TOKEN_SSM_PARAM")
+	if !secretArnSet && !ssmParamSet {
+		firetailApiTokenProvider = StaticTokenProvider(firetailApiToken)
+		return nil
+	}
+	if secretArnSet && ssmParamSet {
+		return errors.New("only one of FIRETAIL_API_TOKEN_SECRET_ARN and FIRETAIL_API_TOKEN_SSM_PARAM may be set")
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	refreshInterval := time.Duration(getIntEnvVar("FIRETAIL_API_TOKEN_REFRESH_SECONDS", int(DefaultTokenRefreshInterval/time.Second))) * time.Second
+	var tokenProvider *CachedTokenProvider
+	if secretArnSet {
+		tokenProvider = NewSecretsManagerTokenProvider(secretsmanager.NewFromConfig(awsConfig), secretArn, refreshInterval)
+	} else {
+		tokenProvider = NewSSMTokenProvider(ssm.NewFromConfig(awsConfig), ssmParam, refreshInterval)
+	}
+	if _, err := tokenProvider.Token(ctx); err != nil {
+		return err
+	}
+	firetailApiTokenProvider = tokenProvider
+	return nil
+}
+
+// loadRoutingTable configures the routing table from the FIRETAIL_ROUTING_TABLE environment variable,
+// which should hold a RoutingTable as YAML or JSON, or from the file at FIRETAIL_ROUTING_TABLE_FILE. If
+// neither is set, all logs are sent to FIRETAIL_API_URL. The tokens of any routes which fetch them from
+// Secrets Manager or SSM are fetched immediately so that a misconfigured Lambda fails at cold start.
+func loadRoutingTable(ctx context.Context) error {
+	tableValue, tableValueSet := os.LookupEnv("FIRETAIL_ROUTING_TABLE")
+	tableFile, tableFileSet := os.LookupEnv("FIRETAIL_ROUTING_TABLE_FILE")
+	if !tableValueSet && !tableFileSet {
+		routingTable = nil
+		return nil
+	}
+	if tableValueSet && tableFileSet {
+		return errors.New("only one of FIRETAIL_ROUTING_TABLE and FIRETAIL_ROUTING_TABLE_FILE may be set")
+	}
+
+	tableBytes := []byte(tableValue)
+	if tableFileSet {
+		var err error
+		tableBytes, err = os.ReadFile(tableFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	table, err := parseRoutingTable(tableBytes, routeTokenConfig{
+		RefreshInterval: time.Duration(getIntEnvVar("FIRETAIL_API_TOKEN_REFRESH_SECONDS", int(DefaultTokenRefreshInterval/time.Second))) * time.Second,
+		SecretsManager: func() (secretsManagerClient, error) {
+			awsConfig, err := config.LoadDefaultConfig(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return secretsmanager.NewFromConfig(awsConfig), nil
+		},
+		SSM: func() (ssmClient, error) {
+			awsConfig, err := config.LoadDefaultConfig(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return ssm.NewFromConfig(awsConfig), nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := table.primeTokens(ctx); err != nil {
+		return err
+	}
+	routingTable = table
+	return nil
+}
+
+// loadRedactionPolicy configures the redaction policy from the FIRETAIL_REDACTION_POLICY environment
+// variable, which should hold a RedactionPolicy as JSON. If it's unset, logs aren't redacted.
+func loadRedactionPolicy() error {
+	policyJson, policyJsonSet := os.LookupEnv("FIRETAIL_REDACTION_POLICY")
+	if !policyJsonSet {
+		redactionPolicy = nil
+		return nil
+	}
+	policy, err := parseRedactionPolicy(policyJson)
+	if err != nil {
+		return err
+	}
+	redactionPolicy = policy
+	return nil
+}
+
+// loadFilterPolicy configures the filter policy from the FIRETAIL_FILTER_POLICY environment variable,
+// which should hold a FilterPolicy as JSON. If it's unset, every log is forwarded.
+func loadFilterPolicy() error {
+	policyJson, policyJsonSet := os.LookupEnv("FIRETAIL_FILTER_POLICY")
+	if !policyJsonSet {
+		filterPolicy = nil
+		return nil
+	}
+	policy, err := parseFilterPolicy(policyJson)
+	if err != nil {
+		return err
+	}
+	filterPolicy = policy
+	return nil
+}
+
+// loadBackfill configures backfilling Cloudwatch export files from the FIRETAIL_BACKFILL_LOG_GROUP and
+// FIRETAIL_BACKFILL_BATCH_EVENTS environment variables. Export files are checkpointed in the S3 bucket
+// FIRETAIL_BACKFILL_CHECKPOINT_S3_BUCKET under FIRETAIL_BACKFILL_CHECKPOINT_S3_PREFIX if it's set, or
+// otherwise in the local file FIRETAIL_BACKFILL_CHECKPOINT_FILE. Only local backfills have a default
+// checkpoint file, as a Lambda's filesystem doesn't outlive it.
+func loadBackfill(ctx context.Context, local bool) error {
+	backfillLogGroup = os.Getenv("FIRETAIL_BACKFILL_LOG_GROUP")
+	backfillBatchEvents = getIntEnvVar("FIRETAIL_BACKFILL_BATCH_EVENTS", DefaultBackfillBatchEvents)
+
+	checkpointBucket, checkpointBucketSet := os.LookupEnv("FIRETAIL_BACKFILL_CHECKPOINT_S3_BUCKET")
+	checkpointFile, checkpointFileSet := os.LookupEnv("FIRETAIL_BACKFILL_CHECKPOINT_FILE")
+	if checkpointBucketSet && checkpointFileSet {
+		return errors.New("only one of FIRETAIL_BACKFILL_CHECKPOINT_S3_BUCKET and FIRETAIL_BACKFILL_CHECKPOINT_FILE may be set")
+	}
+	if !checkpointFileSet && local {
+		checkpointFile, checkpointFileSet = DefaultBackfillCheckpointFile, true
+	}
+
+	var awsConfig aws.Config
+	if !local || checkpointBucketSet {
+		var err error
+		awsConfig, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if !local {
+		backfillS3Client = s3.NewFromConfig(awsConfig)
+	}
+	switch {
+	case checkpointBucketSet:
+		backfillCheckpointStore = &S3BackfillCheckpointStore{
+			Client: s3.NewFromConfig(awsConfig),
+			Bucket: checkpointBucket,
+			Prefix: os.Getenv("FIRETAIL_BACKFILL_CHECKPOINT_S3_PREFIX"),
+		}
+	case checkpointFileSet:
+		backfillCheckpointStore = &FileBackfillCheckpointStore{Path: checkpointFile}
+	default:
+		backfillCheckpointStore = nil
+	}
+	return nil
+}
+
+// loadIngestServerConfig configures the server run in server mode from the FIRETAIL_SERVER_ADDR,
+// FIRETAIL_SERVER_FLUSH_INTERVAL_MS, FIRETAIL_SERVER_MAX_BUFFERED_EVENTS, FIRETAIL_SERVER_ACCESS_KEY
+// and FIRETAIL_SERVER_SHUTDOWN_TIMEOUT_MS environment variables.
+func loadIngestServerConfig() IngestServerConfig {
+	config := DefaultIngestServerConfig
+	if addr, addrSet := os.LookupEnv("FIRETAIL_SERVER_ADDR"); addrSet {
+		config.Addr = addr
+	}
+	config.FlushInterval = time.Duration(getIntEnvVar("FIRETAIL_SERVER_FLUSH_INTERVAL_MS", int(DefaultIngestFlushInterval/time.Millisecond))) * time.Millisecond
+	config.MaxBufferedEvents = getIntEnvVar("FIRETAIL_SERVER_MAX_BUFFERED_EVENTS", DefaultIngestMaxBufferedEvents)
+	config.AccessKey = os.Getenv("FIRETAIL_SERVER_ACCESS_KEY")
+	config.ShutdownTimeout = time.Duration(getIntEnvVar("FIRETAIL_SERVER_SHUTDOWN_TIMEOUT_MS", int(DefaultIngestShutdownTimeout/time.Millisecond))) * time.Millisecond
+	return config
+}
+
+// fatal logs an error and exits, for when the Lambda is misconfigured.
+func fatal(msg string, fields LogFields) {
+	logger.Error(msg, fields)
+	os.Exit(1)
 }
 
-func main() {
+// Main configures the Lambda from its environment variables and starts the handler for FIRETAIL_MODE.
+// It's called by the Lambda's binary in cmd/logs-handler.
+func Main() {
 	loadEnvVars()
-	lambda.Start(Handler)
+	if err := loadHttpClient(); err != nil {
+		fatal("Err loading HTTP client", LogFields{"error": err})
+	}
+	if err := loadTokenProvider(context.Background()); err != nil {
+		fatal("Err loading Firetail API token", LogFields{"error": err})
+	}
+	if err := loadRoutingTable(context.Background()); err != nil {
+		fatal("Err loading routing table", LogFields{"error": err})
+	}
+	if err := loadRedactionPolicy(); err != nil {
+		fatal("Err loading redaction policy", LogFields{"error": err})
+	}
+	if err := loadFilterPolicy(); err != nil {
+		fatal("Err loading filter policy", LogFields{"error": err})
+	}
+	if err := loadDeadLetterSink(context.Background()); err != nil {
+		fatal("Err loading dead letter sink", LogFields{"error": err})
+	}
+	if err := loadRequestStateStore(context.Background()); err != nil {
+		fatal("Err loading request state store", LogFields{"error": err})
+	}
+
+	mode := os.Getenv("FIRETAIL_MODE")
+	if mode == "" || mode == "backfill" || mode == "backfill-local" {
+		if err := loadBackfill(context.Background(), mode == "backfill-local"); err != nil {
+			fatal("Err loading backfill", LogFields{"error": err})
+		}
+	}
+
+	switch mode {
+	case "":
+		lambda.Start(AutoHandler)
+	case "logs":
+		lambda.Start(Handler)
+	case "kinesis":
+		lambda.Start(KinesisHandler)
+	case "firehose":
+		lambda.Start(FirehoseHandler)
+	case "redrive":
+		lambda.Start(RedriveHandler)
+	case "backfill":
+		lambda.Start(BackfillHandler)
+	case "backfill-local":
+		// Local backfills run once outside of Lambda, with no deadline
+		if _, err := BackfillLocal(context.Background(), os.Getenv("FIRETAIL_BACKFILL_PATH")); err != nil {
+			fatal("Err backfilling export files", LogFields{"error": err})
+		}
+	case "server":
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := NewIngestServer(loadIngestServerConfig()).ListenAndServe(ctx); err != nil {
+			fatal("Err running ingest server", LogFields{"error": err})
+		}
+	default:
+		fatal("Unsupported FIRETAIL_MODE", LogFields{"mode": mode})
+	}
 }
@@ -1,9 +1,17 @@
-package main
+package logshandler
 
 import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadEnvVars(t *testing.T) {
@@ -28,4 +36,369 @@ func TestLoadEnvVarsApiUrlUnset(t *testing.T) {
 
 	assert.Equal(t, firetailApiUrl, DefaultFiretailApiUrl)
 	assert.Equal(t, firetailApiToken, MockFiretailApiToken)
-}
\ No newline at end of file
+}
+
+func TestLoadEnvVarsChunkLimits(t *testing.T) {
+	t.Setenv("FIRETAIL_MAX_CHUNK_BYTES", "2048")
+	t.Setenv("FIRETAIL_MAX_CHUNK_RECORDS", "not a number")
+
+	loadEnvVars()
+	defer func() {
+		maxChunkBytes = DefaultMaxChunkBytes
+		maxChunkRecords = DefaultMaxChunkRecords
+	}()
+
+	assert.Equal(t, 2048, maxChunkBytes)
+	assert.Equal(t, DefaultMaxChunkRecords, maxChunkRecords)
+}
+
+func TestLoadEnvVarsCompression(t *testing.T) {
+	t.Setenv("FIRETAIL_COMPRESSION", "gzip")
+
+	loadEnvVars()
+	defer func() { compressionType = NoCompression }()
+
+	assert.Equal(t, GzipCompression, compressionType)
+}
+
+func TestLoadEnvVarsInvalidCompression(t *testing.T) {
+	t.Setenv("FIRETAIL_COMPRESSION", "brotli")
+
+	loadEnvVars()
+
+	assert.Equal(t, NoCompression, compressionType)
+}
+
+func TestLoadDeadLetterSinkUnset(t *testing.T) {
+	err := loadDeadLetterSink(context.Background())
+	require.Nil(t, err)
+	assert.Nil(t, deadLetterSink)
+}
+
+func TestLoadDeadLetterSinkS3(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("FIRETAIL_DEAD_LETTER_S3_BUCKET", "TEST_BUCKET")
+	t.Setenv("FIRETAIL_DEAD_LETTER_S3_PREFIX", "TEST_PREFIX/")
+
+	err := loadDeadLetterSink(context.Background())
+	defer func() { deadLetterSink = nil }()
+	require.Nil(t, err)
+
+	require.IsType(t, &S3DeadLetterSink{}, deadLetterSink)
+	assert.Equal(t, "TEST_BUCKET", deadLetterSink.(*S3DeadLetterSink).Bucket)
+	assert.Equal(t, "TEST_PREFIX/", deadLetterSink.(*S3DeadLetterSink).Prefix)
+}
+
+func TestLoadDeadLetterSinkSQS(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("FIRETAIL_DEAD_LETTER_SQS_QUEUE_URL", "TEST_QUEUE_URL")
+
+	err := loadDeadLetterSink(context.Background())
+	defer func() { deadLetterSink = nil }()
+	require.Nil(t, err)
+
+	require.IsType(t, &SQSDeadLetterSink{}, deadLetterSink)
+	assert.Equal(t, "TEST_QUEUE_URL", deadLetterSink.(*SQSDeadLetterSink).QueueUrl)
+}
+
+func TestLoadDeadLetterSinkBothSet(t *testing.T) {
+	t.Setenv("FIRETAIL_DEAD_LETTER_S3_BUCKET", "TEST_BUCKET")
+	t.Setenv("FIRETAIL_DEAD_LETTER_SQS_QUEUE_URL", "TEST_QUEUE_URL")
+
+	err := loadDeadLetterSink(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "only one of FIRETAIL_DEAD_LETTER_S3_BUCKET and FIRETAIL_DEAD_LETTER_SQS_QUEUE_URL may be set", err.Error())
+}
+
+func TestLoadRequestStateStoreUnset(t *testing.T) {
+	err := loadRequestStateStore(context.Background())
+	require.Nil(t, err)
+	assert.Nil(t, requestStateStore)
+	assert.Equal(t, DefaultRequestStateTTL, requestStateTTL)
+}
+
+func TestLoadRequestStateStoreMemory(t *testing.T) {
+	t.Setenv("FIRETAIL_REQUEST_STATE_STORE", "memory")
+	t.Setenv("FIRETAIL_REQUEST_STATE_TTL_SECONDS", "60")
+
+	err := loadRequestStateStore(context.Background())
+	defer func() {
+		requestStateStore = nil
+		requestStateTTL = DefaultRequestStateTTL
+	}()
+	require.Nil(t, err)
+
+	assert.IsType(t, &MemoryRequestStateStore{}, requestStateStore)
+	assert.Equal(t, time.Minute, requestStateTTL)
+}
+
+func TestLoadRequestStateStoreDynamoDB(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("FIRETAIL_REQUEST_STATE_STORE", "dynamodb")
+	t.Setenv("FIRETAIL_REQUEST_STATE_TABLE", "TEST_TABLE")
+	t.Setenv("FIRETAIL_REQUEST_STATE_DYNAMODB_ENDPOINT", "http://localhost:8000")
+
+	err := loadRequestStateStore(context.Background())
+	defer func() { requestStateStore = nil }()
+	require.Nil(t, err)
+
+	require.IsType(t, &DynamoDBRequestStateStore{}, requestStateStore)
+	assert.Equal(t, "TEST_TABLE", requestStateStore.(*DynamoDBRequestStateStore).TableName)
+	assert.Equal(t, DefaultRequestStateIndex, requestStateStore.(*DynamoDBRequestStateStore).IndexName)
+}
+
+func TestLoadRequestStateStoreDynamoDBNoTable(t *testing.T) {
+	t.Setenv("FIRETAIL_REQUEST_STATE_STORE", "dynamodb")
+
+	err := loadRequestStateStore(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "FIRETAIL_REQUEST_STATE_TABLE must be set when FIRETAIL_REQUEST_STATE_STORE is dynamodb", err.Error())
+}
+
+func TestLoadRequestStateStoreUnsupported(t *testing.T) {
+	t.Setenv("FIRETAIL_REQUEST_STATE_STORE", "redis")
+
+	err := loadRequestStateStore(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "unsupported FIRETAIL_REQUEST_STATE_STORE: redis", err.Error())
+}
+
+func TestLoadRedactionPolicyUnset(t *testing.T) {
+	err := loadRedactionPolicy()
+	require.Nil(t, err)
+	assert.Nil(t, redactionPolicy)
+}
+
+func TestLoadRedactionPolicy(t *testing.T) {
+	t.Setenv("FIRETAIL_REDACTION_POLICY", `{"headerDenylist":["authorization"]}`)
+
+	err := loadRedactionPolicy()
+	defer func() { redactionPolicy = nil }()
+	require.Nil(t, err)
+
+	require.NotNil(t, redactionPolicy)
+	assert.Equal(t, []string{"authorization"}, redactionPolicy.HeaderDenylist)
+}
+
+func TestLoadRedactionPolicyInvalid(t *testing.T) {
+	t.Setenv("FIRETAIL_REDACTION_POLICY", `{"patterns":["("]}`)
+
+	err := loadRedactionPolicy()
+	require.NotNil(t, err)
+	assert.Equal(t, "invalid redaction pattern \"(\": error parsing regexp: missing closing ): `(`", err.Error())
+	assert.Nil(t, redactionPolicy)
+}
+
+func TestLoadEnvVarsLogLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "debug")
+	loadEnvVars()
+	defer func() { logger.Level = LevelInfo }()
+	assert.Equal(t, LevelDebug, logger.Level)
+}
+
+func TestLoadEnvVarsMetricsNamespace(t *testing.T) {
+	t.Setenv("FIRETAIL_METRICS_NAMESPACE", "TEST_NAMESPACE")
+	loadEnvVars()
+	defer func() { metricsNamespace = "" }()
+	assert.Equal(t, "TEST_NAMESPACE", metricsNamespace)
+}
+
+func TestLoadEnvVarsMetricsLogGroupDimension(t *testing.T) {
+	t.Setenv("FIRETAIL_METRICS_LOG_GROUP_DIMENSION", "true")
+	loadEnvVars()
+	defer func() { metricsLogGroupDimension = false }()
+	assert.True(t, metricsLogGroupDimension)
+}
+
+func TestLoadEnvVarsDeadlineSafetyMargin(t *testing.T) {
+	t.Setenv("FIRETAIL_DEADLINE_SAFETY_MARGIN_MS", "500")
+	loadEnvVars()
+	defer func() { deadlineSafetyMargin = DefaultDeadlineSafetyMargin }()
+	assert.Equal(t, 500*time.Millisecond, deadlineSafetyMargin)
+}
+
+func TestLoadHttpClient(t *testing.T) {
+	t.Setenv("FIRETAIL_PROXY_URL", "http://proxy.example.com:3128")
+	t.Setenv("FIRETAIL_TLS_MIN_VERSION", "1.3")
+	t.Setenv("FIRETAIL_HTTP_TIMEOUT_MS", "2500")
+
+	err := loadHttpClient()
+	defer func() { httpClient = mustNewHttpClient(DefaultHttpClientConfig) }()
+	require.Nil(t, err)
+
+	assert.Equal(t, 2500*time.Millisecond, httpClient.Timeout)
+	transport := httpClient.Transport.(*http.Transport)
+	assert.Equal(t, uint16(tls.VersionTLS13), transport.TLSClientConfig.MinVersion)
+	proxyUrl, err := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "api.logging.eu-west-1.prod.firetail.app"}})
+	require.Nil(t, err)
+	assert.Equal(t, "http://proxy.example.com:3128", proxyUrl.String())
+}
+
+func TestLoadHttpClientInvalid(t *testing.T) {
+	t.Setenv("FIRETAIL_TLS_MIN_VERSION", "1.4")
+
+	err := loadHttpClient()
+	require.NotNil(t, err)
+	assert.Equal(t, "unsupported TLS version: 1.4", err.Error())
+}
+
+func TestLoadTokenProviderStatic(t *testing.T) {
+	t.Setenv("FIRETAIL_API_TOKEN", "TEST_TOKEN")
+	loadEnvVars()
+
+	err := loadTokenProvider(context.Background())
+	defer func() { firetailApiTokenProvider = StaticTokenProvider("") }()
+	require.Nil(t, err)
+	assert.Equal(t, StaticTokenProvider("TEST_TOKEN"), firetailApiTokenProvider)
+}
+
+func TestLoadTokenProviderBothSet(t *testing.T) {
+	t.Setenv("FIRETAIL_API_TOKEN_SECRET_ARN", "TEST_SECRET_ARN")
+	t.Setenv("FIRETAIL_API_TOKEN_SSM_PARAM", "/firetail/api-token")
+
+	err := loadTokenProvider(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "only one of FIRETAIL_API_TOKEN_SECRET_ARN and FIRETAIL_API_TOKEN_SSM_PARAM may be set", err.Error())
+}
+
+func TestLoadRoutingTableUnset(t *testing.T) {
+	err := loadRoutingTable(context.Background())
+	require.Nil(t, err)
+	assert.Nil(t, routingTable)
+}
+
+func TestLoadRoutingTable(t *testing.T) {
+	t.Setenv("FIRETAIL_ROUTING_TABLE", `{"routes":[{"name":"orders","apiIds":["ORDERS_API_ID"],"apiToken":"ORDERS_TOKEN"}]}`)
+
+	err := loadRoutingTable(context.Background())
+	defer func() { routingTable = nil }()
+	require.Nil(t, err)
+
+	require.NotNil(t, routingTable)
+	assert.Equal(t, "orders", routingTable.Match("", "ORDERS_API_ID").Name)
+}
+
+func TestLoadRoutingTableFile(t *testing.T) {
+	tableFile := filepath.Join(t.TempDir(), "routes.yaml")
+	require.Nil(t, os.WriteFile(tableFile, []byte("routes:\n  - name: orders\n    apiIds: [ORDERS_API_ID]\n"), 0600))
+	t.Setenv("FIRETAIL_ROUTING_TABLE_FILE", tableFile)
+
+	err := loadRoutingTable(context.Background())
+	defer func() { routingTable = nil }()
+	require.Nil(t, err)
+
+	require.NotNil(t, routingTable)
+	assert.Equal(t, "orders", routingTable.Match("", "ORDERS_API_ID").Name)
+}
+
+func TestLoadRoutingTableBothSet(t *testing.T) {
+	t.Setenv("FIRETAIL_ROUTING_TABLE", `{"routes":[]}`)
+	t.Setenv("FIRETAIL_ROUTING_TABLE_FILE", "routes.yaml")
+
+	err := loadRoutingTable(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "only one of FIRETAIL_ROUTING_TABLE and FIRETAIL_ROUTING_TABLE_FILE may be set", err.Error())
+}
+
+func TestLoadFilterPolicyUnset(t *testing.T) {
+	err := loadFilterPolicy()
+	require.Nil(t, err)
+	assert.Nil(t, filterPolicy)
+}
+
+func TestLoadFilterPolicy(t *testing.T) {
+	t.Setenv("FIRETAIL_FILTER_POLICY", `{"rules":[{"operationNames":["HealthCheck"],"action":"drop"}]}`)
+
+	err := loadFilterPolicy()
+	defer func() { filterPolicy = nil }()
+	require.Nil(t, err)
+
+	require.NotNil(t, filterPolicy)
+	require.Len(t, filterPolicy.Rules, 1)
+	assert.Equal(t, []string{"HealthCheck"}, filterPolicy.Rules[0].OperationNames)
+}
+
+func TestLoadFilterPolicyInvalid(t *testing.T) {
+	t.Setenv("FIRETAIL_FILTER_POLICY", `{"rules":[{"action":"ignore"}]}`)
+
+	err := loadFilterPolicy()
+	require.NotNil(t, err)
+	assert.Equal(t, "filter rule rule1 has unsupported action: ignore", err.Error())
+	assert.Nil(t, filterPolicy)
+}
+
+func TestLoadBackfillLocal(t *testing.T) {
+	t.Setenv("FIRETAIL_BACKFILL_LOG_GROUP", "/aws/appsync/apis/TEST_API_ID")
+	t.Setenv("FIRETAIL_BACKFILL_BATCH_EVENTS", "100")
+
+	err := loadBackfill(context.Background(), true)
+	defer func() {
+		backfillLogGroup = ""
+		backfillBatchEvents = DefaultBackfillBatchEvents
+		backfillCheckpointStore = nil
+	}()
+	require.Nil(t, err)
+
+	assert.Equal(t, "/aws/appsync/apis/TEST_API_ID", backfillLogGroup)
+	assert.Equal(t, 100, backfillBatchEvents)
+	require.IsType(t, &FileBackfillCheckpointStore{}, backfillCheckpointStore)
+	assert.Equal(t, DefaultBackfillCheckpointFile, backfillCheckpointStore.(*FileBackfillCheckpointStore).Path)
+}
+
+func TestLoadBackfillS3(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("FIRETAIL_BACKFILL_CHECKPOINT_S3_BUCKET", "TEST_BUCKET")
+	t.Setenv("FIRETAIL_BACKFILL_CHECKPOINT_S3_PREFIX", "TEST_PREFIX/")
+
+	err := loadBackfill(context.Background(), false)
+	defer func() {
+		backfillS3Client = nil
+		backfillCheckpointStore = nil
+	}()
+	require.Nil(t, err)
+
+	assert.NotNil(t, backfillS3Client)
+	require.IsType(t, &S3BackfillCheckpointStore{}, backfillCheckpointStore)
+	assert.Equal(t, "TEST_BUCKET", backfillCheckpointStore.(*S3BackfillCheckpointStore).Bucket)
+	assert.Equal(t, "TEST_PREFIX/", backfillCheckpointStore.(*S3BackfillCheckpointStore).Prefix)
+}
+
+func TestLoadBackfillS3NoCheckpoints(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	err := loadBackfill(context.Background(), false)
+	defer func() { backfillS3Client = nil }()
+	require.Nil(t, err)
+
+	assert.NotNil(t, backfillS3Client)
+	assert.Nil(t, backfillCheckpointStore)
+}
+
+func TestLoadBackfillBothCheckpointsSet(t *testing.T) {
+	t.Setenv("FIRETAIL_BACKFILL_CHECKPOINT_S3_BUCKET", "TEST_BUCKET")
+	t.Setenv("FIRETAIL_BACKFILL_CHECKPOINT_FILE", "TEST_FILE")
+
+	err := loadBackfill(context.Background(), true)
+	require.NotNil(t, err)
+	assert.Equal(t, "only one of FIRETAIL_BACKFILL_CHECKPOINT_S3_BUCKET and FIRETAIL_BACKFILL_CHECKPOINT_FILE may be set", err.Error())
+}
+
+func TestLoadIngestServerConfig(t *testing.T) {
+	t.Setenv("FIRETAIL_SERVER_ADDR", ":9090")
+	t.Setenv("FIRETAIL_SERVER_FLUSH_INTERVAL_MS", "1000")
+	t.Setenv("FIRETAIL_SERVER_MAX_BUFFERED_EVENTS", "500")
+	t.Setenv("FIRETAIL_SERVER_ACCESS_KEY", "TEST_ACCESS_KEY")
+	t.Setenv("FIRETAIL_SERVER_SHUTDOWN_TIMEOUT_MS", "2000")
+
+	assert.Equal(t, IngestServerConfig{
+		Addr:              ":9090",
+		FlushInterval:     time.Second,
+		MaxBufferedEvents: 500,
+		AccessKey:         "TEST_ACCESS_KEY",
+		ShutdownTimeout:   2 * time.Second,
+	}, loadIngestServerConfig())
+}
+
+func TestLoadIngestServerConfigDefaults(t *testing.T) {
+	assert.Equal(t, DefaultIngestServerConfig, loadIngestServerConfig())
+}
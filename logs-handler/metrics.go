@@ -0,0 +1,201 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxEMFMetricValues is the most values EMF allows a metric to have in a single document.
+const maxEMFMetricValues = 100
+
+// metricsNamespace is the CloudWatch namespace metrics are published to. Custom metrics are charged
+// for, so they're opt-in, and if it's empty, no metrics are published.
+var metricsNamespace string
+
+// metricsLogGroupDimension is whether metrics are also published with the log group as a dimension.
+// Every log group is then a separate set of metrics, so this is opt-in too.
+var metricsLogGroupDimension bool
+
+type MetricUnit string
+
+const (
+	UnitCount        MetricUnit = "Count"
+	UnitBytes        MetricUnit = "Bytes"
+	UnitMilliseconds MetricUnit = "Milliseconds"
+)
+
+// Metrics collects metric values over the course of an invocation so that they can be written out in
+// CloudWatch's Embedded Metric Format (EMF), which CloudWatch extracts metrics from when it ingests
+// the Lambda's own logs. Every metric has the Metrics' Dimensions, and may have extra dimensions of
+// its own. If there are OptionalDimensions, every metric is published a second time with them too.
+type Metrics struct {
+	Namespace          string
+	Dimensions         map[string]string
+	OptionalDimensions map[string]string
+	metrics            []*metric
+}
+
+type metric struct {
+	name       string
+	unit       MetricUnit
+	dimensions map[string]string
+	values     []float64
+}
+
+func NewMetrics(namespace string, dimensions map[string]string) *Metrics {
+	return &Metrics{Namespace: namespace, Dimensions: dimensions}
+}
+
+// Add records a value for the named metric. If a metric is given more than one value, they are all
+// published, so counts should be totalled before they are added.
+func (m *Metrics) Add(name string, unit MetricUnit, value float64) {
+	m.AddWithDimensions(name, unit, value, nil)
+}
+
+// AddWithDimensions records a value for the named metric with dimensions in addition to the
+// Metrics' Dimensions.
+func (m *Metrics) AddWithDimensions(name string, unit MetricUnit, value float64, dimensions map[string]string) {
+	for _, existingMetric := range m.metrics {
+		if existingMetric.name == name && dimensionsKey(existingMetric.dimensions) == dimensionsKey(dimensions) {
+			existingMetric.values = append(existingMetric.values, value)
+			return
+		}
+	}
+	m.metrics = append(m.metrics, &metric{name: name, unit: unit, dimensions: dimensions, values: []float64{value}})
+}
+
+// Write writes an EMF document for each distinct set of extra dimensions to w, one per line. A metric
+// with more values than a document can hold is split across several documents. If w is nil, they are
+// written to the output of the standard library's log package.
+func (m *Metrics) Write(w io.Writer, now time.Time) error {
+	if w == nil {
+		w = log.Writer()
+	}
+
+	// Metrics with different dimension values have to go in separate documents, as each document can
+	// only have one value for each dimension.
+	documentKeys := []string{}
+	documents := map[string][]*metric{}
+	for _, metric := range m.metrics {
+		key := dimensionsKey(metric.dimensions)
+		if _, exists := documents[key]; !exists {
+			documentKeys = append(documentKeys, key)
+		}
+		documents[key] = append(documents[key], metric)
+	}
+
+	for _, key := range documentKeys {
+		for offset := 0; ; offset += maxEMFMetricValues {
+			document := m.emfDocument(documents[key], offset, now)
+			if document == nil {
+				break
+			}
+			documentBytes, err := json.Marshal(document)
+			if err != nil {
+				return err
+			}
+			loggerMu.Lock()
+			_, err = w.Write(append(documentBytes, '\n'))
+			loggerMu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// emfDocument builds an EMF document for up to maxEMFMetricValues values of each of metrics, starting
+// from their value at offset. The metrics must all have the same extra dimensions. It returns nil if
+// none of the metrics have a value at offset.
+func (m *Metrics) emfDocument(metrics []*metric, offset int, now time.Time) map[string]interface{} {
+	document := map[string]interface{}{}
+	for name, value := range m.Dimensions {
+		document[name] = value
+	}
+	for name, value := range metrics[0].dimensions {
+		document[name] = value
+	}
+	dimensionNames := make([]string, 0, len(document))
+	for name := range document {
+		dimensionNames = append(dimensionNames, name)
+	}
+	sort.Strings(dimensionNames)
+	dimensionSets := [][]string{dimensionNames}
+	if len(m.OptionalDimensions) > 0 {
+		optionalDimensionNames := make([]string, 0, len(m.OptionalDimensions))
+		for name, value := range m.OptionalDimensions {
+			document[name] = value
+			optionalDimensionNames = append(optionalDimensionNames, name)
+		}
+		sort.Strings(optionalDimensionNames)
+		dimensionSets = append(dimensionSets, append(append([]string{}, dimensionNames...), optionalDimensionNames...))
+	}
+
+	metricDefinitions := make([]map[string]string, 0, len(metrics))
+	for _, metric := range metrics {
+		if offset >= len(metric.values) {
+			continue
+		}
+		values := metric.values[offset:]
+		if len(values) > maxEMFMetricValues {
+			values = values[:maxEMFMetricValues]
+		}
+		metricDefinitions = append(metricDefinitions, map[string]string{
+			"Name": metric.name,
+			"Unit": string(metric.unit),
+		})
+		if len(values) == 1 {
+			document[metric.name] = values[0]
+		} else {
+			document[metric.name] = values
+		}
+	}
+	if len(metricDefinitions) == 0 {
+		return nil
+	}
+
+	document["_aws"] = map[string]interface{}{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  m.Namespace,
+			"Dimensions": dimensionSets,
+			"Metrics":    metricDefinitions,
+		}},
+	}
+	return document
+}
+
+// dimensionsKey returns a string which is the same for any two equal sets of dimensions.
+func dimensionsKey(dimensions map[string]string) string {
+	pairs := make([]string, 0, len(dimensions))
+	for name, value := range dimensions {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
+
+// statusClass groups a HTTP status code into its class, such as "2xx", for use as a metric dimension.
+// A status code of 0 means there was no response.
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "NoResponse"
+	}
+	return string(rune('0'+statusCode/100)) + "xx"
+}
+
+// appSyncApiIdFromLogGroup extracts the API ID from the name of an AppSync API's log group, which
+// has the format "/aws/appsync/apis/{graphql_api_id}". It returns an empty string for any other log
+// group.
+func appSyncApiIdFromLogGroup(logGroup string) string {
+	const appSyncLogGroupPrefix = "/aws/appsync/apis/"
+	if !strings.HasPrefix(logGroup, appSyncLogGroupPrefix) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(logGroup, appSyncLogGroupPrefix), "/", 2)[0]
+}
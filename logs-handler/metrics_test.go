@@ -0,0 +1,126 @@
+package logshandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	metrics := NewMetrics("TEST_NAMESPACE", map[string]string{"ApiId": "TEST_API_ID"})
+	metrics.Add("LogEvents", UnitCount, 10)
+	metrics.Add("SendLatency", UnitMilliseconds, 5)
+	metrics.Add("SendLatency", UnitMilliseconds, 7)
+	metrics.AddWithDimensions("Responses", UnitCount, 2, map[string]string{"StatusClass": "2xx"})
+	metrics.AddWithDimensions("Responses", UnitCount, 1, map[string]string{"StatusClass": "5xx"})
+
+	var output bytes.Buffer
+	err := metrics.Write(&output, time.UnixMilli(1669806236008))
+	require.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Equal(t, []string{
+		`{"ApiId":"TEST_API_ID","LogEvents":10,"SendLatency":[5,7],"_aws":{"CloudWatchMetrics":[{"Dimensions":[["ApiId"]],"Metrics":[{"Name":"LogEvents","Unit":"Count"},{"Name":"SendLatency","Unit":"Milliseconds"}],"Namespace":"TEST_NAMESPACE"}],"Timestamp":1669806236008}}`,
+		`{"ApiId":"TEST_API_ID","Responses":2,"StatusClass":"2xx","_aws":{"CloudWatchMetrics":[{"Dimensions":[["ApiId","StatusClass"]],"Metrics":[{"Name":"Responses","Unit":"Count"}],"Namespace":"TEST_NAMESPACE"}],"Timestamp":1669806236008}}`,
+		`{"ApiId":"TEST_API_ID","Responses":1,"StatusClass":"5xx","_aws":{"CloudWatchMetrics":[{"Dimensions":[["ApiId","StatusClass"]],"Metrics":[{"Name":"Responses","Unit":"Count"}],"Namespace":"TEST_NAMESPACE"}],"Timestamp":1669806236008}}`,
+	}, lines)
+}
+
+func TestMetricsWriteOptionalDimensions(t *testing.T) {
+	metrics := NewMetrics("TEST_NAMESPACE", map[string]string{"ApiId": "TEST_API_ID"})
+	metrics.OptionalDimensions = map[string]string{"LogGroup": "TEST_LOG_GROUP"}
+	metrics.Add("LogEvents", UnitCount, 10)
+	metrics.AddWithDimensions("Responses", UnitCount, 2, map[string]string{"StatusClass": "2xx"})
+
+	var output bytes.Buffer
+	err := metrics.Write(&output, time.UnixMilli(1669806236008))
+	require.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Equal(t, []string{
+		`{"ApiId":"TEST_API_ID","LogEvents":10,"LogGroup":"TEST_LOG_GROUP","_aws":{"CloudWatchMetrics":[{"Dimensions":[["ApiId"],["ApiId","LogGroup"]],"Metrics":[{"Name":"LogEvents","Unit":"Count"}],"Namespace":"TEST_NAMESPACE"}],"Timestamp":1669806236008}}`,
+		`{"ApiId":"TEST_API_ID","LogGroup":"TEST_LOG_GROUP","Responses":2,"StatusClass":"2xx","_aws":{"CloudWatchMetrics":[{"Dimensions":[["ApiId","StatusClass"],["ApiId","StatusClass","LogGroup"]],"Metrics":[{"Name":"Responses","Unit":"Count"}],"Namespace":"TEST_NAMESPACE"}],"Timestamp":1669806236008}}`,
+	}, lines)
+}
+
+func TestMetricsWriteManyValues(t *testing.T) {
+	metrics := NewMetrics("TEST_NAMESPACE", nil)
+	metrics.Add("LogEvents", UnitCount, 10)
+	for i := 0; i < 250; i++ {
+		metrics.Add("SendLatency", UnitMilliseconds, float64(i))
+	}
+
+	var output bytes.Buffer
+	err := metrics.Write(&output, time.Now())
+	require.Nil(t, err)
+
+	// EMF only allows 100 values per metric in each document
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	sendLatencies := []float64{}
+	for i, line := range lines {
+		var document struct {
+			LogEvents   *float64  `json:"LogEvents"`
+			SendLatency []float64 `json:"SendLatency"`
+		}
+		require.Nil(t, json.Unmarshal([]byte(line), &document))
+		assert.Equal(t, i == 0, document.LogEvents != nil)
+		assert.LessOrEqual(t, len(document.SendLatency), 100)
+		sendLatencies = append(sendLatencies, document.SendLatency...)
+	}
+	require.Len(t, sendLatencies, 250)
+	assert.Equal(t, float64(249), sendLatencies[249])
+}
+
+func TestMetricsWriteNothing(t *testing.T) {
+	var output bytes.Buffer
+	err := NewMetrics("TEST_NAMESPACE", nil).Write(&output, time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, "", output.String())
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(200))
+	assert.Equal(t, "4xx", statusClass(429))
+	assert.Equal(t, "5xx", statusClass(503))
+	assert.Equal(t, "NoResponse", statusClass(0))
+}
+
+func TestAppSyncApiIdFromLogGroup(t *testing.T) {
+	assert.Equal(t, "lcyxyv2rungh7gdht7ylrudsjy", appSyncApiIdFromLogGroup("/aws/appsync/apis/lcyxyv2rungh7gdht7ylrudsjy"))
+	assert.Equal(t, "", appSyncApiIdFromLogGroup("/aws/lambda/TEST_FUNCTION"))
+}
+
+// parseTestMetrics parses the EMF documents in output, and returns the value of each metric keyed by
+// its name and any extra dimension values, e.g. "DroppedEvents/BeginTracing".
+func parseTestMetrics(t *testing.T, output string, baseDimensions ...string) map[string]interface{} {
+	metrics := map[string]interface{}{}
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, `"_aws"`) {
+			continue
+		}
+		var document map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(line), &document))
+		emf := document["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		suffix := ""
+		for _, dimension := range emf["Dimensions"].([]interface{})[0].([]interface{}) {
+			isBaseDimension := false
+			for _, baseDimension := range baseDimensions {
+				isBaseDimension = isBaseDimension || dimension == baseDimension
+			}
+			if !isBaseDimension {
+				suffix += "/" + document[dimension.(string)].(string)
+			}
+		}
+		for _, metric := range emf["Metrics"].([]interface{}) {
+			name := metric.(map[string]interface{})["Name"].(string)
+			metrics[name+suffix] = document[name]
+		}
+	}
+	return metrics
+}
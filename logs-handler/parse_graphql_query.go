@@ -0,0 +1,57 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const graphQLQueryOperationSeparator = ", Operation: "
+const graphQLQueryVariablesSeparator = ", Variables: "
+
+var graphQLNameRegexp = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// Parses the payload of a "GraphQL Query: " log, which AppSync gives us in the format
+// "{query}, Operation: {operationName}, Variables: {variables}". The query document and the variables
+// may both contain the separators, so the variables are found by looking for the first
+// ", Variables: " which is followed by valid JSON, and the operation name by looking for the last
+// ", Operation: " before it which is followed by a valid GraphQL name. If the payload isn't in the
+// expected format then the whole payload is returned as the query.
+func parseGraphQLQueryLog(payload string) (query string, operationName *string, variables *json.RawMessage) {
+	variablesIndex := -1
+	for searchFrom := 0; searchFrom < len(payload); {
+		index := strings.Index(payload[searchFrom:], graphQLQueryVariablesSeparator)
+		if index == -1 {
+			break
+		}
+		index += searchFrom
+		if json.Valid([]byte(payload[index+len(graphQLQueryVariablesSeparator):])) {
+			variablesIndex = index
+			break
+		}
+		searchFrom = index + 1
+	}
+	if variablesIndex == -1 {
+		return payload, nil, nil
+	}
+
+	operationIndex := strings.LastIndex(payload[:variablesIndex], graphQLQueryOperationSeparator)
+	if operationIndex == -1 {
+		return payload, nil, nil
+	}
+	operation := payload[operationIndex+len(graphQLQueryOperationSeparator) : variablesIndex]
+	if operation != "null" && !graphQLNameRegexp.MatchString(operation) {
+		return payload, nil, nil
+	}
+
+	query = payload[:operationIndex]
+	if operation != "null" {
+		operationName = &operation
+	}
+	variablesString := strings.TrimSpace(payload[variablesIndex+len(graphQLQueryVariablesSeparator):])
+	if variablesString != "null" {
+		rawVariables := json.RawMessage(variablesString)
+		variables = &rawVariables
+	}
+	return query, operationName, variables
+}
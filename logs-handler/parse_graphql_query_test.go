@@ -0,0 +1,56 @@
+package logshandler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGraphQLQueryLog(t *testing.T) {
+	query, operationName, variables := parseGraphQLQueryLog("query MyQuery {\n  getPost(id: $id) {\n    id\n  }\n}\n, Operation: MyQuery, Variables: {\"id\":\"TEST_ID\"}")
+	assert.Equal(t, "query MyQuery {\n  getPost(id: $id) {\n    id\n  }\n}\n", query)
+	require.NotNil(t, operationName)
+	assert.Equal(t, "MyQuery", *operationName)
+	require.NotNil(t, variables)
+	assert.Equal(t, "{\"id\":\"TEST_ID\"}", string(*variables))
+}
+
+func TestParseGraphQLQueryLogNullOperationAndVariables(t *testing.T) {
+	query, operationName, variables := parseGraphQLQueryLog("{ listPosts { id } }, Operation: null, Variables: null")
+	assert.Equal(t, "{ listPosts { id } }", query)
+	assert.Nil(t, operationName)
+	assert.Nil(t, variables)
+}
+
+func TestParseGraphQLQueryLogSeparatorsInQuery(t *testing.T) {
+	query, operationName, variables := parseGraphQLQueryLog(
+		`query MyQuery { search(text: "a, Operation: B, Variables: {}, c") { id } }, Operation: MyQuery, Variables: {"filter":{"nested":{"text":", Variables: {}"}},"list":[1,2]}`,
+	)
+	assert.Equal(t, `query MyQuery { search(text: "a, Operation: B, Variables: {}, c") { id } }`, query)
+	require.NotNil(t, operationName)
+	assert.Equal(t, "MyQuery", *operationName)
+	require.NotNil(t, variables)
+	assert.Equal(t, `{"filter":{"nested":{"text":", Variables: {}"}},"list":[1,2]}`, string(*variables))
+}
+
+func TestParseGraphQLQueryLogNoSeparators(t *testing.T) {
+	query, operationName, variables := parseGraphQLQueryLog("TEST_QUERY")
+	assert.Equal(t, "TEST_QUERY", query)
+	assert.Nil(t, operationName)
+	assert.Nil(t, variables)
+}
+
+func TestParseGraphQLQueryLogInvalidVariables(t *testing.T) {
+	query, operationName, variables := parseGraphQLQueryLog("TEST_QUERY, Operation: MyQuery, Variables: {")
+	assert.Equal(t, "TEST_QUERY, Operation: MyQuery, Variables: {", query)
+	assert.Nil(t, operationName)
+	assert.Nil(t, variables)
+}
+
+func TestParseGraphQLQueryLogInvalidOperationName(t *testing.T) {
+	query, operationName, variables := parseGraphQLQueryLog("TEST_QUERY, Operation: My Query, Variables: {}")
+	assert.Equal(t, "TEST_QUERY, Operation: My Query, Variables: {}", query)
+	assert.Nil(t, operationName)
+	assert.Nil(t, variables)
+}
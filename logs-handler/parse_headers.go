@@ -1,4 +1,4 @@
-package main
+package logshandler
 
 import (
 	"errors"
@@ -8,12 +8,12 @@ import (
 
 // Trims the open and closing curly braces from the headers string we get from Cloudwatch
 func trimHeadersString(headersString string) (string, error) {
-	if headersString[0] == '{' {
+	if len(headersString) > 0 && headersString[0] == '{' {
 		headersString = headersString[1:]
 	} else {
 		return "", errors.New("headers string should start with '{'")
 	}
-	if headersString[len(headersString)-1] == '}' {
+	if len(headersString) > 0 && headersString[len(headersString)-1] == '}' {
 		headersString = headersString[:len(headersString)-1]
 	} else {
 		return "", errors.New("headers string should end with '}'")
@@ -21,45 +21,210 @@ func trimHeadersString(headersString string) (string, error) {
 	return headersString, nil
 }
 
-// (ー_ー)!! I am ashamed of this, please do not talk to me about it
 // Parses the headers string we get from CloudWatch into a map[string]string.
+// NOTE: AppSync gives us response headers in the format of Java's Map.toString(). Header values may
+// contain commas, so the boundaries between headers are found by looking for the start of the next
+// header name rather than splitting on commas. A Map can't hold a header name more than once, so if
+// one is repeated, its last value is kept, as Map.put would. Its values aren't joined, as joining
+// them with ", " could create a boundary which would be read as another header.
 func parseHeaders(headersString string) (map[string]string, error) {
 	headersString, err := trimHeadersString(headersString)
 	if err != nil {
 		return nil, err
 	}
 	headers := map[string]string{}
-	parts := strings.Split(headersString, ",")
-	for _, part := range parts {
-		subparts := strings.SplitN(part, "=", 2)
-		if len(subparts) != 2 {
-			return nil, fmt.Errorf("header had !=2 subparts when split by first '=': %s", part)
+	tokenizer := &headersTokenizer{input: headersString}
+	for !tokenizer.done() {
+		key, err := tokenizer.readKey()
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = tokenizer.readValue()
+		if err := tokenizer.readSeparator(); err != nil {
+			return nil, err
 		}
-		headers[strings.Trim(subparts[0], " ")] = subparts[1]
 	}
 	return headers, nil
 }
 
-// (ー_ー)!! I am ashamed of this, please do not talk to me about it
-// Parses the multivalue headers string we get from CloudWatch into a map[string]string.
-// NOTE: AppSync gives us request headers in a plaintext format where values are comma separated.
-// We can't split these values by commas to separate out the individual values, however, as some
-// header values such as that of the User-Agent header may themselves contain a comma.
+// Parses the multivalue headers string we get from CloudWatch into a map[string][]string.
+// NOTE: AppSync gives us request headers in the format of Java's Map.toString(), where each value is
+// a list of strings joined with ", ". Some header values, such as dates and the User-Agent header,
+// may themselves contain a comma, so lists are only split by splitListValue where that's unambiguous.
+// If a header name appears more than once, the values of each of its lists are appended together.
 func parseMultivalueHeaders(headersString string) (map[string][]string, error) {
 	headersString, err := trimHeadersString(headersString)
 	if err != nil {
 		return nil, err
 	}
 	headers := map[string][]string{}
-	for i, part := range strings.Split(headersString, "],") {
-		subparts := strings.SplitN(part, "=[", 2)
-		if len(subparts) != 2 {
-			return nil, fmt.Errorf("multivalue header had !=2 subparts when split by first '=[': %s", part)
+	tokenizer := &headersTokenizer{input: headersString, listValues: true}
+	for !tokenizer.done() {
+		key, err := tokenizer.readKey()
+		if err != nil {
+			return nil, err
+		}
+		value, isEmpty, err := tokenizer.readListValue()
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := headers[key]; !exists {
+			headers[key] = []string{}
 		}
-		if i == len(headers) && subparts[1][len(subparts[1])-1] == ']' {
-			subparts[1] = subparts[1][:len(subparts[1])-1]
+		if !isEmpty {
+			headers[key] = append(headers[key], splitListValue(key, value)...)
+		}
+		if err := tokenizer.readSeparator(); err != nil {
+			return nil, err
 		}
-		headers[strings.Trim(subparts[0], " ")] = []string{subparts[1]}
 	}
 	return headers, nil
 }
+
+// singleValueHeaders are the (lowercase) names of request headers whose values aren't comma
+// separated lists, but may contain a ", ", so their lists can't be split unambiguously.
+var singleValueHeaders = map[string]bool{
+	"authorization":       true,
+	"cookie":              true,
+	"date":                true,
+	"expires":             true,
+	"if-modified-since":   true,
+	"if-range":            true,
+	"if-unmodified-since": true,
+	"last-modified":       true,
+	"proxy-authorization": true,
+	"retry-after":         true,
+	"user-agent":          true,
+}
+
+// splitListValue splits the contents of a list from a multivalue headers string into its values.
+// The list is split on each ", " which isn't inside a quoted string or a comment in parentheses, as
+// defined in RFC 7230, unless the header is one of singleValueHeaders, in which case the whole list
+// is kept as a single value. Empty values are dropped.
+func splitListValue(key string, value string) []string {
+	if singleValueHeaders[strings.ToLower(key)] {
+		return []string{value}
+	}
+	values := []string{}
+	start, inQuotes, commentDepth := 0, false, 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case inQuotes && value[i] == '\\':
+			i++
+		case value[i] == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case value[i] == '(':
+			commentDepth++
+		case value[i] == ')' && commentDepth > 0:
+			commentDepth--
+		case commentDepth == 0 && strings.HasPrefix(value[i:], ", "):
+			if i > start {
+				values = append(values, value[start:i])
+			}
+			start = i + 2
+			i++
+		}
+	}
+	if start < len(value) {
+		values = append(values, value[start:])
+	}
+	return values
+}
+
+// headersTokenizer reads through the contents of a headers string in the format of Java's
+// Map.toString(), which is "key1=value1, key2=value2". Neither the keys nor the values are escaped,
+// so the only way to find where a value ends is to look ahead for the start of the next header,
+// which is a ", " followed by a valid header name and a "=". If listValues is true, the values are
+// lists surrounded by square brackets, so the next header must also start with "=[" and the value
+// must end with a "]".
+type headersTokenizer struct {
+	input      string
+	pos        int
+	listValues bool
+}
+
+func (t *headersTokenizer) done() bool {
+	return t.pos >= len(t.input)
+}
+
+// readKey reads a header name up to and including the following '='.
+func (t *headersTokenizer) readKey() (string, error) {
+	for !t.done() && t.input[t.pos] == ' ' {
+		t.pos++
+	}
+	start := t.pos
+	for !t.done() && isHeaderNameChar(t.input[t.pos]) {
+		t.pos++
+	}
+	if t.done() || t.input[t.pos] != '=' || t.pos == start {
+		return "", fmt.Errorf("expected header name followed by '=' at offset %d of headers string: %s", start, t.input)
+	}
+	key := t.input[start:t.pos]
+	t.pos++
+	return key, nil
+}
+
+// readValue reads a value up to the start of the next header or the end of the input.
+func (t *headersTokenizer) readValue() string {
+	start := t.pos
+	for !t.isValueBoundary(t.pos) {
+		t.pos++
+	}
+	return t.input[start:t.pos]
+}
+
+// readListValue reads a value surrounded by square brackets, and returns the contents of the
+// brackets. isEmpty is true if the list was "[]".
+func (t *headersTokenizer) readListValue() (value string, isEmpty bool, err error) {
+	if t.done() || t.input[t.pos] != '[' {
+		return "", false, fmt.Errorf("expected '[' at offset %d of headers string: %s", t.pos, t.input)
+	}
+	start := t.pos + 1
+	for end := start; end < len(t.input); end++ {
+		if t.input[end] == ']' && t.isValueBoundary(end+1) {
+			t.pos = end + 1
+			return t.input[start:end], end == start, nil
+		}
+	}
+	return "", false, fmt.Errorf("expected ']' to close list starting at offset %d of headers string: %s", t.pos, t.input)
+}
+
+// readSeparator reads the ", " between two headers, if we haven't reached the end of the input.
+func (t *headersTokenizer) readSeparator() error {
+	if t.done() {
+		return nil
+	}
+	if !strings.HasPrefix(t.input[t.pos:], ", ") {
+		return fmt.Errorf("expected ', ' at offset %d of headers string: %s", t.pos, t.input)
+	}
+	t.pos += 2
+	return nil
+}
+
+// isValueBoundary returns true if pos is the end of the input, or the start of a separator followed
+// by another header.
+func (t *headersTokenizer) isValueBoundary(pos int) bool {
+	if pos == len(t.input) {
+		return true
+	}
+	if !strings.HasPrefix(t.input[pos:], ", ") {
+		return false
+	}
+	pos += 2
+	start := pos
+	for pos < len(t.input) && isHeaderNameChar(t.input[pos]) {
+		pos++
+	}
+	if pos == start || !strings.HasPrefix(t.input[pos:], "=") {
+		return false
+	}
+	return !t.listValues || strings.HasPrefix(t.input[pos:], "=[")
+}
+
+// isHeaderNameChar returns true if c is a valid character in a HTTP header name, which is a "token"
+// as defined in RFC 7230.
+func isHeaderNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
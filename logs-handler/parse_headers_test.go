@@ -1,6 +1,8 @@
-package main
+package logshandler
 
 import (
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -39,7 +41,59 @@ func TestParseHeadersMalformed(t *testing.T) {
 	result, err := parseHeaders(testString)
 	assert.Nil(t, result)
 	require.NotNil(t, err)
-	assert.Equal(t, "header had !=2 subparts when split by first '=': Content-Type:application/json; charset:UTF-8", err.Error())
+	assert.Equal(t, "expected header name followed by '=' at offset 0 of headers string: Content-Type:application/json; charset:UTF-8", err.Error())
+}
+
+func TestParseHeadersCommasInValues(t *testing.T) {
+	testString := "{Content-Type=application/json; charset=UTF-8, Vary=Origin, Accept-Encoding, X-Json={\"a\":[1,2], \"b\":\"c=d\"}, Link=<https://example.com/?a=b>; rel=next}"
+
+	result, err := parseHeaders(testString)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string]string{
+		"Content-Type": "application/json; charset=UTF-8",
+		"Vary":         "Origin, Accept-Encoding",
+		"X-Json":       `{"a":[1,2], "b":"c=d"}`,
+		"Link":         "<https://example.com/?a=b>; rel=next",
+	}, result)
+}
+
+func TestParseHeadersEmptyValues(t *testing.T) {
+	result, err := parseHeaders("{X-Empty=, X-Test=value, X-Trailing-Empty=}")
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string]string{
+		"X-Empty":          "",
+		"X-Test":           "value",
+		"X-Trailing-Empty": "",
+	}, result)
+}
+
+func TestParseHeadersRepeatedName(t *testing.T) {
+	result, err := parseHeaders("{Set-Cookie=a=1, X-Test=value, Set-Cookie=b=2}")
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string]string{
+		"Set-Cookie": "b=2",
+		"X-Test":     "value",
+	}, result)
+}
+
+func TestParseHeadersRepeatedNameBoundary(t *testing.T) {
+	// Joining the values with ", " would give "X-Empty=, 0=", which reparses as a header named "0"
+	result, err := parseHeaders("{X-Empty=, X-Empty=0=}")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"X-Empty": "0="}, result)
+
+	reparsedResult, err := parseHeaders(formatHeaders(result))
+	require.Nil(t, err)
+	assert.Equal(t, result, reparsedResult)
+}
+
+func TestParseHeadersEmpty(t *testing.T) {
+	result, err := parseHeaders("{}")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{}, result)
 }
 
 func TestParseMultiValueHeadersMalformed(t *testing.T) {
@@ -47,7 +101,7 @@ func TestParseMultiValueHeadersMalformed(t *testing.T) {
 	result, err := parseMultivalueHeaders(testString)
 	assert.Nil(t, result)
 	require.NotNil(t, err)
-	assert.Equal(t, "multivalue header had !=2 subparts when split by first '=[': Content-Type:[application/json; charset:UTF-8]", err.Error())
+	assert.Equal(t, "expected header name followed by '=' at offset 0 of headers string: Content-Type:[application/json; charset:UTF-8]", err.Error())
 }
 
 func TestParseHeadersNoOpenBrace(t *testing.T) {
@@ -75,8 +129,8 @@ func TestParseMultivalueHeaders(t *testing.T) {
 	assert.Equal(
 		t,
 		map[string][]string{
-			"accept":                       {"application/json, text/plain, */*"},
-			"accept-encoding":              {"gzip, deflate, br"},
+			"accept":                       {"application/json", "text/plain", "*/*"},
+			"accept-encoding":              {"gzip", "deflate", "br"},
 			"accept-language":              {"en-GB,en-US;q=0.9,en;q=0.8"},
 			"cloudfront-forwarded-proto":   {"https"},
 			"cloudfront-is-desktop-viewer": {"true"},
@@ -89,7 +143,7 @@ func TestParseMultivalueHeaders(t *testing.T) {
 			"host":                         {"c5dz3eobtjce7p4emob3koivpa.appsync-api.eu-west-1.amazonaws.com"},
 			"origin":                       {"https://eu-west-1.console.aws.amazon.com"},
 			"referer":                      {"https://eu-west-1.console.aws.amazon.com/"},
-			"sec-ch-ua":                    {"\"Google Chrome\";v=\"107\", \"Chromium\";v=\"107\", \"Not=A?Brand\";v=\"24\""},
+			"sec-ch-ua":                    {"\"Google Chrome\";v=\"107\"", "\"Chromium\";v=\"107\"", "\"Not=A?Brand\";v=\"24\""},
 			"sec-ch-ua-mobile":             {"?0"},
 			"sec-ch-ua-platform":           {"\"macOS\""},
 			"sec-fetch-dest":               {"empty"},
@@ -102,7 +156,7 @@ func TestParseMultivalueHeaders(t *testing.T) {
 			"x-amzn-requestid":             {"832cf953-06db-4b07-9e4f-8d5f8a7691e2"},
 			"x-amzn-trace-id":              {"Root=1-6384e16b-3d08b227276904141dcd192b"},
 			"x-api-key":                    {"****mgidri"},
-			"x-forwarded-for":              {"77.173.29.29, 15.158.40.15"},
+			"x-forwarded-for":              {"77.173.29.29", "15.158.40.15"},
 			"x-forwarded-port":             {"443"},
 			"x-forwarded-proto":            {"https"},
 			"content-length":               {"322"},
@@ -110,3 +164,199 @@ func TestParseMultivalueHeaders(t *testing.T) {
 		result,
 	)
 }
+
+func TestTrimHeadersStringEmpty(t *testing.T) {
+	result, err := trimHeadersString("")
+	assert.Zero(t, result)
+	require.NotNil(t, err)
+	assert.Equal(t, "headers string should start with '{'", err.Error())
+}
+
+func TestParseMultivalueHeadersEmpty(t *testing.T) {
+	result, err := parseMultivalueHeaders("{}")
+	require.Nil(t, err)
+	assert.Equal(t, map[string][]string{}, result)
+}
+
+func TestParseMultivalueHeadersBracketsAndCommas(t *testing.T) {
+	testString := `{cookie=[a=[1], b=2], x-json=[{"list":[[1,2],[3]],"key":"value"}], x-trailing=[value]]}`
+
+	result, err := parseMultivalueHeaders(testString)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"cookie":     {"a=[1], b=2"},
+		"x-json":     {`{"list":[[1,2],[3]],"key":"value"}`},
+		"x-trailing": {"value]"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersEmbeddedBoundary(t *testing.T) {
+	// A list which contains "], " followed by something that isn't a header name and "=[" is still
+	// part of the same header, so it's split into values rather than separate headers
+	testString := `{x-test=[a], not a header=[b], x-other=[c]}`
+
+	result, err := parseMultivalueHeaders(testString)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"x-test":  {"a]", "not a header=[b"},
+		"x-other": {"c"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersEmptyValues(t *testing.T) {
+	result, err := parseMultivalueHeaders("{x-empty-list=[], x-empty-string=[ ], x-test=[value]}")
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"x-empty-list":   {},
+		"x-empty-string": {" "},
+		"x-test":         {"value"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersSeveralValues(t *testing.T) {
+	result, err := parseMultivalueHeaders(`{accept=[text/html, application/json;q=0.9], x-forwarded-for=[203.0.113.1, 198.51.100.2, 192.0.2.3], x-test=[a, , b, ]}`)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"accept":          {"text/html", "application/json;q=0.9"},
+		"x-forwarded-for": {"203.0.113.1", "198.51.100.2", "192.0.2.3"},
+		"x-test":          {"a", "b"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersQuotesAndComments(t *testing.T) {
+	result, err := parseMultivalueHeaders(`{forwarded=[for="[2001:db8::1], x", for=192.0.2.1], via=[1.1 a (Proxy, v1), 1.0 b], x-escaped=["a\", b", c]}`)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"forwarded": {`for="[2001:db8::1], x"`, "for=192.0.2.1"},
+		"via":       {"1.1 a (Proxy, v1)", "1.0 b"},
+		"x-escaped": {`"a\", b"`, "c"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersSingleValueHeaders(t *testing.T) {
+	result, err := parseMultivalueHeaders(`{If-Modified-Since=[Wed, 21 Oct 2015 07:28:00 GMT], cookie=[a=1, b=2], user-agent=[Test/1.0, like Test/2.0]}`)
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"If-Modified-Since": {"Wed, 21 Oct 2015 07:28:00 GMT"},
+		"cookie":            {"a=1, b=2"},
+		"user-agent":        {"Test/1.0, like Test/2.0"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersRepeatedName(t *testing.T) {
+	result, err := parseMultivalueHeaders("{x-test=[value1, value2], x-other=[value], x-test=[value3]}")
+	require.Nil(t, err)
+
+	assert.Equal(t, map[string][]string{
+		"x-test":  {"value1", "value2", "value3"},
+		"x-other": {"value"},
+	}, result)
+}
+
+func TestParseMultivalueHeadersUnclosedList(t *testing.T) {
+	testString := "{x-test=[value, x-other=[value}"
+	result, err := parseMultivalueHeaders(testString)
+	assert.Nil(t, result)
+	require.NotNil(t, err)
+	assert.Equal(t, "expected ']' to close list starting at offset 7 of headers string: x-test=[value, x-other=[value", err.Error())
+}
+
+func TestParseMultivalueHeadersMissingSeparator(t *testing.T) {
+	// Without a ", " there is no boundary between the two headers, so it's all one value
+	result, err := parseMultivalueHeaders("{x-test=[value]x-other=[value]}")
+	require.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"x-test": {"value]x-other=[value"},
+	}, result)
+}
+
+// formatMultivalueHeaders formats headers in the same way AppSync does, ordered by header name.
+func formatMultivalueHeaders(headers map[string][]string) string {
+	keys := []string{}
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		if len(headers[key]) == 0 {
+			parts = append(parts, key+"=[]")
+		}
+		for _, value := range headers[key] {
+			parts = append(parts, key+"=["+value+"]")
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// formatHeaders formats headers in the same way AppSync does, ordered by header name.
+func formatHeaders(headers map[string]string) string {
+	keys := []string{}
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		parts = append(parts, key+"="+headers[key])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func FuzzParseHeaders(f *testing.F) {
+	for _, seed := range []string{
+		"{Content-Type=application/json; charset=UTF-8}",
+		"{Content-Type:application/json; charset:UTF-8}",
+		"Content-Type=application/json; charset=UTF-8}",
+		"{TEST_HEADER=TEST_VALUE}",
+		"{TEST_HEADER=[TEST_VALUE_1, TEST_VALUE_2]}",
+		"{Content-Type=application/json; charset=UTF-8, Vary=Origin, Accept-Encoding}",
+		"{X-Empty=, X-Test=value}",
+		"{}",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, headersString string) {
+		headers, err := parseHeaders(headersString)
+		if err != nil {
+			return
+		}
+		// Anything we can parse should come out the same after being formatted and parsed again
+		reparsedHeaders, err := parseHeaders(formatHeaders(headers))
+		require.Nil(t, err)
+		assert.Equal(t, headers, reparsedHeaders)
+	})
+}
+
+func FuzzParseMultivalueHeaders(f *testing.F) {
+	for _, seed := range []string{
+		"{Content-Type:[application/json; charset:UTF-8]}",
+		"Content-Type=application/json; charset=UTF-8}",
+		"{TEST_HEADER=[TEST_VALUE_1, TEST_VALUE_2]}",
+		"{TEST_HEADER=TEST_VALUE]}",
+		`{content-length=[322], referer=[https://eu-west-1.console.aws.amazon.com/], cloudfront-viewer-country=[NL], sec-fetch-site=[cross-site], x-amzn-requestid=[832cf953-06db-4b07-9e4f-8d5f8a7691e2], origin=[https://eu-west-1.console.aws.amazon.com], x-amz-user-agent=[AWS-Console-AppSync/], x-forwarded-port=[443], via=[2.0 00f66bc6263192200d1a0cdb83e969f8.cloudfront.net (CloudFront)], sec-ch-ua-mobile=[?0], cloudfront-viewer-asn=[1136], cloudfront-is-desktop-viewer=[true], host=[c5dz3eobtjce7p4emob3koivpa.appsync-api.eu-west-1.amazonaws.com], content-type=[application/json], sec-fetch-mode=[cors], x-forwarded-proto=[https], accept-language=[en-GB,en-US;q=0.9,en;q=0.8], x-forwarded-for=[77.173.29.29, 15.158.40.15], accept=[application/json, text/plain, */*], cloudfront-is-smarttv-viewer=[false], sec-ch-ua=["Google Chrome";v="107", "Chromium";v="107", "Not=A?Brand";v="24"], x-amzn-trace-id=[Root=1-6384e16b-3d08b227276904141dcd192b], cloudfront-is-tablet-viewer=[false], sec-ch-ua-platform=["macOS"], x-api-key=[****mgidri], cloudfront-forwarded-proto=[https], accept-encoding=[gzip, deflate, br], x-amz-cf-id=[uNT3aeWVqWr12Wz6b94neGhKRLPPa_o65dR40NZx4KQc08Lotbd_3g==], user-agent=[Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36], cloudfront-is-mobile-viewer=[false], sec-fetch-dest=[empty]}`,
+		`{cookie=[a=[1], b=2], x-json=[{"list":[[1,2],[3]],"key":"value"}], x-trailing=[value]]}`,
+		"{x-empty-list=[], x-test=[value]}",
+		"{}",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, headersString string) {
+		headers, err := parseMultivalueHeaders(headersString)
+		if err != nil {
+			return
+		}
+		// Anything we can parse should come out the same after being formatted and parsed again
+		reparsedHeaders, err := parseMultivalueHeaders(formatMultivalueHeaders(headers))
+		require.Nil(t, err)
+		assert.Equal(t, headers, reparsedHeaders)
+	})
+}
@@ -0,0 +1,438 @@
+package logshandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/lexer"
+)
+
+// RedactedValue replaces any header value, field or substring removed by a RedactionPolicy.
+const RedactedValue = "[REDACTED]"
+
+// redactionPattern is a regular expression whose matches are redacted. If isMatch is not nil, only
+// the matches for which it returns true are redacted.
+type redactionPattern struct {
+	regexp  *regexp.Regexp
+	isMatch func(string) bool
+}
+
+// builtinRedactionPatterns can be referred to by name in the patterns of a RedactionPolicy instead of
+// writing out a regular expression.
+var builtinRedactionPatterns = map[string]redactionPattern{
+	"email": {
+		regexp: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	// Card numbers are checked with the Luhn algorithm so that other long numbers, such as
+	// timestamps, aren't redacted.
+	"cardNumber": {
+		regexp:  regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+		isMatch: isLuhnValid,
+	},
+}
+
+// RedactionPolicy describes what is removed from each FiretailLog before it leaves the Lambda:
+//   - Headers named in HeaderDenylist have their values redacted. If HeaderAllowlist is non-empty,
+//     every header not named in it is also redacted. Header names are case insensitive.
+//   - FieldPaths are JSONPath-style paths, such as "$.context.arguments.password", to fields within
+//     each request and response mapping which are redacted. A "*" matches every key of an object,
+//     and "[*]" every element of a list. Paths to arguments are also applied to the GraphQL
+//     variables, which arguments are usually passed in, so "$.context.arguments.password" redacts
+//     the "password" variable too. Arguments and results can also appear in each mapping's
+//     transformedTemplate and as literals in the query, which paths can't be applied to, so if
+//     there are any FieldPaths, transformedTemplates are redacted whole and the query's string and
+//     number literals are replaced.
+//   - Patterns are regular expressions, or the name of one of the builtinRedactionPatterns, whose
+//     matches are redacted from every string in the log.
+type RedactionPolicy struct {
+	HeaderDenylist  []string `json:"headerDenylist"`
+	HeaderAllowlist []string `json:"headerAllowlist"`
+	FieldPaths      []string `json:"fieldPaths"`
+	Patterns        []string `json:"patterns"`
+
+	headerDenylist  map[string]bool
+	headerAllowlist map[string]bool
+	fieldPaths      [][]string
+	variablePaths   [][]string
+	patterns        []redactionPattern
+}
+
+// redactionPolicy is applied to every FiretailLog if it is not nil.
+var redactionPolicy *RedactionPolicy
+
+// parseRedactionPolicy parses and validates a RedactionPolicy from its JSON representation.
+func parseRedactionPolicy(value string) (*RedactionPolicy, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	policy := &RedactionPolicy{}
+	if err := decoder.Decode(policy); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling redaction policy")
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// compile prepares the exported fields of the policy so that it can be applied.
+func (p *RedactionPolicy) compile() error {
+	p.headerDenylist = map[string]bool{}
+	for _, header := range p.HeaderDenylist {
+		p.headerDenylist[strings.ToLower(header)] = true
+	}
+	p.headerAllowlist = map[string]bool{}
+	for _, header := range p.HeaderAllowlist {
+		p.headerAllowlist[strings.ToLower(header)] = true
+	}
+
+	p.fieldPaths = make([][]string, 0, len(p.FieldPaths))
+	p.variablePaths = [][]string{}
+	for _, fieldPath := range p.FieldPaths {
+		segments, err := parseRedactionFieldPath(fieldPath)
+		if err != nil {
+			return err
+		}
+		p.fieldPaths = append(p.fieldPaths, segments)
+		if len(segments) > 2 && (segments[0] == "context" || segments[0] == "*") && (segments[1] == "arguments" || segments[1] == "*") {
+			p.variablePaths = append(p.variablePaths, segments[2:])
+		}
+	}
+
+	p.patterns = make([]redactionPattern, 0, len(p.Patterns))
+	for _, pattern := range p.Patterns {
+		if builtinPattern, isBuiltin := builtinRedactionPatterns[pattern]; isBuiltin {
+			p.patterns = append(p.patterns, builtinPattern)
+			continue
+		}
+		compiledPattern, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid redaction pattern %q", pattern)
+		}
+		p.patterns = append(p.patterns, redactionPattern{regexp: compiledPattern})
+	}
+	return nil
+}
+
+// parseRedactionFieldPath splits a path such as "$.context.result.items[*].email" into the segments
+// "context", "result", "items", "[*]" and "email".
+func parseRedactionFieldPath(fieldPath string) ([]string, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(fieldPath, "$"), ".")
+	if path == "" {
+		return nil, fmt.Errorf("invalid redaction field path: %s", fieldPath)
+	}
+	segments := []string{}
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			return nil, fmt.Errorf("invalid redaction field path: %s", fieldPath)
+		}
+		key := part
+		if bracket := strings.IndexByte(part, '['); bracket != -1 {
+			key = part[:bracket]
+		}
+		if strings.IndexByte(key, ']') != -1 {
+			return nil, fmt.Errorf("invalid redaction field path: %s", fieldPath)
+		}
+		if key != "" {
+			segments = append(segments, key)
+		}
+		indices := part[len(key):]
+		for indices != "" {
+			end := strings.IndexByte(indices, ']')
+			if indices[0] != '[' || end == -1 {
+				return nil, fmt.Errorf("invalid redaction field path: %s", fieldPath)
+			}
+			index := indices[1:end]
+			if _, err := strconv.Atoi(index); index != "*" && err != nil {
+				return nil, fmt.Errorf("invalid redaction field path: %s", fieldPath)
+			}
+			segments = append(segments, indices[:end+1])
+			indices = indices[end+1:]
+		}
+	}
+	return segments, nil
+}
+
+// RedactFiretailLogs applies policy to each of firetailLogs. Any log which can't be redacted is
+// removed, so that it is never sent anywhere unredacted.
+func RedactFiretailLogs(policy *RedactionPolicy, firetailLogs map[string]*FiretailLog) error {
+	var errs error
+	for requestID, firetailLog := range firetailLogs {
+		if err := policy.Apply(firetailLog); err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "err redacting firetail log for request ID %s", requestID))
+			delete(firetailLogs, requestID)
+		}
+	}
+	return errs
+}
+
+// Apply redacts firetailLog in place according to the policy.
+func (p *RedactionPolicy) Apply(firetailLog *FiretailLog) error {
+	var err error
+	if firetailLog.RequestHeaders, err = p.redactRawMessage(firetailLog.RequestHeaders, p.redactHeaders); err != nil {
+		return errors.WithMessage(err, "err redacting request headers")
+	}
+	if firetailLog.ResponseHeaders, err = p.redactRawMessage(firetailLog.ResponseHeaders, p.redactHeaders); err != nil {
+		return errors.WithMessage(err, "err redacting response headers")
+	}
+	if err = p.redactMappings(firetailLog.RequestMappings); err != nil {
+		return errors.WithMessage(err, "err redacting request mappings")
+	}
+	if err = p.redactMappings(firetailLog.ResponseMappings); err != nil {
+		return errors.WithMessage(err, "err redacting response mappings")
+	}
+	if firetailLog.Variables, err = p.redactRawMessage(firetailLog.Variables, p.redactFields(p.variablePaths)); err != nil {
+		return errors.WithMessage(err, "err redacting variables")
+	}
+	for _, rawMessage := range []**json.RawMessage{&firetailLog.ExecutionSummary, &firetailLog.RequestSummary} {
+		if *rawMessage, err = p.redactRawMessage(*rawMessage, p.redactPatterns); err != nil {
+			return errors.WithMessage(err, "err redacting log")
+		}
+	}
+	if firetailLog.Query != nil {
+		query := *firetailLog.Query
+		if len(p.fieldPaths) > 0 {
+			query = redactQueryLiterals(query)
+		}
+		query, _ = p.redactString(query)
+		firetailLog.Query = &query
+	}
+	return nil
+}
+
+func (p *RedactionPolicy) redactMappings(mappings *[]json.RawMessage) error {
+	if mappings == nil {
+		return nil
+	}
+	redactedMappings := make([]json.RawMessage, len(*mappings))
+	for i, mapping := range *mappings {
+		redactedMapping, err := p.redactRawMessage(&mapping, p.redactMapping)
+		if err != nil {
+			return err
+		}
+		redactedMappings[i] = *redactedMapping
+	}
+	*mappings = redactedMappings
+	return nil
+}
+
+// redactMapping redacts the policy's field paths from a request or response mapping, followed by its
+// patterns. The mapping's transformedTemplate is the template rendered with the same arguments and
+// results the field paths apply to, so if there are any field paths, it's redacted whole.
+func (p *RedactionPolicy) redactMapping(value interface{}) (interface{}, bool) {
+	value, changed := p.redactFields(p.fieldPaths)(value)
+	if mapping, isMap := value.(map[string]interface{}); isMap && len(p.fieldPaths) > 0 {
+		if _, hasTemplate := mapping["transformedTemplate"]; hasTemplate {
+			mapping["transformedTemplate"] = RedactedValue
+			changed = true
+		}
+	}
+	return value, changed
+}
+
+// redactFields returns a function which redacts each of fieldPaths from a value, followed by the
+// policy's patterns.
+func (p *RedactionPolicy) redactFields(fieldPaths [][]string) func(interface{}) (interface{}, bool) {
+	return func(value interface{}) (interface{}, bool) {
+		changed := false
+		for _, fieldPath := range fieldPaths {
+			var fieldChanged bool
+			value, fieldChanged = redactFieldPath(value, fieldPath)
+			changed = changed || fieldChanged
+		}
+		value, patternsChanged := p.redactPatterns(value)
+		return value, changed || patternsChanged
+	}
+}
+
+// redactRawMessage decodes rawMessage, passes it through redact, and re-encodes it if redact changed
+// anything. Unchanged messages are returned as they are so that their formatting is preserved.
+func (p *RedactionPolicy) redactRawMessage(rawMessage *json.RawMessage, redact func(interface{}) (interface{}, bool)) (*json.RawMessage, error) {
+	if rawMessage == nil {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(*rawMessage))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value, changed := redact(value)
+	if !changed {
+		return rawMessage, nil
+	}
+	redactedBytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	redactedMessage := json.RawMessage(redactedBytes)
+	return &redactedMessage, nil
+}
+
+// redactHeaders redacts a map of header names to either a single value or a list of values.
+func (p *RedactionPolicy) redactHeaders(value interface{}) (interface{}, bool) {
+	headers, isMap := value.(map[string]interface{})
+	if !isMap {
+		return p.redactPatterns(value)
+	}
+	changed := false
+	for name, headerValue := range headers {
+		lowerName := strings.ToLower(name)
+		if p.headerDenylist[lowerName] || (len(p.headerAllowlist) > 0 && !p.headerAllowlist[lowerName]) {
+			headers[name] = redactLeaves(headerValue)
+			changed = true
+			continue
+		}
+		var headerChanged bool
+		headers[name], headerChanged = p.redactPatterns(headerValue)
+		changed = changed || headerChanged
+	}
+	return headers, changed
+}
+
+// redactPatterns redacts every match of the policy's patterns from the strings within value.
+func (p *RedactionPolicy) redactPatterns(value interface{}) (interface{}, bool) {
+	if len(p.patterns) == 0 {
+		return value, false
+	}
+	switch typedValue := value.(type) {
+	case string:
+		return p.redactString(typedValue)
+	case []interface{}:
+		changed := false
+		for i, element := range typedValue {
+			var elementChanged bool
+			typedValue[i], elementChanged = p.redactPatterns(element)
+			changed = changed || elementChanged
+		}
+		return typedValue, changed
+	case map[string]interface{}:
+		changed := false
+		for key, element := range typedValue {
+			var elementChanged bool
+			typedValue[key], elementChanged = p.redactPatterns(element)
+			changed = changed || elementChanged
+		}
+		return typedValue, changed
+	default:
+		return value, false
+	}
+}
+
+func (p *RedactionPolicy) redactString(value string) (string, bool) {
+	redacted := value
+	for _, pattern := range p.patterns {
+		redacted = pattern.regexp.ReplaceAllStringFunc(redacted, func(match string) string {
+			if pattern.isMatch != nil && !pattern.isMatch(match) {
+				return match
+			}
+			return RedactedValue
+		})
+	}
+	return redacted, redacted != value
+}
+
+// redactQueryLiterals replaces each string literal in a GraphQL query with a string holding
+// RedactedValue, and each number literal with 0, so that the query is still valid GraphQL. If the
+// query can't be tokenized, the literals can't be found, so the whole query is redacted.
+func redactQueryLiterals(query string) string {
+	// The lexer's positions are in runes rather than bytes
+	queryRunes := []rune(query)
+	var redacted strings.Builder
+	queryLexer := lexer.New(&ast.Source{Input: query})
+	end := 0
+	for {
+		token, err := queryLexer.ReadToken()
+		if err != nil {
+			return RedactedValue
+		}
+		if token.Kind == lexer.EOF {
+			break
+		}
+		var replacement string
+		switch token.Kind {
+		case lexer.String, lexer.BlockString:
+			replacement = strconv.Quote(RedactedValue)
+		case lexer.Int, lexer.Float:
+			replacement = "0"
+		default:
+			continue
+		}
+		redacted.WriteString(string(queryRunes[end:token.Pos.Start]))
+		redacted.WriteString(replacement)
+		end = token.Pos.End
+	}
+	redacted.WriteString(string(queryRunes[end:]))
+	return redacted.String()
+}
+
+// isLuhnValid returns true if the digits in value have a valid Luhn checksum. Any other characters
+// are ignored.
+func isLuhnValid(value string) bool {
+	sum, digits := 0, 0
+	for i := len(value) - 1; i >= 0; i-- {
+		if value[i] < '0' || value[i] > '9' {
+			continue
+		}
+		digit := int(value[i] - '0')
+		if digits%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		digits++
+	}
+	return digits > 0 && sum%10 == 0
+}
+
+// redactFieldPath redacts the fields within value found by following the segments of a field path.
+func redactFieldPath(value interface{}, segments []string) (interface{}, bool) {
+	if len(segments) == 0 {
+		return RedactedValue, true
+	}
+	segment, remainingSegments := segments[0], segments[1:]
+	changed := false
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, element := range typedValue {
+			if segment == "*" || segment == key {
+				var elementChanged bool
+				typedValue[key], elementChanged = redactFieldPath(element, remainingSegments)
+				changed = changed || elementChanged
+			}
+		}
+	case []interface{}:
+		if !strings.HasPrefix(segment, "[") {
+			break
+		}
+		index, err := strconv.Atoi(segment[1 : len(segment)-1])
+		for i, element := range typedValue {
+			if segment == "[*]" || (err == nil && i == index) {
+				var elementChanged bool
+				typedValue[i], elementChanged = redactFieldPath(element, remainingSegments)
+				changed = changed || elementChanged
+			}
+		}
+	}
+	return value, changed
+}
+
+// redactLeaves replaces value with RedactedValue, keeping the shape of any lists so that, for
+// example, a multivalue header keeps its number of values.
+func redactLeaves(value interface{}) interface{} {
+	if list, isList := value.([]interface{}); isList {
+		for i, element := range list {
+			list[i] = redactLeaves(element)
+		}
+		return list
+	}
+	return RedactedValue
+}
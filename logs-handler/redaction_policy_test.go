@@ -0,0 +1,246 @@
+package logshandler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rawMessagePtr(value string) *json.RawMessage {
+	rawMessage := json.RawMessage(value)
+	return &rawMessage
+}
+
+func TestParseRedactionPolicy(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{
+		"headerDenylist": ["Authorization"],
+		"fieldPaths": ["$.context.arguments.password"],
+		"patterns": ["email", "secret-[0-9]+"]
+	}`)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]bool{"authorization": true}, policy.headerDenylist)
+	assert.Equal(t, [][]string{{"context", "arguments", "password"}}, policy.fieldPaths)
+	assert.Equal(t, [][]string{{"password"}}, policy.variablePaths)
+	assert.Len(t, policy.patterns, 2)
+}
+
+func TestParseRedactionPolicyErrs(t *testing.T) {
+	testCases := map[string]string{
+		`{"headerBlocklist": []}`:         "err unmarshalling redaction policy: json: unknown field \"headerBlocklist\"",
+		`{"fieldPaths": ["$.a..b"]}`:      "invalid redaction field path: $.a..b",
+		`{"patterns": ["[unterminated"]}`: "invalid redaction pattern \"[unterminated\": error parsing regexp: missing closing ]: `[unterminated`",
+	}
+	for policyJson, expectedErr := range testCases {
+		policy, err := parseRedactionPolicy(policyJson)
+		require.NotNil(t, err, policyJson)
+		assert.Equal(t, expectedErr, err.Error())
+		assert.Nil(t, policy)
+	}
+}
+
+func TestParseRedactionFieldPath(t *testing.T) {
+	testCases := map[string][]string{
+		"$.context.arguments.password":    {"context", "arguments", "password"},
+		"context.arguments":               {"context", "arguments"},
+		"$.context.result.items[*].email": {"context", "result", "items", "[*]", "email"},
+		"$.context.result[0][1]":          {"context", "result", "[0]", "[1]"},
+		"$[*].*":                          {"[*]", "*"},
+	}
+	for fieldPath, expectedSegments := range testCases {
+		segments, err := parseRedactionFieldPath(fieldPath)
+		require.Nil(t, err, fieldPath)
+		assert.Equal(t, expectedSegments, segments, fieldPath)
+	}
+
+	for _, fieldPath := range []string{"$", "", "$.a.", "$.a[", "$.a[b]", "$.a]"} {
+		_, err := parseRedactionFieldPath(fieldPath)
+		require.NotNil(t, err, fieldPath)
+		assert.Equal(t, "invalid redaction field path: "+fieldPath, err.Error())
+	}
+}
+
+func TestRedactionPolicyHeaderDenylist(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"headerDenylist": ["authorization", "X-API-KEY", "cookie"]}`)
+	require.Nil(t, err)
+	firetailLog := &FiretailLog{
+		RequestHeaders:  rawMessagePtr(`{"Authorization":["Bearer TEST_TOKEN"],"x-api-key":["a","b"],"host":["example.com"]}`),
+		ResponseHeaders: rawMessagePtr(`{"Cookie":"TEST_COOKIE","Content-Type":"application/json"}`),
+	}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, `{"Authorization":["[REDACTED]"],"host":["example.com"],"x-api-key":["[REDACTED]","[REDACTED]"]}`, string(*firetailLog.RequestHeaders))
+	assert.Equal(t, `{"Content-Type":"application/json","Cookie":"[REDACTED]"}`, string(*firetailLog.ResponseHeaders))
+}
+
+func TestRedactionPolicyHeaderAllowlist(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"headerAllowlist": ["Host"]}`)
+	require.Nil(t, err)
+	firetailLog := &FiretailLog{
+		RequestHeaders: rawMessagePtr(`{"authorization":["Bearer TEST_TOKEN"],"host":["example.com"]}`),
+	}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, `{"authorization":["[REDACTED]"],"host":["example.com"]}`, string(*firetailLog.RequestHeaders))
+}
+
+func TestRedactionPolicyFieldPaths(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"fieldPaths": [
+		"$.context.arguments.password",
+		"$.context.result.items[*].email",
+		"$.context.stash.*"
+	]}`)
+	require.Nil(t, err)
+	firetailLog := &FiretailLog{
+		RequestMappings: &[]json.RawMessage{
+			json.RawMessage(`{"context":{"arguments":{"username":"TEST_USER","password":"TEST_PASSWORD"},"stash":{"a":1,"b":{"c":true}}},"fieldName":"login"}`),
+			json.RawMessage(`{ "context": { "arguments": {} } }`),
+		},
+		ResponseMappings: &[]json.RawMessage{
+			json.RawMessage(`{"context":{"result":{"items":[{"id":1,"email":"a@example.com"},{"id":2}]}}}`),
+		},
+	}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, &[]json.RawMessage{
+		json.RawMessage(`{"context":{"arguments":{"password":"[REDACTED]","username":"TEST_USER"},"stash":{"a":"[REDACTED]","b":"[REDACTED]"}},"fieldName":"login"}`),
+		// Mappings with nothing to redact are left exactly as they were
+		json.RawMessage(`{ "context": { "arguments": {} } }`),
+	}, firetailLog.RequestMappings)
+	assert.Equal(t, &[]json.RawMessage{
+		json.RawMessage(`{"context":{"result":{"items":[{"email":"[REDACTED]","id":1},{"id":2}]}}}`),
+	}, firetailLog.ResponseMappings)
+}
+
+func TestRedactionPolicyFieldPathsRedactVariables(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"fieldPaths": [
+		"$.context.arguments.input.password",
+		"$.context.result.password"
+	]}`)
+	require.Nil(t, err)
+	firetailLog := &FiretailLog{
+		Variables: rawMessagePtr(`{"input":{"username":"TEST_USER","password":"TEST_PASSWORD"},"password":"TEST_OTHER_PASSWORD"}`),
+		RequestMappings: &[]json.RawMessage{
+			json.RawMessage(`{"context":{"arguments":{"input":{"username":"TEST_USER","password":"TEST_PASSWORD"}}}}`),
+		},
+	}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	// Only paths to arguments are applied to the variables
+	assert.Equal(t, `{"input":{"password":"[REDACTED]","username":"TEST_USER"},"password":"TEST_OTHER_PASSWORD"}`, string(*firetailLog.Variables))
+	assert.Equal(t, &[]json.RawMessage{
+		json.RawMessage(`{"context":{"arguments":{"input":{"password":"[REDACTED]","username":"TEST_USER"}}}}`),
+	}, firetailLog.RequestMappings)
+}
+
+func TestRedactionPolicyFieldPathsRedactTransformedTemplates(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"fieldPaths": ["$.context.arguments.password"]}`)
+	require.Nil(t, err)
+	firetailLog := &FiretailLog{
+		RequestMappings: &[]json.RawMessage{
+			json.RawMessage(`{"context":{"arguments":{"password":"hunter2"}},"transformedTemplate":"{\"password\":\"hunter2\"}"}`),
+		},
+	}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, &[]json.RawMessage{
+		json.RawMessage(`{"context":{"arguments":{"password":"[REDACTED]"}},"transformedTemplate":"[REDACTED]"}`),
+	}, firetailLog.RequestMappings)
+}
+
+func TestRedactionPolicyFieldPathsRedactQueryLiterals(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"fieldPaths": ["$.context.arguments.password"]}`)
+	require.Nil(t, err)
+	query := `mutation Login($username: String!) { login(username: $username, password: "hunter2", pin: 1234, ratio: 1.5, note: """ünïcode""") { token } }`
+	firetailLog := &FiretailLog{Query: &query}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, `mutation Login($username: String!) { login(username: $username, password: "[REDACTED]", pin: 0, ratio: 0, note: "[REDACTED]") { token } }`, *firetailLog.Query)
+}
+
+func TestRedactionPolicyFieldPathsRedactInvalidQuery(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"fieldPaths": ["$.context.arguments.password"]}`)
+	require.Nil(t, err)
+	query := `mutation { login(password: "hunter2`
+	firetailLog := &FiretailLog{Query: &query}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, RedactedValue, *firetailLog.Query)
+}
+
+func TestRedactionPolicyNoFieldPathsKeepsQueryLiterals(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"headerDenylist": ["authorization"]}`)
+	require.Nil(t, err)
+	query := `query { getPost(id: "TEST_ID", version: 2) { id } }`
+	firetailLog := &FiretailLog{Query: &query}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, `query { getPost(id: "TEST_ID", version: 2) { id } }`, *firetailLog.Query)
+}
+
+func TestRedactionPolicyPatterns(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"patterns": ["email", "cardNumber", "secret-[0-9]+"]}`)
+	require.Nil(t, err)
+	query := `mutation { pay(email: "jo@example.com", card: "4111 1111 1111 1111") }`
+	firetailLog := &FiretailLog{
+		Query:          &query,
+		Variables:      rawMessagePtr(`{"email":"jo@example.com","note":"uses secret-1234","timestamp":"1669806236008","count":4111111111111111}`),
+		RequestHeaders: rawMessagePtr(`{"x-contact":["jo@example.com"]}`),
+		ResponseMappings: &[]json.RawMessage{
+			json.RawMessage(`{"context":{"result":{"card":"4111-1111-1111-1111"}}}`),
+		},
+	}
+
+	err = policy.Apply(firetailLog)
+	require.Nil(t, err)
+
+	assert.Equal(t, `mutation { pay(email: "[REDACTED]", card: "[REDACTED]") }`, *firetailLog.Query)
+	// Numbers which fail the Luhn check, and JSON numbers, aren't redacted
+	assert.Equal(t, `{"count":4111111111111111,"email":"[REDACTED]","note":"uses [REDACTED]","timestamp":"1669806236008"}`, string(*firetailLog.Variables))
+	assert.Equal(t, `{"x-contact":["[REDACTED]"]}`, string(*firetailLog.RequestHeaders))
+	assert.Equal(t, &[]json.RawMessage{
+		json.RawMessage(`{"context":{"result":{"card":"[REDACTED]"}}}`),
+	}, firetailLog.ResponseMappings)
+}
+
+func TestRedactFiretailLogs(t *testing.T) {
+	policy, err := parseRedactionPolicy(`{"headerDenylist": ["authorization"]}`)
+	require.Nil(t, err)
+	firetailLogs := map[string]*FiretailLog{
+		"TEST_ID_1": {RequestID: "TEST_ID_1", RequestHeaders: rawMessagePtr(`{"authorization":["TEST_TOKEN"]}`)},
+		"TEST_ID_2": {RequestID: "TEST_ID_2", RequestHeaders: rawMessagePtr(`{"authorization":`)},
+	}
+
+	err = RedactFiretailLogs(policy, firetailLogs)
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* err redacting firetail log for request ID TEST_ID_2: err redacting request headers: unexpected EOF\n\n", err.Error())
+
+	assert.Equal(t, map[string]*FiretailLog{
+		"TEST_ID_1": {RequestID: "TEST_ID_1", RequestHeaders: rawMessagePtr(`{"authorization":["[REDACTED]"]}`)},
+	}, firetailLogs)
+}
+
+func TestIsLuhnValid(t *testing.T) {
+	assert.True(t, isLuhnValid("4111 1111 1111 1111"))
+	assert.True(t, isLuhnValid("5500-0000-0000-0004"))
+	assert.False(t, isLuhnValid("4111 1111 1111 1112"))
+	assert.False(t, isLuhnValid("1669806236008"))
+	assert.False(t, isLuhnValid(""))
+}
@@ -0,0 +1,91 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// RedriveResult summarises the outcome of a call to RedriveHandler.
+type RedriveResult struct {
+	Redriven int `json:"redriven"`
+	Failed   int `json:"failed"`
+}
+
+// RedriveHandler re-sends every dead letter in the configured dead letter sink to Firetail through
+// SendToFiretail, using the route it originally took. Dead letters which are successfully delivered
+// are removed from the sink. A dead letter may be split into several chunks when it's re-sent, so if
+// only some of them fail, the dead letter is replaced by a dead letter for each failed chunk, and the
+// chunks which were delivered aren't sent again by the next redrive. Dead letters whose route no
+// longer exists are left in the sink, unless they were sent to the default route's API URL.
+func RedriveHandler(ctx context.Context) (*RedriveResult, error) {
+	if deadLetterSink == nil {
+		return nil, errors.New("no dead letter sink configured")
+	}
+
+	result := &RedriveResult{}
+	err := deadLetterSink.ForEach(ctx, func(deadLetter *DeadLetter) error {
+		firetailLogs, err := deadLetter.FiretailLogs()
+		if err != nil {
+			logger.Error("Err decoding dead letter", LogFields{"requestIds": deadLetter.RequestIDs, "error": err})
+			result.Failed++
+			return err
+		}
+		route, err := redriveRoute(deadLetter)
+		if err != nil {
+			logger.Error("Err finding dead letter's route", LogFields{"requestIds": deadLetter.RequestIDs, "error": err})
+			result.Failed++
+			return err
+		}
+		chunkResults, err := SendToFiretail(ctx, firetailLogs, route.apiUrl(), route.apiTokenProvider())
+		if err != nil {
+			logger.Error("Err redriving dead letter", LogFields{"requestIds": deadLetter.RequestIDs, "error": err})
+			result.Failed++
+			return replaceWithFailedChunks(ctx, deadLetter, chunkResults, err)
+		}
+		result.Redriven++
+		return nil
+	})
+	logger.Info("Redrove dead letters", LogFields{"redriven": result.Redriven, "failed": result.Failed})
+	return result, err
+}
+
+// redriveRoute returns the route in the routingTable which deadLetter should be redriven through. If
+// its route has since been renamed or removed, the default route is only used if deadLetter was sent
+// to the same API URL, as the logs may otherwise belong to another Firetail account. Dead letters
+// without a route were stored before there were routes, so they took the default route.
+func redriveRoute(deadLetter *DeadLetter) (*Route, error) {
+	routeName := deadLetter.Route
+	if routeName == "" {
+		routeName = DefaultRouteName
+	}
+	route := routingTable.RouteNamed(routeName)
+	if route.Name != routeName && deadLetter.ApiUrl != route.apiUrl() {
+		return nil, fmt.Errorf("route %s no longer exists, and the dead letter was sent to %s rather than the default route's API URL", routeName, deadLetter.ApiUrl)
+	}
+	return route, nil
+}
+
+// replaceWithFailedChunks puts a new dead letter in the sink for each of the chunkResults of
+// deadLetter which failed, so that deadLetter can be removed. If none of its chunks were delivered,
+// or a new dead letter couldn't be put in the sink, an err is returned so that deadLetter stays in
+// the sink as it is.
+func replaceWithFailedChunks(ctx context.Context, deadLetter *DeadLetter, chunkResults []*ChunkResult, sendErr error) error {
+	failedChunkResults := []*ChunkResult{}
+	for _, chunkResult := range chunkResults {
+		if chunkResult.Err != nil {
+			failedChunkResults = append(failedChunkResults, chunkResult)
+		}
+	}
+	if len(failedChunkResults) == 0 || len(failedChunkResults) == len(chunkResults) {
+		return sendErr
+	}
+	for _, chunkResult := range failedChunkResults {
+		chunkResult.Route = deadLetter.Route
+		if err := deadLetterSink.Put(ctx, newDeadLetter(chunkResult)); err != nil {
+			logger.Error("Err replacing dead letter with its failed chunks", LogFields{"requestIds": deadLetter.RequestIDs, "error": err})
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedriveHandler(t *testing.T) {
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(requestBody))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	sink := &memoryDeadLetterSink{deadLetters: []*DeadLetter{
+		{Payload: "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n"},
+		{Payload: "not json\n"},
+	}}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	result, err := RedriveHandler(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, &RedriveResult{Redriven: 1, Failed: 1}, result)
+	assert.Equal(t, []string{"{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n"}, requestBodies)
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, "not json\n", sink.deadLetters[0].Payload)
+}
+
+func TestRedriveHandlerBadServer(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"fail"}`))
+	}))
+	firetailApiUrl = testServer.URL
+
+	sink := &memoryDeadLetterSink{deadLetters: []*DeadLetter{
+		{Payload: "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n"},
+	}}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	result, err := RedriveHandler(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, &RedriveResult{Redriven: 0, Failed: 1}, result)
+	assert.Len(t, sink.deadLetters, 1)
+}
+
+func TestRedriveHandlerPartialFailure(t *testing.T) {
+	maxChunkRecords = 1
+	defer func() { maxChunkRecords = DefaultMaxChunkRecords }()
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(requestBody))
+		if strings.Contains(string(requestBody), "TEST_ID_2") {
+			w.Write([]byte(`{"message":"fail"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer testServer.Close()
+	firetailApiUrl = testServer.URL
+
+	sink := &memoryDeadLetterSink{deadLetters: []*DeadLetter{{
+		Route:      DefaultRouteName,
+		RequestIDs: []string{"TEST_ID_1", "TEST_ID_2"},
+		Payload:    "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_2\"}\n",
+	}}}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	result, err := RedriveHandler(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, &RedriveResult{Redriven: 0, Failed: 1}, result)
+
+	// The dead letter is replaced by one holding only the chunk which failed
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, DefaultRouteName, sink.deadLetters[0].Route)
+	assert.Equal(t, testServer.URL, sink.deadLetters[0].ApiUrl)
+	assert.Equal(t, []string{"TEST_ID_2"}, sink.deadLetters[0].RequestIDs)
+	assert.Equal(t, "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_2\"}\n", sink.deadLetters[0].Payload)
+
+	// So the chunk which was delivered isn't sent again by the next redrive
+	requestBodies = []string{}
+	_, err = RedriveHandler(context.Background())
+	require.Nil(t, err)
+	for _, requestBody := range requestBodies {
+		assert.NotContains(t, requestBody, "TEST_ID_1")
+	}
+	assert.Len(t, sink.deadLetters, 1)
+}
+
+func TestRedriveHandlerPartialFailurePutErr(t *testing.T) {
+	maxChunkRecords = 1
+	defer func() { maxChunkRecords = DefaultMaxChunkRecords }()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		if strings.Contains(string(requestBody), "TEST_ID_2") {
+			w.Write([]byte(`{"message":"fail"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	defer testServer.Close()
+	firetailApiUrl = testServer.URL
+
+	deadLetter := &DeadLetter{
+		RequestIDs: []string{"TEST_ID_1", "TEST_ID_2"},
+		Payload:    "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_2\"}\n",
+	}
+	sink := &memoryDeadLetterSink{deadLetters: []*DeadLetter{deadLetter}, putErr: errors.New("TEST_ERR")}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	result, err := RedriveHandler(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, &RedriveResult{Redriven: 0, Failed: 1}, result)
+
+	// If the failed chunk can't be stored, the whole dead letter is kept
+	assert.Equal(t, []*DeadLetter{deadLetter}, sink.deadLetters)
+}
+
+func TestRedriveHandlerNoSink(t *testing.T) {
+	result, err := RedriveHandler(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "no dead letter sink configured", err.Error())
+	assert.Nil(t, result)
+}
+
+func TestRedriveHandlerUsesDeadLetterRoute(t *testing.T) {
+	apiKeys := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/orders", r.URL.Path)
+		apiKeys = append(apiKeys, r.Header.Get("x-ft-api-key"))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	table, err := parseRoutingTable([]byte(`{"routes": [{
+		"name": "orders",
+		"apiIds": ["ORDERS_API_ID"],
+		"apiUrl": "`+testServer.URL+`/orders",
+		"apiToken": "ORDERS_TOKEN"
+	}]}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+	routingTable = table
+	defer func() { routingTable = nil }()
+
+	deadLetterSink = &memoryDeadLetterSink{deadLetters: []*DeadLetter{
+		{Route: "orders", Payload: "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n"},
+	}}
+	defer func() { deadLetterSink = nil }()
+
+	result, err := RedriveHandler(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, &RedriveResult{Redriven: 1, Failed: 0}, result)
+	assert.Equal(t, []string{"ORDERS_TOKEN"}, apiKeys)
+}
+
+func TestRedriveHandlerRemovedRoute(t *testing.T) {
+	requestUrls := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestUrls = append(requestUrls, r.URL.Path)
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL + "/default"
+
+	table, err := parseRoutingTable([]byte(`{"routes": [{
+		"name": "orders",
+		"apiIds": ["ORDERS_API_ID"],
+		"apiUrl": "`+testServer.URL+`/orders",
+		"apiToken": "ORDERS_TOKEN"
+	}]}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+	routingTable = table
+	defer func() { routingTable = nil }()
+
+	// The payments route has been removed, so only its dead letter which was sent to the default
+	// route's API URL can be redriven
+	sink := &memoryDeadLetterSink{deadLetters: []*DeadLetter{
+		{Route: "payments", ApiUrl: testServer.URL + "/payments", Payload: "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n"},
+		{Route: "payments", ApiUrl: testServer.URL + "/default", Payload: "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_2\"}\n"},
+	}}
+	deadLetterSink = sink
+	defer func() { deadLetterSink = nil }()
+
+	result, err := RedriveHandler(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, &RedriveResult{Redriven: 1, Failed: 1}, result)
+	assert.Equal(t, []string{"/default"}, requestUrls)
+	require.Len(t, sink.deadLetters, 1)
+	assert.Equal(t, testServer.URL+"/payments", sink.deadLetters[0].ApiUrl)
+}
+
+func TestRedriveRoute(t *testing.T) {
+	firetailApiUrl = "TEST_DEFAULT_URL"
+	table, err := parseRoutingTable([]byte(`{"routes": [{
+		"name": "orders",
+		"apiIds": ["ORDERS_API_ID"],
+		"apiUrl": "TEST_ORDERS_URL",
+		"apiToken": "ORDERS_TOKEN"
+	}]}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+	routingTable = table
+	defer func() { routingTable = nil }()
+
+	route, err := redriveRoute(&DeadLetter{Route: "orders", ApiUrl: "TEST_OLD_ORDERS_URL"})
+	require.Nil(t, err)
+	assert.Equal(t, "orders", route.Name)
+
+	// Dead letters stored before there were routes took the default route
+	route, err = redriveRoute(&DeadLetter{ApiUrl: "TEST_OLD_DEFAULT_URL"})
+	require.Nil(t, err)
+	assert.Equal(t, DefaultRouteName, route.Name)
+
+	route, err = redriveRoute(&DeadLetter{Route: "payments", ApiUrl: "TEST_DEFAULT_URL"})
+	require.Nil(t, err)
+	assert.Equal(t, DefaultRouteName, route.Name)
+
+	route, err = redriveRoute(&DeadLetter{Route: "payments", ApiUrl: "TEST_PAYMENTS_URL"})
+	require.NotNil(t, err)
+	assert.Equal(t, "route payments no longer exists, and the dead letter was sent to TEST_PAYMENTS_URL rather than the default route's API URL", err.Error())
+	assert.Nil(t, route)
+}
@@ -0,0 +1,127 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultRequestStateTTL = 5 * time.Minute
+
+// RequestStateStore buffers the Firetail logs of requests which haven't yet been completed, so that
+// their events can be merged with those that arrive in later Cloudwatch deliveries. Concurrent
+// invocations may receive events for the same request, so each buffered Firetail log has a version,
+// and Put and Delete only change it if it's still at the version the caller got it at.
+type RequestStateStore interface {
+	// Get returns the buffered Firetail log for the given request ID and its version, or nil and a
+	// version of 0 if there isn't one.
+	Get(ctx context.Context, requestID string) (*FiretailLog, int64, error)
+	// Put buffers a Firetail log until it's completed or expiresAt passes, replacing any existing
+	// Firetail log for the same request ID. version is the version Get returned, and if the buffered
+	// Firetail log has changed since, a *RequestStateConflictError is returned.
+	Put(ctx context.Context, firetailLog *FiretailLog, expiresAt time.Time, version int64) error
+	// Delete removes the buffered Firetail log for the given request ID, if there is one. version is
+	// the version Get returned, and if the buffered Firetail log has changed since, a
+	// *RequestStateConflictError is returned.
+	Delete(ctx context.Context, requestID string, version int64) error
+	// Expired removes and returns all of the buffered Firetail logs which expired before now. Each
+	// expired log is only returned once, even to concurrent callers.
+	Expired(ctx context.Context, now time.Time) ([]*FiretailLog, error)
+}
+
+// RequestStateConflictError is returned by a RequestStateStore's Put or Delete if the buffered
+// Firetail log was changed by another caller after it was read, so the change should be retried from
+// a fresh Get.
+type RequestStateConflictError struct {
+	RequestID string
+}
+
+func (e *RequestStateConflictError) Error() string {
+	return fmt.Sprintf("buffered firetail log for request ID %s was changed concurrently", e.RequestID)
+}
+
+var requestStateStore RequestStateStore
+var requestStateTTL = DefaultRequestStateTTL
+
+// MemoryRequestStateStore is a RequestStateStore which holds Firetail logs in memory. In Lambda this
+// only works across invocations which happen to be handled by the same warm instance. Firetail logs
+// are held as JSON, so that callers can't change them without a Put.
+type MemoryRequestStateStore struct {
+	mutex   sync.Mutex
+	entries map[string]memoryRequestStateEntry
+}
+
+type memoryRequestStateEntry struct {
+	logBytes  []byte
+	expiresAt time.Time
+	version   int64
+}
+
+func NewMemoryRequestStateStore() *MemoryRequestStateStore {
+	return &MemoryRequestStateStore{entries: map[string]memoryRequestStateEntry{}}
+}
+
+func (m *MemoryRequestStateStore) Get(ctx context.Context, requestID string) (*FiretailLog, int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, exists := m.entries[requestID]
+	if !exists {
+		return nil, 0, nil
+	}
+	firetailLog, err := entry.firetailLog()
+	if err != nil {
+		return nil, 0, err
+	}
+	return firetailLog, entry.version, nil
+}
+
+func (m *MemoryRequestStateStore) Put(ctx context.Context, firetailLog *FiretailLog, expiresAt time.Time, version int64) error {
+	logBytes, err := json.Marshal(firetailLog)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.entries[firetailLog.RequestID].version != version {
+		return &RequestStateConflictError{RequestID: firetailLog.RequestID}
+	}
+	m.entries[firetailLog.RequestID] = memoryRequestStateEntry{logBytes, expiresAt, version + 1}
+	return nil
+}
+
+func (m *MemoryRequestStateStore) Delete(ctx context.Context, requestID string, version int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.entries[requestID].version != version {
+		return &RequestStateConflictError{RequestID: requestID}
+	}
+	delete(m.entries, requestID)
+	return nil
+}
+
+func (m *MemoryRequestStateStore) Expired(ctx context.Context, now time.Time) ([]*FiretailLog, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	expired := []*FiretailLog{}
+	for requestID, entry := range m.entries {
+		if entry.expiresAt.Before(now) {
+			firetailLog, err := entry.firetailLog()
+			if err != nil {
+				return expired, err
+			}
+			expired = append(expired, firetailLog)
+			delete(m.entries, requestID)
+		}
+	}
+	return expired, nil
+}
+
+func (e memoryRequestStateEntry) firetailLog() (*FiretailLog, error) {
+	var firetailLog FiretailLog
+	if err := json.Unmarshal(e.logBytes, &firetailLog); err != nil {
+		return nil, err
+	}
+	return &firetailLog, nil
+}
@@ -0,0 +1,221 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+const DefaultRequestStateIndex = "expiryBucket-index"
+
+// How long after a request expires DynamoDB may delete it using the "ttl" attribute, if TTL is
+// enabled on the table. This is a backstop, as expired requests are normally deleted once they've
+// been sent to Firetail. It's also how far back Expired looks for expired requests.
+const dynamoDBRequestStateCleanupDelay = 24 * time.Hour
+
+// Requests are bucketed by the hour they expire in, so that Expired can query the few buckets which
+// may hold expired requests rather than scanning the whole table.
+const dynamoDBExpiryBucketSize = time.Hour
+
+// dynamoDBRequestStateClient is the subset of the DynamoDB client's methods used by
+// DynamoDBRequestStateStore.
+type dynamoDBRequestStateClient interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	dynamodb.QueryAPIClient
+}
+
+// DynamoDBRequestStateStore is a RequestStateStore backed by a DynamoDB table with a string partition
+// key named "requestId". Each item holds the Firetail log as JSON in its "log" attribute, its version
+// in its "version" attribute, the time it expires in Unix seconds in its "expiresAt" attribute, and
+// the hour it expires in, also in Unix seconds, in its "expiryBucket" attribute. IndexName is a global
+// secondary index of the table with "expiryBucket" as its number partition key and "expiresAt" as its
+// number sort key.
+type DynamoDBRequestStateStore struct {
+	Client    dynamoDBRequestStateClient
+	TableName string
+	IndexName string
+
+	// sweptBefore is the first bucket which Expired hasn't yet swept since it last passed, so that
+	// later calls don't query the buckets before it again.
+	sweepMutex  sync.Mutex
+	sweptBefore int64
+}
+
+func (d *DynamoDBRequestStateStore) Get(ctx context.Context, requestID string) (*FiretailLog, int64, error) {
+	output, err := d.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.TableName),
+		Key:            map[string]types.AttributeValue{"requestId": &types.AttributeValueMemberS{Value: requestID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if output.Item == nil {
+		return nil, 0, nil
+	}
+	firetailLog, err := unmarshalRequestStateItem(output.Item)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Items written before versions were added have none, and are treated the same as a missing item
+	version := int64(0)
+	if versionAttribute, isNumber := output.Item["version"].(*types.AttributeValueMemberN); isNumber {
+		if version, err = strconv.ParseInt(versionAttribute.Value, 10, 64); err != nil {
+			return nil, 0, errors.WithMessage(err, "err parsing request state item version")
+		}
+	}
+	return firetailLog, version, nil
+}
+
+func (d *DynamoDBRequestStateStore) Put(ctx context.Context, firetailLog *FiretailLog, expiresAt time.Time, version int64) error {
+	logBytes, err := json.Marshal(firetailLog)
+	if err != nil {
+		return err
+	}
+	conditionExpression, expressionAttributeValues := dynamoDBVersionCondition(version)
+	_, err = d.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]types.AttributeValue{
+			"requestId":    &types.AttributeValueMemberS{Value: firetailLog.RequestID},
+			"log":          &types.AttributeValueMemberS{Value: string(logBytes)},
+			"version":      &types.AttributeValueMemberN{Value: strconv.FormatInt(version+1, 10)},
+			"expiresAt":    &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+			"expiryBucket": &types.AttributeValueMemberN{Value: strconv.FormatInt(dynamoDBExpiryBucket(expiresAt), 10)},
+			"ttl":          &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Add(dynamoDBRequestStateCleanupDelay).Unix(), 10)},
+		},
+		ConditionExpression:       conditionExpression,
+		ExpressionAttributeValues: expressionAttributeValues,
+	})
+	return dynamoDBConflictErr(err, firetailLog.RequestID)
+}
+
+func (d *DynamoDBRequestStateStore) Delete(ctx context.Context, requestID string, version int64) error {
+	conditionExpression, expressionAttributeValues := dynamoDBVersionCondition(version)
+	_, err := d.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(d.TableName),
+		Key:                       map[string]types.AttributeValue{"requestId": &types.AttributeValueMemberS{Value: requestID}},
+		ConditionExpression:       conditionExpression,
+		ExpressionAttributeValues: expressionAttributeValues,
+	})
+	return dynamoDBConflictErr(err, requestID)
+}
+
+// dynamoDBVersionCondition returns a condition expression, and its values, which only holds if an
+// item is still at version. Version 0 is a missing item, or one written before versions were added.
+func dynamoDBVersionCondition(version int64) (*string, map[string]types.AttributeValue) {
+	if version == 0 {
+		return aws.String("attribute_not_exists(version)"), nil
+	}
+	return aws.String("version = :version"), map[string]types.AttributeValue{
+		":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)},
+	}
+}
+
+// dynamoDBConflictErr turns the err DynamoDB returns when a version condition fails into a
+// *RequestStateConflictError.
+func dynamoDBConflictErr(err error, requestID string) error {
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		return &RequestStateConflictError{RequestID: requestID}
+	}
+	return err
+}
+
+// Expired queries the index for requests which expired in the buckets since
+// dynamoDBRequestStateCleanupDelay before now, and claims each of them by deleting it, so that each
+// expired request is only returned by one of any concurrent invocations. Requests which were claimed
+// are returned even if there's an err. Only requests which will expire in the future are put, so once
+// a bucket has passed and been swept without any errs, nothing more can expire in it, and later calls
+// to Expired start from the bucket after it.
+func (d *DynamoDBRequestStateStore) Expired(ctx context.Context, now time.Time) ([]*FiretailLog, error) {
+	nowValue := &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)}
+	expired := []*FiretailLog{}
+	var errs error
+	firstBucket := dynamoDBExpiryBucket(now.Add(-dynamoDBRequestStateCleanupDelay))
+	d.sweepMutex.Lock()
+	if d.sweptBefore > firstBucket {
+		firstBucket = d.sweptBefore
+	}
+	d.sweepMutex.Unlock()
+	for bucket := firstBucket; bucket <= dynamoDBExpiryBucket(now); bucket += int64(dynamoDBExpiryBucketSize / time.Second) {
+		paginator := dynamodb.NewQueryPaginator(d.Client, &dynamodb.QueryInput{
+			TableName:              aws.String(d.TableName),
+			IndexName:              aws.String(d.IndexName),
+			KeyConditionExpression: aws.String("expiryBucket = :bucket AND expiresAt < :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":bucket": &types.AttributeValueMemberN{Value: strconv.FormatInt(bucket, 10)},
+				":now":    nowValue,
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return expired, multierror.Append(errs, err)
+			}
+			for _, item := range page.Items {
+				firetailLog, err := d.claim(ctx, item["requestId"], nowValue)
+				if err != nil {
+					errs = multierror.Append(errs, err)
+				} else if firetailLog != nil {
+					expired = append(expired, firetailLog)
+				}
+			}
+		}
+	}
+	if errs == nil {
+		d.sweepMutex.Lock()
+		if currentBucket := dynamoDBExpiryBucket(now); currentBucket > d.sweptBefore {
+			d.sweptBefore = currentBucket
+		}
+		d.sweepMutex.Unlock()
+	}
+	return expired, errs
+}
+
+// claim deletes the item with the given request ID if it has expired before now, and returns its
+// Firetail log. If it's already been claimed, or has since been put again with a later expiry, nil is
+// returned.
+func (d *DynamoDBRequestStateStore) claim(ctx context.Context, requestID types.AttributeValue, now types.AttributeValue) (*FiretailLog, error) {
+	output, err := d.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(d.TableName),
+		Key:                       map[string]types.AttributeValue{"requestId": requestID},
+		ConditionExpression:       aws.String("attribute_exists(requestId) AND expiresAt < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":now": now},
+		ReturnValues:              types.ReturnValueAllOld,
+	})
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalRequestStateItem(output.Attributes)
+}
+
+// dynamoDBExpiryBucket returns the start of the bucket expiresAt falls in, in Unix seconds.
+func dynamoDBExpiryBucket(expiresAt time.Time) int64 {
+	return expiresAt.Truncate(dynamoDBExpiryBucketSize).Unix()
+}
+
+func unmarshalRequestStateItem(item map[string]types.AttributeValue) (*FiretailLog, error) {
+	logAttribute, isString := item["log"].(*types.AttributeValueMemberS)
+	if !isString {
+		return nil, errors.New("request state item has no log attribute")
+	}
+	var firetailLog FiretailLog
+	if err := json.Unmarshal([]byte(logAttribute.Value), &firetailLog); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling request state item")
+	}
+	return &firetailLog, nil
+}
@@ -0,0 +1,225 @@
+package logshandler
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDynamoDBClient is an in-memory stand-in for a single DynamoDB table keyed by "requestId". Its
+// Query and conditional writes only support the expressions used by DynamoDBRequestStateStore.
+// beforeDelete, if set, is called before each DeleteItem to simulate concurrent writers. queries
+// counts the calls to Query.
+type fakeDynamoDBClient struct {
+	items        map[string]map[string]types.AttributeValue
+	beforeDelete func(requestID string)
+	queries      int
+}
+
+func (f *fakeDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[params.Key["requestId"].(*types.AttributeValueMemberS).Value]}, nil
+}
+
+func (f *fakeDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	requestID := params.Item["requestId"].(*types.AttributeValueMemberS).Value
+	if !f.conditionHolds(requestID, params.ConditionExpression, params.ExpressionAttributeValues) {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.items[requestID] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDBClient) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	requestID := params.Key["requestId"].(*types.AttributeValueMemberS).Value
+	if f.beforeDelete != nil {
+		f.beforeDelete(requestID)
+	}
+	if !f.conditionHolds(requestID, params.ConditionExpression, params.ExpressionAttributeValues) {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	item := f.items[requestID]
+	delete(f.items, requestID)
+	output := &dynamodb.DeleteItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		output.Attributes = item
+	}
+	return output, nil
+}
+
+func (f *fakeDynamoDBClient) conditionHolds(requestID string, conditionExpression *string, values map[string]types.AttributeValue) bool {
+	item, exists := f.items[requestID]
+	_, hasVersion := item["version"]
+	switch aws.ToString(conditionExpression) {
+	case "":
+		return true
+	case "attribute_exists(requestId) AND expiresAt < :now":
+		return exists && fakeDynamoDBNumber(item["expiresAt"]) < fakeDynamoDBNumber(values[":now"])
+	case "attribute_not_exists(version)":
+		return !hasVersion
+	case "version = :version":
+		return hasVersion && fakeDynamoDBNumber(item["version"]) == fakeDynamoDBNumber(values[":version"])
+	default:
+		panic("unsupported condition expression")
+	}
+}
+
+func (f *fakeDynamoDBClient) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if aws.ToString(params.IndexName) != "TEST_INDEX" || aws.ToString(params.KeyConditionExpression) != "expiryBucket = :bucket AND expiresAt < :now" {
+		panic("unsupported query")
+	}
+	f.queries++
+	bucket := fakeDynamoDBNumber(params.ExpressionAttributeValues[":bucket"])
+	now := fakeDynamoDBNumber(params.ExpressionAttributeValues[":now"])
+	output := &dynamodb.QueryOutput{}
+	for _, item := range f.items {
+		if fakeDynamoDBNumber(item["expiryBucket"]) == bucket && fakeDynamoDBNumber(item["expiresAt"]) < now {
+			output.Items = append(output.Items, map[string]types.AttributeValue{
+				"requestId":    item["requestId"],
+				"expiryBucket": item["expiryBucket"],
+				"expiresAt":    item["expiresAt"],
+			})
+		}
+	}
+	return output, nil
+}
+
+func fakeDynamoDBNumber(value types.AttributeValue) int64 {
+	number, _ := strconv.ParseInt(value.(*types.AttributeValueMemberN).Value, 10, 64)
+	return number
+}
+
+func TestDynamoDBRequestStateStore(t *testing.T) {
+	client := &fakeDynamoDBClient{items: map[string]map[string]types.AttributeValue{}}
+	store := &DynamoDBRequestStateStore{Client: client, TableName: "TEST_TABLE", IndexName: "TEST_INDEX"}
+	now := time.Unix(1669806236, 0)
+	testQuery := "TEST_QUERY"
+
+	firetailLog, version, err := store.Get(context.Background(), "TEST_ID_1")
+	require.Nil(t, err)
+	assert.Nil(t, firetailLog)
+	assert.Equal(t, int64(0), version)
+
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID_1", Query: &testQuery}, now.Add(-time.Minute), 0))
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID_2", BeginRequestTimestamp: 1000}, now.Add(time.Minute), 0))
+
+	assert.Equal(t, map[string]types.AttributeValue{
+		"requestId":    &types.AttributeValueMemberS{Value: "TEST_ID_2"},
+		"log":          &types.AttributeValueMemberS{Value: "{\"beginRequestTimestamp\":1000,\"request_id\":\"TEST_ID_2\"}"},
+		"version":      &types.AttributeValueMemberN{Value: "1"},
+		"expiresAt":    &types.AttributeValueMemberN{Value: "1669806296"},
+		"expiryBucket": &types.AttributeValueMemberN{Value: "1669806000"},
+		"ttl":          &types.AttributeValueMemberN{Value: "1669892696"},
+	}, client.items["TEST_ID_2"])
+
+	firetailLog, version, err = store.Get(context.Background(), "TEST_ID_2")
+	require.Nil(t, err)
+	assert.Equal(t, &FiretailLog{RequestID: "TEST_ID_2", BeginRequestTimestamp: 1000}, firetailLog)
+	assert.Equal(t, int64(1), version)
+
+	expired, err := store.Expired(context.Background(), now)
+	require.Nil(t, err)
+	assert.Equal(t, []*FiretailLog{{RequestID: "TEST_ID_1", Query: &testQuery}}, expired)
+	assert.NotContains(t, client.items, "TEST_ID_1")
+
+	require.Nil(t, store.Delete(context.Background(), "TEST_ID_2", 1))
+	assert.NotContains(t, client.items, "TEST_ID_2")
+}
+
+func TestDynamoDBRequestStateStoreExpiredSkipsClaimedItems(t *testing.T) {
+	client := &fakeDynamoDBClient{items: map[string]map[string]types.AttributeValue{}}
+	store := &DynamoDBRequestStateStore{Client: client, TableName: "TEST_TABLE", IndexName: "TEST_INDEX"}
+	now := time.Unix(1669806236, 0)
+	testQuery := "TEST_QUERY"
+
+	for _, requestID := range []string{"TEST_ID_1", "TEST_ID_2", "TEST_ID_3"} {
+		require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: requestID, Query: &testQuery}, now.Add(-2*time.Hour), 0))
+	}
+	// Between the query and the claims, another invocation claims TEST_ID_1 and TEST_ID_2 is put again
+	// by an invocation which received more of its events
+	client.beforeDelete = func(requestID string) {
+		client.beforeDelete = nil
+		delete(client.items, "TEST_ID_1")
+		require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID_2", Query: &testQuery}, now.Add(time.Minute), 1))
+	}
+
+	expired, err := store.Expired(context.Background(), now)
+	require.Nil(t, err)
+	assert.Equal(t, []*FiretailLog{{RequestID: "TEST_ID_3", Query: &testQuery}}, expired)
+	assert.Contains(t, client.items, "TEST_ID_2")
+}
+
+func TestDynamoDBRequestStateStoreConflicts(t *testing.T) {
+	client := &fakeDynamoDBClient{items: map[string]map[string]types.AttributeValue{}}
+	store := &DynamoDBRequestStateStore{Client: client, TableName: "TEST_TABLE", IndexName: "TEST_INDEX"}
+	expiresAt := time.Unix(1669806236, 0)
+
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, expiresAt, 0))
+
+	// Another invocation has put the log since version 0 was read
+	err := store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, expiresAt, 0)
+	require.NotNil(t, err)
+	assert.Equal(t, "buffered firetail log for request ID TEST_ID was changed concurrently", err.Error())
+
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, expiresAt, 1))
+	assert.IsType(t, &RequestStateConflictError{}, store.Delete(context.Background(), "TEST_ID", 1))
+	require.Nil(t, store.Delete(context.Background(), "TEST_ID", 2))
+	assert.NotContains(t, client.items, "TEST_ID")
+}
+
+func TestDynamoDBRequestStateStoreUnversionedItem(t *testing.T) {
+	testQuery := "TEST_QUERY"
+	client := &fakeDynamoDBClient{items: map[string]map[string]types.AttributeValue{
+		"TEST_ID": {
+			"requestId": &types.AttributeValueMemberS{Value: "TEST_ID"},
+			"log":       &types.AttributeValueMemberS{Value: `{"query":"TEST_QUERY","request_id":"TEST_ID"}`},
+		},
+	}}
+	store := &DynamoDBRequestStateStore{Client: client, TableName: "TEST_TABLE", IndexName: "TEST_INDEX"}
+
+	// Items written before versions were added can be replaced as version 0
+	firetailLog, version, err := store.Get(context.Background(), "TEST_ID")
+	require.Nil(t, err)
+	assert.Equal(t, &FiretailLog{RequestID: "TEST_ID", Query: &testQuery}, firetailLog)
+	assert.Equal(t, int64(0), version)
+	require.Nil(t, store.Put(context.Background(), firetailLog, time.Unix(1669806236, 0), version))
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "1"}, client.items["TEST_ID"]["version"])
+}
+
+func TestDynamoDBRequestStateStoreExpiredRemembersSweptBuckets(t *testing.T) {
+	client := &fakeDynamoDBClient{items: map[string]map[string]types.AttributeValue{}}
+	store := &DynamoDBRequestStateStore{Client: client, TableName: "TEST_TABLE", IndexName: "TEST_INDEX"}
+	now := time.Unix(1669806236, 0)
+	testQuery := "TEST_QUERY"
+
+	// The first call sweeps every bucket since the cleanup delay
+	_, err := store.Expired(context.Background(), now)
+	require.Nil(t, err)
+	assert.Equal(t, 25, client.queries)
+
+	// Later calls only sweep from the bucket the last one was in
+	client.queries = 0
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID", Query: &testQuery}, now.Add(time.Minute), 0))
+	expired, err := store.Expired(context.Background(), now.Add(time.Hour))
+	require.Nil(t, err)
+	assert.Equal(t, []*FiretailLog{{RequestID: "TEST_ID", Query: &testQuery}}, expired)
+	assert.Equal(t, 2, client.queries)
+}
+
+func TestDynamoDBRequestStateStoreMalformedItem(t *testing.T) {
+	client := &fakeDynamoDBClient{items: map[string]map[string]types.AttributeValue{
+		"TEST_ID": {"requestId": &types.AttributeValueMemberS{Value: "TEST_ID"}},
+	}}
+	store := &DynamoDBRequestStateStore{Client: client, TableName: "TEST_TABLE", IndexName: "TEST_INDEX"}
+
+	firetailLog, _, err := store.Get(context.Background(), "TEST_ID")
+	require.NotNil(t, err)
+	assert.Equal(t, "request state item has no log attribute", err.Error())
+	assert.Nil(t, firetailLog)
+}
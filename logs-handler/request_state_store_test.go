@@ -0,0 +1,72 @@
+package logshandler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRequestStateStore(t *testing.T) {
+	store := NewMemoryRequestStateStore()
+	now := time.Now()
+
+	firetailLog, version, err := store.Get(context.Background(), "TEST_ID_1")
+	require.Nil(t, err)
+	assert.Nil(t, firetailLog)
+	assert.Equal(t, int64(0), version)
+
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID_1"}, now.Add(-time.Second), 0))
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID_2"}, now.Add(time.Second), 0))
+
+	firetailLog, version, err = store.Get(context.Background(), "TEST_ID_2")
+	require.Nil(t, err)
+	assert.Equal(t, &FiretailLog{RequestID: "TEST_ID_2"}, firetailLog)
+	assert.Equal(t, int64(1), version)
+
+	expired, err := store.Expired(context.Background(), now)
+	require.Nil(t, err)
+	assert.Equal(t, []*FiretailLog{{RequestID: "TEST_ID_1"}}, expired)
+	expired, err = store.Expired(context.Background(), now)
+	require.Nil(t, err)
+	assert.Len(t, expired, 0)
+
+	require.Nil(t, store.Delete(context.Background(), "TEST_ID_2", 1))
+	firetailLog, _, err = store.Get(context.Background(), "TEST_ID_2")
+	require.Nil(t, err)
+	assert.Nil(t, firetailLog)
+}
+
+func TestMemoryRequestStateStoreConflicts(t *testing.T) {
+	store := NewMemoryRequestStateStore()
+	expiresAt := time.Now().Add(time.Minute)
+
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, expiresAt, 0))
+
+	// Another caller has put the log since version 0 was read
+	err := store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, expiresAt, 0)
+	require.NotNil(t, err)
+	assert.Equal(t, "buffered firetail log for request ID TEST_ID was changed concurrently", err.Error())
+	assert.IsType(t, &RequestStateConflictError{}, err)
+
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, expiresAt, 1))
+	assert.IsType(t, &RequestStateConflictError{}, store.Delete(context.Background(), "TEST_ID", 1))
+	require.Nil(t, store.Delete(context.Background(), "TEST_ID", 2))
+}
+
+func TestMemoryRequestStateStoreGetReturnsCopy(t *testing.T) {
+	store := NewMemoryRequestStateStore()
+	testQuery := "TEST_QUERY"
+	require.Nil(t, store.Put(context.Background(), &FiretailLog{RequestID: "TEST_ID"}, time.Now().Add(time.Minute), 0))
+
+	firetailLog, _, err := store.Get(context.Background(), "TEST_ID")
+	require.Nil(t, err)
+	firetailLog.Query = &testQuery
+
+	// Changes to a Firetail log which was got aren't buffered until it's put
+	firetailLog, _, err = store.Get(context.Background(), "TEST_ID")
+	require.Nil(t, err)
+	assert.Nil(t, firetailLog.Query)
+}
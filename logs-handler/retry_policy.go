@@ -0,0 +1,134 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy describes how many times, and how often, a request to the Firetail logging API is
+// retried before giving up.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+var retryPolicy = DefaultRetryPolicy
+
+// retryableError wraps an error from a single attempt to send logs to Firetail which is worth
+// retrying. If the Firetail API gave us a Retry-After header, retryAfter will be non-zero.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Backoff returns how long to wait before the given attempt (where the first retry is attempt 1),
+// using exponential backoff with full jitter.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 32 {
+		if exponentialDelay := p.BaseDelay << (attempt - 1); exponentialDelay > 0 && exponentialDelay < p.MaxDelay {
+			delay = exponentialDelay
+		}
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// Do calls attempt until it succeeds, returns an error which isn't a *retryableError, runs out of
+// attempts, or waiting for the next attempt would overrun the deadline of ctx. A Retry-After delay is
+// waited for instead of the backoff, but no longer than MaxDelay, so that a server asking for a long
+// delay can't stall a caller whose ctx has no deadline.
+func (p RetryPolicy) Do(ctx context.Context, attempt func() error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var err error
+	for attemptNumber := 0; attemptNumber < maxAttempts; attemptNumber++ {
+		if attemptNumber > 0 {
+			var retryErr *retryableError
+			if !errors.As(err, &retryErr) {
+				return err
+			}
+			delay := retryErr.retryAfter
+			if delay == 0 {
+				delay = p.Backoff(attemptNumber)
+			} else if p.MaxDelay > 0 && delay > p.MaxDelay {
+				delay = p.MaxDelay
+			}
+			if deadline, hasDeadline := ctx.Deadline(); hasDeadline && time.Now().Add(delay).After(deadline) {
+				return err
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		err = attempt()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// isRetryableStatusCode returns true for the HTTP status codes which indicate the Firetail API may
+// accept the same request if we try again later.
+func isRetryableStatusCode(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// isRetryableNetworkError returns true for errors from the HTTP client which are likely transient.
+func isRetryableNetworkError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may either be a number of seconds
+// or a HTTP date. If the header is absent or malformed it returns zero.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
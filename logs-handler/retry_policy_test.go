@@ -0,0 +1,113 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt < 100; attempt++ {
+		delay := policy.Backoff(attempt)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, time.Second)
+		if attempt == 1 {
+			assert.LessOrEqual(t, delay, 100*time.Millisecond)
+		}
+	}
+}
+
+func TestRetryPolicyDoStopsOnPermanentError(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	attempts := 0
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		return errors.New("TEST_ERR")
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, "TEST_ERR", err.Error())
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicyDoRetriesRetryableErrors(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	attempts := 0
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		return &retryableError{err: errors.New("TEST_ERR")}
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, "TEST_ERR", err.Error())
+	assert.Equal(t, 5, attempts)
+}
+
+func TestRetryPolicyDoStopsWhenContextCancelled(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := policy.Do(ctx, func() error {
+		attempts++
+		cancel()
+		return &retryableError{err: errors.New("TEST_ERR"), retryAfter: time.Minute}
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicyDoClampsRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	attempts := 0
+	startTime := time.Now()
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		return &retryableError{err: errors.New("TEST_ERR"), retryAfter: time.Hour}
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Less(t, time.Since(startTime), time.Second)
+}
+
+func TestRetryPolicyDoZeroAttempts(t *testing.T) {
+	policy := RetryPolicy{}
+	attempts := 0
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestIsRetryableStatusCode(t *testing.T) {
+	for _, statusCode := range []int{429, 500, 502, 503, 504} {
+		assert.True(t, isRetryableStatusCode(statusCode), statusCode)
+	}
+	for _, statusCode := range []int{200, 400, 401, 403, 404} {
+		assert.False(t, isRetryableStatusCode(statusCode), statusCode)
+	}
+}
+
+func TestIsRetryableNetworkError(t *testing.T) {
+	assert.True(t, isRetryableNetworkError(syscall.ECONNRESET))
+	assert.True(t, isRetryableNetworkError(syscall.ECONNREFUSED))
+	assert.True(t, isRetryableNetworkError(io.ErrUnexpectedEOF))
+	assert.False(t, isRetryableNetworkError(errors.New("TEST_ERR")))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 11, 30, 11, 3, 56, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("TEST_VALUE", now))
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(t, time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+}
@@ -0,0 +1,280 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRouteName is the name of the route used for logs which don't match any route in the routing
+// table. It sends logs to firetailApiUrl with firetailApiTokenProvider.
+const DefaultRouteName = "default"
+
+// Route describes where to send the logs of some AppSync APIs:
+//   - LogGroups are the names of the log groups whose logs take this route. They may contain the
+//     wildcards supported by path.Match, such as "/aws/appsync/apis/*".
+//   - ApiIds are the IDs of the AppSync APIs whose logs take this route.
+//   - ApiUrl is the Firetail logging API to send the logs to. If it's empty, firetailApiUrl is used.
+//   - At most one of ApiToken, ApiTokenSecretArn and ApiTokenSSMParam may be set, giving the Firetail
+//     API token directly or the Secrets Manager secret or SSM parameter to fetch it from. If none of
+//     them are set, firetailApiTokenProvider is used.
+type Route struct {
+	Name              string   `json:"name"`
+	LogGroups         []string `json:"logGroups"`
+	ApiIds            []string `json:"apiIds"`
+	ApiUrl            string   `json:"apiUrl"`
+	ApiToken          string   `json:"apiToken"`
+	ApiTokenSecretArn string   `json:"apiTokenSecretArn"`
+	ApiTokenSSMParam  string   `json:"apiTokenSsmParam"`
+
+	tokenProvider TokenProvider
+}
+
+// RoutingTable maps log groups and AppSync API IDs to Routes. Logs take the first route which matches
+// either their log group or their API ID, or the default route if none match.
+type RoutingTable struct {
+	Routes []*Route `json:"routes"`
+}
+
+// routingTable is used to route logs to different Firetail APIs if it is not nil.
+var routingTable *RoutingTable
+
+// routeTokenConfig configures the token providers of routes which fetch their token from Secrets
+// Manager or SSM. The client constructors are only called if a route needs them.
+type routeTokenConfig struct {
+	RefreshInterval time.Duration
+	SecretsManager  func() (secretsManagerClient, error)
+	SSM             func() (ssmClient, error)
+}
+
+// parseRoutingTable parses and validates a RoutingTable from its YAML or JSON representation.
+func parseRoutingTable(value []byte, tokenConfig routeTokenConfig) (*RoutingTable, error) {
+	// JSON is valid YAML, so both are parsed as YAML and then decoded as JSON so that unknown fields
+	// are rejected the same way for either format.
+	var document interface{}
+	if err := yaml.Unmarshal(value, &document); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling routing table")
+	}
+	documentJson, err := json.Marshal(document)
+	if err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling routing table")
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(documentJson)))
+	decoder.DisallowUnknownFields()
+	table := &RoutingTable{}
+	if err := decoder.Decode(table); err != nil {
+		return nil, errors.WithMessage(err, "err unmarshalling routing table")
+	}
+	if err := table.compile(tokenConfig); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// compile validates the routes of the table and creates their token providers.
+func (t *RoutingTable) compile(tokenConfig routeTokenConfig) error {
+	routeNames := map[string]bool{DefaultRouteName: true}
+	for i, route := range t.Routes {
+		if route.Name == "" {
+			return fmt.Errorf("route %d has no name", i+1)
+		}
+		if routeNames[route.Name] {
+			return fmt.Errorf("route name %s is used more than once", route.Name)
+		}
+		routeNames[route.Name] = true
+		if len(route.LogGroups) == 0 && len(route.ApiIds) == 0 {
+			return fmt.Errorf("route %s has no logGroups or apiIds", route.Name)
+		}
+		for _, logGroup := range route.LogGroups {
+			if _, err := path.Match(logGroup, ""); err != nil {
+				return fmt.Errorf("route %s has invalid log group pattern: %s", route.Name, logGroup)
+			}
+		}
+
+		tokenSources := 0
+		for _, tokenSource := range []string{route.ApiToken, route.ApiTokenSecretArn, route.ApiTokenSSMParam} {
+			if tokenSource != "" {
+				tokenSources++
+			}
+		}
+		if tokenSources > 1 {
+			return fmt.Errorf("route %s may only set one of apiToken, apiTokenSecretArn and apiTokenSsmParam", route.Name)
+		}
+
+		switch {
+		case route.ApiToken != "":
+			route.tokenProvider = StaticTokenProvider(route.ApiToken)
+		case route.ApiTokenSecretArn != "":
+			client, err := tokenConfig.SecretsManager()
+			if err != nil {
+				return err
+			}
+			route.tokenProvider = NewSecretsManagerTokenProvider(client, route.ApiTokenSecretArn, tokenConfig.RefreshInterval)
+		case route.ApiTokenSSMParam != "":
+			client, err := tokenConfig.SSM()
+			if err != nil {
+				return err
+			}
+			route.tokenProvider = NewSSMTokenProvider(client, route.ApiTokenSSMParam, tokenConfig.RefreshInterval)
+		}
+	}
+	return nil
+}
+
+// primeTokens fetches the token of every route which has its own token provider, so that a
+// misconfigured route fails at cold start.
+func (t *RoutingTable) primeTokens(ctx context.Context) error {
+	var errs error
+	for _, route := range t.Routes {
+		if route.tokenProvider == nil {
+			continue
+		}
+		if _, err := route.tokenProvider.Token(ctx); err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "err getting firetail api token for route %s", route.Name))
+		}
+	}
+	return errs
+}
+
+// Match returns the first route which matches the log group or API ID, or the default route if none
+// match. The table may be nil, in which case the default route is always returned.
+func (t *RoutingTable) Match(logGroup, apiId string) *Route {
+	if t != nil {
+		for _, route := range t.Routes {
+			if route.matches(logGroup, apiId) {
+				return route
+			}
+		}
+	}
+	return &Route{Name: DefaultRouteName}
+}
+
+// RouteNamed returns the route with the given name, or the default route if there isn't one. The
+// table may be nil, in which case the default route is always returned.
+func (t *RoutingTable) RouteNamed(name string) *Route {
+	if t != nil {
+		for _, route := range t.Routes {
+			if route.Name == name {
+				return route
+			}
+		}
+	}
+	return &Route{Name: DefaultRouteName}
+}
+
+func (r *Route) matches(logGroup, apiId string) bool {
+	for _, logGroupPattern := range r.LogGroups {
+		if matched, _ := path.Match(logGroupPattern, logGroup); matched {
+			return true
+		}
+	}
+	if apiId == "" {
+		return false
+	}
+	for _, routeApiId := range r.ApiIds {
+		if routeApiId == apiId {
+			return true
+		}
+	}
+	return false
+}
+
+// apiUrl returns the Firetail logging API the route sends logs to.
+func (r *Route) apiUrl() string {
+	if r.ApiUrl == "" {
+		return firetailApiUrl
+	}
+	return r.ApiUrl
+}
+
+// apiTokenProvider returns the TokenProvider for the route's Firetail API token.
+func (r *Route) apiTokenProvider() TokenProvider {
+	if r.tokenProvider == nil {
+		return firetailApiTokenProvider
+	}
+	return r.tokenProvider
+}
+
+// routedFiretailLogs are the Firetail logs of a batch which take the same route.
+type routedFiretailLogs struct {
+	Route        *Route
+	FiretailLogs map[string]*FiretailLog
+}
+
+// routeFiretailLogs groups firetailLogs by the route they take through table. Each log is routed by
+// the log group in its metadata, which is the one it was extracted from even if it was buffered by an
+// invocation for another log group, falling back to logGroup for logs without metadata. Each log's API
+// ID is taken from the log itself if possible, falling back to its log group. The groups are returned
+// in the order of the routes in the table, with the default route last.
+func routeFiretailLogs(table *RoutingTable, logGroup string, firetailLogs map[string]*FiretailLog) []*routedFiretailLogs {
+	groups := map[string]*routedFiretailLogs{}
+	for requestID, firetailLog := range firetailLogs {
+		logLogGroup := logGroup
+		if firetailLog.Metadata != nil && firetailLog.Metadata.LogGroup != "" {
+			logLogGroup = firetailLog.Metadata.LogGroup
+		}
+		apiId := firetailLog.GraphQLAPIId()
+		if apiId == "" {
+			apiId = appSyncApiIdFromLogGroup(logLogGroup)
+		}
+		route := table.Match(logLogGroup, apiId)
+		if _, exists := groups[route.Name]; !exists {
+			groups[route.Name] = &routedFiretailLogs{Route: route, FiretailLogs: map[string]*FiretailLog{}}
+		}
+		groups[route.Name].FiretailLogs[requestID] = firetailLog
+	}
+
+	orderedGroups := make([]*routedFiretailLogs, 0, len(groups))
+	if table != nil {
+		for _, route := range table.Routes {
+			if group, exists := groups[route.Name]; exists {
+				orderedGroups = append(orderedGroups, group)
+			}
+		}
+	}
+	if group, exists := groups[DefaultRouteName]; exists {
+		orderedGroups = append(orderedGroups, group)
+	}
+	return orderedGroups
+}
+
+// sendRoutedFiretailLogs sends each group of firetailLogs to the Firetail API of its route through
+// SendToFiretail. The chunk results of every route are returned together, and the errors of each
+// route are prefixed with the route's name. If table is nil, all of the logs take the default route.
+func sendRoutedFiretailLogs(ctx context.Context, table *RoutingTable, logGroup string, firetailLogs map[string]*FiretailLog) ([]*ChunkResult, error) {
+	if table == nil {
+		chunkResults, err := SendToFiretail(ctx, firetailLogs, firetailApiUrl, firetailApiTokenProvider)
+		for _, chunkResult := range chunkResults {
+			chunkResult.Route = DefaultRouteName
+		}
+		return chunkResults, err
+	}
+
+	chunkResults := []*ChunkResult{}
+	var errs error
+	for _, group := range routeFiretailLogs(table, logGroup, firetailLogs) {
+		routeChunkResults, err := SendToFiretail(ctx, group.FiretailLogs, group.Route.apiUrl(), group.Route.apiTokenProvider())
+		for _, chunkResult := range routeChunkResults {
+			chunkResult.Route = group.Route.Name
+		}
+		chunkResults = append(chunkResults, routeChunkResults...)
+		if err == nil {
+			continue
+		}
+		if multiErr, isMultiErr := err.(*multierror.Error); isMultiErr {
+			for _, routeErr := range multiErr.Errors {
+				errs = multierror.Append(errs, errors.WithMessagef(routeErr, "route %s", group.Route.Name))
+			}
+		} else {
+			errs = multierror.Append(errs, errors.WithMessagef(err, "route %s", group.Route.Name))
+		}
+	}
+	return chunkResults, errs
+}
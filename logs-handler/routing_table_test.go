@@ -0,0 +1,232 @@
+package logshandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRouteTokenConfig is a routeTokenConfig whose clients fetch tokens from fakes.
+func testRouteTokenConfig(secretsManager *mockSecretsManagerClient, ssm *mockSSMClient) routeTokenConfig {
+	return routeTokenConfig{
+		RefreshInterval: DefaultTokenRefreshInterval,
+		SecretsManager:  func() (secretsManagerClient, error) { return secretsManager, nil },
+		SSM:             func() (ssmClient, error) { return ssm, nil },
+	}
+}
+
+func TestParseRoutingTableJSON(t *testing.T) {
+	table, err := parseRoutingTable([]byte(`{
+		"routes": [{
+			"name": "orders",
+			"logGroups": ["/aws/appsync/apis/ORDERS_API_ID"],
+			"apiUrl": "https://orders.example.com",
+			"apiToken": "ORDERS_TOKEN"
+		}]
+	}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+	require.Len(t, table.Routes, 1)
+	assert.Equal(t, "orders", table.Routes[0].Name)
+	assert.Equal(t, "https://orders.example.com", table.Routes[0].apiUrl())
+	assert.Equal(t, StaticTokenProvider("ORDERS_TOKEN"), table.Routes[0].apiTokenProvider())
+}
+
+func TestParseRoutingTableYAML(t *testing.T) {
+	secretsManager := &mockSecretsManagerClient{secretValues: []string{"ORDERS_TOKEN"}}
+	ssm := &mockSSMClient{parameterValue: "USERS_TOKEN"}
+	table, err := parseRoutingTable([]byte(`
+routes:
+  - name: orders
+    apiIds: [ORDERS_API_ID]
+    apiTokenSecretArn: ORDERS_SECRET_ARN
+  - name: users
+    logGroups:
+      - /aws/appsync/apis/USERS_*
+    apiTokenSsmParam: /firetail/users
+`), testRouteTokenConfig(secretsManager, ssm))
+	require.Nil(t, err)
+	require.Len(t, table.Routes, 2)
+
+	err = table.primeTokens(context.Background())
+	require.Nil(t, err)
+	token, err := table.Routes[0].apiTokenProvider().Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "ORDERS_TOKEN", token)
+	token, err = table.Routes[1].apiTokenProvider().Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "USERS_TOKEN", token)
+	assert.Len(t, secretsManager.calls, 1)
+	assert.Len(t, ssm.calls, 1)
+}
+
+func TestParseRoutingTableInvalid(t *testing.T) {
+	for _, testCase := range []struct {
+		table         string
+		expectedError string
+	}{
+		{
+			`routes: [{name: orders, logGroup: /aws/appsync/apis/ORDERS_API_ID}]`,
+			"err unmarshalling routing table: json: unknown field \"logGroup\"",
+		},
+		{
+			`routes: [{apiIds: [ORDERS_API_ID]}]`,
+			"route 1 has no name",
+		},
+		{
+			`routes: [{name: default, apiIds: [ORDERS_API_ID]}]`,
+			"route name default is used more than once",
+		},
+		{
+			`routes: [{name: orders, apiIds: [A]}, {name: orders, apiIds: [B]}]`,
+			"route name orders is used more than once",
+		},
+		{
+			`routes: [{name: orders}]`,
+			"route orders has no logGroups or apiIds",
+		},
+		{
+			`routes: [{name: orders, logGroups: ["/aws/appsync/apis/["]}]`,
+			"route orders has invalid log group pattern: /aws/appsync/apis/[",
+		},
+		{
+			`routes: [{name: orders, apiIds: [A], apiToken: TOKEN, apiTokenSsmParam: /firetail/orders}]`,
+			"route orders may only set one of apiToken, apiTokenSecretArn and apiTokenSsmParam",
+		},
+	} {
+		table, err := parseRoutingTable([]byte(testCase.table), testRouteTokenConfig(nil, nil))
+		require.NotNil(t, err, testCase.table)
+		assert.Equal(t, testCase.expectedError, err.Error())
+		assert.Nil(t, table)
+	}
+}
+
+func TestRoutingTablePrimeTokensErr(t *testing.T) {
+	secretsManager := &mockSecretsManagerClient{err: errors.New("access denied")}
+	table, err := parseRoutingTable([]byte(`routes: [{name: orders, apiIds: [A], apiTokenSecretArn: ORDERS_SECRET_ARN}]`), testRouteTokenConfig(secretsManager, nil))
+	require.Nil(t, err)
+
+	err = table.primeTokens(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* err getting firetail api token for route orders: err getting secret ORDERS_SECRET_ARN: access denied\n\n", err.Error())
+}
+
+func TestRoutingTableMatch(t *testing.T) {
+	table, err := parseRoutingTable([]byte(`
+routes:
+  - name: orders
+    logGroups: [/aws/appsync/apis/ORDERS_API_ID]
+  - name: users
+    apiIds: [USERS_API_ID]
+  - name: everything-else
+    logGroups: [/aws/appsync/apis/*]
+`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+
+	assert.Equal(t, "orders", table.Match("/aws/appsync/apis/ORDERS_API_ID", "").Name)
+	assert.Equal(t, "users", table.Match("/custom/log/group", "USERS_API_ID").Name)
+	assert.Equal(t, "everything-else", table.Match("/aws/appsync/apis/OTHER_API_ID", "OTHER_API_ID").Name)
+	assert.Equal(t, DefaultRouteName, table.Match("/custom/log/group", "OTHER_API_ID").Name)
+	assert.Equal(t, DefaultRouteName, (*RoutingTable)(nil).Match("/aws/appsync/apis/ORDERS_API_ID", "").Name)
+}
+
+func TestRoutingTableRouteNamed(t *testing.T) {
+	table, err := parseRoutingTable([]byte(`routes: [{name: orders, apiIds: [ORDERS_API_ID]}]`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+
+	assert.Equal(t, "orders", table.RouteNamed("orders").Name)
+	assert.Equal(t, DefaultRouteName, table.RouteNamed("deleted").Name)
+	assert.Equal(t, DefaultRouteName, (*RoutingTable)(nil).RouteNamed("orders").Name)
+}
+
+func TestDefaultRoute(t *testing.T) {
+	firetailApiUrl = "TEST_DEFAULT_URL"
+	firetailApiTokenProvider = StaticTokenProvider("TEST_DEFAULT_TOKEN")
+	defer func() { firetailApiTokenProvider = StaticTokenProvider("") }()
+
+	route := (*RoutingTable)(nil).Match("", "")
+	assert.Equal(t, "TEST_DEFAULT_URL", route.apiUrl())
+	assert.Equal(t, StaticTokenProvider("TEST_DEFAULT_TOKEN"), route.apiTokenProvider())
+}
+
+func TestRouteFiretailLogsUsesApiIdFromLogs(t *testing.T) {
+	table, err := parseRoutingTable([]byte(`routes: [{name: orders, apiIds: [ORDERS_API_ID]}, {name: users, apiIds: [USERS_API_ID]}]`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+
+	ordersSummary := json.RawMessage(`{"logType":"RequestSummary","graphQLAPIId":"ORDERS_API_ID"}`)
+	firetailLogs := makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2", "TEST_ID_3")
+	firetailLogs["TEST_ID_1"].RequestSummary = &ordersSummary
+
+	groups := routeFiretailLogs(table, "/aws/appsync/apis/USERS_API_ID", firetailLogs)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "orders", groups[0].Route.Name)
+	assert.Len(t, groups[0].FiretailLogs, 1)
+	assert.Contains(t, groups[0].FiretailLogs, "TEST_ID_1")
+	assert.Equal(t, "users", groups[1].Route.Name)
+	assert.Len(t, groups[1].FiretailLogs, 2)
+}
+
+func TestRouteFiretailLogsUsesLogGroupFromMetadata(t *testing.T) {
+	table, err := parseRoutingTable([]byte(`routes: [{name: orders, logGroups: [/aws/appsync/apis/ORDERS_API_ID]}, {name: users, apiIds: [USERS_API_ID]}]`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+
+	firetailLogs := makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2")
+	firetailLogs["TEST_ID_1"].Metadata = &FiretailLogMetadata{LogGroup: "/aws/appsync/apis/USERS_API_ID"}
+
+	groups := routeFiretailLogs(table, "/aws/appsync/apis/ORDERS_API_ID", firetailLogs)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "orders", groups[0].Route.Name)
+	assert.Len(t, groups[0].FiretailLogs, 1)
+	assert.Contains(t, groups[0].FiretailLogs, "TEST_ID_2")
+	assert.Equal(t, "users", groups[1].Route.Name)
+	assert.Len(t, groups[1].FiretailLogs, 1)
+	assert.Contains(t, groups[1].FiretailLogs, "TEST_ID_1")
+}
+
+func TestSendRoutedFiretailLogs(t *testing.T) {
+	apiKeys := map[string][]string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		apiKeys[r.URL.Path] = append(apiKeys[r.URL.Path], r.Header.Get("x-ft-api-key"))
+		if r.URL.Path == "/failing" {
+			w.Write([]byte(`{"message":"fail"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+	firetailApiUrl = testServer.URL + "/default"
+	firetailApiTokenProvider = StaticTokenProvider("DEFAULT_TOKEN")
+	defer func() { firetailApiTokenProvider = StaticTokenProvider("") }()
+
+	table, err := parseRoutingTable([]byte(`{"routes": [{
+		"name": "orders",
+		"logGroups": ["/aws/appsync/apis/ORDERS_API_ID"],
+		"apiUrl": "`+testServer.URL+`/failing",
+		"apiToken": "ORDERS_TOKEN"
+	}]}`), testRouteTokenConfig(nil, nil))
+	require.Nil(t, err)
+
+	chunkResults, err := sendRoutedFiretailLogs(context.Background(), table, "/aws/appsync/apis/ORDERS_API_ID", makeTestFiretailLogs("TEST_ID"))
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* route orders: err sending chunk 1 of 1 (1 logs, 46 bytes) to firetail: got 200 response from firetail api: fail\n\n", err.Error())
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, "orders", chunkResults[0].Route)
+	assert.Equal(t, testServer.URL+"/failing", chunkResults[0].ApiUrl)
+
+	chunkResults, err = sendRoutedFiretailLogs(context.Background(), table, "/aws/appsync/apis/OTHER_API_ID", makeTestFiretailLogs("TEST_ID"))
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, DefaultRouteName, chunkResults[0].Route)
+
+	assert.Equal(t, map[string][]string{
+		"/failing": {"ORDERS_TOKEN"},
+		"/default": {"DEFAULT_TOKEN"},
+	}, apiKeys)
+}
@@ -1,46 +1,125 @@
-package main
+package logshandler
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
+	"io"
 	"net/http"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 )
 
-func SendToFiretail(firetailLogs map[string]*FiretailLog, apiUrl, apiToken string) error {
-	reqBytes := []byte{}
-	for _, firetailLog := range firetailLogs {
-		logBytes, err := json.Marshal(*firetailLog)
-		if err != nil {
-			return err
+// ChunkResult describes the outcome of sending a single chunk of a batch of logs to Firetail. Err
+// is nil if the chunk was delivered successfully. StatusCodes holds the HTTP status code of the
+// response to each attempt, or 0 for attempts which got no response. Route is the name of the route
+// the chunk took, if it was sent through the routing table.
+type ChunkResult struct {
+	Chunk       *logChunk
+	Err         error
+	Attempts    int
+	StatusCodes []int
+	Duration    time.Duration
+	ApiUrl      string
+	Route       string
+}
+
+// SendToFiretail splits firetailLogs into chunks bounded by maxChunkBytes and maxChunkRecords, and
+// sends each chunk to the Firetail logging API independently. A result is returned for every chunk,
+// and if any chunk failed the returned error will describe all of the failures. Once ctx is done, the
+// remaining chunks fail without being sent. If Firetail rejects the token from tokenProvider, the
+// token is invalidated and the request is resent once with a fresh token, so that rotated tokens are
+// picked up without waiting for them to expire from the cache.
+func SendToFiretail(ctx context.Context, firetailLogs map[string]*FiretailLog, apiUrl string, tokenProvider TokenProvider) ([]*ChunkResult, error) {
+	chunks, err := chunkFiretailLogs(firetailLogs, maxChunkBytes, maxChunkRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkResults := make([]*ChunkResult, 0, len(chunks))
+	var errs error
+	tokenRefreshed := false
+	for i, chunk := range chunks {
+		chunkResult := &ChunkResult{Chunk: chunk, ApiUrl: apiUrl}
+		startTime := time.Now()
+		if err := ctx.Err(); err != nil {
+			chunkResult.Err = errors.WithMessage(err, "chunk not sent before deadline")
+		} else if reqBytes, contentEncoding, err := compressPayload(chunk.Payload, compressionType); err != nil {
+			chunkResult.Err = errors.WithMessage(err, "err compressing payload")
+		} else {
+			chunkResult.Err = retryPolicy.Do(ctx, func() error {
+				for {
+					apiToken, err := tokenProvider.Token(ctx)
+					if err != nil {
+						return errors.WithMessage(err, "err getting firetail api token")
+					}
+					statusCode, err := sendRequestToFiretail(ctx, reqBytes, contentEncoding, apiUrl, apiToken)
+					chunkResult.Attempts++
+					chunkResult.StatusCodes = append(chunkResult.StatusCodes, statusCode)
+					if statusCode != http.StatusUnauthorized || tokenRefreshed {
+						return err
+					}
+					// There's only any point resending the request if refreshing the token changed it
+					logger.Info("Firetail rejected API token, refreshing it", nil)
+					tokenProvider.Invalidate()
+					tokenRefreshed = true
+					if refreshedToken, tokenErr := tokenProvider.Token(ctx); tokenErr != nil || refreshedToken == apiToken {
+						return err
+					}
+				}
+			})
+		}
+		chunkResult.Duration = time.Since(startTime)
+		if chunkResult.Err != nil {
+			errs = multierror.Append(errs, errors.WithMessagef(
+				chunkResult.Err, "err sending chunk %d of %d (%d logs, %d bytes) to firetail",
+				i+1, len(chunks), len(chunk.RequestIDs), len(chunk.Payload),
+			))
 		}
-		reqBytes = append(reqBytes, logBytes...)
-		reqBytes = append(reqBytes, '\n')
+		chunkResults = append(chunkResults, chunkResult)
 	}
 
-	req, err := http.NewRequest(
+	return chunkResults, errs
+}
+
+// sendRequestToFiretail makes a single attempt at POSTing reqBytes to the Firetail logging API. If
+// reqBytes has been compressed, contentEncoding should be set accordingly. Unsuccessful responses are
+// returned as a *FiretailAPIError, and any errors which are worth retrying are wrapped in a
+// *retryableError. The status code of the response is returned, or 0 if there was no response.
+func sendRequestToFiretail(ctx context.Context, reqBytes []byte, contentEncoding, apiUrl, apiToken string) (int, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"POST",
 		apiUrl,
 		bytes.NewBuffer(reqBytes),
 	)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	req.Header.Set("x-ft-api-key", apiToken)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		if isRetryableNetworkError(err) {
+			return 0, &retryableError{err: err}
+		}
+		return 0, err
 	}
+	defer func() {
+		// Draining the body lets the connection be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBodyBytes))
+		resp.Body.Close()
+	}()
 
-	var res map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&res)
-	if res["message"] != "success" {
-		return errors.New(fmt.Sprintf("got err response from firetail api: %v", res))
+	err = checkFiretailResponse(resp, time.Now())
+	var apiErr *FiretailAPIError
+	if errors.As(err, &apiErr) && apiErr.Retryable {
+		return resp.StatusCode, &retryableError{err: apiErr, retryAfter: apiErr.RetryAfter}
 	}
-
-	return nil
+	return resp.StatusCode, err
 }
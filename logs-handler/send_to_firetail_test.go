@@ -1,12 +1,20 @@
-package main
+package logshandler
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -23,13 +31,15 @@ func TestSendToFiretail(t *testing.T) {
 	}))
 
 	testQuery := "TEST_QUERY"
-	err := SendToFiretail(map[string]*FiretailLog{
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
 		"TEST_ID": {
 			Query:     &testQuery,
 			RequestID: "TEST_ID",
 		},
-	}, testServer.URL, "TEST_KEY")
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
 	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Nil(t, chunkResults[0].Err)
 
 	wg.Wait()
 }
@@ -46,38 +56,448 @@ func TestSendToFiretailBadServer(t *testing.T) {
 	}))
 
 	testQuery := "TEST_QUERY"
-	err := SendToFiretail(map[string]*FiretailLog{
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
 		"TEST_ID": {
 			Query:     &testQuery,
 			RequestID: "TEST_ID",
 		},
-	}, testServer.URL, "TEST_KEY")
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
 	require.NotNil(t, err)
-	assert.Equal(t, "got err response from firetail api: map[message:fail]", err.Error())
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, "got 200 response from firetail api: fail", chunkResults[0].Err.Error())
 
 	wg.Wait()
 }
 
 func TestSendToFiretailNoServer(t *testing.T) {
 	testQuery := "TEST_QUERY"
-	err := SendToFiretail(map[string]*FiretailLog{
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
 		"TEST_ID": {
 			Query:     &testQuery,
 			RequestID: "TEST_ID",
 		},
-	}, "http://127.0.0.1:0", "TEST_KEY")
+	}, "http://127.0.0.1:0", StaticTokenProvider("TEST_KEY"))
 	require.NotNil(t, err)
-	assert.Contains(t, err.Error(), "Post \"http://127.0.0.1:0\": dial tcp 127.0.0.1:0")
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Contains(t, chunkResults[0].Err.Error(), "Post \"http://127.0.0.1:0\": dial tcp 127.0.0.1:0")
 }
 
 func TestSendToFiretailBadUrl(t *testing.T) {
 	testQuery := "TEST_QUERY"
-	err := SendToFiretail(map[string]*FiretailLog{
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
 		"TEST_ID": {
 			Query:     &testQuery,
 			RequestID: "TEST_ID",
 		},
-	}, "\n", "TEST_KEY")
+	}, "\n", StaticTokenProvider("TEST_KEY"))
 	require.NotNil(t, err)
-	assert.Equal(t, "parse \"\\n\": net/url: invalid control character in URL", err.Error())
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, "parse \"\\n\": net/url: invalid control character in URL", chunkResults[0].Err.Error())
+}
+
+func TestSendToFiretailRetriesServerErrors(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		assert.Equal(t, "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID\"}\n", string(requestBody))
+		requestCount++
+		if requestCount < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	testQuery := "TEST_QUERY"
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Nil(t, chunkResults[0].Err)
+	assert.Equal(t, 3, requestCount)
+	assert.Equal(t, 3, chunkResults[0].Attempts)
+	assert.Equal(t, []int{503, 503, 200}, chunkResults[0].StatusCodes)
+}
+
+func TestSendToFiretailGivesUpAfterMaxAttempts(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	testQuery := "TEST_QUERY"
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, "got 502 response from firetail api", chunkResults[0].Err.Error())
+	assert.Equal(t, 3, requestCount)
+}
+
+func TestSendToFiretailDoesNotRetryUnauthorized(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"unauthorized"}`))
+	}))
+
+	testQuery := "TEST_QUERY"
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, "got 401 response from firetail api: unauthorized", chunkResults[0].Err.Error())
+	assert.Equal(t, 1, requestCount)
+	assert.Equal(t, 1, chunkResults[0].Attempts)
+	assert.Equal(t, []int{401}, chunkResults[0].StatusCodes)
+}
+
+func TestSendToFiretailHonoursRetryAfter(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Second}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	requestTimes := []time.Time{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestTimes = append(requestTimes, time.Now())
+		if len(requestTimes) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	testQuery := "TEST_QUERY"
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Nil(t, chunkResults[0].Err)
+	require.Len(t, requestTimes, 2)
+	assert.GreaterOrEqual(t, requestTimes[1].Sub(requestTimes[0]), time.Second)
+}
+
+func TestSendToFiretailRetryAfterExceedsDeadline(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Hour}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	testQuery := "TEST_QUERY"
+	chunkResults, err := SendToFiretail(ctx, map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, "got 429 response from firetail api", chunkResults[0].Err.Error())
+	assert.Equal(t, 1, requestCount)
+}
+
+func TestSendToFiretailRetryAfterExceedsMaxDelay(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+
+	// Without a deadline on the context, the Retry-After delay is bounded by the max delay
+	testQuery := "TEST_QUERY"
+	startTime := time.Now()
+	chunkResults, err := SendToFiretail(context.Background(), map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, 2, requestCount)
+	assert.Less(t, time.Since(startTime), time.Second)
+}
+
+func TestSendToFiretailChunksLogs(t *testing.T) {
+	maxChunkRecords = 1
+	defer func() { maxChunkRecords = DefaultMaxChunkRecords }()
+
+	requestBodies := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		requestBodies = append(requestBodies, string(requestBody))
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 2)
+	assert.Nil(t, chunkResults[0].Err)
+	assert.Nil(t, chunkResults[1].Err)
+	assert.Equal(t, []string{
+		"{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_1\"}\n",
+		"{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID_2\"}\n",
+	}, requestBodies)
+}
+
+func TestSendToFiretailOneChunkFails(t *testing.T) {
+	maxChunkRecords = 1
+	defer func() { maxChunkRecords = DefaultMaxChunkRecords }()
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		if strings.Contains(string(requestBody), "TEST_ID_1") {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(`{"message":"too large"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* err sending chunk 1 of 2 (1 logs, 48 bytes) to firetail: got 413 response from firetail api: too large\n\n", err.Error())
+	require.Len(t, chunkResults, 2)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, []string{"TEST_ID_1"}, chunkResults[0].Chunk.RequestIDs)
+	assert.Nil(t, chunkResults[1].Err)
+	assert.Equal(t, []string{"TEST_ID_2"}, chunkResults[1].Chunk.RequestIDs)
+}
+
+func TestSendToFiretailGzip(t *testing.T) {
+	compressionType = GzipCompression
+	defer func() { compressionType = NoCompression }()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gzipReader, err := gzip.NewReader(r.Body)
+		require.Nil(t, err)
+		requestBody, err := ioutil.ReadAll(gzipReader)
+		require.Nil(t, err)
+		assert.Equal(t, "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID\"}\n", string(requestBody))
+		wg.Done()
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Nil(t, chunkResults[0].Err)
+
+	wg.Wait()
+}
+
+func TestSendToFiretailZstd(t *testing.T) {
+	compressionType = ZstdCompression
+	defer func() { compressionType = NoCompression }()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "zstd", r.Header.Get("Content-Encoding"))
+		zstdReader, err := zstd.NewReader(r.Body)
+		require.Nil(t, err)
+		defer zstdReader.Close()
+		requestBody, err := ioutil.ReadAll(zstdReader)
+		require.Nil(t, err)
+		assert.Equal(t, "{\"query\":\"TEST_QUERY\",\"request_id\":\"TEST_ID\"}\n", string(requestBody))
+		wg.Done()
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Nil(t, chunkResults[0].Err)
+
+	wg.Wait()
+}
+
+func TestSendToFiretailContextDone(t *testing.T) {
+	requestCount := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testQuery := "TEST_QUERY"
+	chunkResults, err := SendToFiretail(ctx, map[string]*FiretailLog{
+		"TEST_ID": {
+			Query:     &testQuery,
+			RequestID: "TEST_ID",
+		},
+	}, testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	require.NotNil(t, chunkResults[0].Err)
+	assert.Equal(t, "chunk not sent before deadline: context canceled", chunkResults[0].Err.Error())
+	assert.Equal(t, 0, chunkResults[0].Attempts)
+	assert.Equal(t, 0, requestCount)
+}
+
+func TestSendToFiretailNonJSONResponse(t *testing.T) {
+	retryPolicy = RetryPolicy{MaxAttempts: 1}
+	defer func() { retryPolicy = DefaultRetryPolicy }()
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amzn-RequestId", "TEST_REQUEST_ID")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>\n  <body>502 Bad Gateway</body>\n</html>\n"))
+	}))
+
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, "got 502 response from firetail api: <html> <body>502 Bad Gateway</body> </html> (request ID TEST_REQUEST_ID)", chunkResults[0].Err.Error())
+
+	var apiErr *FiretailAPIError
+	require.ErrorAs(t, chunkResults[0].Err, &apiErr)
+	assert.Equal(t, &FiretailAPIError{
+		StatusCode:  502,
+		BodySnippet: "<html> <body>502 Bad Gateway</body> </html>",
+		RequestID:   "TEST_REQUEST_ID",
+		Retryable:   true,
+	}, apiErr)
+}
+
+func TestSendToFiretailEmptyResponse(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, "got 200 response from firetail api", chunkResults[0].Err.Error())
+	assert.Equal(t, 1, chunkResults[0].Attempts)
+
+	var apiErr *FiretailAPIError
+	require.ErrorAs(t, chunkResults[0].Err, &apiErr)
+	assert.False(t, apiErr.Retryable)
+}
+
+func TestSendToFiretailReusesConnections(t *testing.T) {
+	var connections int32
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":"success","ignored":"` + strings.Repeat("x", 8192) + `"}`))
+	}))
+	testServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	testServer.Start()
+	defer testServer.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), testServer.URL, StaticTokenProvider("TEST_KEY"))
+		require.Nil(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestSendToFiretailRefreshesTokenOnUnauthorized(t *testing.T) {
+	apiKeys := []string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKeys = append(apiKeys, r.Header.Get("x-ft-api-key"))
+		if r.Header.Get("x-ft-api-key") != "TEST_KEY_2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"unauthorized"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"success"}`))
+	}))
+
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_KEY_1", "TEST_KEY_2"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), testServer.URL, tokenProvider)
+	require.Nil(t, err)
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, 2, chunkResults[0].Attempts)
+	assert.Equal(t, []int{401, 200}, chunkResults[0].StatusCodes)
+	assert.Equal(t, []string{"TEST_KEY_1", "TEST_KEY_2"}, apiKeys)
+}
+
+func TestSendToFiretailRefreshesTokenOnce(t *testing.T) {
+	maxChunkRecords = 1
+	defer func() { maxChunkRecords = DefaultMaxChunkRecords }()
+
+	requests := int32(0)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"unauthorized"}`))
+	}))
+
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_KEY_1", "TEST_KEY_2"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID_1", "TEST_ID_2"), testServer.URL, tokenProvider)
+	require.NotNil(t, err)
+	require.Len(t, chunkResults, 2)
+	assert.Equal(t, 2, chunkResults[0].Attempts)
+	assert.Equal(t, 1, chunkResults[1].Attempts)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Len(t, client.calls, 2)
+}
+
+func TestSendToFiretailTokenErr(t *testing.T) {
+	client := &mockSecretsManagerClient{err: errors.New("access denied")}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+	chunkResults, err := SendToFiretail(context.Background(), makeTestFiretailLogs("TEST_ID"), "http://127.0.0.1:0", tokenProvider)
+	require.NotNil(t, err)
+	assert.Equal(t, "1 error occurred:\n\t* err sending chunk 1 of 1 (1 logs, 46 bytes) to firetail: err getting firetail api token: err getting secret TEST_SECRET_ARN: access denied\n\n", err.Error())
+	require.Len(t, chunkResults, 1)
+	assert.Equal(t, 0, chunkResults[0].Attempts)
 }
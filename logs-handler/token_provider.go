@@ -0,0 +1,144 @@
+package logshandler
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/pkg/errors"
+)
+
+const DefaultTokenRefreshInterval = 5 * time.Minute
+const DefaultTokenMinRefetchInterval = 10 * time.Second
+
+// TokenProvider provides the token used to authenticate with the Firetail logging API. Invalidate is
+// called when Firetail rejects the token, so that the next call to Token gets a fresh one.
+type TokenProvider interface {
+	Token(ctx context.Context) (string, error)
+	Invalidate()
+}
+
+// firetailApiTokenProvider provides the token for every request to the Firetail logging API.
+var firetailApiTokenProvider TokenProvider = StaticTokenProvider("")
+
+// StaticTokenProvider is a TokenProvider for a token which never changes.
+type StaticTokenProvider string
+
+func (p StaticTokenProvider) Token(ctx context.Context) (string, error) {
+	return string(p), nil
+}
+
+func (p StaticTokenProvider) Invalidate() {}
+
+// CachedTokenProvider is a TokenProvider which caches the token returned by Fetch for
+// RefreshInterval, or until it is invalidated. An invalidated token is kept as a fallback in case the
+// refetch fails. Invalidations and fetches after a failed fetch are limited to one per
+// MinRefetchInterval, so that a token Firetail keeps rejecting, or a backend which keeps failing,
+// isn't fetched on every request.
+type CachedTokenProvider struct {
+	Fetch              func(ctx context.Context) (string, error)
+	RefreshInterval    time.Duration
+	MinRefetchInterval time.Duration
+
+	mu            sync.Mutex
+	token         string
+	fetchedAt     time.Time
+	stale         bool
+	invalidatedAt time.Time
+	failedAt      time.Time
+	fetchErr      error
+}
+
+func (p *CachedTokenProvider) Token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hasToken := !p.fetchedAt.IsZero()
+	if hasToken && !p.stale && time.Since(p.fetchedAt) < p.RefreshInterval {
+		return p.token, nil
+	}
+	if p.fetchErr != nil && time.Since(p.failedAt) < p.MinRefetchInterval {
+		if hasToken {
+			return p.token, nil
+		}
+		return "", p.fetchErr
+	}
+	token, err := p.Fetch(ctx)
+	if err != nil {
+		p.failedAt, p.fetchErr = time.Now(), err
+		// If we still have a token we'd rather keep using it than fail outright
+		if hasToken {
+			logger.Warn("Err refreshing Firetail API token, using cached token", LogFields{"error": err})
+			return p.token, nil
+		}
+		return "", err
+	}
+	p.token, p.fetchedAt, p.stale, p.fetchErr = token, time.Now(), false, nil
+	return token, nil
+}
+
+func (p *CachedTokenProvider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.invalidatedAt) < p.MinRefetchInterval {
+		return
+	}
+	p.stale, p.invalidatedAt = true, time.Now()
+}
+
+// secretsManagerClient is the subset of *secretsmanager.Client used to fetch tokens, so it can be
+// faked in tests.
+type secretsManagerClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// NewSecretsManagerTokenProvider creates a TokenProvider for a token stored as the plaintext value of
+// a Secrets Manager secret.
+func NewSecretsManagerTokenProvider(client secretsManagerClient, secretArn string, refreshInterval time.Duration) *CachedTokenProvider {
+	return &CachedTokenProvider{
+		RefreshInterval:    refreshInterval,
+		MinRefetchInterval: DefaultTokenMinRefetchInterval,
+		Fetch: func(ctx context.Context) (string, error) {
+			output, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+				SecretId: aws.String(secretArn),
+			})
+			if err != nil {
+				return "", errors.WithMessagef(err, "err getting secret %s", secretArn)
+			}
+			if output.SecretString == nil {
+				return "", errors.Errorf("secret %s has no string value", secretArn)
+			}
+			return strings.TrimSpace(*output.SecretString), nil
+		},
+	}
+}
+
+// ssmClient is the subset of *ssm.Client used to fetch tokens, so it can be faked in tests.
+type ssmClient interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// NewSSMTokenProvider creates a TokenProvider for a token stored in an SSM parameter, which should be
+// a SecureString.
+func NewSSMTokenProvider(client ssmClient, parameterName string, refreshInterval time.Duration) *CachedTokenProvider {
+	return &CachedTokenProvider{
+		RefreshInterval:    refreshInterval,
+		MinRefetchInterval: DefaultTokenMinRefetchInterval,
+		Fetch: func(ctx context.Context) (string, error) {
+			output, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+				Name:           aws.String(parameterName),
+				WithDecryption: aws.Bool(true),
+			})
+			if err != nil {
+				return "", errors.WithMessagef(err, "err getting parameter %s", parameterName)
+			}
+			if output.Parameter == nil || output.Parameter.Value == nil {
+				return "", errors.Errorf("parameter %s has no value", parameterName)
+			}
+			return strings.TrimSpace(*output.Parameter.Value), nil
+		},
+	}
+}
@@ -0,0 +1,196 @@
+package logshandler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSecretsManagerClient struct {
+	secretValues []string
+	err          error
+	calls        []*secretsmanager.GetSecretValueInput
+}
+
+func (c *mockSecretsManagerClient) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	c.calls = append(c.calls, params)
+	if c.err != nil {
+		return nil, c.err
+	}
+	secretValue := c.secretValues[0]
+	if len(c.secretValues) > 1 {
+		c.secretValues = c.secretValues[1:]
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(secretValue)}, nil
+}
+
+type mockSSMClient struct {
+	parameterValue string
+	err            error
+	calls          []*ssm.GetParameterInput
+}
+
+func (c *mockSSMClient) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	c.calls = append(c.calls, params)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String(c.parameterValue)}}, nil
+}
+
+func TestStaticTokenProvider(t *testing.T) {
+	tokenProvider := StaticTokenProvider("TEST_TOKEN")
+	tokenProvider.Invalidate()
+	token, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN", token)
+}
+
+func TestSecretsManagerTokenProvider(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN\n"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	token, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN", token)
+	require.Len(t, client.calls, 1)
+	assert.Equal(t, "TEST_SECRET_ARN", *client.calls[0].SecretId)
+}
+
+func TestSecretsManagerTokenProviderErr(t *testing.T) {
+	client := &mockSecretsManagerClient{err: errors.New("access denied")}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	_, err := tokenProvider.Token(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "err getting secret TEST_SECRET_ARN: access denied", err.Error())
+}
+
+func TestSSMTokenProvider(t *testing.T) {
+	client := &mockSSMClient{parameterValue: "TEST_TOKEN"}
+	tokenProvider := NewSSMTokenProvider(client, "/firetail/api-token", time.Hour)
+
+	token, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN", token)
+	require.Len(t, client.calls, 1)
+	assert.Equal(t, "/firetail/api-token", *client.calls[0].Name)
+	assert.True(t, *client.calls[0].WithDecryption)
+}
+
+func TestSSMTokenProviderErr(t *testing.T) {
+	client := &mockSSMClient{err: errors.New("parameter not found")}
+	tokenProvider := NewSSMTokenProvider(client, "/firetail/api-token", time.Hour)
+
+	_, err := tokenProvider.Token(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "err getting parameter /firetail/api-token: parameter not found", err.Error())
+}
+
+func TestCachedTokenProviderCaches(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN_1", "TEST_TOKEN_2"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	for i := 0; i < 3; i++ {
+		token, err := tokenProvider.Token(context.Background())
+		require.Nil(t, err)
+		assert.Equal(t, "TEST_TOKEN_1", token)
+	}
+	assert.Len(t, client.calls, 1)
+}
+
+func TestCachedTokenProviderRefreshes(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN_1", "TEST_TOKEN_2"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", 0)
+
+	token, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN_1", token)
+
+	token, err = tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN_2", token)
+	assert.Len(t, client.calls, 2)
+}
+
+func TestCachedTokenProviderInvalidate(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN_1", "TEST_TOKEN_2"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	token, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN_1", token)
+
+	tokenProvider.Invalidate()
+	token, err = tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN_2", token)
+	assert.Len(t, client.calls, 2)
+}
+
+func TestCachedTokenProviderRefreshErrUsesCachedToken(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", 0)
+
+	_, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+
+	client.err = errors.New("throttled")
+	token, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "TEST_TOKEN", token)
+}
+
+func TestCachedTokenProviderInvalidateKeepsFallback(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	_, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+
+	client.err = errors.New("throttled")
+	tokenProvider.Invalidate()
+	for i := 0; i < 3; i++ {
+		token, err := tokenProvider.Token(context.Background())
+		require.Nil(t, err)
+		assert.Equal(t, "TEST_TOKEN", token)
+	}
+	// Only the first call after the invalidation refetches, the rest wait for MinRefetchInterval
+	assert.Len(t, client.calls, 2)
+}
+
+func TestCachedTokenProviderRateLimitsInvalidations(t *testing.T) {
+	client := &mockSecretsManagerClient{secretValues: []string{"TEST_TOKEN_1", "TEST_TOKEN_2", "TEST_TOKEN_3"}}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	_, err := tokenProvider.Token(context.Background())
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		tokenProvider.Invalidate()
+		token, err := tokenProvider.Token(context.Background())
+		require.Nil(t, err)
+		assert.Equal(t, "TEST_TOKEN_2", token)
+	}
+	assert.Len(t, client.calls, 2)
+}
+
+func TestCachedTokenProviderRateLimitsFailedFetches(t *testing.T) {
+	client := &mockSecretsManagerClient{err: errors.New("throttled")}
+	tokenProvider := NewSecretsManagerTokenProvider(client, "TEST_SECRET_ARN", time.Hour)
+
+	for i := 0; i < 3; i++ {
+		_, err := tokenProvider.Token(context.Background())
+		require.NotNil(t, err)
+		assert.Equal(t, "err getting secret TEST_SECRET_ARN: throttled", err.Error())
+	}
+	assert.Len(t, client.calls, 1)
+}